@@ -3,18 +3,25 @@
 package virtual_fido
 
 import (
-	"github.com/bulwarkid/virtual-fido/ctap"
-	"github.com/bulwarkid/virtual-fido/ctap_hid"
-	"github.com/bulwarkid/virtual-fido/u2f"
+	"fmt"
+
 	"github.com/bulwarkid/virtual-fido/usb"
 	"github.com/bulwarkid/virtual-fido/usbip"
 )
 
-func startClient(client FIDOClient) {
-	ctapServer := ctap.NewCTAPServer(client)
-	u2fServer := u2f.NewU2FServer(client)
-	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
-	usbDevice := usb.NewUSBDevice(ctapHIDServer)
-	server := usbip.NewUSBIPServer([]usbip.USBIPDevice{usbDevice})
+func startClients(clients []FIDOClient) {
+	devices := make([]usbip.USBIPDevice, 0, len(clients))
+	for i, client := range clients {
+		config := usbDeviceConfig
+		config.Index = uint32(i)
+		if i > 0 {
+			// Platforms tell keys apart by serial number
+			config.SerialNumber = fmt.Sprintf("%s %d", config.SerialNumber, i+1)
+		}
+		devices = append(devices, usb.NewUSBDeviceWithConfig(newCTAPHIDServer(client), config))
+	}
+	server := usbip.NewUSBIPServer(devices)
+	server.SetIdleTimeout(usbipIdleTimeout)
+	server.SetAttachmentHandler(usbipAttachmentHandler)
 	server.Start()
 }
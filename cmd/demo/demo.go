@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	virtual_fido "github.com/bulwarkid/virtual-fido"
 	"github.com/bulwarkid/virtual-fido/fido_client"
@@ -31,7 +32,11 @@ func listIdentities(cmd *cobra.Command, args []string) {
 	fmt.Printf("------- Identities in file '%s' -------\n", vaultFilename)
 	sources := client.Identities()
 	for _, source := range sources {
-		fmt.Printf("(%s): '%s' for website '%s'\n", hex.EncodeToString(source.ID[:4]), source.User.Name, source.RelyingParty.Name)
+		lastUsed := "never"
+		if !source.LastUsedAt.IsZero() {
+			lastUsed = source.LastUsedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("(%s): '%s' for website '%s' (created %s, last used %s)\n", hex.EncodeToString(source.ID[:4]), source.User.Name, source.RelyingParty.Name, source.CreatedAt.Format(time.RFC3339), lastUsed)
 	}
 }
 
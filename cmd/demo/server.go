@@ -40,6 +40,8 @@ func (support *ClientSupport) ApproveClientAction(action fido_client.ClientActio
 		return prompt(fmt.Sprintf("Approve login for \"%s\" with identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
 	case fido_client.ClientActionFIDOMakeCredential:
 		return prompt(fmt.Sprintf("Approve account creation for \"%s\" (Y/n)?", params.RelyingParty))
+	case fido_client.ClientActionFIDOUserPresence:
+		return prompt(fmt.Sprintf("Confirm presence for \"%s\" (Y/n)?", params.RelyingParty))
 	case fido_client.ClientActionU2FAuthenticate:
 		return prompt("Approve registration of U2F device (Y/n)?")
 	case fido_client.ClientActionU2FRegister:
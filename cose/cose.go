@@ -19,9 +19,11 @@ type COSEAlgorithmID int32
 const (
 	COSE_ALGORITHM_ID_ES256         COSEAlgorithmID = -7
 	COSE_ALGORITHM_ID_ECDH_HKDF_256 COSEAlgorithmID = -25
+	COSE_ALGORITHM_ID_ES384         COSEAlgorithmID = -35
 	COSE_ALGORITHM_ID_ES512         COSEAlgorithmID = -36
 	COSE_ALGORITHM_ID_ED25519       COSEAlgorithmID = -8
 	COSE_ALGORITHM_ID_PS256         COSEAlgorithmID = -37
+	COSE_ALGORITHM_ID_RS256         COSEAlgorithmID = -257
 )
 
 type coseCurveID int32
@@ -44,6 +46,9 @@ type SupportedCOSEPrivateKey struct {
 	ECDSA   *ecdsa.PrivateKey
 	Ed25519 *ed25519.PrivateKey
 	RSA     *rsa.PrivateKey
+	// DeterministicSignatures signs with RFC 6979 nonces for ECDSA keys. Only set for the
+	// keys of a seeded vault in tests, and not saved with the key.
+	DeterministicSignatures bool
 }
 
 func (key *SupportedCOSEPrivateKey) Equal(otherKey *SupportedCOSEPrivateKey) bool {
@@ -85,8 +90,23 @@ func (key *SupportedCOSEPrivateKey) Public() *SupportedCOSEPublicKey {
 	return &coseKey
 }
 
-func (key *SupportedCOSEPrivateKey) Sign(data []byte) []byte {
+// Algorithm returns the COSE algorithm that signatures made with this key use
+func (key *SupportedCOSEPrivateKey) Algorithm() COSEAlgorithmID {
 	if key.ECDSA != nil {
+		return COSE_ALGORITHM_ID_ES256
+	} else if key.Ed25519 != nil {
+		return COSE_ALGORITHM_ID_ED25519
+	} else if key.RSA != nil {
+		return COSE_ALGORITHM_ID_PS256
+	} else {
+		panic("No supported private key data!")
+	}
+}
+
+func (key *SupportedCOSEPrivateKey) Sign(data []byte) []byte {
+	if key.ECDSA != nil && key.DeterministicSignatures {
+		return crypto.SignECDSADeterministic(key.ECDSA, data)
+	} else if key.ECDSA != nil {
 		return crypto.SignECDSA(key.ECDSA, data)
 	} else if key.Ed25519 != nil {
 		return crypto.SignEd25519(key.Ed25519, data)
@@ -170,8 +190,9 @@ func encodeECDSAPublicKey(publicKey *ecdsa.PublicKey) []byte {
 		KeyType:   int8(COSE_KEY_TYPE_EC2),
 		Algorithm: int8(alg),
 		Curve:     int8(curve),
-		X:         publicKey.X.Bytes(),
-		Y:         publicKey.Y.Bytes(),
+		// Coordinates are fixed length so that the encoding is canonical
+		X: publicKey.X.FillBytes(make([]byte, 32)),
+		Y: publicKey.Y.FillBytes(make([]byte, 32)),
 	}
 	return util.MarshalCBOR(key)
 }
@@ -295,7 +316,7 @@ func encodeRSAPublicKey(publicKey *rsa.PublicKey) []byte {
 		KeyType:   int8(COSE_KEY_TYPE_RSA),
 		Algorithm: int8(COSE_ALGORITHM_ID_PS256),
 		N:         publicKey.N.Bytes(),
-		E:         util.ToBE(publicKey.E),
+		E:         big.NewInt(int64(publicKey.E)).Bytes(),
 	}
 	return util.MarshalCBOR(key)
 }
@@ -305,7 +326,7 @@ func decodeRSAPublicKey(publicKeyBytes []byte) *rsa.PublicKey {
 	err := cbor.Unmarshal(publicKeyBytes, &key)
 	util.CheckErr(err, "Could not unmarshal public key")
 	publicKey := rsa.PublicKey{}
-	publicKey.E = util.FromBE[int](key.E)
+	publicKey.E = int(new(big.Int).SetBytes(key.E).Int64())
 	publicKey.N = &big.Int{}
 	publicKey.N.SetBytes(key.N)
 	return &publicKey
@@ -359,6 +380,57 @@ func MarshalCOSEPublicKey(publicKey *SupportedCOSEPublicKey) []byte {
 	}
 }
 
+// Thumbprint returns the SHA-256 hash of the canonical COSE encoding of a public key,
+// suitable for indexing credentials and displaying key fingerprints
+func Thumbprint(publicKey *SupportedCOSEPublicKey) []byte {
+	return crypto.HashSHA256(MarshalCOSEPublicKey(publicKey))
+}
+
+// The COSE key_ops value for a key that verifies signatures
+const COSE_KEY_OP_VERIFY int = 2
+
+// MarshalCOSEPublicKeyWithOptionalFields encodes a public key like MarshalCOSEPublicKey, but
+// also with the optional kid, the key's Thumbprint, and key_ops of [verify], for testing
+// relying parties that mishandle COSE key parameters they don't need
+func MarshalCOSEPublicKeyWithOptionalFields(publicKey *SupportedCOSEPublicKey) []byte {
+	return AddCOSEKeyOptionalFields(MarshalCOSEPublicKey(publicKey), publicKey)
+}
+
+// AddCOSEKeyOptionalFields adds kid and key_ops to an encoded COSE key for publicKey
+func AddCOSEKeyOptionalFields(encodedKey []byte, publicKey *SupportedCOSEPublicKey) []byte {
+	fields := map[int]interface{}{}
+	util.CheckErr(cbor.Unmarshal(encodedKey, &fields), "Could not decode COSE key")
+	fields[2] = Thumbprint(publicKey)
+	fields[4] = []int{COSE_KEY_OP_VERIFY}
+	return util.MarshalCBOR(fields)
+}
+
+// COSECompressedEC2Key is an EC2 key with point compression, where y is only the sign bit
+type COSECompressedEC2Key struct {
+	KeyType   int8   `cbor:"1,keyasint"`
+	Algorithm int8   `cbor:"3,keyasint"`
+	Curve     int8   `cbor:"-1,keyasint"`
+	X         []byte `cbor:"-2,keyasint"`
+	Y         bool   `cbor:"-3,keyasint"`
+}
+
+// MarshalCompressedCOSEPublicKey encodes EC2 keys with a compressed point, which COSE allows
+// but WebAuthn relying parties generally can't parse. Other key types are encoded as usual.
+func MarshalCompressedCOSEPublicKey(publicKey *SupportedCOSEPublicKey) []byte {
+	if publicKey.ECDSA == nil {
+		return MarshalCOSEPublicKey(publicKey)
+	}
+	var uncompressed COSEEC2Key
+	util.CheckErr(cbor.Unmarshal(encodeECDSAPublicKey(publicKey.ECDSA), &uncompressed), "Could not decode COSE key")
+	return util.MarshalCBOR(COSECompressedEC2Key{
+		KeyType:   uncompressed.KeyType,
+		Algorithm: uncompressed.Algorithm,
+		Curve:     uncompressed.Curve,
+		X:         uncompressed.X,
+		Y:         publicKey.ECDSA.Y.Bit(0) == 1,
+	})
+}
+
 type COSEKeyHeader struct {
 	KeyType   int8 `cbor:"1,keyasint"`
 	Algorithm int8 `cbor:"3,keyasint"`
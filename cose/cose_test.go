@@ -7,6 +7,11 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
 )
 
 func checkErr(t *testing.T, err error) {
@@ -27,6 +32,11 @@ func testCOSEKey(t *testing.T, key *SupportedCOSEPrivateKey) {
 	if !decoded.Equal(key) {
 		t.Fatalf("Encode and decode does not result in same key")
 	}
+	thumbprint := Thumbprint(key.Public())
+	test.AssertArrEqual(t, Thumbprint(decoded.Public()), thumbprint, "Thumbprint changed after private key round trip")
+	decodedPublic, err := UnmarshalCOSEPublicKey(MarshalCOSEPublicKey(key.Public()))
+	checkErr(t, err)
+	test.AssertArrEqual(t, Thumbprint(decodedPublic), thumbprint, "Thumbprint changed after public key round trip")
 }
 
 func TestECDSA(t *testing.T) {
@@ -49,3 +59,72 @@ func TestRSA(t *testing.T) {
 	cosePrivateKey := &SupportedCOSEPrivateKey{RSA: privateKey}
 	testCOSEKey(t, cosePrivateKey)
 }
+
+func TestThumbprintDiffersBetweenKeys(t *testing.T) {
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err)
+	key2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err)
+	thumbprint1 := Thumbprint(&SupportedCOSEPublicKey{ECDSA: &key1.PublicKey})
+	thumbprint2 := Thumbprint(&SupportedCOSEPublicKey{ECDSA: &key2.PublicKey})
+	test.AssertEqual(t, len(thumbprint1), 32, "Thumbprint is not a SHA-256 hash")
+	test.Assert(t, string(thumbprint1) != string(thumbprint2), "Different keys have the same thumbprint")
+}
+
+func TestCOSEKeyOptionalFields(t *testing.T) {
+	key := &SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+	var minimal, extended map[int]interface{}
+	checkErr(t, cbor.Unmarshal(MarshalCOSEPublicKey(key.Public()), &minimal))
+	checkErr(t, cbor.Unmarshal(MarshalCOSEPublicKeyWithOptionalFields(key.Public()), &extended))
+	for _, label := range []int{1, 3, -1, -2, -3} {
+		if _, ok := minimal[label]; !ok {
+			t.Fatalf("Minimal key is missing required label %d", label)
+		}
+	}
+	if len(minimal) != 5 {
+		t.Fatalf("Minimal key has optional fields: %#v", minimal)
+	}
+	if len(extended) != 7 {
+		t.Fatalf("Extended key does not have exactly kid and key_ops added: %#v", extended)
+	}
+	test.AssertArrEqual(t, extended[2].([]byte), Thumbprint(key.Public()), "kid is not the key thumbprint")
+	keyOps := extended[4].([]interface{})
+	test.Assert(t, len(keyOps) == 1 && keyOps[0] == uint64(COSE_KEY_OP_VERIFY), "key_ops is not [verify]")
+	for label, value := range minimal {
+		test.AssertArrEqual(t, util.MarshalCBOR(extended[label]), util.MarshalCBOR(value), "Required field changed")
+	}
+	decoded, err := UnmarshalCOSEPublicKey(MarshalCOSEPublicKeyWithOptionalFields(key.Public()))
+	checkErr(t, err)
+	test.Assert(t, decoded.Equal(key.Public()), "Extended key does not decode to the same key")
+}
+
+func TestCOSEKeyUsesUncompressedPoints(t *testing.T) {
+	// Enough keys that some coordinates have leading zero bytes, which must still be encoded
+	for i := 0; i < 256; i++ {
+		key := &SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+		var fields map[int]interface{}
+		checkErr(t, cbor.Unmarshal(MarshalCOSEPublicKey(key.Public()), &fields))
+		x, xOK := fields[-2].([]byte)
+		y, yOK := fields[-3].([]byte)
+		if !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+			t.Fatalf("COSE key does not have 32 byte x and y coordinates: %#v", fields)
+		}
+		test.AssertArrEqual(t, y, key.ECDSA.Y.FillBytes(make([]byte, 32)), "Wrong y coordinate")
+	}
+}
+
+func TestCompressedCOSEKey(t *testing.T) {
+	key := &SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+	var compressed COSECompressedEC2Key
+	checkErr(t, cbor.Unmarshal(MarshalCompressedCOSEPublicKey(key.Public()), &compressed))
+	test.AssertEqual(t, compressed.Curve, int8(COSE_CURVE_ID_P256), "Wrong curve")
+	prefix := byte(0x02)
+	if compressed.Y {
+		prefix = 0x03
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), append([]byte{prefix}, compressed.X...))
+	test.Assert(t, x != nil && x.Cmp(key.ECDSA.X) == 0 && y.Cmp(key.ECDSA.Y) == 0, "Compressed point does not decompress to the key")
+
+	ed25519Key := &SupportedCOSEPrivateKey{Ed25519: crypto.GenerateEd25519Key()}
+	test.AssertArrEqual(t, MarshalCompressedCOSEPublicKey(ed25519Key.Public()), MarshalCOSEPublicKey(ed25519Key.Public()), "Non-EC2 key changed")
+}
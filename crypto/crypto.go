@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"math/big"
 
@@ -28,12 +29,33 @@ func GenerateECDSAKey() *ecdsa.PrivateKey {
 	return key
 }
 
+// DeriveECDSAKey deterministically maps key material (at least 32 uniformly random bytes)
+// to a P-256 private key
+func DeriveECDSAKey(material []byte) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	nMinusOne := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	d := new(big.Int).SetBytes(material)
+	d.Mod(d, nMinusOne)
+	d.Add(d, big.NewInt(1))
+	privateKey := &ecdsa.PrivateKey{D: d}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+	return privateKey
+}
+
 func GenerateEd25519Key() *ed25519.PrivateKey {
 	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	util.CheckErr(err, "Could not generate Ed25519 private key")
 	return &privateKey
 }
 
+// DeriveEd25519Key deterministically maps key material (at least 32 uniformly random bytes)
+// to an Ed25519 private key
+func DeriveEd25519Key(material []byte) *ed25519.PrivateKey {
+	privateKey := ed25519.NewKeyFromSeed(material[:ed25519.SeedSize])
+	return &privateKey
+}
+
 func GenerateRSAKey() *rsa.PrivateKey {
 	privateKey, err := rsa.GenerateKey(rand.Reader, RSA_NUMBER_OF_BITS)
 	util.CheckErr(err, "Could not generate RSA private key")
@@ -82,16 +104,32 @@ func Decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
 	return decryptedData, nil
 }
 
+// ecdsaHash hashes data with the SHA-2 function COSE pairs with the key's curve: SHA-256 for
+// ES256, SHA-384 for ES384 and SHA-512 for ES512
+func ecdsaHash(curve elliptic.Curve, data []byte) []byte {
+	switch curve.Params().BitSize {
+	case 384:
+		hash := sha512.Sum384(data)
+		return hash[:]
+	case 521:
+		hash := sha512.Sum512(data)
+		return hash[:]
+	default:
+		hash := sha256.Sum256(data)
+		return hash[:]
+	}
+}
+
+// SignECDSA returns an ASN.1 DER signature, a SEQUENCE of the INTEGERs r and s, as WebAuthn
+// and U2F both require rather than the raw r||s form
 func SignECDSA(key *ecdsa.PrivateKey, data []byte) []byte {
-	hash := sha256.Sum256(data)
-	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	signature, err := ecdsa.SignASN1(rand.Reader, key, ecdsaHash(key.Curve, data))
 	util.CheckErr(err, "Could not sign data")
 	return signature
 }
 
 func VerifyECDSA(key *ecdsa.PublicKey, data []byte, signature []byte) bool {
-	hash := sha256.Sum256(data)
-	return ecdsa.VerifyASN1(key, hash[:], signature)
+	return ecdsa.VerifyASN1(key, ecdsaHash(key.Curve, data), signature)
 }
 
 func SignEd25519(key *ed25519.PrivateKey, data []byte) []byte {
@@ -171,9 +209,14 @@ func GenerateECDHKey() *ECDHKey {
 	return &ECDHKey{Priv: priv, X: x, Y: y}
 }
 
-func (key *ECDHKey) ECDH(remoteX, remoteY *big.Int) []byte {
-	secret, _ := elliptic.P256().Params().ScalarMult(remoteX, remoteY, key.Priv)
-	return secret.Bytes()
+// ECDH returns the x-coordinate of the shared point as 32 bytes. The remote key must be a
+// point on P-256, otherwise an attacker could choose it to learn bits of the private key.
+func (key *ECDHKey) ECDH(remoteX, remoteY *big.Int) ([]byte, error) {
+	if remoteX == nil || remoteY == nil || !elliptic.P256().IsOnCurve(remoteX, remoteY) {
+		return nil, fmt.Errorf("Remote ECDH key is not a point on P-256")
+	}
+	secret, _ := elliptic.P256().ScalarMult(remoteX, remoteY, key.Priv)
+	return secret.FillBytes(make([]byte, 32)), nil
 }
 
 func (key *ECDHKey) PublicKeyBytes() []byte {
@@ -2,8 +2,13 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
 	"encoding/hex"
+	"math/big"
 	"testing"
 )
 
@@ -32,6 +37,89 @@ func TestSignVerifyECDSA(t *testing.T) {
 	}
 }
 
+// readDERLength reads a minimally encoded DER length, returning -1 if it is malformed
+func readDERLength(data []byte) (int, []byte) {
+	if len(data) == 0 {
+		return -1, nil
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), data[1:]
+	}
+	// Signatures are under 256 bytes, so only the one byte long form can appear, for lengths of 128 or more
+	if data[0] != 0x81 || len(data) < 2 || data[1] < 0x80 {
+		return -1, nil
+	}
+	return int(data[1]), data[2:]
+}
+
+// checkDERSignature strictly parses a DER ECDSA signature and returns r and s
+func checkDERSignature(t *testing.T, signature []byte) (*big.Int, *big.Int) {
+	if len(signature) == 0 || signature[0] != 0x30 {
+		t.Fatalf("Signature is not a SEQUENCE: %x", signature)
+	}
+	length, rest := readDERLength(signature[1:])
+	if length < 0 || length != len(rest) {
+		t.Fatalf("Invalid SEQUENCE length: %x", signature)
+	}
+	integers := []*big.Int{}
+	for i := 0; i < 2; i++ {
+		if len(rest) == 0 || rest[0] != 0x02 {
+			t.Fatalf("Expected an INTEGER: %x", signature)
+		}
+		length, rest = readDERLength(rest[1:])
+		if length <= 0 || length > len(rest) {
+			t.Fatalf("Invalid INTEGER length: %x", signature)
+		}
+		value := rest[:length]
+		if value[0]&0x80 != 0 {
+			t.Fatalf("INTEGER is negative, missing its 0x00 padding: %x", signature)
+		}
+		if length > 1 && value[0] == 0x00 && value[1]&0x80 == 0 {
+			t.Fatalf("INTEGER is not minimally encoded: %x", signature)
+		}
+		integers = append(integers, new(big.Int).SetBytes(value))
+		rest = rest[length:]
+	}
+	if len(rest) != 0 {
+		t.Fatalf("Trailing data after signature: %x", signature)
+	}
+	return integers[0], integers[1]
+}
+
+func TestECDSASignatureDEREncoding(t *testing.T) {
+	data := []byte("data")
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Enough signatures that r and s regularly have their high bit set or leading zero bytes
+		for i := 0; i < 64; i++ {
+			signature := SignECDSA(key, data)
+			r, s := checkDERSignature(t, signature)
+			if r.Sign() <= 0 || r.Cmp(curve.Params().N) >= 0 || s.Sign() <= 0 || s.Cmp(curve.Params().N) >= 0 {
+				t.Fatalf("%s signature values out of range: %x", curve.Params().Name, signature)
+			}
+			if !ecdsa.Verify(&key.PublicKey, ecdsaHash(curve, data), r, s) {
+				t.Fatalf("%s signature does not verify: %x", curve.Params().Name, signature)
+			}
+			if !VerifyECDSA(&key.PublicKey, data, signature) {
+				t.Fatalf("%s signature rejected by VerifyECDSA: %x", curve.Params().Name, signature)
+			}
+		}
+	}
+
+	key := GenerateECDSAKey()
+	for i := 0; i < 64; i++ {
+		message := []byte{byte(i)}
+		signature := SignECDSADeterministic(key, message)
+		r, s := checkDERSignature(t, signature)
+		if !ecdsa.Verify(&key.PublicKey, ecdsaHash(key.Curve, message), r, s) {
+			t.Fatalf("Deterministic signature does not verify: %x", signature)
+		}
+	}
+}
+
 func TestSignVerifyEd25519(t *testing.T) {
 	data := []byte("data")
 	key := GenerateEd25519Key()
@@ -80,3 +168,32 @@ func TestEncryptDecryptAESCBC(t *testing.T) {
 		t.Fatalf("'%s' does not equal '%s'", hex.EncodeToString(decryptedData), hex.EncodeToString(data))
 	}
 }
+
+func TestDeterministicECDSA(t *testing.T) {
+	// Test vectors from RFC 6979 appendix A.2.5, P-256 with SHA-256
+	dBytes, _ := hex.DecodeString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")
+	key := DeriveECDSAKey(make([]byte, 32))
+	key.D.SetBytes(dBytes)
+	key.PublicKey.X, key.PublicKey.Y = key.Curve.ScalarBaseMult(dBytes)
+	vectors := []struct{ message, r, s string }{
+		{"sample", "efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716", "f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8"},
+		{"test", "f1abb023518351cd71d881567b1ea663ed3efcf6c5132b354f28d3b0b7d38367", "019f4113742a2b14bd25926b49c649155f267e60d3814b4c0cc84250e46f0083"},
+	}
+	for _, vector := range vectors {
+		signature := SignECDSADeterministic(key, []byte(vector.message))
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(parsed.R.FillBytes(make([]byte, 32))) != vector.r ||
+			hex.EncodeToString(parsed.S.FillBytes(make([]byte, 32))) != vector.s {
+			t.Fatalf("Signature of %q does not match RFC 6979 test vector: %x %x", vector.message, parsed.R, parsed.S)
+		}
+		if !bytes.Equal(SignECDSADeterministic(key, []byte(vector.message)), signature) {
+			t.Fatalf("Deterministic signature of %q changed between calls", vector.message)
+		}
+		if !VerifyECDSA(&key.PublicKey, []byte(vector.message), signature) {
+			t.Fatalf("Deterministic signature of %q does not verify", vector.message)
+		}
+	}
+}
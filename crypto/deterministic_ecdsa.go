@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+
+	util "github.com/bulwarkid/virtual-fido/util"
+)
+
+// SignECDSADeterministic signs like SignECDSA but with RFC 6979 nonces, so signing the same
+// data with the same key always gives the same signature. The standard library mixes fresh
+// randomness into every nonce, which makes byte-for-byte golden outputs impossible. Only
+// meant for tests: the nonce generation here has not had the scrutiny of crypto/ecdsa.
+func SignECDSADeterministic(key *ecdsa.PrivateKey, data []byte) []byte {
+	return signECDSADeterministic(key, ecdsaHash(key.Curve, data))
+}
+
+// rfc6979Nonces generates the candidate nonces of RFC 6979 section 3.2 for a P-256 key and a
+// SHA-256 hash, calling accept with each until it returns true
+func rfc6979Nonces(key *ecdsa.PrivateKey, hash []byte, accept func(k *big.Int) bool) {
+	n := key.Curve.Params().N
+	x := key.D.FillBytes(make([]byte, 32))
+	h1 := new(big.Int).Mod(new(big.Int).SetBytes(hash), n).FillBytes(make([]byte, 32))
+	mac := func(key []byte, data ...[]byte) []byte {
+		h := hmac.New(sha256.New, key)
+		for _, d := range data {
+			h.Write(d)
+		}
+		return h.Sum(nil)
+	}
+	v := make([]byte, 32)
+	for i := range v {
+		v[i] = 0x01
+	}
+	k := make([]byte, 32)
+	k = mac(k, v, []byte{0x00}, x, h1)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, x, h1)
+	v = mac(k, v)
+	for {
+		v = mac(k, v)
+		nonce := new(big.Int).SetBytes(v)
+		if nonce.Sign() > 0 && nonce.Cmp(n) < 0 && accept(nonce) {
+			return
+		}
+		k = mac(k, v, []byte{0x00})
+		v = mac(k, v)
+	}
+}
+
+func signECDSADeterministic(key *ecdsa.PrivateKey, hash []byte) []byte {
+	util.Assert(key.Curve.Params().BitSize == 256, "Deterministic signatures need a 256-bit curve")
+	n := key.Curve.Params().N
+	e := new(big.Int).SetBytes(hash)
+	var r, s *big.Int
+	rfc6979Nonces(key, hash, func(k *big.Int) bool {
+		x, _ := key.Curve.ScalarBaseMult(k.FillBytes(make([]byte, 32)))
+		r = new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			return false
+		}
+		s = new(big.Int).Mul(r, key.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		return s.Sign() != 0
+	})
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	util.CheckErr(err, "Could not encode signature")
+	return signature
+}
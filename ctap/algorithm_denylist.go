@@ -0,0 +1,52 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// Reported in getInfo in this order
+var credentialAlgorithms = []cose.COSEAlgorithmID{cose.COSE_ALGORITHM_ID_ES256, cose.COSE_ALGORITHM_ID_ED25519}
+
+// CredentialAlgorithms returns the algorithms the device can create credentials with,
+// before any are denied
+func CredentialAlgorithms() []cose.COSEAlgorithmID {
+	return append([]cose.COSEAlgorithmID{}, credentialAlgorithms...)
+}
+
+// SetDeniedAlgorithms stops the device from creating credentials with the given algorithms,
+// even though it implements them, to model devices hardened by a security policy. Denied
+// algorithms are skipped when choosing from pubKeyCredParams and left out of getInfo.
+func (server *CTAPServer) SetDeniedAlgorithms(algorithms []cose.COSEAlgorithmID) {
+	server.deniedAlgorithms = append([]cose.COSEAlgorithmID{}, algorithms...)
+}
+
+func (server *CTAPServer) allowsAlgorithm(algorithm cose.COSEAlgorithmID) bool {
+	for _, denied := range server.deniedAlgorithms {
+		if denied == algorithm {
+			return false
+		}
+	}
+	return identities.SupportsAlgorithm(algorithm)
+}
+
+// allowedCredentialParams drops the parameters the device won't create credentials for,
+// keeping the relying party's order of preference
+func (server *CTAPServer) allowedCredentialParams(params []webauthn.PublicKeyCredentialParams) []webauthn.PublicKeyCredentialParams {
+	allowed := make([]webauthn.PublicKeyCredentialParams, 0, len(params))
+	for _, param := range params {
+		if param.Type == "public-key" && server.allowsAlgorithm(param.Algorithm) {
+			allowed = append(allowed, param)
+		}
+	}
+	return allowed
+}
+
+func (server *CTAPServer) supportedAlgorithms() []webauthn.PublicKeyCredentialParams {
+	params := make([]webauthn.PublicKeyCredentialParams, 0, len(credentialAlgorithms))
+	for _, algorithm := range credentialAlgorithms {
+		params = append(params, webauthn.PublicKeyCredentialParams{Type: "public-key", Algorithm: algorithm})
+	}
+	return server.allowedCredentialParams(params)
+}
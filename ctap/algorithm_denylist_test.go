@@ -0,0 +1,54 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// algorithmDummyCTAPClient creates credentials with the first algorithm it is offered
+type algorithmDummyCTAPClient struct {
+	*dummyCTAPClient
+}
+
+func (client algorithmDummyCTAPClient) NewCredentialSource(
+	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
+	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity) (*identities.CredentialSource, error) {
+	return client.vault.NewIdentityWithAlgorithm(PubKeyCredParams[0].Algorithm, relyingParty, user), nil
+}
+
+func TestDeniedAlgorithms(t *testing.T) {
+	client := algorithmDummyCTAPClient{&dummyCTAPClient{}}
+	server := NewCTAPServer(client)
+	server.SetDeniedAlgorithms([]cose.COSEAlgorithmID{cose.COSE_ALGORITHM_ID_ES256})
+
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.AssertEqual(t, len(info.Algorithms), 1, "Wrong number of algorithms in getInfo")
+	test.AssertEqual(t, info.Algorithms[0].Algorithm, cose.COSE_ALGORITHM_ID_ED25519, "Denied algorithm in getInfo")
+
+	makeCredential := func(algorithms ...cose.COSEAlgorithmID) ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash: crypto.HashSHA256([]byte("denylist")),
+			RP:             &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+			User:           &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		}
+		for _, algorithm := range algorithms {
+			args.PubKeyCredParams = append(args.PubKeyCredParams, webauthn.PublicKeyCredentialParams{Type: "public-key", Algorithm: algorithm})
+		}
+		return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))[0])
+	}
+	// The relying party prefers ES256, but the device must pick EdDSA
+	test.AssertEqual(t, makeCredential(cose.COSE_ALGORITHM_ID_ES256, cose.COSE_ALGORITHM_ID_ED25519), ctap1ErrSuccess, "makeCredential failed")
+	test.AssertEqual(t, makeCredential(cose.COSE_ALGORITHM_ID_ES256), ctap2ErrUnsupportedAlgorithm, "Denied algorithm accepted")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 1, "Wrong number of credentials")
+	test.AssertEqual(t, client.vault.CredentialSources[0].Algorithm(), cose.COSE_ALGORITHM_ID_ED25519, "Denied algorithm chosen")
+}
@@ -0,0 +1,99 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	attestationPacked     = "packed"
+	attestationPackedSelf = "packed-self"
+	attestationNone       = "none"
+)
+
+// An attestationProvider produces the attestation format and statement for a new
+// credential, or a nil statement if it can't attest that credential
+type attestationProvider func(server *CTAPServer, credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{})
+
+var attestationProviders = map[string]attestationProvider{
+	tpmAttestationFormat: func(server *CTAPServer, credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{}) {
+		// Return an untyped nil rather than a nil *tpmAttestationStatement
+		if statement := server.tpmAttestationStatement(credentialSource, authenticatorData, clientDataHash); statement != nil {
+			return tpmAttestationFormat, statement
+		}
+		return tpmAttestationFormat, nil
+	},
+	attestationPackedSelf: func(server *CTAPServer, credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{}) {
+		return "packed", selfAttestationStatement{
+			Alg: credentialSource.Algorithm(),
+			Sig: credentialSource.PrivateKey.Sign(util.Concat(authenticatorData, clientDataHash)),
+		}
+	},
+	attestationPacked: func(server *CTAPServer, credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{}) {
+		attestationCert := server.client.CreateAttestationCertificiate(credentialSource.PrivateKey)
+		return "packed", basicAttestationStatement{
+			Alg: credentialSource.Algorithm(),
+			Sig: credentialSource.PrivateKey.Sign(util.Concat(authenticatorData, clientDataHash)),
+			X5c: [][]byte{attestationCert},
+		}
+	},
+	attestationNone: func(server *CTAPServer, credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{}) {
+		return "none", map[string]interface{}{}
+	},
+}
+
+// AttestationDebugOutput is one attestation the device can produce for a credential
+type AttestationDebugOutput struct {
+	// Provider name: "tpm", "packed-self", "packed" or "none"
+	Provider  string
+	Format    string
+	Statement []byte
+}
+
+// SetAttestationDebugHandler makes makeCredential also generate every attestation it can
+// produce for the new credential and pass them to handler, for comparing the formats of a
+// single registration. The response still carries the usual attestation. A nil handler, the
+// default, turns this off.
+func (server *CTAPServer) SetAttestationDebugHandler(handler func(outputs []AttestationDebugOutput)) {
+	server.attestationDebugHandler = handler
+}
+
+// attestationProviderOrder lists the providers makeCredential tries, most preferred first
+func (server *CTAPServer) attestationProviderOrder() []string {
+	order := []string{}
+	if server.tpmAIK != nil {
+		order = append(order, tpmAttestationFormat)
+	}
+	if server.selfAttestation {
+		order = append(order, attestationPackedSelf)
+	}
+	return append(order, attestationPacked)
+}
+
+func (server *CTAPServer) attest(credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) (string, interface{}) {
+	for _, name := range server.attestationProviderOrder() {
+		if format, statement := attestationProviders[name](server, credentialSource, authenticatorData, clientDataHash); statement != nil {
+			return format, statement
+		}
+	}
+	util.Panic("packed attestation always succeeds")
+	return "", nil
+}
+
+func (server *CTAPServer) debugAttestations(credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) []AttestationDebugOutput {
+	names := []string{attestationPackedSelf, attestationPacked, attestationNone}
+	if server.tpmAIK != nil {
+		names = append([]string{tpmAttestationFormat}, names...)
+	}
+	outputs := []AttestationDebugOutput{}
+	for _, name := range names {
+		format, statement := attestationProviders[name](server, credentialSource, authenticatorData, clientDataHash)
+		if statement == nil {
+			continue
+		}
+		output := AttestationDebugOutput{Provider: name, Format: format, Statement: util.MarshalCBOR(statement)}
+		ctapLogger.Printf("DEBUG ATTESTATION %s: %s\n\n", name, describeCBOR(output.Statement, nil))
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
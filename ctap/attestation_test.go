@@ -0,0 +1,47 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestAttestationDebugHandler(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	caKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA key")
+	ca, err := identities.CreateSelfSignedCA(caKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	aik, _ := identities.CreateCAPrivateKey()
+	aikCertificate, err := identities.CreateTPMAIKCertificate(ca, caKey, aik)
+	test.Assert(t, err == nil, "Could not create AIK certificate")
+	server.SetTPMAttestation(aik, [][]byte{aikCertificate.Raw})
+
+	var outputs []AttestationDebugOutput
+	server.SetAttestationDebugHandler(func(debugOutputs []AttestationDebugOutput) {
+		outputs = debugOutputs
+	})
+	response := tpmMakeCredential(t, server, cose.COSE_ALGORITHM_ID_ES256)
+	test.AssertEqual(t, response.FormatIdentifer, tpmAttestationFormat, "Debug mode changed the returned attestation")
+
+	expected := []struct{ provider, format string }{
+		{tpmAttestationFormat, "tpm"},
+		{attestationPackedSelf, "packed"},
+		{attestationPacked, "packed"},
+		{attestationNone, "none"},
+	}
+	test.AssertEqual(t, len(outputs), len(expected), "Wrong number of debug attestations")
+	for i, output := range outputs {
+		test.AssertEqual(t, output.Provider, expected[i].provider, "Wrong debug attestation provider")
+		test.AssertEqual(t, output.Format, expected[i].format, "Wrong debug attestation format")
+		var statement map[string]interface{}
+		test.Assert(t, cbor.Unmarshal(output.Statement, &statement) == nil, "Debug attestation statement is not a CBOR map")
+		if output.Format != "none" {
+			_, ok := statement["sig"]
+			test.Assert(t, ok, "Debug attestation has no signature")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type AuthenticatorDataFlags uint8
+
+const (
+	AuthDataFlagUserPresent           AuthenticatorDataFlags = 0x01
+	AuthDataFlagUserVerified          AuthenticatorDataFlags = 0x04
+	AuthDataFlagAttestedDataIncluded  AuthenticatorDataFlags = 0x40
+	AuthDataFlagExtensionDataIncluded AuthenticatorDataFlags = 0x80
+)
+
+type AttestedCredentialData struct {
+	AAGUID              [16]byte
+	CredentialID        []byte
+	CredentialPublicKey []byte // COSE encoded
+}
+
+// AuthenticatorData is laid out as rpIdHash(32) || flags(1) || signCount(4) ||
+// [attestedCredentialData] || [extensions]
+type AuthenticatorData struct {
+	RPIDHash               [32]byte
+	Flags                  AuthenticatorDataFlags
+	SignCount              uint32
+	AttestedCredentialData *AttestedCredentialData
+	Extensions             []byte // CBOR encoded extension outputs
+}
+
+func NewAuthenticatorData(rpID string, flags AuthenticatorDataFlags, signCount uint32) *AuthenticatorData {
+	return &AuthenticatorData{
+		RPIDHash:  sha256.Sum256([]byte(rpID)),
+		Flags:     flags,
+		SignCount: signCount,
+	}
+}
+
+// Bytes encodes the authenticator data, setting the AT and ED flags to match the data present
+func (authData *AuthenticatorData) Bytes() []byte {
+	flags := authData.Flags &^ (AuthDataFlagAttestedDataIncluded | AuthDataFlagExtensionDataIncluded)
+	var attestedData []byte
+	if authData.AttestedCredentialData != nil {
+		flags |= AuthDataFlagAttestedDataIncluded
+		attested := authData.AttestedCredentialData
+		attestedData = util.Concat(attested.AAGUID[:], util.ToBE(uint16(len(attested.CredentialID))), attested.CredentialID, attested.CredentialPublicKey)
+	}
+	if authData.Extensions != nil {
+		flags |= AuthDataFlagExtensionDataIncluded
+	}
+	return util.Concat(authData.RPIDHash[:], []byte{byte(flags)}, util.ToBE(authData.SignCount), attestedData, authData.Extensions)
+}
+
+func (authData *AuthenticatorData) HasFlag(flag AuthenticatorDataFlags) bool {
+	return authData.Flags&flag == flag
+}
+
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("Authenticator data too short: %d bytes", len(data))
+	}
+	authData := AuthenticatorData{}
+	copy(authData.RPIDHash[:], data[:32])
+	authData.Flags = AuthenticatorDataFlags(data[32])
+	authData.SignCount = util.FromBE[uint32](data[33:37])
+	rest := data[37:]
+	if authData.HasFlag(AuthDataFlagAttestedDataIncluded) {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("Attested credential data too short: %d bytes", len(rest))
+		}
+		attested := AttestedCredentialData{}
+		copy(attested.AAGUID[:], rest[:16])
+		idLength := int(util.FromBE[uint16](rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, fmt.Errorf("Credential ID too short: %d bytes, expected %d", len(rest), idLength)
+		}
+		attested.CredentialID = rest[:idLength]
+		rest = rest[idLength:]
+		keyLength, err := cborItemLength(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid credential public key: %w", err)
+		}
+		attested.CredentialPublicKey = rest[:keyLength]
+		rest = rest[keyLength:]
+		authData.AttestedCredentialData = &attested
+	}
+	if authData.HasFlag(AuthDataFlagExtensionDataIncluded) {
+		extensionsLength, err := cborItemLength(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid extensions: %w", err)
+		}
+		authData.Extensions = rest[:extensionsLength]
+		rest = rest[extensionsLength:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("Unexpected %d trailing bytes in authenticator data", len(rest))
+	}
+	return &authData, nil
+}
+
+func cborItemLength(data []byte) (int, error) {
+	decoder := cbor.NewDecoder(bytes.NewReader(data))
+	var item cbor.RawMessage
+	if err := decoder.Decode(&item); err != nil {
+		return 0, err
+	}
+	return decoder.NumBytesRead(), nil
+}
@@ -0,0 +1,108 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestAuthenticatorDataLayout(t *testing.T) {
+	for _, flags := range []AuthenticatorDataFlags{0, AuthDataFlagUserPresent, AuthDataFlagUserVerified, AuthDataFlagUserPresent | AuthDataFlagUserVerified} {
+		data := NewAuthenticatorData("example.com", flags, 0x01020304).Bytes()
+		rpIDHash := sha256.Sum256([]byte("example.com"))
+		test.AssertEqual(t, len(data), 37, "Incorrect authenticator data length")
+		test.Assert(t, bytes.Equal(data[:32], rpIDHash[:]), "Incorrect rpIdHash")
+		test.AssertEqual(t, AuthenticatorDataFlags(data[32]), flags, "Incorrect flags")
+		test.AssertArrEqual(t, data[33:37], []byte{1, 2, 3, 4}, "Incorrect counter")
+
+		parsed, err := ParseAuthenticatorData(data)
+		test.Assert(t, err == nil, "Could not parse authenticator data")
+		test.AssertEqual(t, parsed.Flags, flags, "Flags changed after parsing")
+		test.AssertEqual(t, parsed.SignCount, uint32(0x01020304), "Counter changed after parsing")
+		test.Assert(t, parsed.AttestedCredentialData == nil, "Unexpected attested credential data")
+	}
+}
+
+func TestAuthenticatorDataWithAttestedDataAndExtensions(t *testing.T) {
+	publicKey := cose.MarshalCOSEPublicKey(&cose.SupportedCOSEPublicKey{ECDSA: &crypto.GenerateECDSAKey().PublicKey})
+	extensions := util.MarshalCBOR(map[string]interface{}{"credProtect": 2})
+	authData := NewAuthenticatorData("example.com", AuthDataFlagUserPresent, 7)
+	authData.AttestedCredentialData = &AttestedCredentialData{
+		AAGUID:              aaguid,
+		CredentialID:        []byte{9, 8, 7, 6},
+		CredentialPublicKey: publicKey,
+	}
+	authData.Extensions = extensions
+	data := authData.Bytes()
+	flags := AuthenticatorDataFlags(data[32])
+	test.AssertEqual(t, flags, AuthDataFlagUserPresent|AuthDataFlagAttestedDataIncluded|AuthDataFlagExtensionDataIncluded, "AT and ED flags not set")
+	test.AssertArrEqual(t, data[37:53], aaguid[:], "Incorrect AAGUID position")
+	test.AssertArrEqual(t, data[53:55], []byte{0, 4}, "Incorrect credential ID length")
+	test.AssertArrEqual(t, data[55:59], []byte{9, 8, 7, 6}, "Incorrect credential ID")
+	test.AssertArrEqual(t, data[59:59+len(publicKey)], publicKey, "Incorrect public key position")
+	test.AssertArrEqual(t, data[59+len(publicKey):], extensions, "Incorrect extensions position")
+
+	parsed, err := ParseAuthenticatorData(data)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, parsed.HasFlag(AuthDataFlagUserPresent), "UP flag lost")
+	test.Assert(t, !parsed.HasFlag(AuthDataFlagUserVerified), "UV flag set")
+	test.AssertArrEqual(t, parsed.AttestedCredentialData.CredentialID, []byte{9, 8, 7, 6}, "Credential ID changed after parsing")
+	test.AssertArrEqual(t, parsed.AttestedCredentialData.CredentialPublicKey, publicKey, "Public key changed after parsing")
+	test.AssertArrEqual(t, parsed.Extensions, extensions, "Extensions changed after parsing")
+	test.AssertArrEqual(t, parsed.Bytes(), data, "Re-encoding changed authenticator data")
+}
+
+func TestAuthenticatorDataBuilderClearsStaleFlags(t *testing.T) {
+	data := NewAuthenticatorData("example.com", AuthDataFlagUserPresent|AuthDataFlagAttestedDataIncluded|AuthDataFlagExtensionDataIncluded, 0).Bytes()
+	test.AssertEqual(t, AuthenticatorDataFlags(data[32]), AuthDataFlagUserPresent, "AT/ED set without attested data or extensions")
+	_, err := ParseAuthenticatorData(data[:36])
+	test.Assert(t, err != nil, "Parsed truncated authenticator data")
+}
+
+func TestCOSEKeyOptionalFieldsOption(t *testing.T) {
+	credentialPublicKey := func(server *CTAPServer) []byte {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte("cose key")),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		}
+		response, err := server.makeCredential(util.MarshalCBOR(args), nil)
+		test.Assert(t, err == nil, "Could not create credential")
+		parsed, err := ParseAuthenticatorData(response.AuthData)
+		test.Assert(t, err == nil, "Could not parse authenticator data")
+		return parsed.AttestedCredentialData.CredentialPublicKey
+	}
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	minimal := credentialPublicKey(server)
+	test.AssertArrEqual(t, minimal, cose.MarshalCOSEPublicKey(client.vault.CredentialSources[0].PrivateKey.Public()), "Default key is not minimal")
+
+	server.SetCOSEKeyOptionalFields(true)
+	extended := credentialPublicKey(server)
+	test.AssertArrEqual(t, extended, cose.MarshalCOSEPublicKeyWithOptionalFields(client.vault.CredentialSources[1].PrivateKey.Public()), "Optional fields not included")
+}
+
+func TestCompressedCOSEKeysOption(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	source := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	var fields map[int]interface{}
+	util.CheckErr(cbor.Unmarshal(server.makeAttestedCredentialData(source).CredentialPublicKey, &fields), "Could not decode key")
+	y, ok := fields[-3].([]byte)
+	test.Assert(t, ok && len(y) == 32, "Default key does not have an uncompressed y coordinate")
+
+	server.SetCompressedCOSEKeys(true)
+	fields = nil
+	util.CheckErr(cbor.Unmarshal(server.makeAttestedCredentialData(source).CredentialPublicKey, &fields), "Could not decode key")
+	_, ok = fields[-3].(bool)
+	test.Assert(t, ok, "Compressed key does not have a y sign bit")
+}
@@ -0,0 +1,238 @@
+package ctap
+
+import (
+	"bytes"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	bioModalityFingerprint      uint32 = 0x01
+	bioFingerprintKindTouch     uint32 = 0x01
+	bioMaxTemplateFriendlyName  int    = 64
+	bioTemplateIDLength         int    = 16
+	defaultBioEnrollmentSamples int    = 4
+)
+
+type bioEnrollmentSubcommand uint32
+
+const (
+	bioEnrollmentSubcommandEnrollBegin              bioEnrollmentSubcommand = 0x01
+	bioEnrollmentSubcommandEnrollCaptureNextSample  bioEnrollmentSubcommand = 0x02
+	bioEnrollmentSubcommandCancelCurrentEnrollment  bioEnrollmentSubcommand = 0x03
+	bioEnrollmentSubcommandEnumerateEnrollments     bioEnrollmentSubcommand = 0x04
+	bioEnrollmentSubcommandSetFriendlyName          bioEnrollmentSubcommand = 0x05
+	bioEnrollmentSubcommandRemoveEnrollment         bioEnrollmentSubcommand = 0x06
+	bioEnrollmentSubcommandGetFingerprintSensorInfo bioEnrollmentSubcommand = 0x07
+)
+
+type bioEnrollmentSampleStatus uint32
+
+const (
+	bioEnrollmentSampleGood           bioEnrollmentSampleStatus = 0x00
+	bioEnrollmentSampleNoUserActivity bioEnrollmentSampleStatus = 0x0D
+)
+
+// Keys of the bio enrollment subCommandParams map
+const (
+	bioEnrollmentParamTemplateID   uint64 = 0x01
+	bioEnrollmentParamFriendlyName uint64 = 0x02
+)
+
+type bioEnrollmentArgs struct {
+	Modality          uint32                  `cbor:"1,keyasint,omitempty"`
+	SubCommand        bioEnrollmentSubcommand `cbor:"2,keyasint,omitempty"`
+	SubCommandParams  cbor.RawMessage         `cbor:"3,keyasint,omitempty"`
+	PINUVAuthProtocol uint32                  `cbor:"4,keyasint,omitempty"`
+	PINUVAuthParam    []byte                  `cbor:"5,keyasint,omitempty"`
+	GetModality       bool                    `cbor:"6,keyasint,omitempty"`
+}
+
+type bioTemplateInfo struct {
+	TemplateID   []byte `cbor:"1,keyasint"`
+	FriendlyName string `cbor:"2,keyasint,omitempty"`
+}
+
+type bioEnrollmentResponse struct {
+	Modality                uint32                     `cbor:"1,keyasint,omitempty"`
+	FingerprintKind         uint32                     `cbor:"2,keyasint,omitempty"`
+	MaxCaptureSamples       uint32                     `cbor:"3,keyasint,omitempty"`
+	TemplateID              []byte                     `cbor:"4,keyasint,omitempty"`
+	LastEnrollSampleStatus  *bioEnrollmentSampleStatus `cbor:"5,keyasint,omitempty"`
+	RemainingSamples        *uint32                    `cbor:"6,keyasint,omitempty"`
+	TemplateInfos           []bioTemplateInfo          `cbor:"7,keyasint,omitempty"`
+	MaxTemplateFriendlyName uint32                     `cbor:"8,keyasint,omitempty"`
+}
+
+// An enrollment that has been started but hasn't captured all of its samples yet
+type bioEnrollmentState struct {
+	templateID       []byte
+	remainingSamples int
+}
+
+// SetBioEnrollmentSamples sets how many simulated captures an enrollment needs to complete
+func (server *CTAPServer) SetBioEnrollmentSamples(samples int) {
+	util.Assert(samples > 0, "Bio enrollment needs at least one sample")
+	server.bioEnrollmentSamples = samples
+}
+
+// hasBioEnrollments reports whether a fingerprint is enrolled, which lets the device verify
+// the user itself
+func (server *CTAPServer) hasBioEnrollments() bool {
+	return server.client.SupportsBioEnrollment() && len(server.client.BioEnrollments()) > 0
+}
+
+// matchFingerprint simulates a fingerprint match. As with enrollment samples, a touch the
+// user confirms is a finger the sensor recognizes.
+func (server *CTAPServer) matchFingerprint(relyingParty string) bool {
+	return server.client.ApproveUserPresence(relyingParty)
+}
+
+func (server *CTAPServer) handleBioEnrollment(data []byte, cancelled cancelCheck) []byte {
+	response, err := server.manageBioEnrollment(data, cancelled)
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) manageBioEnrollment(data []byte, cancelled cancelCheck) (interface{}, error) {
+	if !server.client.SupportsBioEnrollment() {
+		return nil, statusError(ctap1ErrInvalidCommand)
+	}
+	var args bioEnrollmentArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return nil, statusError(ctap2ErrInvalidCBOR)
+	}
+	if args.GetModality {
+		return &bioEnrollmentResponse{Modality: bioModalityFingerprint}, nil
+	}
+	if args.Modality != bioModalityFingerprint {
+		return nil, statusError(ctap1ErrInvalidParameter)
+	}
+	if args.SubCommand == bioEnrollmentSubcommandGetFingerprintSensorInfo {
+		return &bioEnrollmentResponse{
+			FingerprintKind:         bioFingerprintKindTouch,
+			MaxCaptureSamples:       uint32(server.bioEnrollmentSamples),
+			MaxTemplateFriendlyName: uint32(bioMaxTemplateFriendlyName),
+		}, nil
+	}
+	if status := checkPINUVAuthProtocol(args.PINUVAuthProtocol, args.PINUVAuthParam); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	// Enrolled fingerprints verify the user, so only someone who knows the PIN may manage them
+	if !server.client.SupportsPIN() || server.client.PINHash() == nil {
+		return nil, statusError(ctap2ErrNoPINSet)
+	}
+	if args.PINUVAuthParam == nil {
+		return nil, statusError(ctap2ErrPINRequired)
+	}
+	// pinUvAuthParam is computed over the modality, the subcommand and its parameters as
+	// the platform encoded them
+	authData := util.Concat([]byte{byte(args.Modality), byte(args.SubCommand)}, args.SubCommandParams)
+	if !secretsEqual(server.derivePINAuth(server.client.PINToken(), authData), args.PINUVAuthParam) {
+		return nil, statusError(ctap2ErrPINAuthInvalid)
+	}
+	var params map[uint64]interface{}
+	if args.SubCommandParams != nil {
+		if err := cbor.Unmarshal(args.SubCommandParams, &params); err != nil {
+			ctapLogger.Printf("ERROR: %s", err)
+			return nil, statusError(ctap2ErrInvalidCBOR)
+		}
+	}
+	templateID, _ := params[bioEnrollmentParamTemplateID].([]byte)
+	switch args.SubCommand {
+	case bioEnrollmentSubcommandEnrollBegin:
+		server.bioEnrollment = &bioEnrollmentState{
+			templateID:       crypto.RandomBytes(bioTemplateIDLength),
+			remainingSamples: server.bioEnrollmentSamples,
+		}
+		return server.captureBioSample(true, cancelled)
+	case bioEnrollmentSubcommandEnrollCaptureNextSample:
+		if server.bioEnrollment == nil || !bytes.Equal(server.bioEnrollment.templateID, templateID) {
+			return nil, statusError(ctap2ErrInvalidOption)
+		}
+		return server.captureBioSample(false, cancelled)
+	case bioEnrollmentSubcommandCancelCurrentEnrollment:
+		server.bioEnrollment = nil
+		return nil, nil
+	case bioEnrollmentSubcommandEnumerateEnrollments:
+		return server.handleEnumerateBioEnrollments()
+	case bioEnrollmentSubcommandSetFriendlyName:
+		friendlyName, ok := params[bioEnrollmentParamFriendlyName].(string)
+		if templateID == nil || !ok {
+			return nil, statusError(ctap2ErrMissingParam)
+		}
+		if len(friendlyName) > bioMaxTemplateFriendlyName {
+			return nil, statusError(ctap1ErrInvalidParameter)
+		}
+		enrollments := server.client.BioEnrollments()
+		index := identities.FindBioEnrollment(enrollments, templateID)
+		if index < 0 {
+			return nil, statusError(ctap2ErrInvalidOption)
+		}
+		enrollments[index].FriendlyName = friendlyName
+		server.client.SetBioEnrollments(enrollments)
+		return nil, nil
+	case bioEnrollmentSubcommandRemoveEnrollment:
+		if templateID == nil {
+			return nil, statusError(ctap2ErrMissingParam)
+		}
+		enrollments := server.client.BioEnrollments()
+		index := identities.FindBioEnrollment(enrollments, templateID)
+		if index < 0 {
+			return nil, statusError(ctap2ErrInvalidOption)
+		}
+		server.client.SetBioEnrollments(append(enrollments[:index:index], enrollments[index+1:]...))
+		return nil, nil
+	default:
+		return nil, statusError(ctap2ErrInvalidSubcommand)
+	}
+}
+
+// captureBioSample simulates touching the sensor: every touch the user confirms is a good
+// sample, and the template is stored once enough samples have been captured
+func (server *CTAPServer) captureBioSample(includeTemplateID bool, cancelled cancelCheck) (*bioEnrollmentResponse, error) {
+	enrollment := server.bioEnrollment
+	status := bioEnrollmentSampleNoUserActivity
+	switch approveUnlessCancelled(cancelled, func() bool { return server.client.ApproveUserPresence("") }) {
+	case ctap2ErrKeepaliveCancel:
+		return nil, statusError(ctap2ErrKeepaliveCancel)
+	case ctap1ErrSuccess:
+		status = bioEnrollmentSampleGood
+		enrollment.remainingSamples--
+	}
+	remainingSamples := uint32(enrollment.remainingSamples)
+	response := &bioEnrollmentResponse{
+		LastEnrollSampleStatus: &status,
+		RemainingSamples:       &remainingSamples,
+	}
+	if includeTemplateID {
+		response.TemplateID = enrollment.templateID
+	}
+	if enrollment.remainingSamples == 0 {
+		enrollments := server.client.BioEnrollments()
+		enrollments = append(enrollments, identities.BioEnrollment{TemplateID: enrollment.templateID})
+		server.client.SetBioEnrollments(enrollments)
+		server.bioEnrollment = nil
+	}
+	return response, nil
+}
+
+func (server *CTAPServer) handleEnumerateBioEnrollments() (*bioEnrollmentResponse, error) {
+	enrollments := server.client.BioEnrollments()
+	if len(enrollments) == 0 {
+		return nil, statusError(ctap2ErrInvalidOption)
+	}
+	templateInfos := make([]bioTemplateInfo, 0, len(enrollments))
+	for _, enrollment := range enrollments {
+		templateInfos = append(templateInfos, bioTemplateInfo{
+			TemplateID:   enrollment.TemplateID,
+			FriendlyName: enrollment.FriendlyName,
+		})
+	}
+	return &bioEnrollmentResponse{TemplateInfos: templateInfos}, nil
+}
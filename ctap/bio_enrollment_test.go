@@ -0,0 +1,169 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func bioEnrollmentCommand(t *testing.T, server *CTAPServer, client *dummyCTAPClient, subCommand bioEnrollmentSubcommand, params map[uint64]interface{}) (ctapStatusCode, bioEnrollmentResponse) {
+	args := bioEnrollmentArgs{
+		Modality:   bioModalityFingerprint,
+		SubCommand: subCommand,
+	}
+	if params != nil {
+		args.SubCommandParams = util.MarshalCBOR(params)
+	}
+	if client.pinHash != nil {
+		authData := util.Concat([]byte{byte(bioModalityFingerprint), byte(subCommand)}, args.SubCommandParams)
+		args.PINUVAuthProtocol = 1
+		args.PINUVAuthParam = server.derivePINAuth(client.pinToken, authData)
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(args)))
+	var decoded bioEnrollmentResponse
+	if len(response) > 1 {
+		err := cbor.Unmarshal(response[1:], &decoded)
+		test.Assert(t, err == nil, "Could not decode bio enrollment response")
+	}
+	return ctapStatusCode(response[0]), decoded
+}
+
+func TestBioEnrollment(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.bioEnrollment = true
+	server := NewCTAPServer(client)
+	server.SetBioEnrollmentSamples(3)
+
+	status, info := bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandGetFingerprintSensorInfo, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not get sensor info")
+	test.AssertEqual(t, info.MaxCaptureSamples, uint32(3), "Incorrect number of samples required")
+
+	status, response := bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandEnrollBegin, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not begin enrollment")
+	test.AssertNotNil(t, response.TemplateID, "No template ID returned")
+	test.AssertEqual(t, *response.LastEnrollSampleStatus, bioEnrollmentSampleGood, "First sample was not good")
+	test.AssertEqual(t, *response.RemainingSamples, uint32(2), "Incorrect samples remaining")
+	templateID := response.TemplateID
+	for remaining := uint32(1); ; remaining-- {
+		status, response = bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandEnrollCaptureNextSample,
+			map[uint64]interface{}{bioEnrollmentParamTemplateID: templateID})
+		test.AssertEqual(t, status, ctap1ErrSuccess, "Could not capture sample")
+		test.AssertEqual(t, *response.RemainingSamples, remaining, "Incorrect samples remaining")
+		if remaining == 0 {
+			break
+		}
+	}
+	test.AssertEqual(t, len(client.bioEnrollments), 1, "Enrollment was not stored")
+
+	status, _ = bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandSetFriendlyName,
+		map[uint64]interface{}{bioEnrollmentParamTemplateID: templateID, bioEnrollmentParamFriendlyName: "Right Thumb"})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not set friendly name")
+	status, response = bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandEnumerateEnrollments, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not enumerate enrollments")
+	test.AssertEqual(t, len(response.TemplateInfos), 1, "Incorrect number of enrollments")
+	test.AssertArrEqual(t, response.TemplateInfos[0].TemplateID, templateID, "Incorrect template ID")
+	test.AssertEqual(t, response.TemplateInfos[0].FriendlyName, "Right Thumb", "Incorrect friendly name")
+
+	var getInfo getInfoResponse
+	err := cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &getInfo)
+	test.Assert(t, err == nil, "Could not decode getInfo")
+	test.Assert(t, getInfo.Options.BioEnroll != nil && *getInfo.Options.BioEnroll, "getInfo does not report an enrollment")
+
+	status, _ = bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandRemoveEnrollment,
+		map[uint64]interface{}{bioEnrollmentParamTemplateID: templateID})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not remove enrollment")
+	status, _ = bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandEnumerateEnrollments, nil)
+	test.AssertEqual(t, status, ctap2ErrInvalidOption, "Enrollments remain after removal")
+}
+
+func TestBioEnrollmentRequiresPINAuth(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.bioEnrollment = true
+	server := NewCTAPServer(client)
+	args := bioEnrollmentArgs{
+		Modality:          bioModalityFingerprint,
+		SubCommand:        bioEnrollmentSubcommandEnrollBegin,
+		PINUVAuthProtocol: 1,
+		PINUVAuthParam:    make([]byte, 16),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINAuthInvalid, "Enrollment began with invalid pinUvAuthParam")
+	test.Assert(t, server.bioEnrollment == nil, "Enrollment state created with invalid pinUvAuthParam")
+}
+
+func TestBioEnrollmentVerifiesUser(t *testing.T) {
+	client := &dummyCTAPClient{bioEnrollment: true}
+	server := NewCTAPServer(client)
+	test.Assert(t, !server.supportsBuiltInUV(), "UV available without an enrolled fingerprint")
+	client.bioEnrollments = []identities.BioEnrollment{{TemplateID: []byte{1}}}
+
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.Assert(t, info.Options.CanUserVerification != nil && *info.Options.CanUserVerification, "uv not reported with an enrolled fingerprint")
+
+	makeArgs := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("fingerprint")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Options:          &makeCredentialOptions{UserVerification: true},
+	}
+	credential, err := server.makeCredential(util.MarshalCBOR(makeArgs), nil)
+	test.Assert(t, err == nil, "makeCredential with a fingerprint failed")
+	test.Assert(t, AuthenticatorDataFlags(credential.AuthData[32])&AuthDataFlagUserVerified != 0, "UV flag not set by a fingerprint match")
+
+	responseBytes := internalUVAssertion(server, client)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getAssertion with a fingerprint failed")
+	var assertion getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &assertion), "Could not decode response")
+	test.Assert(t, AuthenticatorDataFlags(assertion.AuthenticatorData[32])&AuthDataFlagUserVerified != 0, "UV flag not set by a fingerprint match")
+
+	client.denyPresence = true
+	test.AssertEqual(t, ctapStatusCode(internalUVAssertion(server, client)[0]), ctap2ErrUVInvalid, "Assertion allowed without a fingerprint match")
+}
+
+func TestBioEnrollmentRequiresPIN(t *testing.T) {
+	client := &dummyCTAPClient{bioEnrollment: true}
+	server := NewCTAPServer(client)
+	status, _ := bioEnrollmentCommand(t, server, client, bioEnrollmentSubcommandGetFingerprintSensorInfo, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Sensor info refused without a PIN")
+	for _, subCommand := range []bioEnrollmentSubcommand{bioEnrollmentSubcommandEnrollBegin, bioEnrollmentSubcommandEnrollCaptureNextSample,
+		bioEnrollmentSubcommandCancelCurrentEnrollment, bioEnrollmentSubcommandEnumerateEnrollments, bioEnrollmentSubcommandRemoveEnrollment} {
+		status, _ = bioEnrollmentCommand(t, server, client, subCommand, nil)
+		test.AssertEqual(t, status, ctap2ErrNoPINSet, "Bio enrollment subcommand allowed without a PIN")
+	}
+	test.Assert(t, server.bioEnrollment == nil, "Enrollment began without a PIN")
+
+	pinClient := newPINDummyCTAPClient("1234")
+	pinClient.bioEnrollment = true
+	pinServer := NewCTAPServer(pinClient)
+	args := bioEnrollmentArgs{Modality: bioModalityFingerprint, SubCommand: bioEnrollmentSubcommandEnrollBegin}
+	response := pinServer.HandleMessage(util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINRequired, "Enrollment began without pinUvAuthParam")
+}
+
+func TestBioEnrollmentAuthUsesOriginalParams(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.bioEnrollment = true
+	client.bioEnrollments = []identities.BioEnrollment{{TemplateID: []byte{1}}}
+	server := NewCTAPServer(client)
+	// friendlyName before templateId, which canonical re-encoding would reorder
+	params := []byte{0xA2, 0x02, 0x65, 'T', 'h', 'u', 'm', 'b', 0x01, 0x41, 0x01}
+	args := bioEnrollmentArgs{
+		Modality:          bioModalityFingerprint,
+		SubCommand:        bioEnrollmentSubcommandSetFriendlyName,
+		SubCommandParams:  params,
+		PINUVAuthProtocol: 1,
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, util.Concat([]byte{byte(bioModalityFingerprint), byte(bioEnrollmentSubcommandSetFriendlyName)}, params)),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "pinUvAuthParam over the original parameters rejected")
+	test.AssertEqual(t, client.bioEnrollments[0].FriendlyName, "Thumb", "Friendly name not set")
+}
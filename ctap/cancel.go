@@ -0,0 +1,38 @@
+package ctap
+
+// cancelCheck reports whether the host has cancelled the request being handled. A nil
+// check never cancels.
+type cancelCheck func() bool
+
+func (cancelled cancelCheck) check() bool {
+	return cancelled != nil && cancelled()
+}
+
+// A built-in command handler that stops once the request is cancelled
+type cancellableHandler func(request []byte, cancelled cancelCheck) []byte
+
+// HandleCancellableMessage handles a message like HandleMessage, calling cancelled to find
+// out whether the host has given up on it. makeCredential, getAssertion and bioEnrollment
+// check before asking the user and again once the user answers, so a cancelled request
+// fails with CTAP2_ERR_KEEPALIVE_CANCEL without creating a credential, using a signature
+// counter or capturing a sample. Commands added with RegisterCommand aren't cancellable.
+func (server *CTAPServer) HandleCancellableMessage(data []byte, cancelled func() bool) []byte {
+	return server.handleMessage(data, cancelled)
+}
+
+// approveUnlessCancelled asks the user to approve the request, unless the host has already
+// cancelled it. The user may answer after the cancel, so it is checked again afterwards.
+func approveUnlessCancelled(cancelled cancelCheck, approve func() bool) ctapStatusCode {
+	if cancelled.check() {
+		return ctap2ErrKeepaliveCancel
+	}
+	approved := approve()
+	if cancelled.check() {
+		ctapLogger.Printf("ERROR: Request cancelled while waiting for the user\n\n")
+		return ctap2ErrKeepaliveCancel
+	}
+	if !approved {
+		return ctap2ErrOperationDenied
+	}
+	return ctap1ErrSuccess
+}
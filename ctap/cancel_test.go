@@ -0,0 +1,50 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// cancelledDuringApproval reports false when checked before the approval and true after it,
+// as if the host cancelled while the user was being asked
+func cancelledDuringApproval() func() bool {
+	checks := 0
+	return func() bool {
+		checks++
+		return checks > 1
+	}
+}
+
+func TestCancelledRequestHasNoSideEffects(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	makeArgs := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("cancel")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+	}
+	message := util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeArgs))
+	response := server.HandleCancellableMessage(message, cancelledDuringApproval())
+	test.AssertArrEqual(t, response, []byte{byte(ctap2ErrKeepaliveCancel)}, "Cancelled makeCredential not answered with KEEPALIVE_CANCEL")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Cancelled makeCredential created a credential")
+
+	identity := client.vault.NewIdentity(makeArgs.RP, makeArgs.User)
+	assertArgs := getAssertionArgs{
+		RPID:           "example.com",
+		ClientDataHash: crypto.HashSHA256([]byte("cancel")),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+	}
+	message = util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertArgs))
+	response = server.HandleCancellableMessage(message, cancelledDuringApproval())
+	test.AssertArrEqual(t, response, []byte{byte(ctap2ErrKeepaliveCancel)}, "Cancelled getAssertion not answered with KEEPALIVE_CANCEL")
+	test.AssertEqual(t, identity.SignatureCounter, uint32(0), "Cancelled getAssertion used the signature counter")
+
+	response = server.HandleCancellableMessage(message, func() bool { return false })
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Request that wasn't cancelled failed")
+}
@@ -0,0 +1,29 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A command in the CTAP2 vendor range 0x40-0xBF, only answered while CBOR echo is enabled
+const ctapCommandVendorCBOREcho ctapCommand = 0x41
+
+// SetCBOREchoEnabled turns on a diagnostic vendor command, 0x41, that decodes its CBOR
+// parameters and answers with their canonical CTAP2 re-encoding. Comparing the two shows
+// whether a platform's CBOR encoder produces the canonical form authenticators expect.
+func (server *CTAPServer) SetCBOREchoEnabled(enabled bool) {
+	if enabled {
+		server.RegisterCommand(byte(ctapCommandVendorCBOREcho), handleCBOREcho)
+	} else {
+		server.RegisterCommand(byte(ctapCommandVendorCBOREcho), nil)
+	}
+}
+
+func handleCBOREcho(data []byte) []byte {
+	var value interface{}
+	if err := cbor.Unmarshal(data, &value); err != nil {
+		ctapLogger.Printf("ERROR: Could not decode CBOR to echo: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(value)...)
+}
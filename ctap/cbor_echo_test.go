@@ -0,0 +1,32 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+func TestCBOREcho(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	// {2: "b", 1: h'01'} with the keys out of order and 1 encoded in two bytes
+	request := []byte{0xA2, 0x02, 0x61, 0x62, 0x18, 0x01, 0x41, 0x01}
+	message := util.Concat([]byte{byte(ctapCommandVendorCBOREcho)}, request)
+
+	response := server.HandleMessage(message)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrInvalidCommand, "Echo answered while disabled")
+
+	server.SetCBOREchoEnabled(true)
+	response = server.HandleMessage(message)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Echo failed")
+	canonical := util.MarshalCBOR(map[uint64]interface{}{1: []byte{0x01}, 2: "b"})
+	test.AssertArrEqual(t, response[1:], canonical, "Echo is not the canonical encoding")
+	test.AssertArrEqual(t, response[1:], []byte{0xA2, 0x01, 0x41, 0x01, 0x02, 0x61, 0x62}, "Unexpected canonical bytes")
+
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandVendorCBOREcho)}, request[:5]))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidCBOR, "Truncated CBOR echoed")
+
+	server.SetCBOREchoEnabled(false)
+	response = server.HandleMessage(message)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrInvalidCommand, "Echo answered after disabling")
+}
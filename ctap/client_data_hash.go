@@ -0,0 +1,65 @@
+package ctap
+
+import "github.com/bulwarkid/virtual-fido/cose"
+
+// COSE identifiers for the hash algorithms a platform can use for clientDataHash
+const (
+	clientDataHashSHA256 cose.COSEAlgorithmID = -16
+	clientDataHashSHA384 cose.COSEAlgorithmID = -43
+	clientDataHashSHA512 cose.COSEAlgorithmID = -44
+)
+
+var clientDataHashLengths = map[cose.COSEAlgorithmID]int{
+	clientDataHashSHA256: 32,
+	clientDataHashSHA384: 48,
+	clientDataHashSHA512: 64,
+}
+
+// clientDataHashAlg is a vendor extension naming the COSE algorithm clientDataHash was made
+// with. CTAP has no parameter for it, so makeCredential and getAssertion take it as an
+// extension input, which getInfo advertises.
+const extensionClientDataHashAlg = "clientDataHashAlg"
+
+func (server *CTAPServer) supportsClientDataHashAlg() bool {
+	return true
+}
+
+// SetClientDataHashAlgorithms sets the hash algorithms the platform may name in the
+// clientDataHashAlg extension, for flows that hash clientDataJSON with something other than
+// SHA-256. Requests without the extension are always accepted. By default only SHA-256 is
+// supported.
+func (server *CTAPServer) SetClientDataHashAlgorithms(algorithms []cose.COSEAlgorithmID) {
+	server.clientDataHashAlgs = append([]cose.COSEAlgorithmID{}, algorithms...)
+}
+
+// checkClientDataHash rejects a clientDataHash whose algorithm isn't supported or whose
+// length doesn't match the algorithm
+func (server *CTAPServer) checkClientDataHash(hash []byte, extensions map[string]interface{}) ctapStatusCode {
+	input, ok := extensions[extensionClientDataHashAlg]
+	if !ok || !server.isExtensionSupported(extensionClientDataHashAlg) {
+		return ctap1ErrSuccess
+	}
+	var algorithm cose.COSEAlgorithmID
+	switch value := input.(type) {
+	case int64:
+		algorithm = cose.COSEAlgorithmID(value)
+	case uint64:
+		algorithm = cose.COSEAlgorithmID(value)
+	default:
+		return ctap1ErrInvalidParameter
+	}
+	supported := server.clientDataHashAlgs
+	if supported == nil {
+		supported = []cose.COSEAlgorithmID{clientDataHashSHA256}
+	}
+	for _, alg := range supported {
+		if alg == algorithm {
+			if len(hash) != clientDataHashLengths[alg] {
+				return ctap1ErrInvalidParameter
+			}
+			return ctap1ErrSuccess
+		}
+	}
+	ctapLogger.Printf("UNSUPPORTED CLIENT DATA HASH ALGORITHM: %d\n\n", algorithm)
+	return ctap1ErrInvalidParameter
+}
@@ -0,0 +1,71 @@
+package ctap
+
+import (
+	"crypto/sha512"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func clientDataHashMakeCredential(server *CTAPServer, hash []byte, algorithm cose.COSEAlgorithmID) ctapStatusCode {
+	args := makeCredentialArgs{
+		ClientDataHash:   hash,
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       map[string]interface{}{extensionClientDataHashAlg: algorithm},
+	}
+	return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))[0])
+}
+
+func clientDataHashGetAssertion(server *CTAPServer, client *dummyCTAPClient, hash []byte, algorithm cose.COSEAlgorithmID) ctapStatusCode {
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	args := getAssertionArgs{
+		RPID:           "example.com",
+		ClientDataHash: hash,
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+		Extensions:     map[string]interface{}{extensionClientDataHashAlg: algorithm},
+	}
+	return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))[0])
+}
+
+func TestClientDataHashAlgorithm(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	sha256Hash := crypto.HashSHA256([]byte("client data"))
+	sha512Hash := sha512.Sum512([]byte("client data"))
+
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha256Hash, clientDataHashSHA256), ctap1ErrSuccess, "SHA-256 rejected")
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha512Hash[:], clientDataHashSHA512), ctap1ErrInvalidParameter, "SHA-512 accepted by default")
+	test.AssertEqual(t, clientDataHashGetAssertion(server, client, sha512Hash[:], clientDataHashSHA512), ctap1ErrInvalidParameter, "SHA-512 assertion accepted by default")
+
+	server.SetClientDataHashAlgorithms([]cose.COSEAlgorithmID{clientDataHashSHA256, clientDataHashSHA512})
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha512Hash[:], clientDataHashSHA512), ctap1ErrSuccess, "Configured SHA-512 rejected")
+	test.AssertEqual(t, clientDataHashGetAssertion(server, client, sha512Hash[:], clientDataHashSHA512), ctap1ErrSuccess, "Configured SHA-512 assertion rejected")
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha256Hash, clientDataHashSHA512), ctap1ErrInvalidParameter, "Hash with the wrong length accepted")
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha512Hash[:48], clientDataHashSHA384), ctap1ErrInvalidParameter, "Unconfigured SHA-384 accepted")
+}
+
+func TestClientDataHashAlgorithmExtension(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	sha512Hash := sha512.Sum512([]byte("client data"))
+	server.SetClientDataHashAlgorithms([]cose.COSEAlgorithmID{clientDataHashSHA512})
+	server.SetExtensionEnabled(extensionClientDataHashAlg, false)
+	test.AssertEqual(t, clientDataHashMakeCredential(server, sha512Hash[:], clientDataHashSHA256), ctap1ErrSuccess, "Disabled extension not ignored")
+
+	server.SetExtensionEnabled(extensionClientDataHashAlg, true)
+	args := makeCredentialArgs{
+		ClientDataHash:   sha512Hash[:],
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       map[string]interface{}{extensionClientDataHashAlg: "SHA-512"},
+	}
+	status := ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))[0])
+	test.AssertEqual(t, status, ctap1ErrInvalidParameter, "Non-integer algorithm accepted")
+}
@@ -0,0 +1,49 @@
+package ctap
+
+// CommandHandler handles the parameters of a CTAP2 command, everything after the command
+// byte, and returns the response: a status byte optionally followed by CBOR data
+type CommandHandler func(request []byte) []byte
+
+func (server *CTAPServer) registerDefaultCommands() {
+	server.commands = map[ctapCommand]CommandHandler{
+		ctapCommandGetInfo: func(request []byte) []byte {
+			return server.handleGetInfo()
+		},
+		ctapCommandClientPIN: server.handleClientPIN,
+		ctapCommandGetNextAssertion: func(request []byte) []byte {
+			return server.handleGetNextAssertion()
+		},
+		ctapCommandLargeBlobs: server.handleLargeBlobs,
+		ctapCommandConfig:     server.handleConfig,
+	}
+	server.cancellableCommands = map[ctapCommand]cancellableHandler{
+		ctapCommandMakeCredential: server.handleMakeCredential,
+		ctapCommandGetAssertion:   server.handleGetAssertion,
+		ctapCommandBioEnrollment:  server.handleBioEnrollment,
+	}
+	for command, handler := range server.cancellableCommands {
+		handler := handler
+		server.commands[command] = func(request []byte) []byte {
+			return handler(request, nil)
+		}
+	}
+}
+
+// hasCommand reports whether the command is answered, so getInfo only advertises the
+// features of commands that haven't been removed
+func (server *CTAPServer) hasCommand(command ctapCommand) bool {
+	_, ok := server.commands[command]
+	return ok
+}
+
+// RegisterCommand sets the handler for a CTAP2 command byte, adding a new command or
+// replacing a built-in one. A nil handler removes the command, which is then answered
+// with CTAP1_ERR_INVALID_COMMAND.
+func (server *CTAPServer) RegisterCommand(command byte, handler CommandHandler) {
+	delete(server.cancellableCommands, ctapCommand(command))
+	if handler == nil {
+		delete(server.commands, ctapCommand(command))
+		return
+	}
+	server.commands[ctapCommand(command)] = handler
+}
@@ -0,0 +1,43 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	response := server.HandleMessage([]byte{0x41, 0xA0})
+	test.AssertArrEqual(t, response, []byte{byte(ctap1ErrInvalidCommand)}, "Unknown command not rejected")
+
+	var received []byte
+	server.RegisterCommand(0x41, func(request []byte) []byte {
+		received = request
+		return []byte{byte(ctap1ErrSuccess), 0xA0}
+	})
+	response = server.HandleMessage([]byte{0x41, 0xA1, 0x01, 0x02})
+	test.AssertArrEqual(t, response, []byte{byte(ctap1ErrSuccess), 0xA0}, "Custom command handler not invoked")
+	test.AssertArrEqual(t, received, []byte{0xA1, 0x01, 0x02}, "Custom command handler got the wrong parameters")
+
+	// Built-in commands can be overridden and removed
+	server.RegisterCommand(byte(ctapCommandGetInfo), func(request []byte) []byte {
+		return []byte{byte(ctap2ErrNotAllowed)}
+	})
+	test.AssertArrEqual(t, server.HandleMessage([]byte{byte(ctapCommandGetInfo)}), []byte{byte(ctap2ErrNotAllowed)}, "Built-in command not overridden")
+	server.RegisterCommand(0x41, nil)
+	test.AssertArrEqual(t, server.HandleMessage([]byte{0x41}), []byte{byte(ctap1ErrInvalidCommand)}, "Removed command still handled")
+}
+
+func TestRemovedCommandsNotAdvertised(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	server.RegisterCommand(byte(ctapCommandConfig), nil)
+	server.RegisterCommand(byte(ctapCommandLargeBlobs), nil)
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.Assert(t, !info.Options.CanConfig, "authnrCfg reported without authenticatorConfig")
+	test.Assert(t, !info.Options.LargeBlobs, "largeBlobs reported without authenticatorLargeBlobs")
+	test.AssertEqual(t, info.MaxSerializedLargeBlobArray, uint32(0), "maxSerializedLargeBlobArray reported without authenticatorLargeBlobs")
+}
@@ -0,0 +1,64 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// credProtect lets the relying party require user verification before a credential can be
+// used or even discovered
+const extensionCredProtect = "credProtect"
+
+const (
+	credProtectUVOptional                     uint8 = 0x01
+	credProtectUVOptionalWithCredentialIDList uint8 = 0x02
+	credProtectUVRequired                     uint8 = 0x03
+)
+
+func (server *CTAPServer) supportsCredProtect() bool {
+	return true
+}
+
+// credProtectInput returns the requested credProtect level, or 0 if none was requested
+func (server *CTAPServer) credProtectInput(extensions map[string]interface{}) (uint8, ctapStatusCode) {
+	input, ok := extensions[extensionCredProtect]
+	if !ok || !server.isExtensionSupported(extensionCredProtect) {
+		return 0, ctap1ErrSuccess
+	}
+	level, ok := input.(uint64)
+	if !ok || level < uint64(credProtectUVOptional) || level > uint64(credProtectUVRequired) {
+		return 0, ctap1ErrInvalidParameter
+	}
+	return uint8(level), ctap1ErrSuccess
+}
+
+// credentialProtected reports whether the credential's credProtect policy hides it from an
+// assertion made with or without user verification
+func credentialProtected(source *identities.CredentialSource, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) bool {
+	if userVerified {
+		return false
+	}
+	switch source.CredProtect {
+	case credProtectUVRequired:
+		return true
+	case credProtectUVOptionalWithCredentialIDList:
+		return len(allowList) == 0
+	default:
+		return false
+	}
+}
+
+// unprotectedCredentials drops the credentials whose credProtect policy hides them. This
+// happens before a credential is chosen or counted, so a protected credential can't hide
+// the other credentials of the relying party.
+func unprotectedCredentials(sources []*identities.CredentialSource, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) []*identities.CredentialSource {
+	usable := make([]*identities.CredentialSource, 0, len(sources))
+	for _, source := range sources {
+		if credentialProtected(source, allowList, userVerified) {
+			ctapLogger.Printf("SKIPPING CREDENTIAL: Credential requires user verification\n\n")
+			continue
+		}
+		usable = append(usable, source)
+	}
+	return usable
+}
@@ -0,0 +1,102 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func makeCredProtectCredential(t *testing.T, server *CTAPServer, level uint64) {
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("credProtect")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       map[string]interface{}{extensionCredProtect: level},
+		Options:          &makeCredentialOptions{ResidentKey: true, UserVerification: true},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not create credential")
+	var mcResponse makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &mcResponse), "Could not decode response")
+	test.Assert(t, decodeExtensionOutputs(t, mcResponse.AuthData)[extensionCredProtect] == level, "credProtect output missing")
+}
+
+func credProtectAssertion(server *CTAPServer, uv bool) []byte {
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte("credProtect assertion")),
+		Options:        getAssertionOptions{UserVerification: uv},
+	}
+	return server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+}
+
+func TestCredProtectRequiresUV(t *testing.T) {
+	client := &dummyCTAPClient{builtInUV: true}
+	server := NewCTAPServer(client)
+	makeCredProtectCredential(t, server, uint64(credProtectUVRequired))
+	test.AssertEqual(t, client.vault.CredentialSources[0].CredProtect, credProtectUVRequired, "credProtect not stored")
+
+	response := credProtectAssertion(server, true)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Assertion with UV failed")
+	var assertion getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &assertion), "Could not decode response")
+	test.Assert(t, AuthenticatorDataFlags(assertion.AuthenticatorData[32])&AuthDataFlagUserVerified != 0, "UV flag not set")
+
+	// Without UV the credential is hidden
+	response = credProtectAssertion(server, false)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrNoCredentials, "UV-required credential used without UV")
+
+	// Requiring UV when the device can no longer perform it fails instead of skipping UV
+	client.builtInUV = false
+	response = credProtectAssertion(server, true)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidOption, "Required UV skipped")
+}
+
+func TestCredProtectDoesNotHideOtherCredentials(t *testing.T) {
+	client := &dummyCTAPClient{builtInUV: true}
+	server := NewCTAPServer(client)
+	makeCredProtectCredential(t, server, uint64(credProtectUVRequired))
+	unprotected := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "Bob"})
+
+	// The protected credential comes first, but without UV only the other one matches
+	response := credProtectAssertion(server, false)
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Protected credential hid an unprotected one")
+	var assertion getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &assertion), "Could not decode response")
+	test.AssertArrEqual(t, assertion.Credential.ID, unprotected.ID, "Wrong credential used")
+	test.AssertEqual(t, assertion.NumberOfCredentials, 0, "Protected credential counted")
+}
+
+func TestCredProtectWithCredentialIDList(t *testing.T) {
+	client := &dummyCTAPClient{builtInUV: true}
+	server := NewCTAPServer(client)
+	makeCredProtectCredential(t, server, uint64(credProtectUVOptionalWithCredentialIDList))
+	test.AssertEqual(t, ctapStatusCode(credProtectAssertion(server, false)[0]), ctap2ErrNoCredentials, "Credential discovered without UV")
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte("credProtect assertion")),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{client.vault.CredentialSources[0].CTAPDescriptor()},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Listed credential refused without UV")
+}
+
+func TestInvalidCredProtectLevel(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("credProtect")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       map[string]interface{}{extensionCredProtect: uint64(4)},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrInvalidParameter, "Invalid credProtect level accepted")
+}
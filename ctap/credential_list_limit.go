@@ -0,0 +1,25 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// Platforms split longer allow and exclude lists into batches of this size
+const defaultMaxCredentialCountInList = 16
+
+// SetMaxCredentialCountInList sets how many credentials an allowList or excludeList may hold,
+// reported as maxCredentialCountInList in getInfo. Longer lists fail with LIMIT_EXCEEDED
+// before any credential is looked up, so the platform knows to send them in batches.
+func (server *CTAPServer) SetMaxCredentialCountInList(count int) {
+	util.Assert(count > 0, "Credential list limit must be positive")
+	server.maxCredentialCount = count
+}
+
+func (server *CTAPServer) checkCredentialListLength(list []webauthn.PublicKeyCredentialDescriptor) ctapStatusCode {
+	if len(list) > server.maxCredentialCount {
+		ctapLogger.Printf("ERROR: %d credentials in list, the limit is %d\n\n", len(list), server.maxCredentialCount)
+		return ctap2ErrLimitExceeded
+	}
+	return ctap1ErrSuccess
+}
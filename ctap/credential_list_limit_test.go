@@ -0,0 +1,47 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func randomCredentialList(count int) []webauthn.PublicKeyCredentialDescriptor {
+	list := make([]webauthn.PublicKeyCredentialDescriptor, count)
+	for i := range list {
+		list[i] = webauthn.PublicKeyCredentialDescriptor{Type: "public-key", ID: crypto.RandomBytes(16)}
+	}
+	return list
+}
+
+func TestCredentialListLimit(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.AssertEqual(t, info.MaxCredentialCountInList, uint32(defaultMaxCredentialCountInList), "Wrong maxCredentialCountInList in getInfo")
+
+	getAssertion := func(allowList []webauthn.PublicKeyCredentialDescriptor) ctapStatusCode {
+		args := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("preflight")), AllowList: allowList}
+		return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))[0])
+	}
+	test.AssertEqual(t, getAssertion(randomCredentialList(defaultMaxCredentialCountInList)), ctap2ErrNoCredentials, "Allow list at the limit rejected")
+	test.AssertEqual(t, getAssertion(randomCredentialList(defaultMaxCredentialCountInList+1)), ctap2ErrLimitExceeded, "Allow list over the limit accepted")
+
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("preflight")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		ExcludeList:      randomCredentialList(defaultMaxCredentialCountInList + 1),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrLimitExceeded, "Exclude list over the limit accepted")
+
+	server.SetMaxCredentialCountInList(2)
+	test.AssertEqual(t, getAssertion(randomCredentialList(3)), ctap2ErrLimitExceeded, "Allow list over a configured limit accepted")
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
@@ -30,6 +34,9 @@ const (
 	ctapCommandClientPIN        ctapCommand = 0x06
 	ctapCommandReset            ctapCommand = 0x07
 	ctapCommandGetNextAssertion ctapCommand = 0x08
+	ctapCommandBioEnrollment    ctapCommand = 0x09
+	ctapCommandLargeBlobs       ctapCommand = 0x0C
+	ctapCommandConfig           ctapCommand = 0x0D
 )
 
 var ctapCommandDescriptions = map[ctapCommand]string{
@@ -39,6 +46,9 @@ var ctapCommandDescriptions = map[ctapCommand]string{
 	ctapCommandClientPIN:        "ctapCommandClientPIN",
 	ctapCommandReset:            "ctapCommandReset",
 	ctapCommandGetNextAssertion: "ctapCommandGetNextAssertion",
+	ctapCommandBioEnrollment:    "ctapCommandBioEnrollment",
+	ctapCommandLargeBlobs:       "ctapCommandLargeBlobs",
+	ctapCommandConfig:           "ctapCommandConfig",
 }
 
 type ctapStatusCode byte
@@ -51,31 +61,55 @@ const (
 	ctap1ErrInvalidSequence  ctapStatusCode = 0x04
 	ctap1ErrTimeout          ctapStatusCode = 0x05
 	ctap1ErrChannelBusy      ctapStatusCode = 0x06
+	ctap1ErrOther            ctapStatusCode = 0x7F
 
 	ctap2ErrUnsupportedAlgorithm ctapStatusCode = 0x26
 	ctap2ErrInvalidCBOR          ctapStatusCode = 0x12
 	ctap2ErrNoCredentials        ctapStatusCode = 0x2E
 	ctap2ErrOperationDenied      ctapStatusCode = 0x27
 	ctap2ErrMissingParam         ctapStatusCode = 0x14
+	ctap2ErrLimitExceeded        ctapStatusCode = 0x15
+	ctap2ErrUnsupportedExtension ctapStatusCode = 0x16
+	ctap2ErrUnsupportedOption    ctapStatusCode = 0x2B
+	ctap2ErrKeepaliveCancel      ctapStatusCode = 0x2D
+	ctap2ErrInvalidOption        ctapStatusCode = 0x2C
+	ctap2ErrNotAllowed           ctapStatusCode = 0x30
 	ctap2ErrPINInvalid           ctapStatusCode = 0x31
 	ctap2ErrPINBlocked           ctapStatusCode = 0x32
 	ctap2ErrPINAuthInvalid       ctapStatusCode = 0x33
+	ctap2ErrPINAuthBlocked       ctapStatusCode = 0x34
 	ctap2ErrNoPINSet             ctapStatusCode = 0x35
 	ctap2ErrPINRequired          ctapStatusCode = 0x36
 	ctap2ErrPINPolicyViolation   ctapStatusCode = 0x37
 	ctap2ErrPINExpired           ctapStatusCode = 0x38
+	ctap2ErrLargeBlobStorageFull ctapStatusCode = 0x3B
+	ctap2ErrUVBlocked            ctapStatusCode = 0x3C
+	ctap2ErrIntegrityFailure     ctapStatusCode = 0x3D
+	ctap2ErrInvalidSubcommand    ctapStatusCode = 0x3E
+	ctap2ErrUVInvalid            ctapStatusCode = 0x3F
 )
 
 type CTAPClient interface {
 	SupportsResidentKey() bool
 	SupportsPIN() bool
+	// Built-in user verification, used when the platform asks for UV without a PIN
+	SupportsUserVerification() bool
+	VerifyUser(relyingParty string) bool
 
+	// NewCredentialSource creates and stores a credential with the first of the parameters
+	// it supports, returning an error if the credential couldn't be saved
 	NewCredentialSource(
 		PubKeyCredParams []webauthn.PublicKeyCredentialParams,
 		ExcludeList []webauthn.PublicKeyCredentialDescriptor,
 		relyingParty *webauthn.PublicKeyCredentialRPEntity,
-		user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource
-	GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource
+		user *webauthn.PublicKeyCrendentialUserEntity) (*identities.CredentialSource, error)
+	// GetAssertionSources returns the credentials an assertion could use, most preferred
+	// first. It must not change them: the counter is only incremented once the assertion has
+	// been approved.
+	GetAssertionSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*identities.CredentialSource
+	// IncrementSignatureCounter increments and saves the credential's signature counter,
+	// just before the assertion is signed
+	IncrementSignatureCounter(credentialSource *identities.CredentialSource) error
 	CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte
 
 	PINHash() []byte
@@ -84,56 +118,179 @@ type CTAPClient interface {
 	SetPINRetries(retries int32)
 	PINKeyAgreement() *crypto.ECDHKey
 	PINToken() []byte
+	AlwaysUV() bool
+	SetAlwaysUV(alwaysUV bool)
+	// Whether authenticatorConfig enabled enterprise attestation
+	EnterpriseAttestation() bool
+	SetEnterpriseAttestation(enabled bool)
+	// The minimum PIN length set by authenticatorConfig, or 0 for the default, and the
+	// relying parties allowed to read it with the minPinLength extension
+	MinPINLength() int
+	SetMinPINLength(length int)
+	MinPINLengthRPIDs() []string
+	SetMinPINLengthRPIDs(rpIDs []string)
+
+	// Simulated fingerprint sensor enrollments
+	SupportsBioEnrollment() bool
+	BioEnrollments() []identities.BioEnrollment
+	SetBioEnrollments(enrollments []identities.BioEnrollment)
+
+	// The serialized large-blob array, or nil if nothing was written yet
+	LargeBlobArray() []byte
+	SetLargeBlobArray(array []byte)
 
 	ApproveAccountCreation(relyingParty string) bool
 	ApproveAccountLogin(credentialSource *identities.CredentialSource) bool
+	// ApproveUserPresence asks for a touch that isn't tied to a specific credential
+	ApproveUserPresence(relyingParty string) bool
 }
 
+const (
+	pinMaxRetries int32 = 8
+	// Consecutive PIN failures allowed before the device must be power cycled
+	pinMaxConsecutiveFailures int = 3
+	pinMinLength              int = 4
+	// The padded PIN block is 64 bytes and must end in at least one NUL
+	pinMaxLength int = 63
+)
+
 type CTAPServer struct {
-	client CTAPClient
+	client                  CTAPClient
+	pinConsecutiveFailures  int
+	maxPINLength            int
+	bioEnrollmentSamples    int
+	bioEnrollment           *bioEnrollmentState
+	disabledExtensions      map[string]bool
+	tpmAIK                  *cose.SupportedCOSEPrivateKey
+	tpmAIKCertificates      [][]byte
+	transports              []string
+	aaguid                  [16]byte
+	selfAttestation         bool
+	internalPINEntry        func(relyingParty string) (string, bool)
+	attestationDebugHandler func(outputs []AttestationDebugOutput)
+	preferredUVAttempts     uint32
+	commands                map[ctapCommand]CommandHandler
+	cancellableCommands     map[ctapCommand]cancellableHandler
+	maxLargeBlobSize        int
+	largeBlobWrite          *largeBlobWrite
+	vendorConfigCommands    map[uint64]VendorConfigHandler
+	coseKeyOptionalFields   bool
+	strictExtensions        bool
+	compressedCOSEKeys      bool
+	enterpriseCapable       bool
+	enterpriseRPIDs         []string
+	clientDataHashAlgs      []cose.COSEAlgorithmID
+	maxCredentialCount      int
+	deniedAlgorithms        []cose.COSEAlgorithmID
+	vendorInfoFields        map[uint64]interface{}
+	nextAssertion           *nextAssertionState
+	u2fDisabled             bool
 }
 
 func NewCTAPServer(client CTAPClient) *CTAPServer {
-	return &CTAPServer{client: client}
+	server := &CTAPServer{
+		client:               client,
+		maxPINLength:         pinMaxLength,
+		bioEnrollmentSamples: defaultBioEnrollmentSamples,
+		transports:           []string{"usb"},
+		aaguid:               aaguid,
+		maxLargeBlobSize:     defaultLargeBlobArraySize,
+		maxCredentialCount:   defaultMaxCredentialCountInList,
+	}
+	server.registerDefaultCommands()
+	return server
 }
 
-func (server *CTAPServer) HandleMessage(data []byte) []byte {
-	command := ctapCommand(data[0])
-	ctapLogger.Printf("CTAP COMMAND: %s\n\n", ctapCommandDescriptions[command])
-	switch command {
-	case ctapCommandMakeCredential:
-		return server.handleMakeCredential(data[1:])
-	case ctapCommandGetInfo:
-		return server.handleGetInfo()
-	case ctapCommandGetAssertion:
-		return server.handleGetAssertion(data[1:])
-	case ctapCommandClientPIN:
-		return server.handleClientPIN(data[1:])
-	default:
-		panic(fmt.Sprintf("Invalid CTAP Command: %d", command))
+// SetU2FEnabled tells the server whether the transport also answers U2F (CTAP1) messages,
+// so getInfo only reports U2F_V2 when it does. U2F is assumed to be enabled by default.
+func (server *CTAPServer) SetU2FEnabled(enabled bool) {
+	server.u2fDisabled = !enabled
+}
+
+// SetAAGUID sets the authenticator model identifier reported in getInfo and in the
+// attested credential data of new credentials
+func (server *CTAPServer) SetAAGUID(value [16]byte) {
+	server.aaguid = value
+}
+
+// SetSelfAttestation makes makeCredential sign packed attestation statements with the new
+// credential's own key instead of an attestation certificate
+func (server *CTAPServer) SetSelfAttestation(enabled bool) {
+	server.selfAttestation = enabled
+}
+
+// SetCOSEKeyOptionalFields adds the optional kid and key_ops parameters to the COSE public
+// keys of new credentials. By default keys only have the required kty, alg, crv, x and y.
+func (server *CTAPServer) SetCOSEKeyOptionalFields(enabled bool) {
+	server.coseKeyOptionalFields = enabled
+}
+
+// SetCompressedCOSEKeys encodes the EC public keys of new credentials with a compressed
+// point, for testing relying parties against it. WebAuthn expects uncompressed x and y
+// coordinates, which is the default.
+func (server *CTAPServer) SetCompressedCOSEKeys(enabled bool) {
+	server.compressedCOSEKeys = enabled
+}
+
+var supportedTransports = map[string]bool{"usb": true, "nfc": true, "ble": true, "hybrid": true, "internal": true}
+
+// SetTransports sets the transports reported in getInfo and in the descriptors of asserted
+// credentials, which relying parties use to guide their UI. The default is usb only.
+func (server *CTAPServer) SetTransports(transports []string) {
+	util.Assert(len(transports) > 0, "At least one transport is required")
+	for _, transport := range transports {
+		util.Assert(supportedTransports[transport], fmt.Sprintf("Unknown transport: %s", transport))
 	}
+	server.transports = append([]string{}, transports...)
+}
+
+// SetPreferredPlatformUVAttempts sets how many times platforms should try built-in user
+// verification before falling back to the PIN. It is only reported in getInfo when the
+// device has a built-in UV method. Zero, the default, omits it and platforms assume 1.
+func (server *CTAPServer) SetPreferredPlatformUVAttempts(attempts uint32) {
+	server.preferredUVAttempts = attempts
 }
 
-type attestedCredentialData struct {
-	AAGUID             []byte
-	CredentialIDLength uint16
-	CredentialID       []byte
-	EncodedPublicKey   []byte
+// SetMaxPINLength sets the longest PIN, in bytes, that setPIN and changePIN accept
+func (server *CTAPServer) SetMaxPINLength(length int) {
+	util.Assert(length >= pinMinLength && length <= pinMaxLength, "Invalid maximum PIN length")
+	server.maxPINLength = length
 }
 
-type authDataFlags uint8
+// ResetPINAuthBlock clears the per-power-cycle PIN failure count, as if the
+// authenticator had been unplugged and reinserted
+func (server *CTAPServer) ResetPINAuthBlock() {
+	server.pinConsecutiveFailures = 0
+}
 
-const (
-	authDataFlagUserPresent           authDataFlags = 0b00000001
-	authDataFlagUserVerified          authDataFlags = 0b00000100
-	authDataFlagAttestedDataIncluded  authDataFlags = 0b01000000
-	authDataFlagExtensionDataIncluded authDataFlags = 0b10000000
-)
+func (server *CTAPServer) HandleMessage(data []byte) []byte {
+	return server.handleMessage(data, nil)
+}
 
-type authData struct {
-	RelyingPartyIDHash     []byte
-	Flags                  authDataFlags
-	AttestedCredentialData *attestedCredentialData
+func (server *CTAPServer) handleMessage(data []byte, cancelled cancelCheck) []byte {
+	command := ctapCommand(data[0])
+	// Describing a message decodes its CBOR, so only do it when the log is shown
+	describe := util.LogLevelActive(util.LogLevelDebug)
+	if describe {
+		ctapLogger.Printf("CTAP COMMAND: %s\n\n", DescribeCTAPMessage(data))
+	}
+	if command != ctapCommandGetNextAssertion {
+		// getNextAssertion only continues the getAssertion right before it
+		server.nextAssertion = nil
+	}
+	var response []byte
+	if handler, ok := server.cancellableCommands[command]; ok {
+		response = handler(data[1:], cancelled)
+	} else if handler, ok := server.commands[command]; ok {
+		response = handler(data[1:])
+	} else {
+		ctapLogger.Printf("ERROR: Unsupported CTAP command: 0x%02x\n\n", byte(command))
+		response = []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	if describe {
+		ctapLogger.Printf("CTAP RESPONSE: %s\n\n", DescribeCTAPResponse(byte(command), response))
+	}
+	return response
 }
 
 type selfAttestationStatement struct {
@@ -147,19 +304,66 @@ type basicAttestationStatement struct {
 	X5c [][]byte             `cbor:"x5c"`
 }
 
-func makeAttestedCredentialData(credentialSource *identities.CredentialSource) []byte {
-	encodedCredentialPublicKey := cose.MarshalCOSEPublicKey(credentialSource.PrivateKey.Public())
-	return util.Concat(aaguid[:], util.ToBE(uint16(len(credentialSource.ID))), credentialSource.ID, encodedCredentialPublicKey)
+func (server *CTAPServer) makeAttestedCredentialData(credentialSource *identities.CredentialSource) *AttestedCredentialData {
+	publicKey := credentialSource.PrivateKey.Public()
+	encodedKey := cose.MarshalCOSEPublicKey(publicKey)
+	if server.compressedCOSEKeys {
+		encodedKey = cose.MarshalCompressedCOSEPublicKey(publicKey)
+	}
+	if server.coseKeyOptionalFields {
+		encodedKey = cose.AddCOSEKeyOptionalFields(encodedKey, publicKey)
+	}
+	return &AttestedCredentialData{
+		AAGUID:              server.aaguid,
+		CredentialID:        credentialSource.ID,
+		CredentialPublicKey: encodedKey,
+	}
 }
 
-func makeAuthData(rpID string, credentialSource *identities.CredentialSource, attestedCredentialData []byte, flags authDataFlags) []byte {
-	if attestedCredentialData != nil {
-		flags = flags | authDataFlagAttestedDataIncluded
-	} else {
-		attestedCredentialData = []byte{}
+// pinProbeStatus answers a request with a zero length pinUvAuthParam, which platforms send
+// after a touch to find out whether a PIN is set
+func (server *CTAPServer) pinProbeStatus(relyingParty string) ctapStatusCode {
+	if !server.client.ApproveUserPresence(relyingParty) {
+		return ctap2ErrOperationDenied
+	}
+	if server.client.SupportsPIN() && server.client.PINHash() != nil {
+		return ctap2ErrPINInvalid
 	}
-	rpIdHash := sha256.Sum256([]byte(rpID))
-	return util.Concat(rpIdHash[:], []byte{uint8(flags)}, util.ToBE(credentialSource.SignatureCounter), attestedCredentialData)
+	return ctap2ErrNoPINSet
+}
+
+// checkPINUVAuthProtocol rejects a pinUvAuthProtocol the device does not implement, and a
+// pinUvAuthParam sent without the protocol it was computed with
+func checkPINUVAuthProtocol(protocol uint32, pinUVAuthParam []byte) ctapStatusCode {
+	if protocol != 0 && protocol != 1 {
+		ctapLogger.Printf("ERROR: Unsupported pinUvAuthProtocol: %d\n\n", protocol)
+		return ctap1ErrInvalidParameter
+	}
+	if protocol == 0 && pinUVAuthParam != nil {
+		return ctap2ErrMissingParam
+	}
+	return ctap1ErrSuccess
+}
+
+// verifyUserBuiltIn performs built-in user verification when it was asked for and no
+// pinUvAuthParam was given, setting the UV flag only if the user was actually verified
+func (server *CTAPServer) verifyUserBuiltIn(pinUVAuthParam []byte, wantsUV bool, relyingParty string, flags *AuthenticatorDataFlags) ctapStatusCode {
+	if pinUVAuthParam != nil || !wantsUV || !server.supportsBuiltInUV() {
+		return ctap1ErrSuccess
+	}
+	if server.client.SupportsUserVerification() {
+		if !server.client.VerifyUser(relyingParty) {
+			return ctap2ErrOperationDenied
+		}
+	} else if server.hasBioEnrollments() {
+		if !server.matchFingerprint(relyingParty) {
+			return ctap2ErrUVInvalid
+		}
+	} else if status := server.verifyInternalPIN(relyingParty); status != ctap1ErrSuccess {
+		return status
+	}
+	*flags |= AuthDataFlagUserVerified
+	return ctap1ErrSuccess
 }
 
 type makeCredentialOptions struct {
@@ -178,6 +382,17 @@ type makeCredentialArgs struct {
 	Options           *makeCredentialOptions                   `cbor:"7,keyasint,omitempty"`
 	PINUVAuthParam    []byte                                   `cbor:"8,keyasint,omitempty"`
 	PINUVAuthProtocol uint32                                   `cbor:"9,keyasint,omitempty"`
+	Enterprise        uint32                                   `cbor:"10,keyasint,omitempty"`
+}
+
+// validate rejects options that aren't allowed in makeCredential. rk and uv default to
+// false. User presence is always required for a new credential, so the platform must not
+// send up.
+func (options *makeCredentialOptions) validate() ctapStatusCode {
+	if options != nil && options.UserPresence != nil {
+		return ctap2ErrInvalidOption
+	}
+	return ctap1ErrSuccess
 }
 
 func (args makeCredentialArgs) String() string {
@@ -194,121 +409,289 @@ func (args makeCredentialArgs) String() string {
 	)
 }
 
+const (
+	maxUserIDLength     = 64
+	maxRPIDLength       = 255
+	maxEntityNameLength = 64
+)
+
+// validateEntities checks the rp and user entities against the CTAP2 size limits
+func (args makeCredentialArgs) validateEntities() ctapStatusCode {
+	if args.RP == nil || args.User == nil {
+		return ctap2ErrMissingParam
+	}
+	if len(args.User.ID) > maxUserIDLength || len(args.RP.ID) > maxRPIDLength {
+		return ctap1ErrInvalidParameter
+	}
+	for _, name := range []string{args.RP.Name, args.User.Name, args.User.DisplayName} {
+		if len(name) > maxEntityNameLength {
+			return ctap1ErrInvalidParameter
+		}
+	}
+	return ctap1ErrSuccess
+}
+
 type makeCredentialResponse struct {
-	FormatIdentifer      string                    `cbor:"1,keyasint"`
-	AuthData             []byte                    `cbor:"2,keyasint"`
-	AttestationStatement basicAttestationStatement `cbor:"3,keyasint"`
+	FormatIdentifer      string      `cbor:"1,keyasint"`
+	AuthData             []byte      `cbor:"2,keyasint"`
+	AttestationStatement interface{} `cbor:"3,keyasint"`
+	// Set when an enterprise attestation was returned
+	EPAtt        bool   `cbor:"4,keyasint,omitempty"`
+	LargeBlobKey []byte `cbor:"5,keyasint,omitempty"`
 }
 
-func (server *CTAPServer) handleMakeCredential(data []byte) []byte {
+func (server *CTAPServer) handleMakeCredential(data []byte, cancelled cancelCheck) []byte {
+	response, err := server.makeCredential(data, cancelled)
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) makeCredential(data []byte, cancelled cancelCheck) (*makeCredentialResponse, error) {
 	var args makeCredentialArgs
-	err := cbor.Unmarshal(data, &args)
-	util.CheckErr(err, fmt.Sprintf("Could not decode CBOR for MAKE_CREDENTIAL: %s %v", err, data))
-	ctapLogger.Printf("MAKE CREDENTIAL: %s\n\n", args)
-	var flags authDataFlags = 0
-
-	supported := false
-	for _, param := range args.PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-		}
+	if err := cbor.Unmarshal(data, &args); err != nil {
+		ctapLogger.Printf("ERROR: Could not decode CBOR for MAKE_CREDENTIAL: %s\n\n", err)
+		return nil, statusError(ctap2ErrInvalidCBOR)
+	}
+	var flags AuthenticatorDataFlags = 0
+	if status := args.validateEntities(); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := server.checkClientDataHash(args.ClientDataHash, args.Extensions); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := server.checkCredentialListLength(args.ExcludeList); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := args.Options.validate(); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if args.PINUVAuthParam != nil && len(args.PINUVAuthParam) == 0 {
+		return nil, statusError(server.pinProbeStatus(args.RP.Name))
 	}
-	if !supported {
+	if status := checkPINUVAuthProtocol(args.PINUVAuthProtocol, args.PINUVAuthParam); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+
+	credentialParams := server.allowedCredentialParams(args.PubKeyCredParams)
+	if len(credentialParams) == 0 {
 		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
-		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
+		return nil, statusError(ctap2ErrUnsupportedAlgorithm)
 	}
 
-	if server.client.SupportsPIN() {
+	wantsUV := (args.Options != nil && args.Options.UserVerification) || server.client.AlwaysUV()
+	if status := server.verifyUserBuiltIn(args.PINUVAuthParam, wantsUV, args.RP.ID, &flags); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if args.Options != nil && args.Options.UserVerification && !server.canVerifyUser() {
+		// Without a UV method or a PIN to get a pinUvAuthToken with, uv can never be satisfied
+		ctapLogger.Printf("ERROR: uv requested but the device can't verify the user\n\n")
+		return nil, statusError(ctap2ErrInvalidOption)
+	}
+	if server.client.SupportsPIN() && flags&AuthDataFlagUserVerified == 0 {
 		if args.PINUVAuthProtocol == 1 && args.PINUVAuthParam != nil {
 			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
+			if !secretsEqual(pinAuth, args.PINUVAuthParam) {
+				return nil, statusError(ctap2ErrPINAuthInvalid)
 			}
-			flags = flags | authDataFlagUserVerified
+			flags = flags | AuthDataFlagUserVerified
 		} else if args.PINUVAuthParam == nil && server.client.PINHash() != nil {
-			return []byte{byte(ctap2ErrPINRequired)}
-		} else if args.PINUVAuthParam != nil && args.PINUVAuthProtocol != 1 {
-			return []byte{byte(ctap2ErrPINAuthInvalid)}
+			return nil, statusError(ctap2ErrPINRequired)
 		}
 	}
+	if server.client.AlwaysUV() && flags&AuthDataFlagUserVerified == 0 {
+		return nil, statusError(ctap2ErrPINRequired)
+	}
 
-	if !server.client.ApproveAccountCreation(args.RP.Name) {
-		ctapLogger.Printf("ERROR: Unapproved action (Create account)")
-		return []byte{byte(ctap2ErrOperationDenied)}
+	if status := server.checkMakeCredentialExtensions(args.Extensions); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	enterprise, status := server.applyEnterpriseAttestation(args.Enterprise, args.RP.ID)
+	if status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	credProtect, status := server.credProtectInput(args.Extensions)
+	if status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	largeBlobKey, status := server.largeBlobKeyInput(args.Extensions, args.Options != nil && args.Options.ResidentKey)
+	if status != ctap1ErrSuccess {
+		return nil, statusError(status)
 	}
-	flags = flags | authDataFlagUserPresent
 
-	credentialSource := server.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RP, args.User)
-	if credentialSource == nil {
-		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
-		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
+	var mcSalts *hmacSecretSalts
+	hmacSecretRequested := server.isExtensionSupported(extensionHMACSecret) && isExtensionEnabled(args.Extensions, extensionHMACSecret)
+	hmacSecretMCSupported := hmacSecretRequested && server.isExtensionSupported(extensionHMACSecretMC)
+	if input, ok := args.Extensions[extensionHMACSecretMC]; ok && hmacSecretMCSupported && flags&AuthDataFlagUserVerified != 0 {
+		// hmac-secret-mc returns an hmac-secret output at creation time, but only when UV was performed
+		var status ctapStatusCode
+		mcSalts, status = server.decryptHMACSecretSalts(input)
+		if status != ctap1ErrSuccess {
+			return nil, statusError(status)
+		}
 	}
-	attestedCredentialData := makeAttestedCredentialData(credentialSource)
-	authenticatorData := makeAuthData(args.RP.ID, credentialSource, attestedCredentialData, flags)
 
-	attestationCert := server.client.CreateAttestationCertificiate(credentialSource.PrivateKey)
-	attestationSignature := credentialSource.PrivateKey.Sign(append(authenticatorData, args.ClientDataHash...))
-	attestationStatement := basicAttestationStatement{
-		Alg: cose.COSE_ALGORITHM_ID_ES256,
-		Sig: attestationSignature,
-		X5c: [][]byte{attestationCert},
+	if status := approveUnlessCancelled(cancelled, func() bool { return server.client.ApproveAccountCreation(args.RP.Name) }); status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: Unapproved action (Create account)")
+		return nil, statusError(status)
+	}
+	flags = flags | AuthDataFlagUserPresent
+
+	credentialSource, err := server.client.NewCredentialSource(credentialParams, args.ExcludeList, args.RP, args.User)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create credential: %w", err)
+	}
+	authData := NewAuthenticatorData(args.RP.ID, flags, credentialSource.SignatureCounter)
+	authData.AttestedCredentialData = server.makeAttestedCredentialData(credentialSource)
+	extensionOutputs := map[string]interface{}{}
+	if hmacSecretRequested && credentialSource.CredRandomWithUV != nil {
+		extensionOutputs[extensionHMACSecret] = true
+		if mcSalts != nil {
+			extensionOutputs[extensionHMACSecretMC] = hmacSecretOutput(credentialSource, mcSalts, true)
+		}
 	}
+	if output := server.minPINLengthOutput(args.Extensions, args.RP.ID); output != nil {
+		extensionOutputs[extensionMinPINLength] = output
+	}
+	if credProtect != 0 {
+		credentialSource.CredProtect = credProtect
+		extensionOutputs[extensionCredProtect] = credProtect
+	}
+	authData.Extensions = encodeExtensionOutputs(extensionOutputs)
+	authenticatorData := authData.Bytes()
 
-	response := makeCredentialResponse{
-		AuthData:             authenticatorData,
-		FormatIdentifer:      "packed",
-		AttestationStatement: attestationStatement,
+	response := &makeCredentialResponse{AuthData: authenticatorData, EPAtt: enterprise}
+	if largeBlobKey {
+		response.LargeBlobKey = credentialSource.LargeBlobKey
+	}
+	response.FormatIdentifer, response.AttestationStatement = server.attest(credentialSource, authenticatorData, args.ClientDataHash)
+	if server.attestationDebugHandler != nil {
+		server.attestationDebugHandler(server.debugAttestations(credentialSource, authenticatorData, args.ClientDataHash))
 	}
-	ctapLogger.Printf("MAKE CREDENTIAL RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	return response, nil
 }
 
 type getInfoOptions struct {
-	IsPlatform      bool  `cbor:"plat"`
-	CanResidentKey  bool  `cbor:"rk"`
-	HasClientPIN    *bool `cbor:"clientPin,omitempty"`
-	CanUserPresence bool  `cbor:"up"`
-	// CanUserVerification bool  `cbor:"uv"`
+	IsPlatform          bool  `cbor:"plat" json:"plat"`
+	CanResidentKey      bool  `cbor:"rk" json:"rk"`
+	HasClientPIN        *bool `cbor:"clientPin,omitempty" json:"clientPin,omitempty"`
+	CanUserPresence     bool  `cbor:"up" json:"up"`
+	AlwaysUV            *bool `cbor:"alwaysUv,omitempty" json:"alwaysUv,omitempty"`
+	CanConfig           bool  `cbor:"authnrCfg,omitempty" json:"authnrCfg,omitempty"`
+	CanUserVerification *bool `cbor:"uv,omitempty" json:"uv,omitempty"`
+	BioEnroll           *bool `cbor:"bioEnroll,omitempty" json:"bioEnroll,omitempty"`
+	SetMinPINLength     bool  `cbor:"setMinPINLength,omitempty" json:"setMinPINLength,omitempty"`
+	LargeBlobs          bool  `cbor:"largeBlobs,omitempty" json:"largeBlobs,omitempty"`
+	Enterprise          *bool `cbor:"ep,omitempty" json:"ep,omitempty"`
 }
 
 type getInfoResponse struct {
-	Versions []string `cbor:"1,keyasint,omitempty"`
-	//Extensions []string `cbor:"2,keyasint,omitempty"`
-	AAGUID  [16]byte       `cbor:"3,keyasint,omitempty"`
-	Options getInfoOptions `cbor:"4,keyasint,omitempty"`
+	Versions   []string       `cbor:"1,keyasint,omitempty" json:"versions,omitempty"`
+	Extensions []string       `cbor:"2,keyasint,omitempty" json:"extensions,omitempty"`
+	AAGUID     [16]byte       `cbor:"3,keyasint,omitempty" json:"-"`
+	Options    getInfoOptions `cbor:"4,keyasint,omitempty" json:"options"`
 	//MaxMessageSize uint32   `cbor:"5,keyasint,omitempty"`
-	PINUVAuthProtocols []uint32 `cbor:"6,keyasint,omitempty"`
+	PINUVAuthProtocols          []uint32 `cbor:"6,keyasint,omitempty" json:"pinUvAuthProtocols,omitempty"`
+	MaxCredentialCountInList    uint32   `cbor:"7,keyasint,omitempty" json:"maxCredentialCountInList,omitempty"`
+	Transports                  []string `cbor:"9,keyasint,omitempty" json:"transports,omitempty"`
+	MaxSerializedLargeBlobArray uint32   `cbor:"11,keyasint,omitempty" json:"maxSerializedLargeBlobArray,omitempty"`
+	MinPINLength                uint32   `cbor:"13,keyasint,omitempty" json:"minPINLength,omitempty"`
+	MaxRPIDsForSetMinPINLength  uint32   `cbor:"16,keyasint,omitempty" json:"maxRPIDsForSetMinPINLength,omitempty"`
+	PreferredPlatformUVAttempts uint32   `cbor:"17,keyasint,omitempty" json:"preferredPlatformUvAttempts,omitempty"`
+	VendorConfigCommands        []uint64 `cbor:"21,keyasint,omitempty" json:"vendorPrototypeConfigCommands,omitempty"`
+	// The credential algorithms makeCredential may choose
+	Algorithms []webauthn.PublicKeyCredentialParams `cbor:"10,keyasint,omitempty" json:"algorithms,omitempty"`
+}
+
+// getInfoJSON is getInfoResponse with the AAGUID rendered as hex rather than a byte array
+type getInfoJSON struct {
+	getInfoResponse
+	AAGUID string `json:"aaguid"`
 }
 
 func (server *CTAPServer) handleGetInfo() []byte {
+	return append([]byte{byte(ctap1ErrSuccess)}, server.encodeGetInfo()...)
+}
+
+// GetInfoJSON returns the same data as the CBOR getInfo command as JSON, for tooling that
+// wants to inspect the authenticator's capabilities
+func (server *CTAPServer) GetInfoJSON() ([]byte, error) {
+	info := server.getInfo()
+	return json.Marshal(getInfoJSON{getInfoResponse: info, AAGUID: hex.EncodeToString(info.AAGUID[:])})
+}
+
+func (server *CTAPServer) getInfo() getInfoResponse {
+	alwaysUV := server.client.AlwaysUV()
+	// Not FIDO_2_1: the 2.1 PIN/UV token permissions, pinUvAuthProtocol 2 and
+	// credentialManagement aren't implemented, and a 2.1 platform would rely on them
+	versions := []string{"FIDO_2_0"}
+	if !alwaysUV && !server.u2fDisabled {
+		// U2F can't verify the user, so it is refused while alwaysUv is enabled
+		versions = append(versions, "U2F_V2")
+	}
 	response := getInfoResponse{
-		Versions: []string{"FIDO_2_0", "U2F_V2"},
-		AAGUID:   aaguid,
+		Versions:   versions,
+		AAGUID:     server.aaguid,
+		Transports: server.transports,
 		Options: getInfoOptions{
 			IsPlatform:      false,
 			CanResidentKey:  server.client.SupportsResidentKey(),
 			CanUserPresence: true,
-			// CanUserVerification: true,
+			CanConfig:       server.hasCommand(ctapCommandConfig),
+			Enterprise:      server.enterpriseAttestationOption(),
 		},
+		MaxCredentialCountInList: uint32(server.maxCredentialCount),
+		VendorConfigCommands:     server.vendorConfigCommandIDs(),
+		Algorithms:               server.supportedAlgorithms(),
+	}
+	if server.hasCommand(ctapCommandLargeBlobs) {
+		response.Options.LargeBlobs = true
+		response.MaxSerializedLargeBlobArray = uint32(server.maxLargeBlobSize)
+	}
+	if server.supportsBuiltInUV() {
+		canUserVerification := true
+		response.Options.CanUserVerification = &canUserVerification
+		response.PreferredPlatformUVAttempts = server.preferredUVAttempts
 	}
 	if server.client.SupportsPIN() {
 		var clientPIN bool = server.client.PINHash() != nil
 		response.Options.HasClientPIN = &clientPIN
 		response.PINUVAuthProtocols = []uint32{1}
+		response.Options.SetMinPINLength = true
+		response.MinPINLength = uint32(server.minPINLength())
+		response.MaxRPIDsForSetMinPINLength = uint32(maxRPIDsForSetMinPINLength)
 	}
-	ctapLogger.Printf("GET_INFO RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	if extensions := server.supportedExtensions(); len(extensions) > 0 {
+		response.Extensions = extensions
+	}
+	if server.client.SupportsBioEnrollment() {
+		// bioEnroll is false until a fingerprint has been enrolled
+		bioEnroll := len(server.client.BioEnrollments()) > 0
+		response.Options.BioEnroll = &bioEnroll
+	}
+	response.Options.AlwaysUV = &alwaysUV
+	return response
 }
 
 type getAssertionOptions struct {
 	UserVerification bool  `cbor:"uv,omitempty"`
 	UserPresence     *bool `cbor:"up,omitempty"`
+	// Only decoded to reject it: rk has no meaning for getAssertion
+	ResidentKey *bool `cbor:"rk,omitempty"`
+}
+
+// validate rejects options that aren't allowed in getAssertion. up defaults to true and uv
+// to false.
+func (options getAssertionOptions) validate() ctapStatusCode {
+	if options.ResidentKey != nil {
+		return ctap2ErrInvalidOption
+	}
+	return ctap1ErrSuccess
 }
 
 type getAssertionArgs struct {
 	RPID              string                                   `cbor:"1,keyasint"`
 	ClientDataHash    []byte                                   `cbor:"2,keyasint"`
 	AllowList         []webauthn.PublicKeyCredentialDescriptor `cbor:"3,keyasint"`
+	Extensions        map[string]interface{}                   `cbor:"4,keyasint,omitempty"`
 	Options           getAssertionOptions                      `cbor:"5,keyasint"`
 	PINUVAuthParam    []byte                                   `cbor:"6,keyasint,omitempty"`
 	PINUVAuthProtocol uint32                                   `cbor:"7,keyasint,omitempty"`
@@ -318,63 +701,237 @@ type getAssertionResponse struct {
 	Credential        *webauthn.PublicKeyCredentialDescriptor `cbor:"1,keyasint,omitempty"`
 	AuthenticatorData []byte                                  `cbor:"2,keyasint"`
 	Signature         []byte                                  `cbor:"3,keyasint"`
-	//User                *PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
-	//NumberOfCredentials int32 `cbor:"5,keyasint"`
+	// Only present for discoverable credentials, which the platform finds by user
+	User *webauthn.PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
+	// Only present when more than one discoverable credential matched
+	NumberOfCredentials int    `cbor:"5,keyasint,omitempty"`
+	LargeBlobKey        []byte `cbor:"7,keyasint,omitempty"`
 }
 
-func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
-	var flags authDataFlags = 0
+// usableCredentialDescriptors drops allow list entries with an unknown type, which the spec
+// says to ignore, and entries without a credential ID, which can't match any credential
+func usableCredentialDescriptors(descriptors []webauthn.PublicKeyCredentialDescriptor) []webauthn.PublicKeyCredentialDescriptor {
+	usable := make([]webauthn.PublicKeyCredentialDescriptor, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if descriptor.Type != "public-key" || len(descriptor.ID) == 0 {
+			ctapLogger.Printf("IGNORING CREDENTIAL DESCRIPTOR: %#v\n\n", descriptor)
+			continue
+		}
+		usable = append(usable, descriptor)
+	}
+	return usable
+}
+
+func (server *CTAPServer) handleGetAssertion(data []byte, cancelled cancelCheck) []byte {
+	response, err := server.getAssertion(data, cancelled)
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) getAssertion(data []byte, cancelled cancelCheck) (*getAssertionResponse, error) {
+	var flags AuthenticatorDataFlags = 0
 	var args getAssertionArgs
 	err := cbor.Unmarshal(data, &args)
 	if err != nil {
 		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2ErrInvalidCBOR)}
+		return nil, statusError(ctap2ErrInvalidCBOR)
+	}
+	if status := args.Options.validate(); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := server.checkClientDataHash(args.ClientDataHash, args.Extensions); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := server.checkCredentialListLength(args.AllowList); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if args.PINUVAuthParam != nil && len(args.PINUVAuthParam) == 0 {
+		return nil, statusError(server.pinProbeStatus(args.RPID))
+	}
+	if status := checkPINUVAuthProtocol(args.PINUVAuthProtocol, args.PINUVAuthParam); status != ctap1ErrSuccess {
+		return nil, statusError(status)
 	}
-	ctapLogger.Printf("GET ASSERTION: %#v\n\n", args)
 
+	wantsUV := args.Options.UserVerification || server.client.AlwaysUV()
+	if status := server.verifyUserBuiltIn(args.PINUVAuthParam, wantsUV, args.RPID, &flags); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
 	if server.client.SupportsPIN() {
 		if args.PINUVAuthParam != nil {
-			if args.PINUVAuthProtocol != 1 {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
 			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
+			if !secretsEqual(pinAuth, args.PINUVAuthParam) {
+				return nil, statusError(ctap2ErrPINAuthInvalid)
 			}
-			flags = flags | authDataFlagUserVerified
+			flags = flags | AuthDataFlagUserVerified
 		}
 	}
+	if server.client.AlwaysUV() && flags&AuthDataFlagUserVerified == 0 {
+		return nil, statusError(ctap2ErrPINRequired)
+	}
+	if args.Options.UserVerification && flags&AuthDataFlagUserVerified == 0 {
+		// The relying party required UV but the device has no way to perform it, which
+		// makeCredential rejects the same way
+		ctapLogger.Printf("ERROR: uv requested but the user wasn't verified\n\n")
+		return nil, statusError(ctap2ErrInvalidOption)
+	}
+	extensions, status := server.parseAssertionExtensions(args.Extensions)
+	if status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
 
-	credentialSource := server.client.GetAssertionSource(args.RPID, args.AllowList)
-	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
-	if credentialSource == nil {
+	allowList := usableCredentialDescriptors(args.AllowList)
+	if len(args.AllowList) > 0 && len(allowList) == 0 {
+		// An allow list of only malformed entries must not fall back to discoverable credentials
+		ctapLogger.Printf("ERROR: No usable credentials in allow list\n\n")
+		return nil, statusError(ctap2ErrNoCredentials)
+	}
+	sources := server.client.GetAssertionSources(args.RPID, allowList)
+	sources = unprotectedCredentials(sources, allowList, flags&AuthDataFlagUserVerified != 0)
+	if len(sources) == 0 {
 		ctapLogger.Printf("ERROR: No Credentials\n\n")
-		return []byte{byte(ctap2ErrNoCredentials)}
+		return nil, statusError(ctap2ErrNoCredentials)
+	}
+	credentialSource := sources[0]
+	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
+	if !credentialSource.CounterAvailable() {
+		ctapLogger.Printf("ERROR: Signature counter exhausted\n\n")
+		return nil, statusError(ctap2ErrNotAllowed)
 	}
 
 	if args.Options.UserPresence == nil || *args.Options.UserPresence {
-		if !server.client.ApproveAccountLogin(credentialSource) {
+		if status := approveUnlessCancelled(cancelled, func() bool { return server.client.ApproveAccountLogin(credentialSource) }); status != ctap1ErrSuccess {
 			ctapLogger.Printf("ERROR: Unapproved action (Account login)")
-			return []byte{byte(ctap2ErrOperationDenied)}
+			return nil, statusError(status)
 		}
-		flags = flags | authDataFlagUserPresent
+		flags = flags | AuthDataFlagUserPresent
 	}
 
-	authData := makeAuthData(args.RPID, credentialSource, nil, flags)
-	signature := credentialSource.PrivateKey.Sign(util.Concat(authData, args.ClientDataHash))
+	assertion := &nextAssertionState{
+		rpID:           args.RPID,
+		clientDataHash: args.ClientDataHash,
+		flags:          flags,
+		extensions:     extensions,
+		discoverable:   len(allowList) == 0,
+	}
+	response, err := server.signAssertion(assertion, credentialSource)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.discoverable && len(sources) > 1 {
+		// With an allow list only the first match is used, so there is never a next one
+		response.NumberOfCredentials = len(sources)
+		assertion.sources = sources[1:]
+		assertion.deadline = time.Now().Add(nextAssertionTimeout)
+		server.nextAssertion = assertion
+	}
+
+	return response, nil
+}
+
+// signAssertion increments the credential's counter and signs the assertion. The user must
+// already have approved it.
+func (server *CTAPServer) signAssertion(assertion *nextAssertionState, credentialSource *identities.CredentialSource) (*getAssertionResponse, error) {
+	if !credentialSource.CounterAvailable() {
+		ctapLogger.Printf("ERROR: Signature counter exhausted\n\n")
+		return nil, statusError(ctap2ErrNotAllowed)
+	}
+	if err := server.client.IncrementSignatureCounter(credentialSource); err != nil {
+		return nil, fmt.Errorf("Could not increment signature counter: %w", err)
+	}
+
+	authenticatorData := NewAuthenticatorData(assertion.rpID, assertion.flags, credentialSource.SignatureCounter)
+	authenticatorData.Extensions = encodeExtensionOutputs(assertion.extensions.outputs(credentialSource, assertion.flags))
+	authData := authenticatorData.Bytes()
+	signature := credentialSource.PrivateKey.Sign(util.Concat(authData, assertion.clientDataHash))
 
 	credentialDescriptor := credentialSource.CTAPDescriptor()
-	response := getAssertionResponse{
+	credentialDescriptor.Transports = server.transports
+	response := &getAssertionResponse{
 		Credential:        &credentialDescriptor,
 		AuthenticatorData: authData,
 		Signature:         signature,
-		//User:                credentialSource.User,
-		//NumberOfCredentials: 1,
 	}
+	if assertion.discoverable && credentialSource.User != nil {
+		// Names identify the user, so they are only returned after user verification
+		user := webauthn.PublicKeyCrendentialUserEntity{ID: credentialSource.User.ID}
+		if assertion.flags&AuthDataFlagUserVerified != 0 {
+			user.Name = credentialSource.User.Name
+			user.DisplayName = credentialSource.User.DisplayName
+		}
+		response.User = &user
+	}
+	if assertion.extensions.largeBlobKey {
+		response.LargeBlobKey = credentialSource.LargeBlobKey
+	}
+	return response, nil
+}
+
+type configSubcommand uint32
+
+const (
+	configSubcommandEnableEnterpriseAttestation configSubcommand = 0x01
+	configSubcommandToggleAlwaysUV              configSubcommand = 0x02
+	configSubcommandSetMinPINLength             configSubcommand = 0x03
+)
 
-	ctapLogger.Printf("GET ASSERTION RESPONSE: %#v\n\n", response)
+type configArgs struct {
+	SubCommand        configSubcommand       `cbor:"1,keyasint"`
+	SubCommandParams  map[uint64]interface{} `cbor:"2,keyasint,omitempty"`
+	PINUVAuthProtocol uint32                 `cbor:"3,keyasint,omitempty"`
+	PINUVAuthParam    []byte                 `cbor:"4,keyasint,omitempty"`
+}
 
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+func (server *CTAPServer) handleConfig(data []byte) []byte {
+	return encodeResponse(nil, server.authenticatorConfig(data))
+}
+
+func (server *CTAPServer) authenticatorConfig(data []byte) error {
+	var args configArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return statusError(ctap2ErrInvalidCBOR)
+	}
+	if status := checkPINUVAuthProtocol(args.PINUVAuthProtocol, args.PINUVAuthParam); status != ctap1ErrSuccess {
+		return statusError(status)
+	}
+	if server.client.SupportsPIN() && server.client.PINHash() != nil {
+		if args.PINUVAuthParam == nil {
+			return statusError(ctap2ErrPINRequired)
+		}
+		// pinUvAuthParam is computed over 32 bytes of 0xff, the command byte and the subcommand
+		authData := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(args.SubCommand)})
+		if args.SubCommandParams != nil {
+			authData = append(authData, util.MarshalCBOR(args.SubCommandParams)...)
+		}
+		if !secretsEqual(server.derivePINAuth(server.client.PINToken(), authData), args.PINUVAuthParam) {
+			return statusError(ctap2ErrPINAuthInvalid)
+		}
+	}
+	switch args.SubCommand {
+	case configSubcommandEnableEnterpriseAttestation:
+		return server.handleEnableEnterpriseAttestation()
+	case configSubcommandToggleAlwaysUV:
+		return server.handleToggleAlwaysUV()
+	case configSubcommandSetMinPINLength:
+		return server.handleSetMinPINLength(args.SubCommandParams)
+	case configSubcommandVendorPrototype:
+		return server.handleVendorConfig(args.SubCommandParams)
+	default:
+		return statusError(ctap2ErrInvalidSubcommand)
+	}
+}
+
+// handleToggleAlwaysUV flips alwaysUv, so toggling twice restores the original setting.
+// handleConfig has already checked pinUvAuthParam if a PIN is set.
+func (server *CTAPServer) handleToggleAlwaysUV() error {
+	alwaysUV := !server.client.AlwaysUV()
+	hasPIN := server.client.SupportsPIN() && server.client.PINHash() != nil
+	if alwaysUV && !hasPIN && !server.supportsBuiltInUV() {
+		// alwaysUv can't be satisfied without a user verification method
+		return statusError(ctap2ErrNoPINSet)
+	}
+	server.client.SetAlwaysUV(alwaysUV)
+	return nil
 }
 
 type clientPINSubcommand uint32
@@ -427,9 +984,21 @@ func (args clientPINResponse) String() string {
 		args.Retries)
 }
 
-func (server *CTAPServer) getPINSharedSecret(remoteKey cose.COSEEC2Key) []byte {
+// getPINSharedSecret derives the PIN protocol 1 shared secret from the platform's key
+// agreement key, which must be an uncompressed P-256 point
+func (server *CTAPServer) getPINSharedSecret(remoteKey cose.COSEEC2Key) ([]byte, ctapStatusCode) {
+	if remoteKey.KeyType != int8(cose.COSE_KEY_TYPE_EC2) || remoteKey.Curve != int8(cose.COSE_CURVE_ID_P256) ||
+		len(remoteKey.X) != 32 || len(remoteKey.Y) != 32 {
+		ctapLogger.Printf("ERROR: Platform key agreement key is not a P-256 key: %s\n\n", &remoteKey)
+		return nil, ctap1ErrInvalidParameter
+	}
 	pinKey := server.client.PINKeyAgreement()
-	return crypto.HashSHA256(pinKey.ECDH(util.BytesToBigInt(remoteKey.X), util.BytesToBigInt(remoteKey.Y)))
+	secret, err := pinKey.ECDH(util.BytesToBigInt(remoteKey.X), util.BytesToBigInt(remoteKey.Y))
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s\n\n", err)
+		return nil, ctap1ErrInvalidParameter
+	}
+	return crypto.HashSHA256(secret), ctap1ErrSuccess
 }
 
 func (server *CTAPServer) derivePINAuth(sharedSecret []byte, data []byte) []byte {
@@ -454,133 +1023,204 @@ func (server *CTAPServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []
 	return decryptedPIN
 }
 
+// secretsEqual compares PIN hashes, tokens and MACs in constant time, so response times
+// don't reveal how many leading bytes of a guess were right
+func secretsEqual(a []byte, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// hashPIN is the LEFT(SHA-256(pin), 16) the authenticator stores instead of the PIN
+func hashPIN(pin []byte) []byte {
+	return crypto.HashSHA256(pin)[:16]
+}
+
+// SetPIN sets the PIN directly, as setPIN would over the wire, and resets the retry counter.
+// Intended for seeding known state in tests.
+func (server *CTAPServer) SetPIN(pin string) error {
+	if !server.client.SupportsPIN() {
+		return fmt.Errorf("PIN is not enabled on this device")
+	}
+	if server.validatePIN([]byte(pin)) != ctap1ErrSuccess {
+		return fmt.Errorf("PIN does not meet the PIN policy")
+	}
+	server.client.SetPINRetries(pinMaxRetries)
+	server.client.SetPINHash(hashPIN([]byte(pin)))
+	server.pinConsecutiveFailures = 0
+	return nil
+}
+
+// validatePIN checks a decrypted, NUL-trimmed PIN against the PIN policy
+func (server *CTAPServer) validatePIN(pin []byte) ctapStatusCode {
+	if len(pin) < server.minPINLength() || len(pin) > server.maxPINLength || !utf8.Valid(pin) {
+		return ctap2ErrPINPolicyViolation
+	}
+	return ctap1ErrSuccess
+}
+
 func (server *CTAPServer) handleClientPIN(data []byte) []byte {
+	response, err := server.clientPIN(data)
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) clientPIN(data []byte) (interface{}, error) {
 	if !server.client.SupportsPIN() {
-		return []byte{byte(ctap1ErrInvalidCommand)}
+		return nil, statusError(ctap1ErrInvalidCommand)
 	}
 	var args clientPINArgs
 	err := cbor.Unmarshal(data, &args)
 	if err != nil {
 		ctapLogger.Printf("ERROR: %s", err)
-		return []byte{byte(ctap2ErrInvalidCBOR)}
+		return nil, statusError(ctap2ErrInvalidCBOR)
 	}
 	if args.PINUVAuthProtocol != 1 {
-		return []byte{byte(ctap1ErrInvalidParameter)}
+		return nil, statusError(ctap1ErrInvalidParameter)
 	}
 	ctapLogger.Printf("CLIENT_PIN: %v\n\n", args)
-	var response []byte
 	switch args.SubCommand {
 	case clientPINSubcommandGetRetries:
-		response = server.handleGetRetries()
+		return server.handleGetRetries(), nil
 	case clientPinSubcommandGetKeyAgreement:
-		response = server.handleGetKeyAgreement()
+		return server.handleGetKeyAgreement(), nil
 	case clientPINSubcommandSetPIN:
-		response = server.handleSetPIN(args)
+		return nil, server.handleSetPIN(args)
 	case clientPINSubcommandChangePIN:
-		response = server.handleChangePIN(args)
+		return nil, server.handleChangePIN(args)
 	case clientPinSubcommandGetPINToken:
-		response = server.handleGetPINToken(args)
+		return server.handleGetPINToken(args)
 	default:
-		return []byte{byte(ctap2ErrMissingParam)}
+		return nil, statusError(ctap2ErrMissingParam)
 	}
-	ctapLogger.Printf("CLIENT_PIN RESPONSE: %#v\n\n", response)
-	return response
 }
 
-func (server *CTAPServer) handleGetRetries() []byte {
+func (server *CTAPServer) handleGetRetries() *clientPINResponse {
 	retries := uint8(server.client.PINRetries())
-	response := clientPINResponse{
+	response := &clientPINResponse{
 		Retries: &retries,
 	}
 	ctapLogger.Printf("CLIENT_PIN_GET_RETRIES: %v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	return response
 }
 
-func (server *CTAPServer) handleGetKeyAgreement() []byte {
+func (server *CTAPServer) handleGetKeyAgreement() *clientPINResponse {
 	key := server.client.PINKeyAgreement()
-	response := clientPINResponse{
+	response := &clientPINResponse{
 		KeyAgreement: &cose.COSEEC2Key{
 			KeyType:   int8(cose.COSE_KEY_TYPE_EC2),
 			Algorithm: int8(cose.COSE_ALGORITHM_ID_ECDH_HKDF_256),
-			X:         key.X.Bytes(),
-			Y:         key.Y.Bytes(),
+			Curve:     int8(cose.COSE_CURVE_ID_P256),
+			X:         key.X.FillBytes(make([]byte, 32)),
+			Y:         key.Y.FillBytes(make([]byte, 32)),
 		},
 	}
 	ctapLogger.Printf("CLIENT_PIN_GET_KEY_AGREEMENT RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	return response
 }
 
-func (server *CTAPServer) handleSetPIN(args clientPINArgs) []byte {
+func (server *CTAPServer) handleSetPIN(args clientPINArgs) error {
 	if server.client.PINHash() != nil {
-		return []byte{byte(ctap2ErrPINAuthInvalid)}
+		return statusError(ctap2ErrPINAuthInvalid)
 	}
 	if args.KeyAgreement == nil || args.PINUVAuthParam == nil || args.NewPINEncoding == nil {
-		return []byte{byte(ctap2ErrMissingParam)}
+		return statusError(ctap2ErrMissingParam)
+	}
+	sharedSecret, status := server.getPINSharedSecret(*args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return statusError(status)
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
 	pinAuth := server.derivePINAuth(sharedSecret, args.NewPINEncoding)
-	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	if !secretsEqual(pinAuth, args.PINUVAuthParam) {
+		return statusError(ctap2ErrPINAuthInvalid)
 	}
 	decryptedPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(decryptedPIN) < 4 {
-		return []byte{byte(ctap2ErrPINPolicyViolation)}
+	if status := server.validatePIN(decryptedPIN); status != ctap1ErrSuccess {
+		return statusError(status)
 	}
-	pinHash := crypto.HashSHA256(decryptedPIN)[:16]
-	server.client.SetPINRetries(8)
+	pinHash := hashPIN(decryptedPIN)
+	server.client.SetPINRetries(pinMaxRetries)
 	server.client.SetPINHash(pinHash)
 	ctapLogger.Printf("SETTING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
-	return []byte{byte(ctap1ErrSuccess)}
+	return nil
+}
+
+// verifyPINHash checks an encrypted PIN hash against the stored one, decrementing the
+// retry counter before comparing and restoring it only when the PIN matches
+func (server *CTAPServer) verifyPINHash(sharedSecret []byte, pinHashEncoding []byte) ctapStatusCode {
+	if server.pinConsecutiveFailures >= pinMaxConsecutiveFailures {
+		return ctap2ErrPINAuthBlocked
+	}
+	retries := server.client.PINRetries() - 1
+	server.client.SetPINRetries(retries)
+	return server.checkPINHash(server.decryptPINHash(sharedSecret, pinHashEncoding), retries)
 }
 
-func (server *CTAPServer) handleChangePIN(args clientPINArgs) []byte {
+// checkPINHash compares a PIN hash with the stored one after the retry counter has been
+// decremented to retries
+func (server *CTAPServer) checkPINHash(pinHash []byte, retries int32) ctapStatusCode {
+	if !secretsEqual(pinHash, server.client.PINHash()) {
+		// TODO: Regenerate the key agreement key on mismatch
+		ctapLogger.Printf("MISMATCH: Provided PIN doesn't match stored PIN\n\n")
+		unsafeCtapLogger.Printf("MISMATCH: Provided PIN hash %v, stored PIN hash %v\n\n", hex.EncodeToString(pinHash), hex.EncodeToString(server.client.PINHash()))
+		server.pinConsecutiveFailures++
+		if retries <= 0 {
+			return ctap2ErrPINBlocked
+		}
+		if server.pinConsecutiveFailures >= pinMaxConsecutiveFailures {
+			return ctap2ErrPINAuthBlocked
+		}
+		return ctap2ErrPINInvalid
+	}
+	server.pinConsecutiveFailures = 0
+	server.client.SetPINRetries(pinMaxRetries)
+	return ctap1ErrSuccess
+}
+
+func (server *CTAPServer) handleChangePIN(args clientPINArgs) error {
+	if server.client.PINHash() == nil {
+		// There is nothing to change, the platform has to use setPIN
+		return statusError(ctap2ErrNoPINSet)
+	}
 	if args.KeyAgreement == nil || args.PINUVAuthParam == nil {
-		return []byte{byte(ctap2ErrMissingParam)}
+		return statusError(ctap2ErrMissingParam)
 	}
-	if server.client.PINRetries() == 0 {
-		return []byte{byte(ctap2ErrPINBlocked)}
+	if server.client.PINRetries() <= 0 {
+		return statusError(ctap2ErrPINBlocked)
+	}
+	sharedSecret, status := server.getPINSharedSecret(*args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return statusError(status)
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
 	pinAuth := server.derivePINAuth(sharedSecret, append(args.NewPINEncoding, args.PINHashEncoding...))
-	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	if !secretsEqual(pinAuth, args.PINUVAuthParam) {
+		return statusError(ctap2ErrPINAuthInvalid)
 	}
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	decryptedPINHash := crypto.DecryptAESCBC(sharedSecret, args.PINHashEncoding)
-	if !bytes.Equal(server.client.PINHash(), decryptedPINHash) {
-		// TODO: Mismatch detected, handle it
-		return []byte{byte(ctap2ErrPINInvalid)}
+	if status := server.verifyPINHash(sharedSecret, args.PINHashEncoding); status != ctap1ErrSuccess {
+		return statusError(status)
 	}
-	server.client.SetPINRetries(8)
 	newPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(newPIN) < 4 {
-		return []byte{byte(ctap2ErrPINPolicyViolation)}
+	if status := server.validatePIN(newPIN); status != ctap1ErrSuccess {
+		return statusError(status)
 	}
-	pinHash := crypto.HashSHA256(newPIN)[:16]
-	server.client.SetPINHash(pinHash)
-	return []byte{byte(ctap1ErrSuccess)}
+	server.client.SetPINHash(hashPIN(newPIN))
+	return nil
 }
 
-func (server *CTAPServer) handleGetPINToken(args clientPINArgs) []byte {
-	if args.PINHashEncoding == nil || args.KeyAgreement.X == nil {
-		return []byte{byte(ctap2ErrMissingParam)}
+func (server *CTAPServer) handleGetPINToken(args clientPINArgs) (*clientPINResponse, error) {
+	if args.PINHashEncoding == nil || args.KeyAgreement == nil || args.KeyAgreement.X == nil {
+		return nil, statusError(ctap2ErrMissingParam)
 	}
 	if server.client.PINRetries() <= 0 {
-		return []byte{byte(ctap2ErrPINBlocked)}
-	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	pinHash := server.decryptPINHash(sharedSecret, args.PINHashEncoding)
-	ctapLogger.Printf("TRYING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
-	if !bytes.Equal(pinHash, server.client.PINHash()) {
-		// TODO: Handle mismatch here by regening the key agreement key
-		ctapLogger.Printf("MISMATCH: Provided PIN %v doesn't match stored PIN %v\n\n", hex.EncodeToString(pinHash), hex.EncodeToString(server.client.PINHash()))
-		return []byte{byte(ctap2ErrPINInvalid)}
-	}
-	server.client.SetPINRetries(8)
-	response := clientPINResponse{
+		return nil, statusError(ctap2ErrPINBlocked)
+	}
+	sharedSecret, status := server.getPINSharedSecret(*args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	if status := server.verifyPINHash(sharedSecret, args.PINHashEncoding); status != ctap1ErrSuccess {
+		return nil, statusError(status)
+	}
+	response := &clientPINResponse{
 		PinToken: crypto.EncryptAESCBC(sharedSecret, server.client.PINToken()),
 	}
 	ctapLogger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n", response)
-	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+	return response, nil
 }
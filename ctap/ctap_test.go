@@ -2,6 +2,9 @@ package ctap
 
 import (
 	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"encoding/json"
 	"testing"
 
 	"github.com/bulwarkid/virtual-fido/cose"
@@ -15,48 +18,129 @@ import (
 
 type dummyCTAPClient struct {
 	vault identities.IdentityVault
+
+	pinEnabled      bool
+	pinHash         []byte
+	pinRetries      int32
+	pinKeyAgreement *crypto.ECDHKey
+	pinToken        []byte
+	alwaysUV        bool
+	builtInUV       bool
+	minPINLength    int
+	minPINRPIDs     []string
+	largeBlobArray  []byte
+	enterpriseAtt   bool
+
+	bioEnrollment  bool
+	bioEnrollments []identities.BioEnrollment
+	denyPresence   bool
+}
+
+func newPINDummyCTAPClient(pin string) *dummyCTAPClient {
+	return &dummyCTAPClient{
+		pinEnabled:      true,
+		pinHash:         crypto.HashSHA256([]byte(pin))[:16],
+		pinRetries:      8,
+		pinKeyAgreement: crypto.GenerateECDHKey(),
+		pinToken:        crypto.RandomBytes(16),
+	}
 }
+
 func (client *dummyCTAPClient) SupportsResidentKey() bool {
 	return true
 }
 func (client *dummyCTAPClient) SupportsPIN() bool {
-	return false
+	return client.pinEnabled
+}
+func (client *dummyCTAPClient) SupportsUserVerification() bool {
+	return client.builtInUV
+}
+func (client *dummyCTAPClient) VerifyUser(relyingParty string) bool {
+	return client.builtInUV
 }
 
 func (client *dummyCTAPClient) NewCredentialSource(
 	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
 	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
 	relyingParty *webauthn.PublicKeyCredentialRPEntity,
-	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
-	return client.vault.NewIdentity(relyingParty, user)
+	user *webauthn.PublicKeyCrendentialUserEntity) (*identities.CredentialSource, error) {
+	return client.vault.NewIdentity(relyingParty, user), nil
 }
-func (client *dummyCTAPClient) GetAssertionSource(
-	relyingPartyID string, 
-	allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
-	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
-	if len(sources) > 0 {
-		return sources[0]
-	} else {
-		return nil
-	}
+func (client *dummyCTAPClient) GetAssertionSources(
+	relyingPartyID string,
+	allowList []webauthn.PublicKeyCredentialDescriptor) []*identities.CredentialSource {
+	return client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
+}
+func (client *dummyCTAPClient) IncrementSignatureCounter(credentialSource *identities.CredentialSource) error {
+	return client.vault.IncrementCounter(credentialSource)
 }
 func (client *dummyCTAPClient) CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
 	return nil
 }
 
 func (client *dummyCTAPClient) PINHash() []byte {
-	return nil
+	return client.pinHash
+}
+func (client *dummyCTAPClient) SetPINHash(pin []byte) {
+	client.pinHash = pin
 }
-func (client *dummyCTAPClient) SetPINHash(pin []byte) {}
 func (client *dummyCTAPClient) PINRetries() int32 {
-	return 0
+	return client.pinRetries
+}
+func (client *dummyCTAPClient) SetPINRetries(retries int32) {
+	client.pinRetries = retries
 }
-func (client *dummyCTAPClient) SetPINRetries(retries int32) {}
 func (client *dummyCTAPClient) PINKeyAgreement() *crypto.ECDHKey {
-	return nil
+	return client.pinKeyAgreement
 }
 func (client *dummyCTAPClient) PINToken() []byte {
-	return nil
+	return client.pinToken
+}
+func (client *dummyCTAPClient) AlwaysUV() bool {
+	return client.alwaysUV
+}
+func (client *dummyCTAPClient) SetAlwaysUV(alwaysUV bool) {
+	client.alwaysUV = alwaysUV
+}
+func (client *dummyCTAPClient) EnterpriseAttestation() bool {
+	return client.enterpriseAtt
+}
+func (client *dummyCTAPClient) SetEnterpriseAttestation(enabled bool) {
+	client.enterpriseAtt = enabled
+}
+
+func (client *dummyCTAPClient) LargeBlobArray() []byte {
+	return client.largeBlobArray
+}
+
+func (client *dummyCTAPClient) SetLargeBlobArray(array []byte) {
+	client.largeBlobArray = array
+}
+
+func (client *dummyCTAPClient) MinPINLength() int {
+	return client.minPINLength
+}
+
+func (client *dummyCTAPClient) SetMinPINLength(length int) {
+	client.minPINLength = length
+}
+
+func (client *dummyCTAPClient) MinPINLengthRPIDs() []string {
+	return client.minPINRPIDs
+}
+
+func (client *dummyCTAPClient) SetMinPINLengthRPIDs(rpIDs []string) {
+	client.minPINRPIDs = rpIDs
+}
+
+func (client *dummyCTAPClient) SupportsBioEnrollment() bool {
+	return client.bioEnrollment
+}
+func (client *dummyCTAPClient) BioEnrollments() []identities.BioEnrollment {
+	return append([]identities.BioEnrollment{}, client.bioEnrollments...)
+}
+func (client *dummyCTAPClient) SetBioEnrollments(enrollments []identities.BioEnrollment) {
+	client.bioEnrollments = enrollments
 }
 
 func (client *dummyCTAPClient) ApproveAccountCreation(relyingParty string) bool {
@@ -65,6 +149,9 @@ func (client *dummyCTAPClient) ApproveAccountCreation(relyingParty string) bool
 func (client *dummyCTAPClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
 	return true
 }
+func (client *dummyCTAPClient) ApproveUserPresence(relyingParty string) bool {
+	return !client.denyPresence
+}
 
 func TestMakeCredential(t *testing.T) {
 	client := &dummyCTAPClient{}
@@ -108,8 +195,10 @@ func TestMakeCredential(t *testing.T) {
 	util.CheckErr(err, "Invalid response")
 	test.AssertNotNil(t, response.AuthData, "AuthData is nil")
 	test.AssertNotEqual(t, response.FormatIdentifer, "", "Format is empty")
-	test.AssertNotNil(t, response.AttestationStatement.Sig, "Attestation signature is nil")
-	test.AssertNotNil(t, response.AttestationStatement.X5c, "Attestation cert is nil")
+	var statement basicAttestationStatement
+	util.CheckErr(decodeExtensionInput(response.AttestationStatement, &statement), "Invalid attestation statement")
+	test.AssertNotNil(t, statement.Sig, "Attestation signature is nil")
+	test.AssertNotNil(t, statement.X5c, "Attestation cert is nil")
 }
 
 func TestGetAssertion(t *testing.T) {
@@ -161,7 +250,656 @@ func TestGetInfo(t *testing.T) {
 	util.CheckErr(err, "Could not decode response")
 	test.AssertContains(t, response.Versions, "U2F_V2", "U2F not supported")
 	test.AssertContains(t, response.Versions, "FIDO_2_0", "FIDO2.0 not supported")
+	test.AssertArrEqual(t, response.Versions, []string{"FIDO_2_0", "U2F_V2"}, "FIDO_2_1 reported without the 2.1 PIN/UV token flows")
+	test.Assert(t, response.Options.CanConfig, "authenticatorConfig not reported")
 	test.Assert(t, !bytes.Equal(make([]byte,16), response.AAGUID[:]), "AAGUID is empty")
 	test.Assert(t, response.Options.CanResidentKey, "Cant use resident keys")
 	test.Assert(t, !response.Options.IsPlatform, "Is not marked a non-platform auth")
-}
\ No newline at end of file
+}
+
+func TestGetInfoWithoutU2F(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	server.SetU2FEnabled(false)
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.AssertArrEqual(t, info.Versions, []string{"FIDO_2_0"}, "U2F_V2 reported with U2F disabled")
+}
+
+func TestTransports(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	getInfo := func() getInfoResponse {
+		var info getInfoResponse
+		util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+		return info
+	}
+	getAssertionTransports := func() []string {
+		args := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("transports"))}
+		response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "getAssertion failed")
+		var decoded getAssertionResponse
+		util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode getAssertion response")
+		return decoded.Credential.Transports
+	}
+	test.AssertArrEqual(t, getInfo().Transports, []string{"usb"}, "Wrong default transports in getInfo")
+	test.AssertArrEqual(t, getAssertionTransports(), []string{"usb"}, "Wrong default transports in credential descriptor")
+
+	server.SetTransports([]string{"usb", "nfc"})
+	test.AssertArrEqual(t, getInfo().Transports, []string{"usb", "nfc"}, "Configured transports not in getInfo")
+	test.AssertArrEqual(t, getAssertionTransports(), []string{"usb", "nfc"}, "Configured transports not in credential descriptor")
+	jsonBytes, err := server.GetInfoJSON()
+	test.Assert(t, err == nil, "Could not export getInfo as JSON")
+	var jsonInfo struct {
+		Transports []string `json:"transports"`
+	}
+	util.CheckErr(json.Unmarshal(jsonBytes, &jsonInfo), "Could not decode getInfo JSON")
+	test.AssertArrEqual(t, jsonInfo.Transports, []string{"usb", "nfc"}, "Configured transports not in getInfo JSON")
+}
+
+func TestGetInfoJSON(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	responseBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getInfo failed")
+	var cborInfo getInfoResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &cborInfo), "Could not decode getInfo")
+
+	jsonBytes, err := server.GetInfoJSON()
+	test.Assert(t, err == nil, "Could not export getInfo as JSON")
+	var jsonInfo struct {
+		Versions           []string        `json:"versions"`
+		Extensions         []string        `json:"extensions"`
+		AAGUID             string          `json:"aaguid"`
+		Options            map[string]bool `json:"options"`
+		PINUVAuthProtocols []uint32        `json:"pinUvAuthProtocols"`
+	}
+	util.CheckErr(json.Unmarshal(jsonBytes, &jsonInfo), "Could not decode getInfo JSON")
+	test.AssertArrEqual(t, jsonInfo.Versions, cborInfo.Versions, "Versions differ")
+	test.AssertArrEqual(t, jsonInfo.Extensions, cborInfo.Extensions, "Extensions differ")
+	test.AssertEqual(t, jsonInfo.AAGUID, hex.EncodeToString(cborInfo.AAGUID[:]), "AAGUID differs")
+	test.AssertArrEqual(t, jsonInfo.PINUVAuthProtocols, cborInfo.PINUVAuthProtocols, "PIN protocols differ")
+	test.AssertEqual(t, jsonInfo.Options["rk"], cborInfo.Options.CanResidentKey, "rk option differs")
+	test.AssertEqual(t, jsonInfo.Options["up"], cborInfo.Options.CanUserPresence, "up option differs")
+	test.AssertEqual(t, jsonInfo.Options["clientPin"], *cborInfo.Options.HasClientPIN, "clientPin option differs")
+	test.AssertEqual(t, jsonInfo.Options["alwaysUv"], *cborInfo.Options.AlwaysUV, "alwaysUv option differs")
+
+	// The export reflects runtime state, just like the CBOR command
+	client.SetPINHash(nil)
+	jsonBytes, err = server.GetInfoJSON()
+	test.Assert(t, err == nil, "Could not export getInfo as JSON")
+	util.CheckErr(json.Unmarshal(jsonBytes, &jsonInfo), "Could not decode getInfo JSON")
+	test.Assert(t, !jsonInfo.Options["clientPin"], "clientPin still set after clearing the PIN")
+}
+
+// platformKeyAgreement performs the platform side of PIN protocol 1 key agreement
+func platformKeyAgreement(client *dummyCTAPClient) (*cose.COSEEC2Key, []byte) {
+	platformKey := crypto.GenerateECDHKey()
+	authenticatorKey := client.PINKeyAgreement()
+	secret, err := platformKey.ECDH(authenticatorKey.X, authenticatorKey.Y)
+	util.CheckErr(err, "Could not perform key agreement")
+	return &cose.COSEEC2Key{
+		KeyType:   int8(cose.COSE_KEY_TYPE_EC2),
+		Algorithm: int8(cose.COSE_ALGORITHM_ID_ECDH_HKDF_256),
+		Curve:     int8(cose.COSE_CURVE_ID_P256),
+		X:         platformKey.X.FillBytes(make([]byte, 32)),
+		Y:         platformKey.Y.FillBytes(make([]byte, 32)),
+	}, crypto.HashSHA256(secret)
+}
+
+func getPINToken(server *CTAPServer, client *dummyCTAPClient, pin string) ctapStatusCode {
+	keyAgreement, sharedSecret := platformKeyAgreement(client)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 1,
+		SubCommand:        clientPinSubcommandGetPINToken,
+		KeyAgreement:      keyAgreement,
+		PINHashEncoding:   crypto.EncryptAESCBC(sharedSecret, crypto.HashSHA256([]byte(pin))[:16]),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func TestSetPINDirectly(t *testing.T) {
+	client := newPINDummyCTAPClient("")
+	client.pinHash = nil
+	client.pinRetries = 3
+	server := NewCTAPServer(client)
+	test.Assert(t, server.SetPIN("12") != nil, "PIN shorter than the policy allows was set")
+	test.Assert(t, client.pinHash == nil, "PIN hash stored for a rejected PIN")
+
+	test.Assert(t, server.SetPIN("4321") == nil, "Could not set PIN")
+	test.AssertEqual(t, client.pinRetries, int32(8), "Retries not reset")
+	test.AssertEqual(t, getPINToken(server, client, "4321"), ctap1ErrSuccess, "Pre-seeded PIN rejected over the wire")
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+
+	test.Assert(t, NewCTAPServer(&dummyCTAPClient{}).SetPIN("4321") != nil, "PIN set on a device without PIN support")
+}
+
+func TestPINRetriesResetOnSuccess(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, client.pinRetries, int32(6), "Retries not decremented on failure")
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap1ErrSuccess, "Correct PIN rejected")
+	test.AssertEqual(t, client.pinRetries, int32(8), "Retries not reset on success")
+	// The consecutive failure count is also cleared by a successful attempt
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap1ErrSuccess, "Correct PIN rejected")
+}
+
+func TestPINAuthBlockedAfterConsecutiveFailures(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, getPINToken(server, client, "0000"), ctap2ErrPINAuthBlocked, "Not soft blocked after 3 failures")
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap2ErrPINAuthBlocked, "Correct PIN accepted while soft blocked")
+	test.AssertEqual(t, client.pinRetries, int32(5), "Blocked attempts should not use retries")
+
+	server.ResetPINAuthBlock()
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap1ErrSuccess, "Correct PIN rejected after power cycle")
+	test.AssertEqual(t, client.pinRetries, int32(8), "Retries not reset on success")
+}
+
+func TestPINBlockedAfterMaxRetries(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	for i := 0; i < 8; i++ {
+		if i > 0 && i%3 == 0 {
+			server.ResetPINAuthBlock()
+		}
+		status := getPINToken(server, client, "0000")
+		test.Assert(t, status == ctap2ErrPINInvalid || status == ctap2ErrPINAuthBlocked || status == ctap2ErrPINBlocked, "Wrong PIN accepted")
+	}
+	test.AssertEqual(t, client.pinRetries, int32(0), "Retries not exhausted")
+	server.ResetPINAuthBlock()
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap2ErrPINBlocked, "PIN not blocked after max retries")
+}
+
+func toggleAlwaysUV(server *CTAPServer, client *dummyCTAPClient) ctapStatusCode {
+	args := configArgs{SubCommand: configSubcommandToggleAlwaysUV}
+	if client.pinHash != nil {
+		authData := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(configSubcommandToggleAlwaysUV)})
+		args.PINUVAuthProtocol = 1
+		args.PINUVAuthParam = server.derivePINAuth(client.pinToken, authData)
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func TestAlwaysUV(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{0, 1, 2, 3, 4}, Name: "Alice"})
+	clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: clientDataHash,
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+	}
+	message := util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap1ErrSuccess, "Assertion without UV failed")
+
+	test.AssertEqual(t, toggleAlwaysUV(server, client), ctap1ErrSuccess, "Could not enable alwaysUv")
+	test.Assert(t, client.alwaysUV, "alwaysUv not enabled")
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrPINRequired, "Assertion without UV allowed with alwaysUv")
+
+	args.PINUVAuthProtocol = 1
+	args.PINUVAuthParam = server.derivePINAuth(client.pinToken, clientDataHash)
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Assertion with UV failed")
+
+	var info getInfoResponse
+	infoBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	util.CheckErr(cbor.Unmarshal(infoBytes[1:], &info), "Could not decode getInfo")
+	test.Assert(t, info.Options.AlwaysUV != nil && *info.Options.AlwaysUV, "alwaysUv not reported in getInfo")
+	for _, version := range info.Versions {
+		test.Assert(t, version != "U2F_V2", "U2F reported with alwaysUv")
+	}
+
+	test.AssertEqual(t, toggleAlwaysUV(server, client), ctap1ErrSuccess, "Could not disable alwaysUv")
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap1ErrSuccess, "Assertion without UV failed")
+}
+
+func alwaysUVOption(server *CTAPServer) bool {
+	var info getInfoResponse
+	infoBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	util.CheckErr(cbor.Unmarshal(infoBytes[1:], &info), "Could not decode getInfo")
+	return info.Options.AlwaysUV != nil && *info.Options.AlwaysUV
+}
+
+func TestToggleAlwaysUVTwice(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	test.Assert(t, !alwaysUVOption(server), "alwaysUv enabled initially")
+	test.AssertEqual(t, toggleAlwaysUV(server, client), ctap1ErrSuccess, "Could not enable alwaysUv")
+	test.Assert(t, alwaysUVOption(server), "alwaysUv not reported after the first toggle")
+	test.AssertEqual(t, toggleAlwaysUV(server, client), ctap1ErrSuccess, "Could not disable alwaysUv")
+	test.Assert(t, !alwaysUVOption(server), "alwaysUv not back to its initial value after the second toggle")
+
+	message := util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(configArgs{SubCommand: configSubcommandToggleAlwaysUV}))
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrPINRequired, "Toggled alwaysUv without pinUvAuthParam")
+	args := configArgs{SubCommand: configSubcommandToggleAlwaysUV, PINUVAuthProtocol: 1, PINUVAuthParam: make([]byte, 16)}
+	message = util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args))
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrPINAuthInvalid, "Toggled alwaysUv with an invalid pinUvAuthParam")
+	test.Assert(t, !alwaysUVOption(server), "alwaysUv toggled without PIN auth")
+}
+
+func makeCredentialWithUV(server *CTAPServer) []byte {
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("uv")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Options:          &makeCredentialOptions{UserVerification: true},
+	}
+	return server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+}
+
+func TestMakeCredentialUVRequested(t *testing.T) {
+	response := makeCredentialWithUV(NewCTAPServer(&dummyCTAPClient{}))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidOption, "uv accepted without a PIN or UV method")
+	noPINSet := &dummyCTAPClient{pinEnabled: true}
+	response = makeCredentialWithUV(NewCTAPServer(noPINSet))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrInvalidOption, "uv accepted before a PIN was set")
+
+	response = makeCredentialWithUV(NewCTAPServer(newPINDummyCTAPClient("1234")))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrPINRequired, "uv with a PIN did not ask for a pinUvAuthToken")
+
+	response = makeCredentialWithUV(NewCTAPServer(&dummyCTAPClient{builtInUV: true}))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "uv with a built-in UV method failed")
+	var decoded makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode makeCredential response")
+	test.Assert(t, AuthenticatorDataFlags(decoded.AuthData[32])&AuthDataFlagUserVerified != 0, "UV flag not set by the built-in UV method")
+}
+
+func TestAlwaysUVRequiresPIN(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, toggleAlwaysUV(server, client), ctap2ErrNoPINSet, "Enabled alwaysUv without a UV method")
+	test.Assert(t, !client.alwaysUV, "alwaysUv enabled without a UV method")
+}
+
+func pinProbeMessages() [][]byte {
+	makeCredential := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("probe")),
+		2: webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		3: webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		8: []byte{},
+		9: 1,
+	}
+	getAssertion := map[int]interface{}{
+		1: "example.com",
+		2: crypto.HashSHA256([]byte("probe")),
+		6: []byte{},
+		7: 1,
+	}
+	return [][]byte{
+		util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)),
+		util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)),
+	}
+}
+
+func TestPINProbeWithoutPIN(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.pinHash = nil
+	server := NewCTAPServer(client)
+	for _, message := range pinProbeMessages() {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrNoPINSet, "Probe without PIN did not return PIN_NOT_SET")
+	}
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Probe created a credential")
+}
+
+func TestPINProbeWithPIN(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	for _, message := range pinProbeMessages() {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrPINInvalid, "Probe with PIN did not return PIN_INVALID")
+	}
+	test.AssertEqual(t, client.pinRetries, int32(8), "Probe used a PIN retry")
+}
+
+func assertionCredentialCount(t *testing.T, server *CTAPServer, rpID string) (int, bool) {
+	args := getAssertionArgs{
+		RPID:           rpID,
+		ClientDataHash: crypto.HashSHA256([]byte("count")),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not get assertion")
+	var fields map[uint64]interface{}
+	err := cbor.Unmarshal(response[1:], &fields)
+	test.Assert(t, err == nil, "Could not decode assertion response")
+	count, ok := fields[5].(uint64)
+	return int(count), ok
+}
+
+func TestNumberOfCredentials(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	client.vault.NewIdentity(rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	_, present := assertionCredentialCount(t, server, rp.ID)
+	test.Assert(t, !present, "numberOfCredentials present for a single credential")
+
+	client.vault.NewIdentity(rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "Bob"})
+	count, present := assertionCredentialCount(t, server, rp.ID)
+	test.Assert(t, present, "numberOfCredentials missing for two credentials")
+	test.AssertEqual(t, count, 2, "Incorrect numberOfCredentials")
+}
+
+func setPIN(server *CTAPServer, client *dummyCTAPClient, pin []byte) ctapStatusCode {
+	keyAgreement, sharedSecret := platformKeyAgreement(client)
+	paddedPIN := make([]byte, 64)
+	copy(paddedPIN, pin)
+	newPINEncoding := crypto.EncryptAESCBC(sharedSecret, paddedPIN)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 1,
+		SubCommand:        clientPINSubcommandSetPIN,
+		KeyAgreement:      keyAgreement,
+		PINUVAuthParam:    server.derivePINAuth(sharedSecret, newPINEncoding),
+		NewPINEncoding:    newPINEncoding,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func changePIN(server *CTAPServer, client *dummyCTAPClient, oldPIN []byte, newPIN []byte) ctapStatusCode {
+	keyAgreement, sharedSecret := platformKeyAgreement(client)
+	paddedPIN := make([]byte, 64)
+	copy(paddedPIN, newPIN)
+	newPINEncoding := crypto.EncryptAESCBC(sharedSecret, paddedPIN)
+	pinHashEncoding := crypto.EncryptAESCBC(sharedSecret, crypto.HashSHA256(oldPIN)[:16])
+	args := clientPINArgs{
+		PINUVAuthProtocol: 1,
+		SubCommand:        clientPINSubcommandChangePIN,
+		KeyAgreement:      keyAgreement,
+		PINUVAuthParam:    server.derivePINAuth(sharedSecret, util.Concat(newPINEncoding, pinHashEncoding)),
+		NewPINEncoding:    newPINEncoding,
+		PINHashEncoding:   pinHashEncoding,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func TestSetPINWhenPINAlreadySet(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.pinHash = nil
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, changePIN(server, client, []byte("1234"), []byte("5678")), ctap2ErrNoPINSet, "changePIN succeeded without a PIN")
+	test.AssertEqual(t, setPIN(server, client, []byte("1234")), ctap1ErrSuccess, "Could not set PIN")
+
+	test.AssertEqual(t, setPIN(server, client, []byte("5678")), ctap2ErrPINAuthInvalid, "setPIN replaced an existing PIN")
+	test.AssertArrEqual(t, client.pinHash, crypto.HashSHA256([]byte("1234"))[:16], "PIN changed by setPIN")
+
+	test.AssertEqual(t, changePIN(server, client, []byte("1234"), []byte("5678")), ctap1ErrSuccess, "changePIN failed")
+	test.AssertArrEqual(t, client.pinHash, crypto.HashSHA256([]byte("5678"))[:16], "PIN not changed by changePIN")
+}
+
+func TestSetPINPolicy(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.pinHash = nil
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, setPIN(server, client, bytes.Repeat([]byte{'1'}, 64)), ctap2ErrPINPolicyViolation, "64 byte PIN accepted")
+	test.AssertEqual(t, setPIN(server, client, []byte{'1', '2', 0xff, 0xfe}), ctap2ErrPINPolicyViolation, "Invalid UTF-8 PIN accepted")
+	test.AssertEqual(t, setPIN(server, client, []byte("123")), ctap2ErrPINPolicyViolation, "Short PIN accepted")
+	test.Assert(t, client.pinHash == nil, "PIN set by invalid request")
+
+	pin := []byte("pïn✓")
+	test.AssertEqual(t, setPIN(server, client, pin), ctap1ErrSuccess, "Multibyte UTF-8 PIN rejected")
+	test.AssertArrEqual(t, client.pinHash, crypto.HashSHA256(pin)[:16], "Incorrect PIN hash stored")
+}
+
+func TestMaxPINLength(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.pinHash = nil
+	server := NewCTAPServer(client)
+	server.SetMaxPINLength(8)
+	test.AssertEqual(t, setPIN(server, client, []byte("123456789")), ctap2ErrPINPolicyViolation, "PIN over maximum length accepted")
+	test.AssertEqual(t, setPIN(server, client, []byte("12345678")), ctap1ErrSuccess, "PIN at maximum length rejected")
+}
+
+func makeCredentialWithUser(server *CTAPServer, user webauthn.PublicKeyCrendentialUserEntity) ctapStatusCode {
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("entity limits")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &user,
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func TestMakeCredentialEntityLimits(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: bytes.Repeat([]byte{1}, 65), Name: "alice"}
+	test.AssertEqual(t, makeCredentialWithUser(server, user), ctap1ErrInvalidParameter, "65 byte user ID accepted")
+	user.ID = bytes.Repeat([]byte{1}, 64)
+	user.Name = string(bytes.Repeat([]byte{'a'}, 65))
+	test.AssertEqual(t, makeCredentialWithUser(server, user), ctap1ErrInvalidParameter, "65 byte user name accepted")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Credential created for oversized entity")
+
+	user.Name = "alice"
+	test.AssertEqual(t, makeCredentialWithUser(server, user), ctap1ErrSuccess, "64 byte user ID rejected")
+}
+
+func TestGetAssertionRejectsCredentialFromOtherRP(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "a.example", Name: "A"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"})
+	args := getAssertionArgs{
+		RPID:           "b.example",
+		ClientDataHash: crypto.HashSHA256([]byte("cross rp")),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrNoCredentials, "Credential asserted for another RP")
+	test.AssertEqual(t, identity.SignatureCounter, uint32(0), "Counter incremented for a cross-RP request")
+}
+
+func TestMakeCredentialOptions(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	makeCredential := func(options interface{}) []byte {
+		args := map[int]interface{}{
+			1: crypto.HashSHA256([]byte("options")),
+			2: webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+			3: webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		}
+		if options != nil {
+			args[7] = options
+		}
+		return server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	}
+	for _, options := range []map[string]bool{{"up": true}, {"up": false}, {"rk": true, "up": true}} {
+		test.AssertEqual(t, ctapStatusCode(makeCredential(options)[0]), ctap2ErrInvalidOption, "up option accepted in makeCredential")
+	}
+
+	// Without options the credential has user presence but not user verification
+	responseBytes := makeCredential(nil)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "makeCredential without options failed")
+	var response makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Invalid response")
+	flags := AuthenticatorDataFlags(response.AuthData[32])
+	test.Assert(t, flags&AuthDataFlagUserPresent != 0, "up did not default to true")
+	test.Assert(t, flags&AuthDataFlagUserVerified == 0, "uv did not default to false")
+}
+
+func TestGetAssertionOptions(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	getAssertion := func(options interface{}) []byte {
+		args := map[int]interface{}{
+			1: "rp",
+			2: crypto.HashSHA256([]byte("options")),
+			3: []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+		}
+		if options != nil {
+			args[5] = options
+		}
+		return server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	}
+	for _, options := range []map[string]bool{{"rk": true}, {"rk": false}, {"rk": false, "up": true}} {
+		test.AssertEqual(t, ctapStatusCode(getAssertion(options)[0]), ctap2ErrInvalidOption, "rk option accepted in getAssertion")
+	}
+
+	flagsFor := func(options interface{}) AuthenticatorDataFlags {
+		responseBytes := getAssertion(options)
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getAssertion failed")
+		var response getAssertionResponse
+		util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Invalid response")
+		return AuthenticatorDataFlags(response.AuthenticatorData[32])
+	}
+	flags := flagsFor(nil)
+	test.Assert(t, flags&AuthDataFlagUserPresent != 0, "up did not default to true")
+	test.Assert(t, flags&AuthDataFlagUserVerified == 0, "uv did not default to false")
+	test.Assert(t, flagsFor(map[string]bool{"up": false})&AuthDataFlagUserPresent == 0, "up set when the platform asked for a silent assertion")
+}
+
+func TestPreferredPlatformUVAttempts(t *testing.T) {
+	getInfo := func(server *CTAPServer) map[int]interface{} {
+		var info map[int]interface{}
+		util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+		return info
+	}
+	client := &dummyCTAPClient{builtInUV: true}
+	server := NewCTAPServer(client)
+	_, ok := getInfo(server)[17]
+	test.Assert(t, !ok, "preferredPlatformUvAttempts reported without being configured")
+	server.SetPreferredPlatformUVAttempts(3)
+	test.Assert(t, getInfo(server)[17] == uint64(3), "preferredPlatformUvAttempts not reported")
+
+	client.builtInUV = false
+	_, ok = getInfo(server)[17]
+	test.Assert(t, !ok, "preferredPlatformUvAttempts reported without a UV method")
+}
+
+func TestUnsupportedPINUVAuthProtocol(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.bioEnrollment = true
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	clientDataHash := crypto.HashSHA256([]byte("protocol"))
+	pinAuth := server.derivePINAuth(client.pinToken, clientDataHash)
+	messages := func(protocol uint32) map[string][]byte {
+		return map[string][]byte{
+			"makeCredential": util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredentialArgs{
+				ClientDataHash:    clientDataHash,
+				RP:                &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+				User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "Bob"},
+				PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+				PINUVAuthParam:    pinAuth,
+				PINUVAuthProtocol: protocol,
+			})),
+			"getAssertion": util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertionArgs{
+				RPID:              "rp",
+				ClientDataHash:    clientDataHash,
+				AllowList:         []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+				PINUVAuthParam:    pinAuth,
+				PINUVAuthProtocol: protocol,
+			})),
+			"authenticatorConfig": util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(configArgs{
+				SubCommand:        configSubcommandToggleAlwaysUV,
+				PINUVAuthParam:    pinAuth,
+				PINUVAuthProtocol: protocol,
+			})),
+			"bioEnrollment": util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(bioEnrollmentArgs{
+				Modality:          bioModalityFingerprint,
+				SubCommand:        bioEnrollmentSubcommandEnumerateEnrollments,
+				PINUVAuthParam:    pinAuth,
+				PINUVAuthProtocol: protocol,
+			})),
+		}
+	}
+	for name, message := range messages(3) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap1ErrInvalidParameter, "pinUvAuthProtocol 3 accepted by "+name)
+	}
+	for name, message := range messages(0) {
+		test.AssertEqual(t, ctapStatusCode(server.HandleMessage(message)[0]), ctap2ErrMissingParam, "pinUvAuthParam without a protocol accepted by "+name)
+	}
+	test.AssertEqual(t, len(client.vault.CredentialSources), 1, "Credential created with an unsupported protocol")
+	test.AssertEqual(t, client.alwaysUV, false, "alwaysUv toggled with an unsupported protocol")
+	test.AssertEqual(t, ctapStatusCode(server.HandleMessage(messages(1)["getAssertion"])[0]), ctap1ErrSuccess, "pinUvAuthProtocol 1 rejected")
+}
+
+func TestGetKeyAgreementEncoding(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	args := clientPINArgs{PINUVAuthProtocol: 1, SubCommand: clientPinSubcommandGetKeyAgreement}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "getKeyAgreement failed")
+	var decoded map[int]map[int]interface{}
+	util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode getKeyAgreement response")
+	key := decoded[1]
+	test.Assert(t, key[1] == uint64(2), "Key agreement kty is not EC2")
+	test.Assert(t, key[3] == int64(-25), "Key agreement alg is not ECDH-ES+HKDF-256")
+	test.Assert(t, key[-1] == uint64(1), "Key agreement crv is not P-256")
+	x, _ := key[-2].([]byte)
+	y, _ := key[-3].([]byte)
+	test.Assert(t, len(x) == 32 && len(y) == 32, "Key agreement coordinates are not 32 bytes")
+	test.Assert(t, elliptic.P256().IsOnCurve(util.BytesToBigInt(x), util.BytesToBigInt(y)), "Key agreement key is not on P-256")
+
+	// The platform can use the decoded key to get a PIN token
+	test.AssertEqual(t, getPINToken(server, client, "1234"), ctap1ErrSuccess, "Valid key agreement rejected")
+}
+
+func TestInvalidPlatformKeyAgreement(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	getPINTokenWith := func(modify func(key *cose.COSEEC2Key)) ctapStatusCode {
+		keyAgreement, sharedSecret := platformKeyAgreement(client)
+		modify(keyAgreement)
+		args := clientPINArgs{
+			PINUVAuthProtocol: 1,
+			SubCommand:        clientPinSubcommandGetPINToken,
+			KeyAgreement:      keyAgreement,
+			PINHashEncoding:   crypto.EncryptAESCBC(sharedSecret, crypto.HashSHA256([]byte("1234"))[:16]),
+		}
+		response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+		return ctapStatusCode(response[0])
+	}
+	offCurve := getPINTokenWith(func(key *cose.COSEEC2Key) {
+		key.Y[31] ^= 1
+	})
+	test.AssertEqual(t, offCurve, ctap1ErrInvalidParameter, "Off-curve platform key accepted")
+	otherCurve := getPINTokenWith(func(key *cose.COSEEC2Key) {
+		key.Curve = int8(cose.COSE_CURVE_ID_ED25519)
+	})
+	test.AssertEqual(t, otherCurve, ctap1ErrInvalidParameter, "Non-P-256 platform key accepted")
+	test.AssertEqual(t, client.pinRetries, int32(8), "Invalid key agreement used a PIN retry")
+}
+
+func TestGetAssertionSkipsMalformedAllowListEntries(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	identity.Discoverable = false
+	assertion := func(allowList []webauthn.PublicKeyCredentialDescriptor) []byte {
+		args := getAssertionArgs{RPID: "rp", ClientDataHash: crypto.HashSHA256([]byte("allow list")), AllowList: allowList}
+		return server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	}
+
+	response := assertion([]webauthn.PublicKeyCredentialDescriptor{
+		{Type: "public-key", ID: []byte{}},
+		identity.CTAPDescriptor(),
+		{Type: "unknown-type", ID: identity.ID},
+	})
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Valid entry not matched")
+	var decoded getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode response")
+	test.AssertArrEqual(t, decoded.Credential.ID, identity.ID, "Wrong credential asserted")
+	test.AssertEqual(t, decoded.NumberOfCredentials, 0, "Malformed entries counted as credentials")
+
+	response = assertion([]webauthn.PublicKeyCredentialDescriptor{{Type: "public-key"}})
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap2ErrNoCredentials, "Only malformed entries matched a credential")
+}
@@ -0,0 +1,213 @@
+package ctap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type ctapFieldNames map[uint64]string
+
+var ctapRequestFieldNames = map[ctapCommand]ctapFieldNames{
+	ctapCommandMakeCredential: {
+		1:  "clientDataHash",
+		2:  "rp",
+		3:  "user",
+		4:  "pubKeyCredParams",
+		5:  "excludeList",
+		6:  "extensions",
+		7:  "options",
+		8:  "pinUvAuthParam",
+		9:  "pinUvAuthProtocol",
+		10: "enterpriseAttestation",
+	},
+	ctapCommandGetAssertion: {
+		1: "rpId",
+		2: "clientDataHash",
+		3: "allowList",
+		4: "extensions",
+		5: "options",
+		6: "pinUvAuthParam",
+		7: "pinUvAuthProtocol",
+	},
+	ctapCommandClientPIN: {
+		1:  "pinUvAuthProtocol",
+		2:  "subCommand",
+		3:  "keyAgreement",
+		4:  "pinUvAuthParam",
+		5:  "newPinEnc",
+		6:  "pinHashEnc",
+		9:  "permissions",
+		10: "rpId",
+	},
+	ctapCommandBioEnrollment: {
+		1: "modality",
+		2: "subCommand",
+		3: "subCommandParams",
+		4: "pinUvAuthProtocol",
+		5: "pinUvAuthParam",
+		6: "getModality",
+	},
+	ctapCommandLargeBlobs: {
+		1: "get",
+		2: "set",
+		3: "offset",
+		4: "length",
+		5: "pinUvAuthParam",
+		6: "pinUvAuthProtocol",
+	},
+	ctapCommandConfig: {
+		1: "subCommand",
+		2: "subCommandParams",
+		3: "pinUvAuthProtocol",
+		4: "pinUvAuthParam",
+	},
+}
+
+var getAssertionResponseFieldNames = ctapFieldNames{
+	1: "credential",
+	2: "authData",
+	3: "signature",
+	4: "user",
+	5: "numberOfCredentials",
+	6: "userSelected",
+	7: "largeBlobKey",
+}
+
+var ctapResponseFieldNames = map[ctapCommand]ctapFieldNames{
+	ctapCommandMakeCredential: {
+		1: "fmt",
+		2: "authData",
+		3: "attStmt",
+		4: "epAtt",
+		5: "largeBlobKey",
+	},
+	ctapCommandGetAssertion:     getAssertionResponseFieldNames,
+	ctapCommandGetNextAssertion: getAssertionResponseFieldNames,
+	ctapCommandGetInfo: {
+		1:  "versions",
+		2:  "extensions",
+		3:  "aaguid",
+		4:  "options",
+		5:  "maxMsgSize",
+		6:  "pinUvAuthProtocols",
+		7:  "maxCredentialCountInList",
+		8:  "maxCredentialIdLength",
+		9:  "transports",
+		10: "algorithms",
+		11: "maxSerializedLargeBlobArray",
+		12: "forcePINChange",
+		13: "minPINLength",
+		14: "firmwareVersion",
+		15: "maxCredBlobLength",
+		16: "maxRPIDsForSetMinPINLength",
+		17: "preferredPlatformUvAttempts",
+		18: "uvModality",
+		19: "certifications",
+		20: "remainingDiscoverableCredentials",
+		21: "vendorPrototypeConfigCommands",
+	},
+	ctapCommandBioEnrollment: {
+		1: "modality",
+		2: "fingerprintKind",
+		3: "maxCaptureSamplesRequiredForEnroll",
+		4: "templateId",
+		5: "lastEnrollSampleStatus",
+		6: "remainingSamples",
+		7: "templateInfos",
+		8: "maxTemplateFriendlyName",
+	},
+	ctapCommandLargeBlobs: {
+		1: "config",
+	},
+	ctapCommandClientPIN: {
+		1: "keyAgreement",
+		2: "pinUvAuthToken",
+		3: "pinRetries",
+		4: "powerCycleState",
+		5: "uvRetries",
+	},
+}
+
+func commandDescription(command ctapCommand) string {
+	if description, ok := ctapCommandDescriptions[command]; ok {
+		return description
+	}
+	return fmt.Sprintf("0x%x", uint8(command))
+}
+
+// DescribeCTAPMessage renders a CTAP2 request (command byte followed by CBOR parameters)
+// as human-readable text for logging and debugging
+func DescribeCTAPMessage(message []byte) string {
+	if len(message) == 0 {
+		return "<empty CTAP message>"
+	}
+	command := ctapCommand(message[0])
+	return fmt.Sprintf("%s %s", commandDescription(command), describeCBOR(message[1:], ctapRequestFieldNames[command]))
+}
+
+// DescribeCTAPResponse renders a CTAP2 response (status byte followed by CBOR data) to the
+// given command as human-readable text for logging and debugging
+func DescribeCTAPResponse(command byte, response []byte) string {
+	if len(response) == 0 {
+		return "<empty CTAP response>"
+	}
+	description := fmt.Sprintf("%s RESPONSE status: 0x%02x", commandDescription(ctapCommand(command)), response[0])
+	if len(response) == 1 {
+		return description
+	}
+	return fmt.Sprintf("%s %s", description, describeCBOR(response[1:], ctapResponseFieldNames[ctapCommand(command)]))
+}
+
+func describeCBOR(data []byte, fieldNames ctapFieldNames) string {
+	if len(data) == 0 {
+		return "{}"
+	}
+	var value interface{}
+	if err := cbor.Unmarshal(data, &value); err != nil {
+		return fmt.Sprintf("<invalid CBOR: %s 0x%s>", err, hex.EncodeToString(data))
+	}
+	return describeValue(value, fieldNames)
+}
+
+func describeValue(value interface{}, fieldNames ctapFieldNames) string {
+	switch value := value.(type) {
+	case []byte:
+		return "0x" + hex.EncodeToString(value)
+	case string:
+		return fmt.Sprintf("%q", value)
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, describeValue(item, nil))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[interface{}]interface{}:
+		keys := make([]interface{}, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprintf("%020v", keys[i]) < fmt.Sprintf("%020v", keys[j])
+		})
+		entries := make([]string, 0, len(value))
+		for _, key := range keys {
+			entries = append(entries, fmt.Sprintf("%s: %s", describeKey(key, fieldNames), describeValue(value[key], nil)))
+		}
+		return "{ " + strings.Join(entries, ", ") + " }"
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func describeKey(key interface{}, fieldNames ctapFieldNames) string {
+	if intKey, ok := key.(uint64); ok {
+		if name, ok := fieldNames[intKey]; ok {
+			return name
+		}
+	}
+	return fmt.Sprintf("%v", key)
+}
@@ -0,0 +1,46 @@
+package ctap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestDescribeGetInfoResponse(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	response := ctap.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	description := DescribeCTAPResponse(byte(ctapCommandGetInfo), response)
+	test.Assert(t, strings.HasPrefix(description, "ctapCommandGetInfo RESPONSE status: 0x00"), "Missing command and status: "+description)
+	test.Assert(t, strings.Contains(description, `versions: ["FIDO_2_0", "U2F_V2"]`), "Missing versions: "+description)
+	test.Assert(t, strings.Contains(description, "aaguid: 0x756c5af5eca601a32fc6d30ce2f201c5"), "Missing AAGUID: "+description)
+	test.Assert(t, strings.Contains(description, "options: { rk: true, up: true, plat: false, alwaysUv: false, authnrCfg: true, largeBlobs: true }"), "Missing options: "+description)
+}
+
+func TestDescribeMakeCredentialRequest(t *testing.T) {
+	args := makeCredentialArgs{
+		ClientDataHash: []byte{0xde, 0xad, 0xbe, 0xef},
+		RP: &webauthn.PublicKeyCredentialRPEntity{
+			ID:   "example.com",
+			Name: "Example",
+		},
+		User: &webauthn.PublicKeyCrendentialUserEntity{
+			ID:          []byte{1, 2},
+			DisplayName: "Alice",
+			Name:        "alice",
+		},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+		},
+	}
+	message := util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args))
+	description := DescribeCTAPMessage(message)
+	test.Assert(t, strings.HasPrefix(description, "ctapCommandMakeCredential { clientDataHash: 0xdeadbeef, "), "Missing command or hash: "+description)
+	test.Assert(t, strings.Contains(description, `rp: { id: "example.com", name: "Example" }`), "Missing RP: "+description)
+	test.Assert(t, strings.Contains(description, `user: { id: 0x0102, name: "alice", displayName: "Alice" }`), "Missing user: "+description)
+	test.Assert(t, strings.Contains(description, `pubKeyCredParams: [{ alg: -7, type: "public-key" }]`), "Missing params: "+description)
+}
@@ -0,0 +1,58 @@
+package ctap
+
+const (
+	// The RP ID is on a list preconfigured into the device by its vendor
+	enterpriseAttestationVendorFacilitated uint32 = 1
+	// The platform vouches for the RP, which is only allowed for managed platforms
+	enterpriseAttestationPlatformManaged uint32 = 2
+)
+
+// SetEnterpriseAttestation makes the device enterprise attestation capable, reported as the
+// ep option in getInfo. Vendor facilitated enterprise attestation is only given to the
+// relying parties in rpIDs. It stays disabled until the platform enables it with
+// authenticatorConfig.
+func (server *CTAPServer) SetEnterpriseAttestation(rpIDs []string) {
+	server.enterpriseCapable = true
+	server.enterpriseRPIDs = append([]string{}, rpIDs...)
+}
+
+func (server *CTAPServer) enterpriseAttestationOption() *bool {
+	if !server.enterpriseCapable {
+		return nil
+	}
+	enabled := server.client.EnterpriseAttestation()
+	return &enabled
+}
+
+func (server *CTAPServer) handleEnableEnterpriseAttestation() error {
+	if !server.enterpriseCapable {
+		return statusError(ctap2ErrUnsupportedOption)
+	}
+	server.client.SetEnterpriseAttestation(true)
+	return nil
+}
+
+// applyEnterpriseAttestation decides whether a requested enterprise attestation is given.
+// Requests the device can't honor for this relying party are downgraded to a regular
+// attestation rather than refused.
+func (server *CTAPServer) applyEnterpriseAttestation(mode uint32, relyingPartyID string) (bool, ctapStatusCode) {
+	if mode == 0 {
+		return false, ctap1ErrSuccess
+	}
+	if !server.enterpriseCapable || !server.client.EnterpriseAttestation() {
+		return false, ctap1ErrInvalidParameter
+	}
+	switch mode {
+	case enterpriseAttestationVendorFacilitated:
+		for _, rpID := range server.enterpriseRPIDs {
+			if rpID == relyingPartyID {
+				return true, ctap1ErrSuccess
+			}
+		}
+		return false, ctap1ErrSuccess
+	case enterpriseAttestationPlatformManaged:
+		return true, ctap1ErrSuccess
+	default:
+		return false, ctap2ErrInvalidOption
+	}
+}
@@ -0,0 +1,72 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func enterpriseMakeCredential(server *CTAPServer, relyingParty string, mode uint32) (ctapStatusCode, *makeCredentialResponse) {
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("enterprise")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: relyingParty, Name: relyingParty},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Enterprise:       mode,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	if ctapStatusCode(response[0]) != ctap1ErrSuccess {
+		return ctapStatusCode(response[0]), nil
+	}
+	var decoded makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode makeCredential response")
+	return ctap1ErrSuccess, &decoded
+}
+
+func enableEnterpriseAttestation(server *CTAPServer) ctapStatusCode {
+	args := configArgs{SubCommand: configSubcommandEnableEnterpriseAttestation}
+	return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))[0])
+}
+
+func TestEnterpriseAttestation(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	status, _ := enterpriseMakeCredential(server, "corp.example.com", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrInvalidParameter, "Enterprise attestation on a device without it")
+	test.AssertEqual(t, enableEnterpriseAttestation(server), ctap2ErrUnsupportedOption, "Enabled enterprise attestation on a device without it")
+
+	server.SetEnterpriseAttestation([]string{"corp.example.com"})
+	status, _ = enterpriseMakeCredential(server, "corp.example.com", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrInvalidParameter, "Enterprise attestation while disabled")
+	test.AssertEqual(t, enableEnterpriseAttestation(server), ctap1ErrSuccess, "Could not enable enterprise attestation")
+	test.Assert(t, client.enterpriseAtt, "Enterprise attestation not stored")
+
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.Assert(t, info.Options.Enterprise != nil && *info.Options.Enterprise, "ep not reported in getInfo")
+
+	status, response := enterpriseMakeCredential(server, "corp.example.com", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Enterprise attestation failed")
+	test.Assert(t, response.EPAtt, "epAtt not set for an authorized relying party")
+
+	// Relying parties that aren't on the list get a regular attestation
+	status, response = enterpriseMakeCredential(server, "other.example.com", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Downgraded enterprise attestation failed")
+	test.Assert(t, !response.EPAtt, "epAtt set for a relying party that isn't authorized")
+
+	status, response = enterpriseMakeCredential(server, "other.example.com", enterpriseAttestationPlatformManaged)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Platform managed enterprise attestation failed")
+	test.Assert(t, response.EPAtt, "epAtt not set for platform managed enterprise attestation")
+
+	status, response = enterpriseMakeCredential(server, "corp.example.com", 0)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "makeCredential failed")
+	test.Assert(t, !response.EPAtt, "epAtt set without a request")
+
+	status, _ = enterpriseMakeCredential(server, "corp.example.com", 3)
+	test.AssertEqual(t, status, ctap2ErrInvalidOption, "Unknown enterprise attestation mode accepted")
+}
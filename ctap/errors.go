@@ -0,0 +1,69 @@
+package ctap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// CTAPError is a CTAP status code returned as a Go error. Handlers return it and the wire
+// layer turns it back into the status byte, so callers can match failures with errors.Is.
+type CTAPError struct {
+	code ctapStatusCode
+}
+
+// NewCTAPError creates an error for a CTAP status code, for comparing with errors.Is
+func NewCTAPError(code byte) *CTAPError {
+	return &CTAPError{code: ctapStatusCode(code)}
+}
+
+// Code returns the status byte sent to the platform
+func (err *CTAPError) Code() byte {
+	return byte(err.code)
+}
+
+func (err *CTAPError) Error() string {
+	return fmt.Sprintf("CTAP error 0x%02x", byte(err.code))
+}
+
+func (err *CTAPError) Is(target error) bool {
+	other, ok := target.(*CTAPError)
+	return ok && other.code == err.code
+}
+
+// statusError converts a status code to an error, with success becoming nil
+func statusError(code ctapStatusCode) error {
+	if code == ctap1ErrSuccess {
+		return nil
+	}
+	return &CTAPError{code: code}
+}
+
+// encodeResponse serializes a handler's result: the status byte, followed by the CBOR
+// encoded response on success unless there is none. Errors that aren't a CTAPError
+// become CTAP1_ERR_OTHER.
+func encodeResponse(response interface{}, err error) []byte {
+	if err != nil {
+		var ctapErr *CTAPError
+		if errors.As(err, &ctapErr) {
+			return []byte{ctapErr.Code()}
+		}
+		ctapLogger.Printf("ERROR: %s\n\n", err)
+		return []byte{byte(ctap1ErrOther)}
+	}
+	if response == nil {
+		return []byte{byte(ctap1ErrSuccess)}
+	}
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+// Execute handles a CTAP2 message like HandleMessage, but returns failures as a CTAPError
+// and only the CBOR response on success
+func (server *CTAPServer) Execute(message []byte) ([]byte, error) {
+	response := server.HandleMessage(message)
+	if err := statusError(ctapStatusCode(response[0])); err != nil {
+		return nil, err
+	}
+	return response[1:], nil
+}
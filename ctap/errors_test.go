@@ -0,0 +1,50 @@
+package ctap
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestMakeCredentialReturnsCTAPError(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("errors")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSEAlgorithmID(-1)}},
+	}
+	response, err := server.makeCredential(util.MarshalCBOR(args), nil)
+	test.Assert(t, response == nil, "Response returned for a failed makeCredential")
+	var ctapErr *CTAPError
+	test.Assert(t, errors.As(err, &ctapErr), "makeCredential did not return a CTAPError")
+	test.AssertEqual(t, ctapErr.Code(), byte(ctap2ErrUnsupportedAlgorithm), "Wrong error code")
+	test.Assert(t, errors.Is(fmt.Errorf("Wrapped: %w", err), NewCTAPError(byte(ctap2ErrUnsupportedAlgorithm))), "errors.Is does not match a wrapped CTAPError")
+	test.Assert(t, !errors.Is(err, NewCTAPError(byte(ctap2ErrNoCredentials))), "errors.Is matched a different code")
+
+	// The wire layer sends the code as the status byte
+	message := util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args))
+	test.AssertArrEqual(t, server.HandleMessage(message), []byte{byte(ctap2ErrUnsupportedAlgorithm)}, "Wrong status byte")
+	test.AssertArrEqual(t, encodeResponse(nil, fmt.Errorf("Not a CTAP error")), []byte{byte(ctap1ErrOther)}, "Other errors not sent as CTAP1_ERR_OTHER")
+	_, err = server.Execute(message)
+	test.Assert(t, errors.Is(err, NewCTAPError(byte(ctap2ErrUnsupportedAlgorithm))), "Execute did not return the CTAPError")
+}
+
+func TestCommandHandlersReturnCTAPError(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	args := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("errors"))}
+	response, err := server.getAssertion(util.MarshalCBOR(args), nil)
+	test.Assert(t, response == nil, "Response returned for a failed getAssertion")
+	test.Assert(t, errors.Is(err, NewCTAPError(byte(ctap2ErrNoCredentials))), "getAssertion did not return a CTAPError")
+
+	err = server.authenticatorConfig(util.MarshalCBOR(configArgs{SubCommand: configSubcommandEnableEnterpriseAttestation}))
+	test.Assert(t, errors.Is(err, NewCTAPError(byte(ctap2ErrUnsupportedOption))), "authenticatorConfig did not return a CTAPError")
+	// Commands without a response body send only the status byte
+	test.AssertArrEqual(t, encodeResponse(nil, nil), []byte{byte(ctap1ErrSuccess)}, "Body sent without a response")
+}
@@ -0,0 +1,159 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type ctapExtension struct {
+	name      string
+	supported func(server *CTAPServer) bool
+	// Another extension this one only adds to, if any
+	requires string
+}
+
+// devicePubKey asks for a device-bound key alongside the credential. Virtual devices have
+// no hardware to bind a key to, so it is never offered and its inputs are ignored.
+const extensionDevicePubKey = "devicePubKey"
+
+func (server *CTAPServer) supportsDevicePubKey() bool {
+	return false
+}
+
+// ctapExtensions lists every implemented extension in the order getInfo reports them
+var ctapExtensions = []ctapExtension{
+	{name: extensionHMACSecret, supported: (*CTAPServer).supportsHMACSecret},
+	{name: extensionHMACSecretMC, supported: (*CTAPServer).supportsHMACSecret, requires: extensionHMACSecret},
+	{name: extensionDevicePubKey, supported: (*CTAPServer).supportsDevicePubKey},
+	{name: extensionMinPINLength, supported: (*CTAPServer).supportsMinPINLength},
+	{name: extensionCredProtect, supported: (*CTAPServer).supportsCredProtect},
+	{name: extensionLargeBlobKey, supported: (*CTAPServer).supportsLargeBlobKey},
+	{name: extensionClientDataHashAlg, supported: (*CTAPServer).supportsClientDataHashAlg},
+}
+
+// SetExtensionEnabled turns an implemented extension on or off. Disabled extensions are
+// left out of getInfo and their inputs are ignored.
+func (server *CTAPServer) SetExtensionEnabled(name string, enabled bool) {
+	if server.disabledExtensions == nil {
+		server.disabledExtensions = make(map[string]bool)
+	}
+	server.disabledExtensions[name] = !enabled
+}
+
+func (server *CTAPServer) isExtensionSupported(name string) bool {
+	if server.disabledExtensions[name] {
+		return false
+	}
+	for _, extension := range ctapExtensions {
+		if extension.name == name {
+			if extension.requires != "" && !server.isExtensionSupported(extension.requires) {
+				return false
+			}
+			return extension.supported(server)
+		}
+	}
+	return false
+}
+
+func (server *CTAPServer) supportedExtensions() []string {
+	extensions := []string{}
+	for _, extension := range ctapExtensions {
+		if server.isExtensionSupported(extension.name) {
+			extensions = append(extensions, extension.name)
+		}
+	}
+	return extensions
+}
+
+// SetStrictExtensions makes makeCredential fail with CTAP2_ERR_UNSUPPORTED_EXTENSION when
+// it gets an extension that isn't implemented or is disabled. The spec requires ignoring
+// them, which is the default, but rejecting them shows which inputs a platform sends.
+func (server *CTAPServer) SetStrictExtensions(strict bool) {
+	server.strictExtensions = strict
+}
+
+// checkMakeCredentialExtensions ignores unsupported extension inputs, or rejects them in
+// strict mode
+func (server *CTAPServer) checkMakeCredentialExtensions(inputs map[string]interface{}) ctapStatusCode {
+	for name := range inputs {
+		if server.isExtensionSupported(name) {
+			continue
+		}
+		if server.strictExtensions {
+			ctapLogger.Printf("ERROR: Unsupported extension %s\n\n", name)
+			return ctap2ErrUnsupportedExtension
+		}
+		ctapLogger.Printf("IGNORING EXTENSION: %s\n\n", name)
+	}
+	return ctap1ErrSuccess
+}
+
+// Extension inputs to getAssertion, processed before the user is asked for approval
+type assertionExtensions struct {
+	hmacSecretSalts *hmacSecretSalts
+	largeBlobKey    bool
+}
+
+// parseAssertionExtensions hands each supported getAssertion extension input to its handler.
+// Unknown, disabled and makeCredential-only extensions are ignored, as the spec requires.
+func (server *CTAPServer) parseAssertionExtensions(inputs map[string]interface{}) (*assertionExtensions, ctapStatusCode) {
+	extensions := &assertionExtensions{}
+	for name, input := range inputs {
+		if !server.isExtensionSupported(name) {
+			ctapLogger.Printf("IGNORING EXTENSION: %s\n\n", name)
+			continue
+		}
+		switch name {
+		case extensionHMACSecret:
+			salts, status := server.decryptHMACSecretSalts(input)
+			if status != ctap1ErrSuccess {
+				return nil, status
+			}
+			extensions.hmacSecretSalts = salts
+		case extensionLargeBlobKey:
+			if requested, _ := input.(bool); !requested {
+				return nil, ctap2ErrInvalidOption
+			}
+			extensions.largeBlobKey = true
+		case extensionClientDataHashAlg:
+			// Already checked against clientDataHash
+		default:
+			ctapLogger.Printf("IGNORING EXTENSION: %s is not an assertion extension\n\n", name)
+		}
+	}
+	return extensions, ctap1ErrSuccess
+}
+
+// outputs computes the authenticator extension outputs for the credential that was used
+func (extensions *assertionExtensions) outputs(credentialSource *identities.CredentialSource, flags AuthenticatorDataFlags) map[string]interface{} {
+	outputs := map[string]interface{}{}
+	if extensions.hmacSecretSalts != nil {
+		if output := hmacSecretOutput(credentialSource, extensions.hmacSecretSalts, flags&AuthDataFlagUserVerified != 0); output != nil {
+			outputs[extensionHMACSecret] = output
+		}
+	}
+	return outputs
+}
+
+// decodeExtensionInput converts a generically decoded extension input into a typed struct
+func decodeExtensionInput(input interface{}, value interface{}) error {
+	data, err := cbor.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return cbor.Unmarshal(data, value)
+}
+
+func encodeExtensionOutputs(outputs map[string]interface{}) []byte {
+	if len(outputs) == 0 {
+		return nil
+	}
+	return util.MarshalCBOR(outputs)
+}
+
+func isExtensionEnabled(extensions map[string]interface{}, name string) bool {
+	enabled, ok := extensions[name].(bool)
+	return ok && enabled
+}
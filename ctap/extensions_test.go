@@ -0,0 +1,131 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func getInfoExtensions(t *testing.T, server *CTAPServer) []string {
+	var response getInfoResponse
+	err := cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &response)
+	test.Assert(t, err == nil, "Could not decode getInfo")
+	return response.Extensions
+}
+
+func TestGetInfoExtensions(t *testing.T) {
+	server := NewCTAPServer(newPINDummyCTAPClient("1234"))
+	test.AssertArrEqual(t, getInfoExtensions(t, server), []string{extensionHMACSecret, extensionHMACSecretMC, extensionMinPINLength, extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "Incorrect default extensions")
+
+	server.SetExtensionEnabled(extensionHMACSecretMC, false)
+	test.AssertArrEqual(t, getInfoExtensions(t, server), []string{extensionHMACSecret, extensionMinPINLength, extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "Disabled extension still reported")
+
+	server.SetExtensionEnabled(extensionHMACSecretMC, true)
+	test.AssertArrEqual(t, getInfoExtensions(t, server), []string{extensionHMACSecret, extensionHMACSecretMC, extensionMinPINLength, extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "Re-enabled extension not reported")
+
+	server.SetExtensionEnabled(extensionHMACSecret, false)
+	test.AssertArrEqual(t, getInfoExtensions(t, server), []string{extensionMinPINLength, extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "hmac-secret-mc reported without hmac-secret")
+
+	// hmac-secret needs the PIN protocol to encrypt salts, and minPinLength needs a PIN
+	noPINServer := NewCTAPServer(&dummyCTAPClient{})
+	test.AssertArrEqual(t, getInfoExtensions(t, noPINServer), []string{extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "PIN extensions reported without PIN support")
+}
+
+func TestGetAssertionIgnoresUnknownExtensions(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	getAssertion := func(extensions map[string]interface{}) []byte {
+		args := getAssertionArgs{
+			RPID:           "example.com",
+			ClientDataHash: crypto.HashSHA256([]byte("extensions")),
+			Extensions:     extensions,
+		}
+		response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "getAssertion with extensions failed")
+		var decoded getAssertionResponse
+		util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode getAssertion response")
+		return decoded.AuthenticatorData
+	}
+
+	hmacSecretInput, _ := hmacSecretExtensionInput(server, client, crypto.RandomBytes(32))
+	outputs := decodeExtensionOutputs(t, getAssertion(map[string]interface{}{
+		extensionHMACSecret: hmacSecretInput,
+		"credBlob":          true,
+		"largeBlobKey":      true,
+		"example-unknown":   map[string]interface{}{"nested": []byte{1, 2, 3}},
+	}))
+	_, ok := outputs[extensionHMACSecret].([]byte)
+	test.Assert(t, ok, "hmac-secret was not processed")
+	test.AssertEqual(t, len(outputs), 1, "Outputs returned for unknown extensions")
+
+	authData, err := ParseAuthenticatorData(getAssertion(map[string]interface{}{"example-unknown": "value", extensionHMACSecretMC: true}))
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, !authData.HasFlag(AuthDataFlagExtensionDataIncluded), "Extension data included for unknown extensions only")
+}
+
+func TestDevicePubKeyIgnored(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	server.SetExtensionEnabled(extensionDevicePubKey, true)
+	test.AssertArrEqual(t, getInfoExtensions(t, server), []string{extensionHMACSecret, extensionHMACSecretMC, extensionMinPINLength, extensionCredProtect, extensionLargeBlobKey, extensionClientDataHashAlg}, "devicePubKey reported in getInfo")
+
+	devicePubKeyInput := map[string]interface{}{extensionDevicePubKey: map[string]interface{}{"attestation": "none"}}
+	clientDataHash := crypto.HashSHA256([]byte("devicePubKey"))
+	makeCredential := makeCredentialArgs{
+		ClientDataHash:    clientDataHash,
+		RP:                &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"},
+		PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:        devicePubKeyInput,
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, clientDataHash),
+		PINUVAuthProtocol: 1,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "makeCredential with devicePubKey failed")
+	var mcResponse makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &mcResponse), "Could not decode makeCredential response")
+	authData, err := ParseAuthenticatorData(mcResponse.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, !authData.HasFlag(AuthDataFlagExtensionDataIncluded), "Extension data included for unsupported devicePubKey")
+
+	getAssertion := getAssertionArgs{RPID: "example.com", ClientDataHash: clientDataHash, Extensions: devicePubKeyInput}
+	response = server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "getAssertion with devicePubKey failed")
+	var gaResponse getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &gaResponse), "Could not decode getAssertion response")
+	authData, err = ParseAuthenticatorData(gaResponse.AuthenticatorData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, !authData.HasFlag(AuthDataFlagExtensionDataIncluded), "Extension data included for unsupported devicePubKey")
+}
+
+func TestMakeCredentialUnknownExtensions(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	makeCredential := func(extensions map[string]interface{}) ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte("extensions")),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Extensions:       extensions,
+		}
+		response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		return ctapStatusCode(response[0])
+	}
+	unknown := map[string]interface{}{"example-made-up": true}
+
+	test.AssertEqual(t, makeCredential(unknown), ctap1ErrSuccess, "Unknown extension not ignored by default")
+
+	server.SetStrictExtensions(true)
+	test.AssertEqual(t, makeCredential(unknown), ctap2ErrUnsupportedExtension, "Unknown extension accepted in strict mode")
+	test.AssertEqual(t, makeCredential(map[string]interface{}{extensionCredProtect: uint64(1)}), ctap1ErrSuccess, "Supported extension rejected in strict mode")
+	server.SetExtensionEnabled(extensionCredProtect, false)
+	test.AssertEqual(t, makeCredential(map[string]interface{}{extensionCredProtect: uint64(1)}), ctap2ErrUnsupportedExtension, "Disabled extension accepted in strict mode")
+}
@@ -0,0 +1,41 @@
+package ctap
+
+import (
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+// The platform has this long after each assertion to ask for the next credential
+const nextAssertionTimeout = 30 * time.Second
+
+// nextAssertionState is a getAssertion with several discoverable credentials, kept so that
+// getNextAssertion can sign with the remaining ones. The user approved the first assertion,
+// and the others reuse its flags without asking again.
+type nextAssertionState struct {
+	rpID           string
+	clientDataHash []byte
+	flags          AuthenticatorDataFlags
+	extensions     *assertionExtensions
+	discoverable   bool
+	sources        []*identities.CredentialSource
+	deadline       time.Time
+}
+
+func (server *CTAPServer) handleGetNextAssertion() []byte {
+	response, err := server.getNextAssertion()
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) getNextAssertion() (*getAssertionResponse, error) {
+	assertion := server.nextAssertion
+	if assertion == nil || len(assertion.sources) == 0 || time.Now().After(assertion.deadline) {
+		ctapLogger.Printf("ERROR: No getAssertion to continue\n\n")
+		server.nextAssertion = nil
+		return nil, statusError(ctap2ErrNotAllowed)
+	}
+	credentialSource := assertion.sources[0]
+	assertion.sources = assertion.sources[1:]
+	assertion.deadline = time.Now().Add(nextAssertionTimeout)
+	return server.signAssertion(assertion, credentialSource)
+}
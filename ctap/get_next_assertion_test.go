@@ -0,0 +1,97 @@
+package ctap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func nextAssertionCredentials(client *dummyCTAPClient) []*identities.CredentialSource {
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	return []*identities.CredentialSource{
+		client.vault.NewIdentity(rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice", DisplayName: "Alice"}),
+		client.vault.NewIdentity(rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "bob", DisplayName: "Bob"}),
+		client.vault.NewIdentity(rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{3}, Name: "carol", DisplayName: "Carol"}),
+	}
+}
+
+func decodeAssertion(t *testing.T, response []byte) *getAssertionResponse {
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Assertion failed")
+	var assertion getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &assertion), "Could not decode assertion")
+	return &assertion
+}
+
+func getNextAssertion(server *CTAPServer) []byte {
+	return server.HandleMessage([]byte{byte(ctapCommandGetNextAssertion)})
+}
+
+func TestGetNextAssertion(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	sources := nextAssertionCredentials(client)
+	clientDataHash := crypto.HashSHA256([]byte("next assertion"))
+	args := getAssertionArgs{RPID: "example.com", ClientDataHash: clientDataHash}
+	first := decodeAssertion(t, server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))))
+	test.AssertEqual(t, first.NumberOfCredentials, 3, "Incorrect numberOfCredentials")
+
+	assertions := []*getAssertionResponse{first,
+		decodeAssertion(t, getNextAssertion(server)), decodeAssertion(t, getNextAssertion(server))}
+	for i, assertion := range assertions {
+		source := sources[i]
+		test.AssertArrEqual(t, assertion.Credential.ID, source.ID, "Wrong credential")
+		test.Assert(t, assertion.User != nil, "User missing from discoverable assertion")
+		test.AssertArrEqual(t, assertion.User.ID, source.User.ID, "Wrong user")
+		test.AssertEqual(t, assertion.User.Name, "", "User name returned without user verification")
+		test.Assert(t, source.PrivateKey.Public().Verify(util.Concat(assertion.AuthenticatorData, clientDataHash), assertion.Signature), "Invalid signature")
+		test.AssertEqual(t, source.SignatureCounter, uint32(1), "Counter not incremented for each credential")
+		if i > 0 {
+			test.AssertEqual(t, assertion.NumberOfCredentials, 0, "numberOfCredentials in getNextAssertion")
+		}
+	}
+	test.AssertEqual(t, ctapStatusCode(getNextAssertion(server)[0]), ctap2ErrNotAllowed, "getNextAssertion past the last credential")
+}
+
+func TestGetNextAssertionVerifiedUser(t *testing.T) {
+	client := &dummyCTAPClient{builtInUV: true}
+	server := NewCTAPServer(client)
+	nextAssertionCredentials(client)
+	args := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("next assertion")), Options: getAssertionOptions{UserVerification: true}}
+	first := decodeAssertion(t, server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))))
+	test.AssertEqual(t, first.User.Name, "alice", "User name missing after user verification")
+	next := decodeAssertion(t, getNextAssertion(server))
+	test.AssertEqual(t, next.User.DisplayName, "Bob", "User display name missing after user verification")
+	test.Assert(t, AuthenticatorDataFlags(next.AuthenticatorData[32])&AuthDataFlagUserVerified != 0, "UV flag not kept")
+}
+
+func TestGetNextAssertionState(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	sources := nextAssertionCredentials(client)
+	message := util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("state"))}))
+	test.AssertEqual(t, ctapStatusCode(getNextAssertion(server)[0]), ctap2ErrNotAllowed, "getNextAssertion without getAssertion")
+
+	// Any other command ends the assertion
+	decodeAssertion(t, server.HandleMessage(message))
+	server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(getNextAssertion(server)[0]), ctap2ErrNotAllowed, "getNextAssertion after another command")
+
+	decodeAssertion(t, server.HandleMessage(message))
+	server.nextAssertion.deadline = time.Now().Add(-time.Second)
+	test.AssertEqual(t, ctapStatusCode(getNextAssertion(server)[0]), ctap2ErrNotAllowed, "getNextAssertion after the timeout")
+
+	// With an allow list only the first match is used and no count is reported
+	allowList := []webauthn.PublicKeyCredentialDescriptor{sources[1].CTAPDescriptor(), sources[2].CTAPDescriptor()}
+	args := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("state")), AllowList: allowList}
+	assertion := decodeAssertion(t, server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))))
+	test.AssertArrEqual(t, assertion.Credential.ID, sources[1].ID, "Wrong credential from allow list")
+	test.AssertEqual(t, assertion.NumberOfCredentials, 0, "numberOfCredentials with an allow list")
+	test.Assert(t, assertion.User == nil, "User returned for an allow list assertion")
+	test.AssertEqual(t, ctapStatusCode(getNextAssertion(server)[0]), ctap2ErrNotAllowed, "getNextAssertion after an allow list assertion")
+}
@@ -0,0 +1,61 @@
+package ctap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Rewrite the golden files in testdata with the current output")
+
+// checkGolden compares a CTAP response byte-for-byte against testdata/<name>.golden, which
+// holds it as hex. Run the tests with -update-golden to regenerate the file.
+func checkGolden(t *testing.T, name string, command ctapCommand, actual []byte) {
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		util.CheckErr(os.MkdirAll("testdata", 0755), "Could not create testdata")
+		util.CheckErr(os.WriteFile(path, []byte(hex.EncodeToString(actual)+"\n"), 0644), "Could not write golden file")
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read golden file %s (run with -update-golden to create it): %s", path, err)
+	}
+	expected, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid golden file %s: %s", path, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Output does not match %s\nexpected: %s\nactual:   %s",
+			path, DescribeCTAPResponse(byte(command), expected), DescribeCTAPResponse(byte(command), actual))
+	}
+}
+
+func TestGoldenMakeCredentialPackedSelf(t *testing.T) {
+	client := &dummyCTAPClient{}
+	client.vault.SetDeterministicSeed([]byte("virtual-fido golden seed"))
+	server := NewCTAPServer(client)
+	server.SetAAGUID([16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+	server.SetSelfAttestation(true)
+
+	args := makeCredentialArgs{
+		ClientDataHash: crypto.HashSHA256([]byte("golden client data")),
+		RP:             &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:           &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3, 4}, Name: "alice", DisplayName: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+		},
+		Options: &makeCredentialOptions{ResidentKey: true},
+	}
+	message := util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args))
+	checkGolden(t, "make_credential_packed_self_es256", ctapCommandMakeCredential, server.HandleMessage(message))
+}
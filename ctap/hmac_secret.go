@@ -0,0 +1,82 @@
+package ctap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+const (
+	extensionHMACSecret   = "hmac-secret"
+	extensionHMACSecretMC = "hmac-secret-mc"
+)
+
+type hmacSecretInput struct {
+	KeyAgreement      *cose.COSEEC2Key `cbor:"1,keyasint"`
+	SaltEnc           []byte           `cbor:"2,keyasint"`
+	SaltAuth          []byte           `cbor:"3,keyasint"`
+	PINUVAuthProtocol uint32           `cbor:"4,keyasint,omitempty"`
+}
+
+// Salts decrypted from an hmac-secret input, along with the secret used to encrypt the output
+type hmacSecretSalts struct {
+	sharedSecret []byte
+	salts        [][]byte
+}
+
+func (server *CTAPServer) supportsHMACSecret() bool {
+	// The platform needs the PIN key agreement to encrypt salts
+	return server.client.SupportsPIN()
+}
+
+func (server *CTAPServer) decryptHMACSecretSalts(extensionInput interface{}) (*hmacSecretSalts, ctapStatusCode) {
+	var input hmacSecretInput
+	if err := decodeExtensionInput(extensionInput, &input); err != nil {
+		return nil, ctap2ErrInvalidCBOR
+	}
+	if input.KeyAgreement == nil || input.SaltEnc == nil || input.SaltAuth == nil {
+		return nil, ctap2ErrMissingParam
+	}
+	if input.PINUVAuthProtocol != 0 && input.PINUVAuthProtocol != 1 {
+		return nil, ctap1ErrInvalidParameter
+	}
+	// saltEnc is AES-CBC without padding, so this is also the length of the decrypted salts
+	if len(input.SaltEnc) != 32 && len(input.SaltEnc) != 64 {
+		return nil, ctap1ErrInvalidLength
+	}
+	sharedSecret, status := server.getPINSharedSecret(*input.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return nil, status
+	}
+	if !secretsEqual(server.derivePINAuth(sharedSecret, input.SaltEnc), input.SaltAuth) {
+		return nil, ctap2ErrPINAuthInvalid
+	}
+	decrypted := crypto.DecryptAESCBC(sharedSecret, input.SaltEnc)
+	salts := [][]byte{decrypted[:32]}
+	if len(decrypted) == 64 {
+		salts = append(salts, decrypted[32:])
+	}
+	return &hmacSecretSalts{sharedSecret: sharedSecret, salts: salts}, ctap1ErrSuccess
+}
+
+// hmacSecretOutput computes the encrypted HMAC of each salt with the credential's
+// CredRandom, or nil if the credential predates hmac-secret support
+func hmacSecretOutput(source *identities.CredentialSource, salts *hmacSecretSalts, userVerified bool) []byte {
+	credRandom := source.CredRandomWithoutUV
+	if userVerified {
+		credRandom = source.CredRandomWithUV
+	}
+	if credRandom == nil {
+		return nil
+	}
+	output := make([]byte, 0, 64)
+	for _, salt := range salts.salts {
+		mac := hmac.New(sha256.New, credRandom)
+		mac.Write(salt)
+		output = append(output, mac.Sum(nil)...)
+	}
+	return crypto.EncryptAESCBC(salts.sharedSecret, output)
+}
@@ -0,0 +1,189 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func hmacSecretExtensionInput(server *CTAPServer, client *dummyCTAPClient, salts []byte) (map[int]interface{}, []byte) {
+	keyAgreement, sharedSecret := platformKeyAgreement(client)
+	saltEnc := crypto.EncryptAESCBC(sharedSecret, salts)
+	return map[int]interface{}{
+		1: keyAgreement,
+		2: saltEnc,
+		3: server.derivePINAuth(sharedSecret, saltEnc),
+	}, sharedSecret
+}
+
+func decodeExtensionOutputs(t *testing.T, authDataBytes []byte) map[string]interface{} {
+	authData, err := ParseAuthenticatorData(authDataBytes)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, authData.HasFlag(AuthDataFlagExtensionDataIncluded), "No extension outputs in authenticator data")
+	outputs := map[string]interface{}{}
+	util.CheckErr(cbor.Unmarshal(authData.Extensions, &outputs), "Could not decode extension outputs")
+	return outputs
+}
+
+func TestHMACSecretMakeCredentialOutputMatchesAssertion(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	salts := crypto.RandomBytes(64)
+
+	clientDataHash := crypto.HashSHA256([]byte("make credential"))
+	mcInput, mcSharedSecret := hmacSecretExtensionInput(server, client, salts)
+	makeCredential := makeCredentialArgs{
+		ClientDataHash:    clientDataHash,
+		RP:                &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"},
+		PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:        map[string]interface{}{extensionHMACSecret: true, extensionHMACSecretMC: mcInput},
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, clientDataHash),
+		PINUVAuthProtocol: 1,
+	}
+	responseBytes := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "makeCredential failed")
+	var mcResponse makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &mcResponse), "Could not decode makeCredential response")
+	mcOutputs := decodeExtensionOutputs(t, mcResponse.AuthData)
+	test.Assert(t, mcOutputs[extensionHMACSecret] == true, "hmac-secret not enabled")
+	mcOutput, ok := mcOutputs[extensionHMACSecretMC].([]byte)
+	test.Assert(t, ok, "No hmac-secret-mc output")
+	mcSecret := crypto.DecryptAESCBC(mcSharedSecret, mcOutput)
+	test.AssertEqual(t, len(mcSecret), 64, "hmac-secret-mc output should cover both salts")
+
+	assertionHash := crypto.HashSHA256([]byte("get assertion"))
+	gaInput, gaSharedSecret := hmacSecretExtensionInput(server, client, salts)
+	getAssertion := getAssertionArgs{
+		RPID:              "example.com",
+		ClientDataHash:    assertionHash,
+		Extensions:        map[string]interface{}{extensionHMACSecret: gaInput},
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, assertionHash),
+		PINUVAuthProtocol: 1,
+	}
+	responseBytes = server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getAssertion failed")
+	var gaResponse getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &gaResponse), "Could not decode getAssertion response")
+	gaOutput, ok := decodeExtensionOutputs(t, gaResponse.AuthenticatorData)[extensionHMACSecret].([]byte)
+	test.Assert(t, ok, "No hmac-secret output")
+	test.Assert(t, bytes.Equal(crypto.DecryptAESCBC(gaSharedSecret, gaOutput), mcSecret), "makeCredential and getAssertion hmac-secret outputs differ")
+
+	// Without UV the other CredRandom is used, so the output must differ
+	getAssertion.PINUVAuthParam = nil
+	getAssertion.PINUVAuthProtocol = 0
+	gaInput, gaSharedSecret = hmacSecretExtensionInput(server, client, salts)
+	getAssertion.Extensions = map[string]interface{}{extensionHMACSecret: gaInput}
+	responseBytes = server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getAssertion without UV failed")
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &gaResponse), "Could not decode getAssertion response")
+	gaOutput = decodeExtensionOutputs(t, gaResponse.AuthenticatorData)[extensionHMACSecret].([]byte)
+	test.Assert(t, !bytes.Equal(crypto.DecryptAESCBC(gaSharedSecret, gaOutput), mcSecret), "hmac-secret output without UV matches UV output")
+}
+
+func TestHMACSecretMakeCredentialRequiresUV(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	client.pinHash = nil // No PIN set, so makeCredential proceeds without UV
+	server := NewCTAPServer(client)
+	mcInput, _ := hmacSecretExtensionInput(server, client, crypto.RandomBytes(32))
+	makeCredential := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("make credential")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       map[string]interface{}{extensionHMACSecret: true, extensionHMACSecretMC: mcInput},
+	}
+	responseBytes := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "makeCredential failed")
+	var response makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode makeCredential response")
+	outputs := decodeExtensionOutputs(t, response.AuthData)
+	test.Assert(t, outputs[extensionHMACSecret] == true, "hmac-secret not enabled")
+	_, ok := outputs[extensionHMACSecretMC]
+	test.Assert(t, !ok, "hmac-secret-mc output returned without UV")
+}
+
+func TestHMACSecretAssertionSignatureCoversExtensions(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	source := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	clientDataHash := crypto.HashSHA256([]byte("get assertion"))
+	input, _ := hmacSecretExtensionInput(server, client, crypto.RandomBytes(32))
+	getAssertion := getAssertionArgs{
+		RPID:           "example.com",
+		ClientDataHash: clientDataHash,
+		Extensions:     map[string]interface{}{extensionHMACSecret: input},
+	}
+	responseBytes := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertion)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "getAssertion failed")
+	var response getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode getAssertion response")
+	authData, err := ParseAuthenticatorData(response.AuthenticatorData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, authData.HasFlag(AuthDataFlagExtensionDataIncluded), "ED flag not set")
+	// rpIdHash || flags || counter, followed directly by the extensions
+	test.AssertArrEqual(t, response.AuthenticatorData[37:], authData.Extensions, "Extensions are not at the end of authData")
+
+	publicKey := source.PrivateKey.Public()
+	test.Assert(t, publicKey.Verify(util.Concat(response.AuthenticatorData, clientDataHash), response.Signature), "Signature does not cover authData with extensions")
+	withoutExtensions := response.AuthenticatorData[:37]
+	test.Assert(t, !publicKey.Verify(util.Concat(withoutExtensions, clientDataHash), response.Signature), "Signature verifies without the extensions")
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func TestHMACSecretOneAndTwoSalts(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	salt1, salt2 := crypto.RandomBytes(32), crypto.RandomBytes(32)
+	// Returns the decrypted hmac-secret output, or the status if getAssertion failed
+	assert := func(salts []byte) ([]byte, ctapStatusCode) {
+		input, sharedSecret := hmacSecretExtensionInput(server, client, salts)
+		args := getAssertionArgs{
+			RPID:           "example.com",
+			ClientDataHash: crypto.HashSHA256([]byte("salts")),
+			AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+			Extensions:     map[string]interface{}{extensionHMACSecret: input},
+		}
+		responseBytes := server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+		if ctapStatusCode(responseBytes[0]) != ctap1ErrSuccess {
+			return nil, ctapStatusCode(responseBytes[0])
+		}
+		var response getAssertionResponse
+		util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode getAssertion response")
+		output, ok := decodeExtensionOutputs(t, response.AuthenticatorData)[extensionHMACSecret].([]byte)
+		test.Assert(t, ok, "No hmac-secret output")
+		return crypto.DecryptAESCBC(sharedSecret, output), ctap1ErrSuccess
+	}
+
+	single, status := assert(salt1)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "getAssertion with one salt failed")
+	test.AssertEqual(t, len(single), 32, "One salt should give one output")
+	test.AssertArrEqual(t, single, hmacSHA256(identity.CredRandomWithoutUV, salt1), "Output is not the HMAC of the salt")
+	again, _ := assert(salt1)
+	test.AssertArrEqual(t, again, single, "Output changed between assertions")
+
+	dual, status := assert(util.Concat(salt1, salt2))
+	test.AssertEqual(t, status, ctap1ErrSuccess, "getAssertion with two salts failed")
+	test.AssertEqual(t, len(dual), 64, "Two salts should give two outputs")
+	test.AssertArrEqual(t, dual[:32], single, "First output depends on the second salt")
+	test.AssertArrEqual(t, dual[32:], hmacSHA256(identity.CredRandomWithoutUV, salt2), "Second output is not the HMAC of the second salt")
+
+	_, status = assert(crypto.RandomBytes(48))
+	test.AssertEqual(t, status, ctap1ErrInvalidLength, "Salt that is neither 32 nor 64 bytes accepted")
+}
@@ -0,0 +1,41 @@
+package ctap
+
+// SetInternalPINEntry emulates an authenticator with a built-in keypad. When the platform
+// asks for user verification without a pinUvAuthParam, the device prompts for the PIN with
+// the given callback and checks it itself, so no clientPIN key agreement or pinUvAuthToken
+// is involved. The callback returns false if the user cancelled. Wrong PINs count against
+// the same retry counters as clientPIN. A nil callback disables internal PIN entry.
+func (server *CTAPServer) SetInternalPINEntry(prompt func(relyingParty string) (string, bool)) {
+	server.internalPINEntry = prompt
+}
+
+// supportsBuiltInUV reports whether the device can verify the user without the platform,
+// with the client's own method, an enrolled fingerprint or a PIN entered on the device
+func (server *CTAPServer) supportsBuiltInUV() bool {
+	if server.client.SupportsUserVerification() || server.hasBioEnrollments() {
+		return true
+	}
+	return server.internalPINEntry != nil && server.client.SupportsPIN() && server.client.PINHash() != nil
+}
+
+// canVerifyUser reports whether the user can be verified at all, either by the device or
+// with a pinUvAuthToken from the PIN
+func (server *CTAPServer) canVerifyUser() bool {
+	return server.supportsBuiltInUV() || (server.client.SupportsPIN() && server.client.PINHash() != nil)
+}
+
+func (server *CTAPServer) verifyInternalPIN(relyingParty string) ctapStatusCode {
+	if server.pinConsecutiveFailures >= pinMaxConsecutiveFailures {
+		return ctap2ErrPINAuthBlocked
+	}
+	if server.client.PINRetries() <= 0 {
+		return ctap2ErrPINBlocked
+	}
+	pin, ok := server.internalPINEntry(relyingParty)
+	if !ok {
+		return ctap2ErrOperationDenied
+	}
+	retries := server.client.PINRetries() - 1
+	server.client.SetPINRetries(retries)
+	return server.checkPINHash(hashPIN([]byte(pin)), retries)
+}
@@ -0,0 +1,66 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func internalUVAssertion(server *CTAPServer, client *dummyCTAPClient) []byte {
+	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{0, 1, 2, 3, 4}, Name: "Alice"})
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte("internal uv")),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{identity.CTAPDescriptor()},
+		Options:        getAssertionOptions{UserVerification: true},
+	}
+	return server.HandleMessage(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+}
+
+func TestInternalPINEntry(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	prompted := ""
+	server.SetInternalPINEntry(func(relyingParty string) (string, bool) {
+		prompted = relyingParty
+		return "1234", true
+	})
+
+	var info getInfoResponse
+	infoBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	util.CheckErr(cbor.Unmarshal(infoBytes[1:], &info), "Could not decode getInfo")
+	test.Assert(t, info.Options.CanUserVerification != nil && *info.Options.CanUserVerification, "uv not reported in getInfo")
+
+	responseBytes := internalUVAssertion(server, client)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Assertion with internal UV failed")
+	test.AssertEqual(t, prompted, "rp", "Device did not prompt for the PIN")
+	var response getAssertionResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+	flags := AuthenticatorDataFlags(response.AuthenticatorData[32])
+	test.Assert(t, flags&AuthDataFlagUserVerified != 0, "UV flag not set after internal PIN entry")
+	test.Assert(t, flags&AuthDataFlagUserPresent != 0, "UP flag not set")
+}
+
+func TestInternalPINEntryFailures(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	pin, ok := "0000", true
+	server.SetInternalPINEntry(func(relyingParty string) (string, bool) {
+		return pin, ok
+	})
+	test.AssertEqual(t, ctapStatusCode(internalUVAssertion(server, client)[0]), ctap2ErrPINInvalid, "Wrong PIN accepted")
+	test.AssertEqual(t, client.pinRetries, int32(7), "Retries not decremented for a wrong on-device PIN")
+
+	ok = false
+	test.AssertEqual(t, ctapStatusCode(internalUVAssertion(server, client)[0]), ctap2ErrOperationDenied, "Cancelled PIN entry allowed")
+	test.AssertEqual(t, client.pinRetries, int32(7), "Cancelled PIN entry used a retry")
+
+	pin, ok = "1234", true
+	test.AssertEqual(t, ctapStatusCode(internalUVAssertion(server, client)[0]), ctap1ErrSuccess, "Correct PIN rejected")
+	test.AssertEqual(t, client.pinRetries, int32(8), "Retries not reset on success")
+}
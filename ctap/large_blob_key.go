@@ -0,0 +1,23 @@
+package ctap
+
+// largeBlobKey gives the platform a per-credential key, which it uses to encrypt the
+// credential's entry in the large-blob array
+const extensionLargeBlobKey = "largeBlobKey"
+
+func (server *CTAPServer) supportsLargeBlobKey() bool {
+	// The key is only useful with somewhere to store the blobs
+	return server.hasCommand(ctapCommandLargeBlobs)
+}
+
+// largeBlobKeyInput reports whether makeCredential asked for the credential's large-blob
+// key. The input must be true, and only discoverable credentials can have large blobs.
+func (server *CTAPServer) largeBlobKeyInput(extensions map[string]interface{}, residentKey bool) (bool, ctapStatusCode) {
+	input, ok := extensions[extensionLargeBlobKey]
+	if !ok || !server.isExtensionSupported(extensionLargeBlobKey) {
+		return false, ctap1ErrSuccess
+	}
+	if requested, _ := input.(bool); !requested || !residentKey {
+		return false, ctap2ErrInvalidOption
+	}
+	return true, ctap1ErrSuccess
+}
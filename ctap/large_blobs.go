@@ -0,0 +1,151 @@
+package ctap
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// The spec requires room for at least 1024 bytes of serialized large-blob array
+	minLargeBlobArraySize     int = 1024
+	defaultLargeBlobArraySize int = 4096
+	// Fragments must fit in a message of the default 1024 byte maxMsgSize with 64 bytes spare
+	largeBlobMaxFragmentLength int = 1024 - 64
+	largeBlobHashLength        int = 16
+)
+
+type largeBlobsArgs struct {
+	Get               *uint32 `cbor:"1,keyasint,omitempty"`
+	Set               []byte  `cbor:"2,keyasint,omitempty"`
+	Offset            *uint32 `cbor:"3,keyasint,omitempty"`
+	Length            *uint32 `cbor:"4,keyasint,omitempty"`
+	PINUVAuthParam    []byte  `cbor:"5,keyasint,omitempty"`
+	PINUVAuthProtocol uint32  `cbor:"6,keyasint,omitempty"`
+}
+
+type largeBlobsResponse struct {
+	Config []byte `cbor:"1,keyasint"`
+}
+
+// largeBlobWrite tracks a serialized large-blob array being written in fragments
+type largeBlobWrite struct {
+	expectedLength int
+	data           []byte
+}
+
+// SetMaxLargeBlobArraySize sets how many bytes of serialized large-blob array the device
+// stores, reported in getInfo as maxSerializedLargeBlobArray
+func (server *CTAPServer) SetMaxLargeBlobArraySize(size int) {
+	util.Assert(size >= minLargeBlobArraySize, "Large-blob storage must hold at least 1024 bytes")
+	server.maxLargeBlobSize = size
+}
+
+// emptyLargeBlobArray is the initial serialized array: an empty CBOR array followed by the
+// truncated SHA-256 hash of it
+func emptyLargeBlobArray() []byte {
+	array := []byte{0x80}
+	return util.Concat(array, crypto.HashSHA256(array)[:largeBlobHashLength])
+}
+
+func (server *CTAPServer) largeBlobArray() []byte {
+	if array := server.client.LargeBlobArray(); array != nil {
+		return array
+	}
+	return emptyLargeBlobArray()
+}
+
+func (server *CTAPServer) handleLargeBlobs(data []byte) []byte {
+	response, err := server.largeBlobs(data)
+	return encodeResponse(response, err)
+}
+
+func (server *CTAPServer) largeBlobs(data []byte) (interface{}, error) {
+	var args largeBlobsArgs
+	if err := cbor.Unmarshal(data, &args); err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return nil, statusError(ctap2ErrInvalidCBOR)
+	}
+	if args.Offset == nil || (args.Get == nil) == (args.Set == nil) {
+		return nil, statusError(ctap1ErrInvalidParameter)
+	}
+	if args.Get != nil {
+		return server.getLargeBlobs(int(*args.Get), int(*args.Offset), args.Length)
+	}
+	return nil, server.setLargeBlobs(args)
+}
+
+func (server *CTAPServer) getLargeBlobs(count int, offset int, length *uint32) (*largeBlobsResponse, error) {
+	if length != nil {
+		return nil, statusError(ctap1ErrInvalidParameter)
+	}
+	if count > largeBlobMaxFragmentLength {
+		return nil, statusError(ctap1ErrInvalidLength)
+	}
+	array := server.largeBlobArray()
+	if offset > len(array) {
+		return nil, statusError(ctap1ErrInvalidParameter)
+	}
+	end := offset + count
+	if end > len(array) {
+		end = len(array)
+	}
+	return &largeBlobsResponse{Config: array[offset:end]}, nil
+}
+
+func (server *CTAPServer) setLargeBlobs(args largeBlobsArgs) error {
+	if len(args.Set) > largeBlobMaxFragmentLength {
+		return statusError(ctap1ErrInvalidLength)
+	}
+	offset := int(*args.Offset)
+	if offset == 0 {
+		if args.Length == nil {
+			return statusError(ctap1ErrInvalidParameter)
+		}
+		if int(*args.Length) > server.maxLargeBlobSize {
+			return statusError(ctap2ErrLargeBlobStorageFull)
+		}
+		if int(*args.Length) < largeBlobHashLength+1 {
+			return statusError(ctap1ErrInvalidParameter)
+		}
+		server.largeBlobWrite = &largeBlobWrite{expectedLength: int(*args.Length)}
+	} else if args.Length != nil {
+		return statusError(ctap1ErrInvalidParameter)
+	}
+	write := server.largeBlobWrite
+	if write == nil || offset != len(write.data) {
+		return statusError(ctap1ErrInvalidSequence)
+	}
+	if status := checkPINUVAuthProtocol(args.PINUVAuthProtocol, args.PINUVAuthParam); status != ctap1ErrSuccess {
+		return statusError(status)
+	}
+	if (server.client.SupportsPIN() && server.client.PINHash() != nil) || server.client.AlwaysUV() {
+		if args.PINUVAuthParam == nil {
+			return statusError(ctap2ErrPINRequired)
+		}
+		// pinUvAuthParam covers 32 bytes of 0xff, the command byte, 0x00, the offset and the fragment hash
+		offsetBytes := make([]byte, 4)
+		binary.LittleEndian.PutUint32(offsetBytes, uint32(offset))
+		authData := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandLargeBlobs), 0x00}, offsetBytes, crypto.HashSHA256(args.Set))
+		if !secretsEqual(server.derivePINAuth(server.client.PINToken(), authData), args.PINUVAuthParam) {
+			return statusError(ctap2ErrPINAuthInvalid)
+		}
+	}
+	if offset+len(args.Set) > write.expectedLength {
+		return statusError(ctap1ErrInvalidParameter)
+	}
+	write.data = append(write.data, args.Set...)
+	if len(write.data) < write.expectedLength {
+		return nil
+	}
+	server.largeBlobWrite = nil
+	array := write.data[:len(write.data)-largeBlobHashLength]
+	if !bytes.Equal(crypto.HashSHA256(array)[:largeBlobHashLength], write.data[len(array):]) {
+		return statusError(ctap2ErrIntegrityFailure)
+	}
+	server.client.SetLargeBlobArray(write.data)
+	return nil
+}
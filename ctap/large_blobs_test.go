@@ -0,0 +1,135 @@
+package ctap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func largeBlobsRequest(server *CTAPServer, args largeBlobsArgs) []byte {
+	return server.HandleMessage(util.Concat([]byte{byte(ctapCommandLargeBlobs)}, util.MarshalCBOR(args)))
+}
+
+// serializedLargeBlobArray builds a valid serialized array of the given total length
+func serializedLargeBlobArray(length int) []byte {
+	// A CBOR array with a single byte string, padded out to the requested length
+	header := []byte{0x81, 0x59, 0, 0}
+	contentLength := length - largeBlobHashLength - len(header)
+	header[2], header[3] = byte(contentLength>>8), byte(contentLength)
+	array := util.Concat(header, make([]byte, contentLength))
+	return util.Concat(array, crypto.HashSHA256(array)[:largeBlobHashLength])
+}
+
+// writeLargeBlobArray writes an array in maximum size fragments, returning the status of the last one
+func writeLargeBlobArray(server *CTAPServer, array []byte) ctapStatusCode {
+	for offset := 0; offset < len(array); offset += largeBlobMaxFragmentLength {
+		end := offset + largeBlobMaxFragmentLength
+		if end > len(array) {
+			end = len(array)
+		}
+		fragmentOffset := uint32(offset)
+		args := largeBlobsArgs{Set: array[offset:end], Offset: &fragmentOffset}
+		if offset == 0 {
+			length := uint32(len(array))
+			args.Length = &length
+		}
+		status := ctapStatusCode(largeBlobsRequest(server, args)[0])
+		if status != ctap1ErrSuccess {
+			return status
+		}
+	}
+	return ctap1ErrSuccess
+}
+
+func readLargeBlobArray(t *testing.T, server *CTAPServer) []byte {
+	var array []byte
+	for {
+		count, offset := uint32(largeBlobMaxFragmentLength), uint32(len(array))
+		response := largeBlobsRequest(server, largeBlobsArgs{Get: &count, Offset: &offset})
+		test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Could not read large blobs")
+		var decoded largeBlobsResponse
+		util.CheckErr(cbor.Unmarshal(response[1:], &decoded), "Could not decode large blobs")
+		array = append(array, decoded.Config...)
+		if len(decoded.Config) < int(count) {
+			return array
+		}
+	}
+}
+
+func TestLargeBlobsInitialArray(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	test.AssertArrEqual(t, readLargeBlobArray(t, server), emptyLargeBlobArray(), "Initial array is not empty")
+}
+
+func TestLargeBlobsCapacity(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	server.SetMaxLargeBlobArraySize(2048)
+
+	var info getInfoResponse
+	infoBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	util.CheckErr(cbor.Unmarshal(infoBytes[1:], &info), "Could not decode getInfo")
+	test.Assert(t, info.Options.LargeBlobs, "largeBlobs not reported in getInfo")
+	test.AssertEqual(t, info.MaxSerializedLargeBlobArray, uint32(2048), "Wrong maxSerializedLargeBlobArray")
+
+	full := serializedLargeBlobArray(2048)
+	test.AssertEqual(t, writeLargeBlobArray(server, full), ctap1ErrSuccess, "Could not fill large-blob storage")
+	test.AssertArrEqual(t, client.largeBlobArray, full, "Array not stored")
+	test.AssertArrEqual(t, readLargeBlobArray(t, server), full, "Stored array not returned")
+
+	test.AssertEqual(t, writeLargeBlobArray(server, serializedLargeBlobArray(2049)), ctap2ErrLargeBlobStorageFull, "Oversized array accepted")
+	test.AssertArrEqual(t, client.largeBlobArray, full, "Oversized write changed the stored array")
+}
+
+func TestLargeBlobsIntegrityAndSequence(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+
+	corrupted := serializedLargeBlobArray(1200)
+	corrupted[len(corrupted)-1] ^= 0xff
+	test.AssertEqual(t, writeLargeBlobArray(server, corrupted), ctap2ErrIntegrityFailure, "Corrupted array accepted")
+	test.Assert(t, client.largeBlobArray == nil, "Corrupted array stored")
+
+	offset := uint32(16)
+	status := ctapStatusCode(largeBlobsRequest(server, largeBlobsArgs{Set: []byte{1}, Offset: &offset})[0])
+	test.AssertEqual(t, status, ctap1ErrInvalidSequence, "Write without a starting fragment accepted")
+}
+
+func TestLargeBlobKey(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	extensions := map[string]interface{}{extensionLargeBlobKey: true}
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("large blob key")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       extensions,
+	}
+	_, err := server.makeCredential(util.MarshalCBOR(args), nil)
+	test.Assert(t, errors.Is(err, NewCTAPError(byte(ctap2ErrInvalidOption))), "largeBlobKey accepted for a non-discoverable credential")
+
+	args.Options = &makeCredentialOptions{ResidentKey: true}
+	credential, err := server.makeCredential(util.MarshalCBOR(args), nil)
+	test.Assert(t, err == nil, "makeCredential with largeBlobKey failed")
+	test.AssertEqual(t, len(credential.LargeBlobKey), 32, "No large-blob key returned")
+
+	assertionArgs := getAssertionArgs{RPID: "example.com", ClientDataHash: crypto.HashSHA256([]byte("large blob key"))}
+	assertion, err := server.getAssertion(util.MarshalCBOR(assertionArgs), nil)
+	test.Assert(t, err == nil, "getAssertion failed")
+	test.Assert(t, assertion.LargeBlobKey == nil, "Large-blob key returned without the extension")
+	assertionArgs.Extensions = extensions
+	assertion, err = server.getAssertion(util.MarshalCBOR(assertionArgs), nil)
+	test.Assert(t, err == nil, "getAssertion with largeBlobKey failed")
+	test.AssertArrEqual(t, assertion.LargeBlobKey, credential.LargeBlobKey, "Different large-blob key returned")
+
+	server.RegisterCommand(byte(ctapCommandLargeBlobs), nil)
+	assertion, err = server.getAssertion(util.MarshalCBOR(assertionArgs), nil)
+	test.Assert(t, err == nil && assertion.LargeBlobKey == nil, "Large-blob key returned without large-blob storage")
+}
@@ -0,0 +1,70 @@
+package ctap
+
+// minPinLength reports the minimum PIN length in makeCredential, but only to relying
+// parties that setMinPINLength put on the list
+const extensionMinPINLength = "minPinLength"
+
+// Most RP IDs a single setMinPINLength may allow to receive the minimum PIN length
+const maxRPIDsForSetMinPINLength = 8
+
+type setMinPINLengthParams struct {
+	NewMinPINLength   uint32   `cbor:"1,keyasint,omitempty"`
+	MinPINLengthRPIDs []string `cbor:"2,keyasint,omitempty"`
+	ForceChangePIN    bool     `cbor:"3,keyasint,omitempty"`
+}
+
+func (server *CTAPServer) supportsMinPINLength() bool {
+	return server.client.SupportsPIN()
+}
+
+// minPINLength is the shortest PIN the policy allows, which can only be raised
+func (server *CTAPServer) minPINLength() int {
+	if length := server.client.MinPINLength(); length > pinMinLength {
+		return length
+	}
+	return pinMinLength
+}
+
+func (server *CTAPServer) handleSetMinPINLength(subCommandParams map[uint64]interface{}) error {
+	if !server.client.SupportsPIN() {
+		return statusError(ctap1ErrInvalidCommand)
+	}
+	var params setMinPINLengthParams
+	if err := decodeExtensionInput(subCommandParams, &params); err != nil {
+		ctapLogger.Printf("ERROR: Invalid setMinPINLength parameters: %s\n\n", err)
+		return statusError(ctap2ErrInvalidCBOR)
+	}
+	if params.ForceChangePIN {
+		// Forcing a PIN change needs state the PIN commands don't track
+		return statusError(ctap2ErrUnsupportedOption)
+	}
+	newLength := int(params.NewMinPINLength)
+	if newLength == 0 {
+		newLength = server.minPINLength()
+	}
+	if newLength < server.minPINLength() || newLength > server.maxPINLength {
+		return statusError(ctap2ErrPINPolicyViolation)
+	}
+	if len(params.MinPINLengthRPIDs) > maxRPIDsForSetMinPINLength {
+		return statusError(ctap1ErrInvalidParameter)
+	}
+	server.client.SetMinPINLength(newLength)
+	if params.MinPINLengthRPIDs != nil {
+		server.client.SetMinPINLengthRPIDs(params.MinPINLengthRPIDs)
+	}
+	return nil
+}
+
+// minPINLengthOutput returns the minPinLength extension output for a new credential, or
+// nil if the relying party isn't allowed to see it
+func (server *CTAPServer) minPINLengthOutput(extensions map[string]interface{}, relyingPartyID string) interface{} {
+	if !server.isExtensionSupported(extensionMinPINLength) || !isExtensionEnabled(extensions, extensionMinPINLength) {
+		return nil
+	}
+	for _, allowed := range server.client.MinPINLengthRPIDs() {
+		if allowed == relyingPartyID {
+			return uint32(server.minPINLength())
+		}
+	}
+	return nil
+}
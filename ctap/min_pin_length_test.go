@@ -0,0 +1,82 @@
+package ctap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func setMinPINLength(server *CTAPServer, client *dummyCTAPClient, params map[uint64]interface{}) ctapStatusCode {
+	authData := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandConfig), byte(configSubcommandSetMinPINLength)}, util.MarshalCBOR(params))
+	args := configArgs{
+		SubCommand:        configSubcommandSetMinPINLength,
+		SubCommandParams:  params,
+		PINUVAuthProtocol: 1,
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, authData),
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+// makeCredentialMinPINLength returns the minPinLength extension output for a new credential
+// on relyingParty, or nil if there was none
+func makeCredentialMinPINLength(t *testing.T, server *CTAPServer, client *dummyCTAPClient, relyingParty string) interface{} {
+	clientDataHash := crypto.HashSHA256([]byte("minPinLength"))
+	args := makeCredentialArgs{
+		ClientDataHash:    clientDataHash,
+		RP:                &webauthn.PublicKeyCredentialRPEntity{ID: relyingParty, Name: relyingParty},
+		User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:        map[string]interface{}{extensionMinPINLength: true},
+		PINUVAuthParam:    server.derivePINAuth(client.pinToken, clientDataHash),
+		PINUVAuthProtocol: 1,
+	}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "makeCredential failed")
+	var mcResponse makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &mcResponse), "Could not decode makeCredential response")
+	authData, err := ParseAuthenticatorData(mcResponse.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	if !authData.HasFlag(AuthDataFlagExtensionDataIncluded) {
+		return nil
+	}
+	return decodeExtensionOutputs(t, mcResponse.AuthData)[extensionMinPINLength]
+}
+
+func TestMinPINLengthRPIDs(t *testing.T) {
+	client := newPINDummyCTAPClient("123456")
+	server := NewCTAPServer(client)
+	test.Assert(t, makeCredentialMinPINLength(t, server, client, "listed.example") == nil, "minPinLength sent before any RP was allowed")
+
+	status := setMinPINLength(server, client, map[uint64]interface{}{1: 6, 2: []string{"listed.example"}})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "setMinPINLength failed")
+	test.Assert(t, makeCredentialMinPINLength(t, server, client, "listed.example") == uint64(6), "Listed RP did not get minPinLength")
+	test.Assert(t, makeCredentialMinPINLength(t, server, client, "other.example") == nil, "minPinLength sent to an RP off the list")
+
+	var info getInfoResponse
+	util.CheckErr(cbor.Unmarshal(server.HandleMessage([]byte{byte(ctapCommandGetInfo)})[1:], &info), "Could not decode getInfo")
+	test.AssertEqual(t, info.MinPINLength, uint32(6), "getInfo minPINLength not updated")
+	test.AssertEqual(t, info.MaxRPIDsForSetMinPINLength, uint32(maxRPIDsForSetMinPINLength), "maxRPIDsForSetMinPINLength not reported")
+	test.Assert(t, info.Options.SetMinPINLength, "setMinPINLength option not reported")
+}
+
+func TestSetMinPINLengthPolicy(t *testing.T) {
+	client := newPINDummyCTAPClient("123456")
+	server := NewCTAPServer(client)
+	test.AssertEqual(t, setMinPINLength(server, client, map[uint64]interface{}{1: 6}), ctap1ErrSuccess, "Raising the minimum PIN length failed")
+	test.AssertEqual(t, setMinPINLength(server, client, map[uint64]interface{}{1: 5}), ctap2ErrPINPolicyViolation, "Minimum PIN length lowered")
+	tooMany := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	test.AssertEqual(t, setMinPINLength(server, client, map[uint64]interface{}{2: tooMany}), ctap1ErrInvalidParameter, "Too many RP IDs accepted")
+	test.AssertEqual(t, client.minPINLength, 6, "Minimum PIN length changed by a rejected request")
+
+	// New PINs must meet the raised minimum
+	client.pinHash = nil
+	test.AssertEqual(t, setPIN(server, client, []byte("12345")), ctap2ErrPINPolicyViolation, "PIN shorter than the minimum accepted")
+	test.AssertEqual(t, setPIN(server, client, []byte("123456")), ctap1ErrSuccess, "PIN of the minimum length rejected")
+}
@@ -0,0 +1,71 @@
+package ctap
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Best effort: looks for variable-time comparisons whose arguments look like PIN material.
+// It can't prove every secret comparison is constant time, but catches a bytes.Equal
+// creeping back into the PIN code.
+func TestSecretComparisonsAreConstantTime(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	test.Assert(t, err == nil, "Could not list source files")
+	fileSet := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		parsed, err := parser.ParseFile(fileSet, file, nil, 0)
+		test.Assert(t, err == nil, "Could not parse "+file)
+		ast.Inspect(parsed, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if function := types.ExprString(call.Fun); function != "bytes.Equal" {
+				return true
+			}
+			for _, arg := range call.Args {
+				if expression := strings.ToLower(types.ExprString(arg)); strings.Contains(expression, "pin") || strings.Contains(expression, "auth") {
+					t.Errorf("%s: bytes.Equal compares secret %s", fileSet.Position(call.Pos()), types.ExprString(arg))
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestPINHashOffByOneByte(t *testing.T) {
+	client := newPINDummyCTAPClient("1234")
+	server := NewCTAPServer(client)
+	getPINTokenWithHash := func(pinHash []byte) ctapStatusCode {
+		keyAgreement, sharedSecret := platformKeyAgreement(client)
+		args := clientPINArgs{
+			PINUVAuthProtocol: 1,
+			SubCommand:        clientPinSubcommandGetPINToken,
+			KeyAgreement:      keyAgreement,
+			PINHashEncoding:   crypto.EncryptAESCBC(sharedSecret, pinHash),
+		}
+		return ctapStatusCode(server.HandleMessage(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))[0])
+	}
+	for _, index := range []int{0, 15} {
+		pinHash := hashPIN([]byte("1234"))
+		pinHash[index] ^= 0x01
+		test.AssertEqual(t, getPINTokenWithHash(pinHash), ctap2ErrPINInvalid, "PIN hash wrong in one byte accepted")
+	}
+	test.AssertEqual(t, getPINTokenWithHash(hashPIN([]byte("1234"))), ctap1ErrSuccess, "Correct PIN hash rejected")
+
+	test.Assert(t, secretsEqual([]byte{1, 2, 3}, []byte{1, 2, 3}), "Equal secrets differ")
+	test.Assert(t, !secretsEqual([]byte{1, 2, 3}, []byte{1, 2, 4}), "Different secrets are equal")
+	test.Assert(t, !secretsEqual([]byte{1, 2, 3}, []byte{1, 2}), "Secrets of different lengths are equal")
+}
@@ -0,0 +1,129 @@
+package ctap
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Values from the TPM 2.0 Library specification, Part 2: Structures
+const (
+	tpmAttributeFixedTPM            uint32 = 1 << 1
+	tpmAttributeFixedParent         uint32 = 1 << 4
+	tpmAttributeSensitiveDataOrigin uint32 = 1 << 5
+	tpmAttributeUserWithAuth        uint32 = 1 << 6
+	tpmAttributeNoDA                uint32 = 1 << 10
+	tpmAttributeSign                uint32 = 1 << 18
+)
+
+const (
+	tpmGeneratedValue   uint32 = 0xff544347
+	tpmSTAttestCertify  uint16 = 0x8017
+	tpmAlgECC           uint16 = 0x0023
+	tpmAlgSHA256        uint16 = 0x000B
+	tpmAlgNull          uint16 = 0x0010
+	tpmECCNISTP256      uint16 = 0x0003
+	tpmObjectAttributes uint32 = tpmAttributeFixedTPM | tpmAttributeFixedParent | tpmAttributeSensitiveDataOrigin |
+		tpmAttributeUserWithAuth | tpmAttributeNoDA | tpmAttributeSign
+)
+
+const tpmAttestationFormat = "tpm"
+
+type tpmAttestationStatement struct {
+	Ver      string               `cbor:"ver"`
+	Alg      cose.COSEAlgorithmID `cbor:"alg"`
+	X5c      [][]byte             `cbor:"x5c"`
+	Sig      []byte               `cbor:"sig"`
+	CertInfo []byte               `cbor:"certInfo"`
+	PubArea  []byte               `cbor:"pubArea"`
+}
+
+// SetTPMAttestation makes makeCredential use the tpm attestation format, certifying
+// credentials with the given attestation identity key. x5c is the AIK certificate followed
+// by any intermediates, see identities.CreateTPMAIKCertificate. Only P-256 AIKs and
+// credentials are supported, other credentials still get packed attestation.
+func (server *CTAPServer) SetTPMAttestation(aik *cose.SupportedCOSEPrivateKey, x5c [][]byte) {
+	util.Assert(aik == nil || (aik.ECDSA != nil && aik.ECDSA.Curve == elliptic.P256()), "TPM AIK must be a P-256 key")
+	util.Assert(aik == nil || len(x5c) > 0, "TPM attestation needs an AIK certificate")
+	server.tpmAIK = aik
+	server.tpmAIKCertificates = x5c
+}
+
+// tpm2b encodes a TPM2B_ structure: a 16-bit size followed by that many bytes
+func tpm2b(data []byte) []byte {
+	return util.Concat(util.ToBE(uint16(len(data))), data)
+}
+
+// tpmName is the TPM name of an object: its name algorithm followed by the digest of its
+// public area
+func tpmName(publicArea []byte) []byte {
+	digest := sha256.Sum256(publicArea)
+	return util.Concat(util.ToBE(tpmAlgSHA256), digest[:])
+}
+
+// tpmPublicArea builds the TPMT_PUBLIC describing a credential key as a TPM signing key,
+// or returns nil if the key can't be represented
+func tpmPublicArea(key *cose.SupportedCOSEPublicKey) []byte {
+	if key.ECDSA == nil || key.ECDSA.Curve != elliptic.P256() {
+		return nil
+	}
+	return util.Concat(
+		util.ToBE(tpmAlgECC),
+		util.ToBE(tpmAlgSHA256),
+		util.ToBE(tpmObjectAttributes),
+		tpm2b(nil), // authPolicy
+		// TPMS_ECC_PARMS: no symmetric algorithm, scheme or KDF restrictions
+		util.ToBE(tpmAlgNull),
+		util.ToBE(tpmAlgNull),
+		util.ToBE(tpmECCNISTP256),
+		util.ToBE(tpmAlgNull),
+		// TPMS_ECC_POINT
+		tpm2b(key.ECDSA.X.FillBytes(make([]byte, 32))),
+		tpm2b(key.ECDSA.Y.FillBytes(make([]byte, 32))),
+	)
+}
+
+// tpmCertifyInfo builds the TPMS_ATTEST a TPM2_Certify of the credential key would return,
+// with extraData binding it to this makeCredential
+func tpmCertifyInfo(aik *cose.SupportedCOSEPrivateKey, publicArea []byte, extraData []byte) []byte {
+	aikPublicArea := tpmPublicArea(aik.Public())
+	return util.Concat(
+		util.ToBE(tpmGeneratedValue),
+		util.ToBE(tpmSTAttestCertify),
+		tpm2b(tpmName(aikPublicArea)), // qualifiedSigner
+		tpm2b(extraData),
+		// TPMS_CLOCK_INFO: clock, resetCount, restartCount and safe
+		util.ToBE(uint64(0)),
+		util.ToBE(uint32(0)),
+		util.ToBE(uint32(0)),
+		[]byte{1},
+		util.ToBE(uint64(0)), // firmwareVersion
+		// TPMS_CERTIFY_INFO: the credential key is a primary object, so its qualified name
+		// is its name
+		tpm2b(tpmName(publicArea)),
+		tpm2b(tpmName(publicArea)),
+	)
+}
+
+// tpmAttestationStatement certifies the credential with the AIK, or returns nil if the
+// credential key can't be described as a TPM key
+func (server *CTAPServer) tpmAttestationStatement(credentialSource *identities.CredentialSource, authenticatorData []byte, clientDataHash []byte) *tpmAttestationStatement {
+	publicArea := tpmPublicArea(credentialSource.PrivateKey.Public())
+	if publicArea == nil {
+		return nil
+	}
+	// ES256 signatures hash with SHA-256, so extraData is the SHA-256 of attToBeSigned
+	extraData := sha256.Sum256(util.Concat(authenticatorData, clientDataHash))
+	certInfo := tpmCertifyInfo(server.tpmAIK, publicArea, extraData[:])
+	return &tpmAttestationStatement{
+		Ver:      "2.0",
+		Alg:      cose.COSE_ALGORITHM_ID_ES256,
+		X5c:      server.tpmAIKCertificates,
+		Sig:      server.tpmAIK.Sign(certInfo),
+		CertInfo: certInfo,
+		PubArea:  publicArea,
+	}
+}
@@ -0,0 +1,95 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func tpmMakeCredential(t *testing.T, server *CTAPServer, algorithm cose.COSEAlgorithmID) makeCredentialResponse {
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte("tpm")),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: algorithm}},
+	}
+	responseBytes := server.HandleMessage(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "makeCredential failed")
+	var response makeCredentialResponse
+	util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode makeCredential response")
+	return response
+}
+
+func TestTPMAttestationStructure(t *testing.T) {
+	client := &dummyCTAPClient{}
+	server := NewCTAPServer(client)
+	caKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA key")
+	ca, err := identities.CreateSelfSignedCA(caKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	aik, _ := identities.CreateCAPrivateKey()
+	aikCertificate, err := identities.CreateTPMAIKCertificate(ca, caKey, aik)
+	test.Assert(t, err == nil, "Could not create AIK certificate")
+	server.SetTPMAttestation(aik, [][]byte{aikCertificate.Raw})
+
+	response := tpmMakeCredential(t, server, cose.COSE_ALGORITHM_ID_ES256)
+	test.AssertEqual(t, response.FormatIdentifer, "tpm", "Wrong attestation format")
+	var statement tpmAttestationStatement
+	util.CheckErr(decodeExtensionInput(response.AttestationStatement, &statement), "Could not decode tpm statement")
+	test.AssertEqual(t, statement.Ver, "2.0", "Wrong TPM version")
+	test.AssertEqual(t, statement.Alg, cose.COSE_ALGORITHM_ID_ES256, "Wrong attestation algorithm")
+	test.Assert(t, len(statement.X5c) == 1 && bytes.Equal(statement.X5c[0], aikCertificate.Raw), "AIK certificate not included")
+
+	// TPMT_PUBLIC for the credential key
+	authData, err := ParseAuthenticatorData(response.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	credentialKey, err := cose.UnmarshalCOSEPublicKey(authData.AttestedCredentialData.CredentialPublicKey)
+	test.Assert(t, err == nil, "Could not decode credential key")
+	pubArea := bytes.NewBuffer(statement.PubArea)
+	test.AssertEqual(t, util.ReadBE[uint16](pubArea), tpmAlgECC, "pubArea is not an ECC key")
+	test.AssertEqual(t, util.ReadBE[uint16](pubArea), tpmAlgSHA256, "pubArea name algorithm is not SHA-256")
+	attributes := util.ReadBE[uint32](pubArea)
+	test.Assert(t, attributes&tpmAttributeSign != 0 && attributes&tpmAttributeFixedTPM != 0, "pubArea is not a fixed signing key")
+	test.AssertEqual(t, util.ReadBE[uint16](pubArea), uint16(0), "pubArea has an auth policy")
+	test.AssertArrEqual(t, util.Read(pubArea, 8), util.Concat(util.ToBE(tpmAlgNull), util.ToBE(tpmAlgNull), util.ToBE(tpmECCNISTP256), util.ToBE(tpmAlgNull)), "Wrong ECC parameters")
+	test.AssertEqual(t, util.ReadBE[uint16](pubArea), uint16(32), "Wrong X length")
+	test.AssertArrEqual(t, util.Read(pubArea, 32), credentialKey.ECDSA.X.FillBytes(make([]byte, 32)), "pubArea X does not match credential")
+	test.AssertEqual(t, util.ReadBE[uint16](pubArea), uint16(32), "Wrong Y length")
+	test.AssertArrEqual(t, util.Read(pubArea, 32), credentialKey.ECDSA.Y.FillBytes(make([]byte, 32)), "pubArea Y does not match credential")
+	test.AssertEqual(t, pubArea.Len(), 0, "Trailing bytes in pubArea")
+
+	// TPMS_ATTEST certifying that key
+	certInfo := bytes.NewBuffer(statement.CertInfo)
+	test.AssertEqual(t, util.ReadBE[uint32](certInfo), tpmGeneratedValue, "Wrong magic")
+	test.AssertEqual(t, util.ReadBE[uint16](certInfo), tpmSTAttestCertify, "Wrong attestation type")
+	util.Read(certInfo, uint(util.ReadBE[uint16](certInfo)))
+	extraData := util.Read(certInfo, uint(util.ReadBE[uint16](certInfo)))
+	attToBeSigned := sha256.Sum256(util.Concat(response.AuthData, crypto.HashSHA256([]byte("tpm"))))
+	test.AssertArrEqual(t, extraData, attToBeSigned[:], "extraData is not the hash of attToBeSigned")
+	util.Read(certInfo, 17+8)
+	pubAreaDigest := sha256.Sum256(statement.PubArea)
+	test.AssertArrEqual(t, util.Read(certInfo, uint(util.ReadBE[uint16](certInfo))), util.Concat(util.ToBE(tpmAlgSHA256), pubAreaDigest[:]), "certInfo does not name pubArea")
+	util.Read(certInfo, uint(util.ReadBE[uint16](certInfo)))
+	test.AssertEqual(t, certInfo.Len(), 0, "Trailing bytes in certInfo")
+	test.Assert(t, aik.Public().Verify(statement.CertInfo, statement.Sig), "certInfo not signed by the AIK")
+}
+
+func TestTPMAttestationSkipsEd25519(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	aik, _ := identities.CreateCAPrivateKey()
+	server.SetTPMAttestation(aik, [][]byte{{0}})
+	vault := identities.NewIdentityVault()
+	source := vault.NewIdentityWithAlgorithm(cose.COSE_ALGORITHM_ID_ED25519,
+		&webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "Alice"})
+	test.Assert(t, server.tpmAttestationStatement(source, []byte{}, []byte{}) == nil, "Ed25519 credential got a tpm attestation")
+}
@@ -0,0 +1,54 @@
+package ctap
+
+import (
+	"sort"
+)
+
+const (
+	configSubcommandVendorPrototype configSubcommand = 0xFF
+	// The subCommandParams key carrying the vendor's own command ID
+	vendorConfigParamCommandID uint64 = 0x01
+)
+
+// VendorConfigHandler runs a vendorPrototype authenticatorConfig command with its
+// subCommandParams, which include the vendorCommandId, and returns the status code
+type VendorConfigHandler func(params map[uint64]interface{}) byte
+
+// RegisterVendorConfigCommand handles the vendorPrototype authenticatorConfig subcommand
+// for the given vendorCommandId, for emulating proprietary features of specific devices.
+// The ID is listed in getInfo as a vendorPrototypeConfigCommand. A nil handler removes it.
+func (server *CTAPServer) RegisterVendorConfigCommand(vendorCommandID uint64, handler VendorConfigHandler) {
+	if handler == nil {
+		delete(server.vendorConfigCommands, vendorCommandID)
+		return
+	}
+	if server.vendorConfigCommands == nil {
+		server.vendorConfigCommands = make(map[uint64]VendorConfigHandler)
+	}
+	server.vendorConfigCommands[vendorCommandID] = handler
+}
+
+func (server *CTAPServer) vendorConfigCommandIDs() []uint64 {
+	ids := make([]uint64, 0, len(server.vendorConfigCommands))
+	for id := range server.vendorConfigCommands {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (server *CTAPServer) handleVendorConfig(params map[uint64]interface{}) error {
+	rawID, ok := params[vendorConfigParamCommandID]
+	if !ok {
+		return statusError(ctap2ErrMissingParam)
+	}
+	vendorCommandID, ok := rawID.(uint64)
+	if !ok {
+		return statusError(ctap1ErrInvalidParameter)
+	}
+	handler, ok := server.vendorConfigCommands[vendorCommandID]
+	if !ok {
+		return statusError(ctap2ErrUnsupportedOption)
+	}
+	return statusError(ctapStatusCode(handler(params)))
+}
@@ -0,0 +1,50 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func vendorConfig(server *CTAPServer, params map[uint64]interface{}) ctapStatusCode {
+	args := configArgs{SubCommand: configSubcommandVendorPrototype, SubCommandParams: params}
+	response := server.HandleMessage(util.Concat([]byte{byte(ctapCommandConfig)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(response[0])
+}
+
+func TestVendorConfigCommand(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	var received map[uint64]interface{}
+	server.RegisterVendorConfigCommand(0x1234, func(params map[uint64]interface{}) byte {
+		received = params
+		return byte(ctap1ErrSuccess)
+	})
+
+	var info getInfoResponse
+	infoBytes := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	util.CheckErr(cbor.Unmarshal(infoBytes[1:], &info), "Could not decode getInfo")
+	test.AssertArrEqual(t, info.VendorConfigCommands, []uint64{0x1234}, "Vendor command not listed in getInfo")
+
+	status := vendorConfig(server, map[uint64]interface{}{vendorConfigParamCommandID: uint64(0x1234), 2: "enable-feature"})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Vendor command failed")
+	test.Assert(t, received != nil, "Vendor handler not called")
+	test.Assert(t, received[vendorConfigParamCommandID] == uint64(0x1234), "vendorCommandId not passed to handler")
+	test.Assert(t, received[2] == "enable-feature", "Parameters not passed to handler")
+}
+
+func TestUnregisteredVendorConfigCommand(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	server.RegisterVendorConfigCommand(0x1234, func(params map[uint64]interface{}) byte {
+		return byte(ctap1ErrSuccess)
+	})
+	status := vendorConfig(server, map[uint64]interface{}{vendorConfigParamCommandID: uint64(0x5678)})
+	test.AssertEqual(t, status, ctap2ErrUnsupportedOption, "Unregistered vendor command accepted")
+	status = vendorConfig(server, map[uint64]interface{}{})
+	test.AssertEqual(t, status, ctap2ErrMissingParam, "Vendor command without an ID accepted")
+
+	server.RegisterVendorConfigCommand(0x1234, nil)
+	status = vendorConfig(server, map[uint64]interface{}{vendorConfigParamCommandID: uint64(0x1234)})
+	test.AssertEqual(t, status, ctap2ErrUnsupportedOption, "Removed vendor command still handled")
+}
@@ -0,0 +1,38 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// getInfo keys from here up are left to vendors, well clear of the standard fields
+const minVendorInfoKey = 0x40
+
+// SetVendorInfoField adds a vendor-specific field to the getInfo response, such as a
+// firmware string, to emulate the extra fields of specific devices. Keys below 0x40 are
+// reserved for standard fields. A nil value removes the field.
+func (server *CTAPServer) SetVendorInfoField(key uint64, value interface{}) {
+	util.Assert(key >= minVendorInfoKey, "getInfo vendor fields must not use standard keys")
+	if value == nil {
+		delete(server.vendorInfoFields, key)
+		return
+	}
+	if server.vendorInfoFields == nil {
+		server.vendorInfoFields = make(map[uint64]interface{})
+	}
+	server.vendorInfoFields[key] = value
+}
+
+// encodeGetInfo encodes the getInfo response along with any vendor fields
+func (server *CTAPServer) encodeGetInfo() []byte {
+	encoded := util.MarshalCBOR(server.getInfo())
+	if len(server.vendorInfoFields) == 0 {
+		return encoded
+	}
+	fields := map[uint64]cbor.RawMessage{}
+	util.CheckErr(cbor.Unmarshal(encoded, &fields), "Could not decode getInfo response")
+	for key, value := range server.vendorInfoFields {
+		fields[key] = util.MarshalCBOR(value)
+	}
+	return util.MarshalCBOR(fields)
+}
@@ -0,0 +1,36 @@
+package ctap
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestVendorInfoField(t *testing.T) {
+	server := NewCTAPServer(&dummyCTAPClient{})
+	standard := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	server.SetVendorInfoField(0x60, "firmware 1.2.3")
+
+	response := server.HandleMessage([]byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "getInfo failed")
+	fields := map[uint64]interface{}{}
+	util.CheckErr(cbor.Unmarshal(response[1:], &fields), "Could not decode getInfo")
+	test.Assert(t, fields[0x60] == "firmware 1.2.3", "Vendor field missing from getInfo")
+
+	var info, standardInfo getInfoResponse
+	util.CheckErr(cbor.Unmarshal(response[1:], &info), "Could not decode getInfo")
+	util.CheckErr(cbor.Unmarshal(standard[1:], &standardInfo), "Could not decode getInfo")
+	test.AssertArrEqual(t, util.MarshalCBOR(info), util.MarshalCBOR(standardInfo), "Vendor field changed the standard fields")
+
+	server.SetVendorInfoField(0x60, nil)
+	test.AssertArrEqual(t, server.HandleMessage([]byte{byte(ctapCommandGetInfo)}), standard, "Removed vendor field still in getInfo")
+}
+
+func TestVendorInfoFieldRejectsStandardKeys(t *testing.T) {
+	defer func() {
+		test.Assert(t, recover() != nil, "Vendor field with a standard key accepted")
+	}()
+	NewCTAPServer(&dummyCTAPClient{}).SetVendorInfoField(0x04, true)
+}
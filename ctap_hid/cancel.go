@@ -0,0 +1,78 @@
+package ctap_hid
+
+import "sync"
+
+// CTAP2_ERR_KEEPALIVE_CANCEL, the CBOR status of a request the host cancelled
+const ctap2ErrKeepaliveCancel byte = 0x2D
+
+// processingState tracks the CBOR request a channel is handling. The channel's message lock
+// is held until the request returns, which can be as long as the user takes to approve it,
+// so CANCEL checks this state instead of waiting for the lock.
+type processingState struct {
+	lock      sync.Mutex
+	active    bool
+	cancelled bool
+}
+
+func (state *processingState) start() {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.active = true
+	state.cancelled = false
+}
+
+// finish ends the request, reporting whether it was cancelled, in which case the host has
+// already been answered
+func (state *processingState) finish() bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.active = false
+	return state.cancelled
+}
+
+// cancel marks the request as cancelled and calls respond, or returns false if no request
+// is being handled
+func (state *processingState) cancel(respond func()) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if !state.active || state.cancelled {
+		return false
+	}
+	state.cancelled = true
+	respond()
+	return true
+}
+
+func (state *processingState) isCancelled() bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.cancelled
+}
+
+// unlessCancelled calls f if the request hasn't been cancelled, so keepalives never follow
+// the response to a cancelled request
+func (state *processingState) unlessCancelled(f func()) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if !state.cancelled {
+		f()
+	}
+}
+
+func isCancelPacket(message []byte) bool {
+	return len(message) > 4 && ctapHIDCommand(message[4]) == ctapHIDCommandCancel
+}
+
+// cancelProcessing aborts the CBOR request being handled on the channel, if any, answering
+// it with KEEPALIVE_CANCEL at once. A CTAPHIDCancellableClient stops the request before it
+// changes any state; other CTAP servers still finish it, and their response is dropped.
+func (channel *ctapHIDChannel) cancelProcessing() bool {
+	cancelled := channel.processing.cancel(func() {
+		ctapHIDLogger.Printf("CTAPHID: CANCEL received while handling CBOR on channel %d\n\n", channel.channelId)
+		channel.server.sendResponse(channel.channelId, ctapHIDCommandCBOR, []byte{ctap2ErrKeepaliveCancel})
+	})
+	if cancelled && channel.server.cancelHandler != nil {
+		channel.server.cancelHandler(uint32(channel.channelId), uint8(ctapHIDCommandCBOR))
+	}
+	return cancelled
+}
@@ -12,6 +12,9 @@ type ctapHIDChannel struct {
 	channelId   ctapHIDChannelID
 	messageLock sync.Locker
 	transaction *ctapHIDTransaction
+	stats       channelStats
+	reassembly  reassemblyState
+	processing  processingState
 }
 
 func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapHIDChannel {
@@ -24,18 +27,40 @@ func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapH
 }
 
 func (channel *ctapHIDChannel) handleMessage(message []byte) {
+	if isCancelPacket(message) && channel.cancelProcessing() {
+		return
+	}
 	channel.messageLock.Lock()
 	defer channel.messageLock.Unlock()
+	if channel.transaction != nil && isInitPacket(message) {
+		// An INIT on a channel aborts any pending transaction so the host can resync
+		ctapHIDLogger.Printf("CTAPHID: INIT received during transaction on channel %d, aborting transaction\n\n", channel.channelId)
+		channel.transaction = nil
+	}
+	if channel.transaction != nil && isCommandPacket(message) && ctapHIDCommand(message[4]) != ctapHIDCommandCancel {
+		// Channels are serial: a new command before the pending one is reassembled is refused
+		// without touching the pending transaction, so its continuation packets still apply
+		ctapHIDLogger.Printf("CTAPHID: Command 0x%x received during transaction on channel %d, channel busy\n\n", message[4], channel.channelId)
+		channel.server.sendError(channel.channelId, ctapHIDErrorChannelBusy)
+		return
+	}
+	inFlight := false
+	var inFlightCommand ctapHIDCommand
 	if channel.transaction == nil {
 		channel.transaction = newCTAPHIDTransaction(message)
 	} else {
+		inFlight = true
+		inFlightCommand = channel.transaction.result.header.Command
 		channel.transaction.addMessage(message)
 	}
+	channel.reassembly.update(channel.transaction)
 	if channel.transaction.done {
-		if channel.transaction.errorCode != 0 {
-			channel.server.sendError(channel.channelId, channel.transaction.errorCode)
+		if channel.transaction.err != nil {
+			channel.server.sendHIDError(channel.channelId, channel.transaction.err)
 		} else if !channel.transaction.cancelled {
 			channel.handleFinalizedMessage(channel.transaction.result.header, channel.transaction.result.payload)
+		} else if inFlight && channel.server.cancelHandler != nil {
+			channel.server.cancelHandler(uint32(channel.channelId), uint8(inFlightCommand))
 		}
 		channel.transaction = nil
 	}
@@ -43,6 +68,12 @@ func (channel *ctapHIDChannel) handleMessage(message []byte) {
 
 func (channel *ctapHIDChannel) handleFinalizedMessage(header ctapHIDMessageHeader, payload []byte) {
 	ctapHIDLogger.Printf("CTAPHID FINALIZED MESSAGE: %s %#v\n\n", header, payload)
+	channel.stats.record(header.Command)
+	if header.Command != ctapHIDCommandInit && channel.server.isPaused() {
+		ctapHIDLogger.Printf("CTAPHID: Device is paused, rejecting %s\n\n", header)
+		channel.server.sendError(header.ChannelID, ctapHIDErrorChannelBusy)
+		return
+	}
 	if channel.channelId == ctapHIDBroadcastChannel {
 		channel.handleBroadcastMessage(header, payload)
 	} else {
@@ -60,23 +91,50 @@ type ctapHIDInitResponse struct {
 	CapabilitiesFlags  ctapHIDCapabilityFlag
 }
 
+func isInitPacket(message []byte) bool {
+	return len(message) > 4 && ctapHIDCommand(message[4]) == ctapHIDCommandInit
+}
+
+// isCommandPacket reports whether message starts a new command rather than continuing one
+func isCommandPacket(message []byte) bool {
+	return len(message) > 4 && message[4]&(1<<7) != 0
+}
+
+// sendInitResponse answers an INIT on responseChannel, telling the host to use channelId from now on
+func (channel *ctapHIDChannel) sendInitResponse(responseChannel ctapHIDChannelID, channelId ctapHIDChannelID, nonce []byte) {
+	response := ctapHIDInitResponse{
+		NewChannelID:       channelId,
+		ProtocolVersion:    2,
+		DeviceVersionMajor: 0,
+		DeviceVersionMinor: 0,
+		DeviceVersionBuild: 1,
+		CapabilitiesFlags:  channel.server.capabilities(),
+	}
+	copy(response.Nonce[:], nonce)
+	ctapHIDLogger.Printf("CTAPHID INIT RESPONSE: %#v\n\n", response)
+	channel.server.sendResponse(responseChannel, ctapHIDCommandInit, util.ToLE(response))
+}
+
 func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeader, payload []byte) {
 	switch header.Command {
 	case ctapHIDCommandInit:
+		if len(payload) != 8 {
+			channel.server.sendError(ctapHIDBroadcastChannel, ctapHIDErrorInvalidLength)
+			return
+		}
+		if !channel.server.initLimiter.allow() {
+			channel.server.sendError(ctapHIDBroadcastChannel, ctapHIDErrorChannelBusy)
+			return
+		}
+		// Broadcast INIT allocates a new channel, but the response still goes out on broadcast
 		newChannel := channel.server.newChannel()
-		nonce := payload[:8]
-		response := ctapHIDInitResponse{
-			NewChannelID:       newChannel.channelId,
-			ProtocolVersion:    2,
-			DeviceVersionMajor: 0,
-			DeviceVersionMinor: 0,
-			DeviceVersionBuild: 1,
-			CapabilitiesFlags:  ctapHIDCapabilityCBOR,
+		if newChannel == nil {
+			channel.server.sendError(ctapHIDBroadcastChannel, ctapHIDErrorChannelBusy)
+			return
 		}
-		copy(response.Nonce[:], nonce)
-		ctapHIDLogger.Printf("CTAPHID INIT RESPONSE: %#v\n\n", response)
-		channel.server.sendResponse(ctapHIDBroadcastChannel, ctapHIDCommandInit, util.ToLE(response))
+		channel.sendInitResponse(ctapHIDBroadcastChannel, newChannel.channelId, payload)
 	case ctapHIDCommandPing:
+		// PING is a transport echo: it never reaches the CTAP or U2F servers, so it never waits for user presence
 		channel.server.sendResponse(ctapHIDBroadcastChannel, ctapHIDCommandPing, payload)
 	default:
 		util.Panic(fmt.Sprintf("Invalid CTAPHID Broadcast command: %#v", header))
@@ -86,17 +144,59 @@ func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeade
 func (channel *ctapHIDChannel) handleDataMessage(header ctapHIDMessageHeader, payload []byte) {
 	switch header.Command {
 	case ctapHIDCommandMsg:
+		if channel.server.u2fServer == nil {
+			channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidCommand)
+			return
+		}
 		responsePayload := channel.server.u2fServer.HandleMessage(payload)
+		channel.server.simulateResponseDelay()
 		ctapHIDLogger.Printf("CTAPHID MSG RESPONSE: %d %#v\n\n", len(responsePayload), responsePayload)
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandMsg, responsePayload)
 	case ctapHIDCommandCBOR:
-		stop := util.StartRecurringFunction(keepConnectionAlive(channel.server, channel.channelId, ctapHIDStatusUpneeded), 50)
-		responsePayload := channel.server.ctapServer.HandleMessage(payload)
+		if channel.server.ctapServer == nil {
+			channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidCommand)
+			return
+		}
+		if !channel.server.cborLimiter.acquire() {
+			ctapHIDLogger.Printf("CTAPHID ERROR: Too many CBOR commands in flight\n\n")
+			channel.server.sendError(header.ChannelID, ctapHIDErrorChannelBusy)
+			return
+		}
+		defer channel.server.cborLimiter.release()
+		channel.processing.start()
+		keepAlive := keepConnectionAlive(channel.server, channel.channelId, ctapHIDStatusUpneeded)
+		stop := util.StartRecurringFunction(func() { channel.processing.unlessCancelled(keepAlive) }, 50)
+		var responsePayload []byte
+		if cancellable, ok := channel.server.ctapServer.(CTAPHIDCancellableClient); ok {
+			responsePayload = cancellable.HandleCancellableMessage(payload, channel.processing.isCancelled)
+		} else {
+			responsePayload = channel.server.ctapServer.HandleMessage(payload)
+		}
+		channel.server.simulateResponseDelay()
 		stop <- 0
+		if channel.processing.finish() {
+			ctapHIDLogger.Printf("CTAPHID: Dropping the response to a cancelled CBOR request\n\n")
+			return
+		}
 		ctapHIDLogger.Printf("CTAPHID CBOR RESPONSE: %#v\n\n", responsePayload)
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandCBOR, responsePayload)
 	case ctapHIDCommandPing:
+		// Answered even while a CBOR or MSG request on another channel waits for user presence
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandPing, payload)
+	case ctapHIDCommandWink:
+		if channel.server.winkHandler == nil {
+			channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidCommand)
+			return
+		}
+		channel.server.winkHandler()
+		channel.server.sendResponse(header.ChannelID, ctapHIDCommandWink, []byte{})
+	case ctapHIDCommandInit:
+		if len(payload) != 8 {
+			channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidLength)
+			return
+		}
+		// INIT on an allocated channel is a resync: keep the channel and respond on it
+		channel.sendInitResponse(channel.channelId, channel.channelId, payload)
 	default:
 		panic(fmt.Sprintf("Invalid CTAPHID Channel command: %s", header))
 	}
@@ -2,48 +2,182 @@ package ctap_hid
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
 var ctapHIDLogger = util.NewLogger("[CTAPHID] ", util.LogLevelDebug)
 
+const (
+	defaultInitRateLimit = 100
+	defaultInitBurst     = 100
+)
+
 type CTAPHIDClient interface {
 	HandleMessage(data []byte) []byte
 }
 
+// CTAPHIDCancellableClient is a CBOR handler that can abandon a request once the host
+// cancels it, so the request has no side effects after the host stopped waiting
+type CTAPHIDCancellableClient interface {
+	HandleCancellableMessage(data []byte, cancelled func() bool) []byte
+}
+
 type CTAPHIDServer struct {
 	ctapServer      CTAPHIDClient
 	u2fServer       CTAPHIDClient
 	maxChannelID    ctapHIDChannelID
 	channels        map[ctapHIDChannelID]*ctapHIDChannel
+	channelsLock    sync.Locker
+	initLimiter     *rateLimiter
+	cborLimiter     *transactionLimiter
 	responsesLock   sync.Locker
 	responseHandler func(response []byte)
+	winkHandler     func()
+	cancelHandler   func(channelID uint32, command uint8)
+	minDelay        time.Duration
+	maxDelay        time.Duration
+	packetLog       io.Writer
+	packetLogLock   sync.Locker
+	paused          bool
+	pausedLock      sync.Locker
+	nextChannelID   func() ctapHIDChannelID
+	packetSize      int
 }
 
+// NewCTAPHIDServer creates a server passing CBOR messages to ctapServer and raw MSG messages to
+// u2fServer. A nil u2fServer makes a CBOR-only device that advertises NMSG and rejects MSG,
+// and a nil ctapServer makes a U2F-only device that doesn't advertise CBOR and rejects it.
 func NewCTAPHIDServer(ctapServer CTAPHIDClient, u2fServer CTAPHIDClient) *CTAPHIDServer {
 	server := &CTAPHIDServer{
 		ctapServer:      ctapServer,
 		u2fServer:       u2fServer,
 		maxChannelID:    0,
 		channels:        make(map[ctapHIDChannelID]*ctapHIDChannel),
+		channelsLock:    &sync.Mutex{},
+		initLimiter:     newRateLimiter(defaultInitRateLimit, defaultInitBurst),
+		cborLimiter:     &transactionLimiter{},
 		responsesLock:   &sync.Mutex{},
 		responseHandler: nil,
+		packetLog:       nil,
+		packetLogLock:   &sync.Mutex{},
+		pausedLock:      &sync.Mutex{},
+		packetSize:      ctapHIDMaxPacketSize,
 	}
 	server.channels[ctapHIDBroadcastChannel] = newCTAPHIDChannel(server, ctapHIDBroadcastChannel)
 	return server
 }
 
+func (server *CTAPHIDServer) capabilities() ctapHIDCapabilityFlag {
+	capabilities := ctapHIDCapabilityFlag(0)
+	if server.ctapServer != nil {
+		capabilities |= ctapHIDCapabilityCBOR
+	}
+	if server.u2fServer == nil {
+		capabilities |= ctapHIDCapabilityNoMsg
+	}
+	if server.winkHandler != nil {
+		capabilities |= ctapHIDCapabilityWink
+	}
+	return capabilities
+}
+
 func (server *CTAPHIDServer) SetResponseHandler(handler func(response []byte)) {
 	server.responseHandler = handler
 }
 
+// SetWinkHandler calls handler when the host sends WINK, asking the device to identify
+// itself to the user. WINK is only advertised, and only accepted, while a handler is set.
+func (server *CTAPHIDServer) SetWinkHandler(handler func()) {
+	server.winkHandler = handler
+}
+
+// SetCancelHandler calls handler when a CANCEL aborts a transaction that was still being
+// received, or a CBOR request waiting for the user, with the channel it was on and its
+// CTAPHID command (e.g. 0x90 for CBOR), so embedders can clean up any UI for it. A CANCEL
+// with nothing in flight is not reported.
+func (server *CTAPHIDServer) SetCancelHandler(handler func(channelID uint32, command uint8)) {
+	server.cancelHandler = handler
+}
+
+// Pause makes the device temporarily unavailable, as if it were busy on another interface:
+// every command except INIT fails with CHANNEL_BUSY until Resume is called.
+func (server *CTAPHIDServer) Pause() {
+	server.pausedLock.Lock()
+	defer server.pausedLock.Unlock()
+	server.paused = true
+}
+
+// Resume undoes Pause, so commands are processed normally again
+func (server *CTAPHIDServer) Resume() {
+	server.pausedLock.Lock()
+	defer server.pausedLock.Unlock()
+	server.paused = false
+}
+
+func (server *CTAPHIDServer) isPaused() bool {
+	server.pausedLock.Lock()
+	defer server.pausedLock.Unlock()
+	return server.paused
+}
+
+// SetInitRateLimit limits how many channels broadcast INITs may allocate per second, with
+// up to burst allocations at once. INITs over the limit fail with CHANNEL_BUSY. A zero
+// rate disables the limit.
+func (server *CTAPHIDServer) SetInitRateLimit(perSecond int, burst int) {
+	server.initLimiter.setRate(perSecond, burst)
+}
+
+// SetMaxConcurrentCBOR limits how many CBOR commands may execute at once across all
+// channels. Each one can be waiting on user presence, so commands over the limit fail
+// immediately with CHANNEL_BUSY. A zero limit, the default, disables the cap.
+func (server *CTAPHIDServer) SetMaxConcurrentCBOR(limit int) {
+	util.Assert(limit >= 0, "Concurrent CBOR limit can't be negative")
+	server.cborLimiter.setLimit(limit)
+}
+
+// SetPacketSize sets the packet size responses are fragmented to, for transports other than
+// USB HID whose MTU isn't 64 bytes. It should be set before any messages are handled.
+func (server *CTAPHIDServer) SetPacketSize(size int) {
+	util.Assert(size > ctapHIDInitHeaderSize, "Packet size must leave room for a payload")
+	server.packetSize = size
+}
+
+// SetPacketLog writes a hexdump of every raw packet received and sent to out. Passing nil
+// turns packet logging off, which is the default.
+func (server *CTAPHIDServer) SetPacketLog(out io.Writer) {
+	server.packetLogLock.Lock()
+	defer server.packetLogLock.Unlock()
+	server.packetLog = out
+}
+
+func (server *CTAPHIDServer) logPacket(direction string, packet []byte) {
+	server.packetLogLock.Lock()
+	defer server.packetLogLock.Unlock()
+	if server.packetLog == nil {
+		return
+	}
+	channelId := ctapHIDChannelID(0)
+	if len(packet) >= 4 {
+		channelId = util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(packet))
+	}
+	fmt.Fprintf(server.packetLog, "%s channel 0x%08x (%d bytes)\n%s", direction, channelId, len(packet), hex.Dump(packet))
+}
+
 func (server *CTAPHIDServer) sendResponsePackets(packets [][]byte) {
 	// Packets should be sequential and continuous per transaction
 	server.responsesLock.Lock()
 	defer server.responsesLock.Unlock()
 	// ctapHIDLogger.Printf("ADDING MESSAGE: %#v\n\n", response)
+	for _, packet := range packets {
+		server.logPacket("OUT", packet)
+	}
 	if server.responseHandler != nil {
 		for _, packet := range packets {
 			server.responseHandler(packet)
@@ -52,9 +186,20 @@ func (server *CTAPHIDServer) sendResponsePackets(packets [][]byte) {
 }
 
 func (server *CTAPHIDServer) HandleMessage(message []byte) {
+	server.logPacket("IN", message)
+	if len(message) < ctapHIDContinuationHeaderSize {
+		// Too short to be any packet, so it may not even hold a whole channel ID
+		ctapHIDLogger.Printf("CTAPHID ERROR: %d byte frame is shorter than any packet header\n\n", len(message))
+		channelId := ctapHIDBroadcastChannel
+		if len(message) >= 4 {
+			channelId = util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(message))
+		}
+		server.sendError(channelId, ctapHIDErrorInvalidLength)
+		return
+	}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
-	channel, exists := server.channels[channelId]
+	channel, exists := server.getChannel(channelId)
 	if !exists {
 		server.sendError(channelId, ctapHIDErrorInvalidChannel)
 		return
@@ -62,27 +207,75 @@ func (server *CTAPHIDServer) HandleMessage(message []byte) {
 	channel.handleMessage(message)
 }
 
+func (server *CTAPHIDServer) getChannel(channelId ctapHIDChannelID) (*ctapHIDChannel, bool) {
+	server.channelsLock.Lock()
+	defer server.channelsLock.Unlock()
+	channel, exists := server.channels[channelId]
+	return channel, exists
+}
+
+// setChannelIDAllocator lets tests choose the IDs INIT hands out instead of counting up
+// from maxChannelID. A nil allocator restores the default.
+func (server *CTAPHIDServer) setChannelIDAllocator(allocator func() ctapHIDChannelID) {
+	server.channelsLock.Lock()
+	defer server.channelsLock.Unlock()
+	server.nextChannelID = allocator
+}
+
+// newChannel allocates the next channel ID, or returns nil if that ID is reserved or
+// already in use
 func (server *CTAPHIDServer) newChannel() *ctapHIDChannel {
-	channel := newCTAPHIDChannel(server, server.maxChannelID+1)
-	server.maxChannelID += 1
-	server.channels[channel.channelId] = channel
+	// Multiple hosts can INIT at the same time, so channel allocation must be atomic
+	server.channelsLock.Lock()
+	defer server.channelsLock.Unlock()
+	var channelId ctapHIDChannelID
+	if server.nextChannelID != nil {
+		channelId = server.nextChannelID()
+	} else {
+		server.maxChannelID += 1
+		channelId = server.maxChannelID
+	}
+	if _, exists := server.channels[channelId]; exists || channelId == 0 {
+		ctapHIDLogger.Printf("CTAPHID ERROR: Refusing to reallocate channel %d\n\n", channelId)
+		return nil
+	}
+	channel := newCTAPHIDChannel(server, channelId)
+	server.channels[channelId] = channel
 	return channel
 }
 
 func (server *CTAPHIDServer) sendResponse(channelID ctapHIDChannelID, command ctapHIDCommand, payload []byte) {
-	packets := createResponsePackets(channelID, command, payload)
+	if len(payload) > maxMessageSize(server.packetSize) {
+		// Fragmenting it would need sequence numbers past 127, which hosts read as a new init packet
+		ctapHIDLogger.Printf("CTAPHID ERROR: %d byte response is larger than the maximum message size %d\n\n", len(payload), maxMessageSize(server.packetSize))
+		server.sendError(channelID, ctapHIDErrorOther)
+		return
+	}
+	packets := createResponsePackets(server.packetSize, channelID, command, payload)
 	server.sendResponsePackets(packets)
 }
 
 func (server *CTAPHIDServer) sendError(channelID ctapHIDChannelID, errorCode ctapHIDErrorCode) {
-	response := ctapHidError(channelID, errorCode)
+	response := ctapHidError(server.packetSize, channelID, errorCode)
 	server.sendResponsePackets(response)
 }
 
-func createResponsePackets(channelId ctapHIDChannelID, command ctapHIDCommand, payload []byte) [][]byte {
+// sendHIDError sends the code of a HIDError to the host, or ERR_OTHER for any other error
+func (server *CTAPHIDServer) sendHIDError(channelID ctapHIDChannelID, err error) {
+	var hidErr *HIDError
+	if !errors.As(err, &hidErr) {
+		ctapHIDLogger.Printf("CTAPHID ERROR: %s\n\n", err)
+		hidErr = &HIDError{code: ctapHIDErrorOther}
+	}
+	server.sendError(channelID, hidErr.code)
+}
+
+func createResponsePackets(packetSize int, channelId ctapHIDChannelID, command ctapHIDCommand, payload []byte) [][]byte {
+	util.Assert(len(payload) <= maxMessageSize(packetSize), "CTAPHID payload too large to fragment")
 	packets := [][]byte{}
 	sequence := -1
-	for len(payload) > 0 {
+	// An empty payload still needs its init packet
+	for sequence < 0 || len(payload) > 0 {
 		packet := []byte{}
 		if sequence < 0 {
 			packet = append(packet, util.ToLE(channelId)...)
@@ -93,13 +286,13 @@ func createResponsePackets(channelId ctapHIDChannelID, command ctapHIDCommand, p
 			packet = append(packet, byte(uint8(sequence)))
 		}
 		sequence++
-		bytesLeft := ctapHIDMaxPacketSize - len(packet)
+		bytesLeft := packetSize - len(packet)
 		if bytesLeft > len(payload) {
 			bytesLeft = len(payload)
 		}
 		packet = append(packet, payload[:bytesLeft]...)
 		payload = payload[bytesLeft:]
-		packet = util.Pad(packet, ctapHIDMaxPacketSize)
+		packet = util.Pad(packet, packetSize)
 		packets = append(packets, packet)
 	}
 	return packets
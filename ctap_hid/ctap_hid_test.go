@@ -2,7 +2,10 @@ package ctap_hid
 
 import (
 	"bytes"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/util"
@@ -42,3 +45,1068 @@ func TestOpenChannel(t *testing.T) {
 	server.SetResponseHandler(responseHandler)
 	server.HandleMessage(initializationMessage)
 }
+
+func TestConcurrentInit(t *testing.T) {
+	dummyCTAP := dummyHandler{}
+	dummyU2F := dummyHandler{}
+	server := NewCTAPHIDServer(&dummyCTAP, &dummyU2F)
+	responses := make(map[string]ctapHIDChannelID)
+	server.SetResponseHandler(func(response []byte) {
+		buffer := bytes.NewBuffer(response)
+		util.ReadLE[ctapHIDChannelID](buffer)
+		util.ReadLE[ctapHIDCommand](buffer)
+		util.ReadBE[uint16](buffer)
+		initResponse := util.ReadLE[ctapHIDInitResponse](buffer)
+		responses[string(initResponse.Nonce[:])] = initResponse.NewChannelID
+	})
+	numInits := 50
+	nonces := make([][]byte, numInits)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numInits; i++ {
+		nonces[i] = crypto.RandomBytes(8)
+		message := util.Pad(util.Concat(
+			util.ToLE(ctapHIDBroadcastChannel),
+			[]byte{byte(ctapHIDCommandInit)},
+			util.ToBE[uint16](8),
+			nonces[i]), ctapHIDMaxPacketSize)
+		wg.Add(1)
+		go func() {
+			server.HandleMessage(message)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if len(responses) != numInits {
+		t.Fatalf("Expected %d INIT responses, got %d", numInits, len(responses))
+	}
+	channelIDs := make(map[ctapHIDChannelID]bool)
+	for _, nonce := range nonces {
+		channelID, ok := responses[string(nonce)]
+		if !ok {
+			t.Fatalf("No INIT response for nonce %#v", nonce)
+		}
+		if channelIDs[channelID] {
+			t.Fatalf("Channel ID %d allocated twice", channelID)
+		}
+		channelIDs[channelID] = true
+	}
+}
+
+func TestInitResponseEncoding(t *testing.T) {
+	response := ctapHIDInitResponse{
+		Nonce:              [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		NewChannelID:       0x11223344,
+		ProtocolVersion:    2,
+		DeviceVersionMajor: 3,
+		DeviceVersionMinor: 4,
+		DeviceVersionBuild: 5,
+		CapabilitiesFlags:  ctapHIDCapabilityCBOR | ctapHIDCapabilityWink,
+	}
+	expected := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x44, 0x33, 0x22, 0x11, 2, 3, 4, 5, 0b00000101}
+	encoded := util.ToLE(response)
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("Incorrect INIT response encoding: %#v vs %#v", encoded, expected)
+	}
+	if util.SizeOf[ctapHIDInitResponse]() != 17 {
+		t.Fatalf("INIT response is not 17 bytes: %d", util.SizeOf[ctapHIDInitResponse]())
+	}
+}
+
+func initPacket(channelId ctapHIDChannelID, nonce []byte) []byte {
+	return util.Pad(util.Concat(
+		util.ToLE(channelId),
+		[]byte{byte(ctapHIDCommandInit)},
+		util.ToBE(uint16(len(nonce))),
+		nonce), ctapHIDMaxPacketSize)
+}
+
+func parseInitResponse(t *testing.T, packet []byte) (ctapHIDChannelID, ctapHIDInitResponse) {
+	buffer := bytes.NewBuffer(packet)
+	channelId := util.ReadLE[ctapHIDChannelID](buffer)
+	command := util.ReadLE[ctapHIDCommand](buffer)
+	if command != ctapHIDCommandInit {
+		t.Fatalf("Expected INIT response, got command 0x%x", command)
+	}
+	util.ReadBE[uint16](buffer)
+	return channelId, util.ReadLE[ctapHIDInitResponse](buffer)
+}
+
+func TestBroadcastAndChannelInit(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+
+	nonce := crypto.RandomBytes(8)
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, nonce))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one response to broadcast INIT, got %d", len(responses))
+	}
+	responseChannel, response := parseInitResponse(t, responses[0])
+	if responseChannel != ctapHIDBroadcastChannel {
+		t.Fatalf("Broadcast INIT response not sent on broadcast channel: 0x%x", responseChannel)
+	}
+	if !bytes.Equal(response.Nonce[:], nonce) {
+		t.Fatalf("Broadcast INIT response has wrong nonce")
+	}
+	channelId := response.NewChannelID
+	if channelId == ctapHIDBroadcastChannel || channelId == 0 {
+		t.Fatalf("Broadcast INIT allocated invalid channel: 0x%x", channelId)
+	}
+
+	responses = nil
+	nonce = crypto.RandomBytes(8)
+	server.HandleMessage(initPacket(channelId, nonce))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one response to channel INIT, got %d", len(responses))
+	}
+	responseChannel, response = parseInitResponse(t, responses[0])
+	if responseChannel != channelId {
+		t.Fatalf("Channel INIT response not sent on the same channel: 0x%x vs 0x%x", responseChannel, channelId)
+	}
+	if response.NewChannelID != channelId {
+		t.Fatalf("Channel INIT changed the channel ID: 0x%x vs 0x%x", response.NewChannelID, channelId)
+	}
+	if !bytes.Equal(response.Nonce[:], nonce) {
+		t.Fatalf("Channel INIT response has wrong nonce")
+	}
+}
+
+func TestChannelInitAbortsTransaction(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	channelId := response.NewChannelID
+
+	// Start a multi-packet message, then resync before it completes
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(channelId),
+		[]byte{byte(ctapHIDCommandPing)},
+		util.ToBE[uint16](100)), ctapHIDMaxPacketSize))
+	nonce := crypto.RandomBytes(8)
+	server.HandleMessage(initPacket(channelId, nonce))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one response to resync INIT, got %d", len(responses))
+	}
+	responseChannel, response := parseInitResponse(t, responses[0])
+	if responseChannel != channelId || response.NewChannelID != channelId || !bytes.Equal(response.Nonce[:], nonce) {
+		t.Fatalf("Incorrect resync INIT response: %#v", response)
+	}
+}
+
+func TestInitRateLimit(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	server.SetInitRateLimit(10, 5)
+	now := time.Now()
+	server.initLimiter.now = func() time.Time { return now }
+	server.initLimiter.lastRefill = now
+	accepted, busy := 0, 0
+	server.SetResponseHandler(func(response []byte) {
+		command := ctapHIDCommand(response[4])
+		if command == ctapHIDCommandInit {
+			accepted++
+		} else if command == ctapHIDCommandError && ctapHIDErrorCode(response[7]) == ctapHIDErrorChannelBusy {
+			busy++
+		}
+	})
+	for i := 0; i < 20; i++ {
+		server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	}
+	if accepted != 5 || busy != 15 {
+		t.Fatalf("Expected 5 accepted and 15 busy INITs, got %d and %d", accepted, busy)
+	}
+
+	// After half a second at 10 per second, 5 more channels may be allocated
+	now = now.Add(500 * time.Millisecond)
+	accepted, busy = 0, 0
+	for i := 0; i < 10; i++ {
+		server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	}
+	if accepted != 5 || busy != 5 {
+		t.Fatalf("Expected 5 accepted and 5 busy INITs after recovery, got %d and %d", accepted, busy)
+	}
+}
+
+func TestPacketLog(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	server.SetResponseHandler(func(response []byte) {})
+	log := new(bytes.Buffer)
+	server.SetPacketLog(log)
+
+	nonce := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04}
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, nonce))
+	output := log.String()
+	inbound := strings.Index(output, "IN channel 0xffffffff (64 bytes)")
+	outbound := strings.Index(output, "OUT channel 0xffffffff (64 bytes)")
+	if inbound < 0 || outbound < 0 {
+		t.Fatalf("Packet log is missing a direction header: %s", output)
+	}
+	if inbound > outbound {
+		t.Fatalf("Inbound packet logged after its response: %s", output)
+	}
+	// The nonce appears in both the INIT request and its response
+	if strings.Count(output, "ad be ef 01 02 03 04") != 2 {
+		t.Fatalf("Packet log does not contain hexdumps of both packets: %s", output)
+	}
+
+	log.Reset()
+	server.SetPacketLog(nil)
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, nonce))
+	if log.Len() != 0 {
+		t.Fatalf("Packets logged after logging was turned off")
+	}
+}
+
+func TestErrorPacket(t *testing.T) {
+	packets := ctapHidError(ctapHIDMaxPacketSize, 0x01020304, ctapHIDErrorInvalidChannel)
+	if len(packets) != 1 || len(packets[0]) != ctapHIDMaxPacketSize {
+		t.Fatalf("Error not framed as a single %d byte packet: %v", ctapHIDMaxPacketSize, packets)
+	}
+	packet := packets[0]
+	buffer := bytes.NewBuffer(packet)
+	channelId := util.ReadLE[ctapHIDChannelID](buffer)
+	command := util.ReadLE[ctapHIDCommand](buffer)
+	payloadLength := util.ReadBE[uint16](buffer)
+	if channelId != 0x01020304 || command != ctapHIDCommandError {
+		t.Fatalf("Incorrect error packet header: 0x%x 0x%x", channelId, command)
+	}
+	if payloadLength != 1 {
+		t.Fatalf("Error payload is %d bytes, not 1", payloadLength)
+	}
+	payload := buffer.Bytes()
+	if payload[0] != byte(ctapHIDErrorInvalidChannel) {
+		t.Fatalf("Incorrect error code: 0x%x", payload[0])
+	}
+	if !bytes.Equal(payload[1:], make([]byte, len(payload)-1)) {
+		t.Fatalf("Error packet has extra bytes after the error code: %v", payload)
+	}
+}
+
+func TestInitWithU2FDisabled(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, nil)
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(ctapHIDBroadcastChannel),
+		[]byte{byte(ctapHIDCommandInit)},
+		util.ToBE[uint16](8),
+		crypto.RandomBytes(8)), ctapHIDMaxPacketSize))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one INIT response, got %d", len(responses))
+	}
+	initResponse := util.ReadLE[ctapHIDInitResponse](bytes.NewBuffer(responses[0][7:]))
+	if initResponse.CapabilitiesFlags&ctapHIDCapabilityNoMsg == 0 {
+		t.Fatalf("NMSG not set with U2F disabled: %#v", initResponse)
+	}
+	if initResponse.CapabilitiesFlags&ctapHIDCapabilityCBOR == 0 {
+		t.Fatalf("CBOR not set with U2F disabled: %#v", initResponse)
+	}
+
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(initResponse.NewChannelID),
+		[]byte{byte(ctapHIDCommandMsg)},
+		util.ToBE[uint16](4),
+		[]byte{0, 3, 0, 0}), ctapHIDMaxPacketSize))
+	if len(responses) != 2 || responses[1][4] != byte(ctapHIDCommandError) || responses[1][7] != byte(ctapHIDErrorInvalidCommand) {
+		t.Fatalf("MSG with U2F disabled did not return INVALID_CMD: %#v", responses[1:])
+	}
+
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(initResponse.NewChannelID),
+		[]byte{byte(ctapHIDCommandCBOR)},
+		util.ToBE[uint16](1),
+		[]byte{0x04}), ctapHIDMaxPacketSize))
+	last := responses[len(responses)-1]
+	if last[4] != byte(ctapHIDCommandCBOR) {
+		t.Fatalf("CBOR with U2F disabled did not succeed: %#v", last)
+	}
+}
+
+func TestInitWithCBORDisabled(t *testing.T) {
+	server := NewCTAPHIDServer(nil, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(ctapHIDBroadcastChannel),
+		[]byte{byte(ctapHIDCommandInit)},
+		util.ToBE[uint16](8),
+		crypto.RandomBytes(8)), ctapHIDMaxPacketSize))
+	initResponse := util.ReadLE[ctapHIDInitResponse](bytes.NewBuffer(responses[0][7:]))
+	if initResponse.CapabilitiesFlags&(ctapHIDCapabilityCBOR|ctapHIDCapabilityNoMsg) != 0 {
+		t.Fatalf("CBOR or NMSG set with CBOR disabled: %#v", initResponse)
+	}
+
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(initResponse.NewChannelID),
+		[]byte{byte(ctapHIDCommandCBOR)},
+		util.ToBE[uint16](1),
+		[]byte{0x04}), ctapHIDMaxPacketSize))
+	if len(responses) != 2 || responses[1][4] != byte(ctapHIDCommandError) || responses[1][7] != byte(ctapHIDErrorInvalidCommand) {
+		t.Fatalf("CBOR with CBOR disabled did not return INVALID_CMD: %#v", responses[1:])
+	}
+
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(initResponse.NewChannelID),
+		[]byte{byte(ctapHIDCommandMsg)},
+		util.ToBE[uint16](4),
+		[]byte{0, 3, 0, 0}), ctapHIDMaxPacketSize))
+	if responses[len(responses)-1][4] != byte(ctapHIDCommandMsg) {
+		t.Fatalf("MSG with CBOR disabled did not succeed: %#v", responses[2:])
+	}
+}
+
+type fixedResponseHandler struct {
+	response []byte
+}
+
+func (handler *fixedResponseHandler) HandleMessage(data []byte) []byte {
+	return handler.response
+}
+
+func sendCBORRequest(server *CTAPHIDServer) [][]byte {
+	var packets [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		packets = append(packets, response)
+	})
+	nonce := crypto.RandomBytes(8)
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit)}, util.ToBE[uint16](8), nonce), ctapHIDMaxPacketSize))
+	channelID := util.ReadLE[ctapHIDInitResponse](bytes.NewBuffer(packets[0][7:])).NewChannelID
+	packets = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x04}), ctapHIDMaxPacketSize))
+	// Drop keepalives
+	responses := [][]byte{}
+	for _, packet := range packets {
+		if packet[4] != byte(ctapHIDCommandKeepalive) {
+			responses = append(responses, packet)
+		}
+	}
+	return responses
+}
+
+func TestLargeResponseFraming(t *testing.T) {
+	response := crypto.RandomBytes(maxMessageSize(ctapHIDMaxPacketSize))
+	packets := sendCBORRequest(NewCTAPHIDServer(&fixedResponseHandler{response: response}, &dummyHandler{}))
+	if len(packets) != ctapHIDMaxSequence+2 {
+		t.Fatalf("Expected %d packets for a %d byte response, got %d", ctapHIDMaxSequence+2, len(response), len(packets))
+	}
+	if packets[0][4] != byte(ctapHIDCommandCBOR) || util.ReadBE[uint16](bytes.NewBuffer(packets[0][5:7])) != uint16(len(response)) {
+		t.Fatalf("Incorrect init packet: %#v", packets[0][:7])
+	}
+	reassembled := append([]byte{}, packets[0][7:]...)
+	for i, packet := range packets[1:] {
+		if len(packet) != ctapHIDMaxPacketSize {
+			t.Fatalf("Continuation packet %d is %d bytes", i, len(packet))
+		}
+		if packet[4] != byte(i) {
+			t.Fatalf("Continuation packet %d has sequence number %d", i, packet[4])
+		}
+		reassembled = append(reassembled, packet[5:]...)
+	}
+	if !bytes.Equal(reassembled[:len(response)], response) {
+		t.Fatalf("Reassembled response does not match")
+	}
+}
+
+func TestPacketSize(t *testing.T) {
+	response := crypto.RandomBytes(300)
+	server := NewCTAPHIDServer(&fixedResponseHandler{response: response}, &dummyHandler{})
+	server.SetPacketSize(128)
+	packets := sendCBORRequest(server)
+	// 121 bytes in the init packet and 123 in each continuation packet
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 packets for a %d byte response, got %d", len(response), len(packets))
+	}
+	reassembled := append([]byte{}, packets[0][ctapHIDInitHeaderSize:]...)
+	for i, packet := range packets {
+		if len(packet) != 128 {
+			t.Fatalf("Packet %d is %d bytes", i, len(packet))
+		}
+		if i > 0 {
+			reassembled = append(reassembled, packet[ctapHIDContinuationHeaderSize:]...)
+		}
+	}
+	if !bytes.Equal(reassembled[:len(response)], response) {
+		t.Fatalf("Reassembled response does not match")
+	}
+}
+
+func TestOversizedResponse(t *testing.T) {
+	response := crypto.RandomBytes(10 * 1024)
+	packets := sendCBORRequest(NewCTAPHIDServer(&fixedResponseHandler{response: response}, &dummyHandler{}))
+	if len(packets) != 1 || packets[0][4] != byte(ctapHIDCommandError) || packets[0][7] != byte(ctapHIDErrorOther) {
+		t.Fatalf("Oversized response was not replaced by an error: %d packets", len(packets))
+	}
+}
+
+type recordingHandler struct {
+	requests [][]byte
+}
+
+func (handler *recordingHandler) HandleMessage(data []byte) []byte {
+	handler.requests = append(handler.requests, data)
+	return []byte{0x00}
+}
+
+func TestResyncMidReassemblyThenCBOR(t *testing.T) {
+	ctapHandler := &recordingHandler{}
+	server := NewCTAPHIDServer(ctapHandler, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		if response[4] != byte(ctapHIDCommandKeepalive) {
+			responses = append(responses, response)
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	channelId := response.NewChannelID
+
+	// Wedge the channel with a CBOR request that's missing its last continuation packet
+	stale := crypto.RandomBytes(150)
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE(uint16(len(stale))), stale[:57]), ctapHIDMaxPacketSize))
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{0}, stale[57:116]), ctapHIDMaxPacketSize))
+
+	// Another host can still allocate a channel while this one is stuck
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one response to broadcast INIT, got %d", len(responses))
+	}
+	responseChannel, response := parseInitResponse(t, responses[0])
+	if responseChannel != ctapHIDBroadcastChannel || response.NewChannelID == channelId {
+		t.Fatalf("Broadcast INIT during a pending transaction allocated channel 0x%x", response.NewChannelID)
+	}
+
+	// Resync the wedged channel, then send a complete two-packet CBOR request
+	responses = nil
+	nonce := crypto.RandomBytes(8)
+	server.HandleMessage(initPacket(channelId, nonce))
+	if len(responses) != 1 {
+		t.Fatalf("Expected one response to resync INIT, got %d", len(responses))
+	}
+	responseChannel, response = parseInitResponse(t, responses[0])
+	if responseChannel != channelId || response.NewChannelID != channelId || !bytes.Equal(response.Nonce[:], nonce) {
+		t.Fatalf("Incorrect resync INIT response: %#v", response)
+	}
+	request := crypto.RandomBytes(100)
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE(uint16(len(request))), request[:57]), ctapHIDMaxPacketSize))
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{0}, request[57:]), ctapHIDMaxPacketSize))
+	if len(ctapHandler.requests) != 1 || !bytes.Equal(ctapHandler.requests[0], request) {
+		t.Fatalf("CTAP server did not receive the request sent after resync: %#v", ctapHandler.requests)
+	}
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandCBOR) || !bytes.Equal(responses[0][:4], util.ToLE(channelId)) {
+		t.Fatalf("Expected a CBOR response on channel 0x%x, got %#v", channelId, responses)
+	}
+}
+
+func TestPingDuringCBORReassemblyIsBusy(t *testing.T) {
+	ctapHandler := &recordingHandler{}
+	server := NewCTAPHIDServer(ctapHandler, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		if response[4] != byte(ctapHIDCommandKeepalive) {
+			responses = append(responses, response)
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	channelId := response.NewChannelID
+
+	// Start a two-packet CBOR request, then PING on the same channel before it completes
+	request := crypto.RandomBytes(100)
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE(uint16(len(request))), request[:57]), ctapHIDMaxPacketSize))
+	ping := []byte("ping payload")
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandPing)}, util.ToBE(uint16(len(ping))), ping), ctapHIDMaxPacketSize))
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorChannelBusy) {
+		t.Fatalf("Expected PING during reassembly to be rejected as busy, got %#v", responses)
+	}
+	if reassembly := server.PendingReassemblies()[0]; !reassembly.InProgress || reassembly.Command != uint8(ctapHIDCommandCBOR) || reassembly.ReceivedLength != 57 {
+		t.Fatalf("PING changed the pending CBOR reassembly: %#v", reassembly)
+	}
+
+	// The CBOR request still completes, and the channel accepts PING afterwards
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{0}, request[57:]), ctapHIDMaxPacketSize))
+	if len(ctapHandler.requests) != 1 || !bytes.Equal(ctapHandler.requests[0], request) {
+		t.Fatalf("CTAP server did not receive the interrupted request: %#v", ctapHandler.requests)
+	}
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandCBOR) {
+		t.Fatalf("Expected a CBOR response, got %#v", responses)
+	}
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandPing)}, util.ToBE(uint16(len(ping))), ping), ctapHIDMaxPacketSize))
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandPing) || !bytes.Equal(responses[0][7:7+len(ping)], ping) {
+		t.Fatalf("PING after the CBOR request was not echoed: %#v", responses)
+	}
+}
+
+func TestConcurrentInitStress(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	numInits := 500
+	server.SetInitRateLimit(numInits, numInits)
+	lock := &sync.Mutex{}
+	allocated := make(map[ctapHIDChannelID]int)
+	server.SetResponseHandler(func(response []byte) {
+		if ctapHIDCommand(response[4]) != ctapHIDCommandInit {
+			return
+		}
+		_, initResponse := parseInitResponse(t, response)
+		lock.Lock()
+		allocated[initResponse.NewChannelID]++
+		lock.Unlock()
+	})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numInits; i++ {
+		message := initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8))
+		wg.Add(1)
+		go func() {
+			server.HandleMessage(message)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	successful := 0
+	for channelId, count := range allocated {
+		if count != 1 {
+			t.Fatalf("Channel ID %d allocated %d times", channelId, count)
+		}
+		successful += count
+	}
+	if successful != numInits {
+		t.Fatalf("Expected %d successful INITs, got %d", numInits, successful)
+	}
+	if len(server.channels) != successful+1 {
+		t.Fatalf("Expected %d channels including broadcast, got %d", successful+1, len(server.channels))
+	}
+}
+
+func TestInitRefusesExistingChannelID(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	// Simulate a channel that was allocated without going through maxChannelID
+	existing := newCTAPHIDChannel(server, 1)
+	server.channels[1] = existing
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorChannelBusy) {
+		t.Fatalf("INIT reusing an existing channel ID was not refused: %#v", responses)
+	}
+	if server.channels[1] != existing {
+		t.Fatalf("Existing channel was replaced")
+	}
+
+	// The next INIT moves past the taken ID
+	responses = nil
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	if response.NewChannelID != 2 {
+		t.Fatalf("Expected channel 2 after refusing channel 1, got %d", response.NewChannelID)
+	}
+}
+
+func TestChannelIDAllocator(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.setChannelIDAllocator(func() ctapHIDChannelID { return 0x42 })
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	if response.NewChannelID != 0x42 {
+		t.Fatalf("Expected forced channel 0x42, got 0x%x", response.NewChannelID)
+	}
+	if _, exists := server.channels[0x42]; !exists {
+		t.Fatalf("Forced channel was not registered")
+	}
+
+	// The forced ID is now taken, so allocating it again is refused
+	responses = nil
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorChannelBusy) {
+		t.Fatalf("Reallocating the forced channel was not refused: %#v", responses)
+	}
+
+	server.setChannelIDAllocator(nil)
+	responses = nil
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response = parseInitResponse(t, responses[0])
+	if response.NewChannelID != 1 {
+		t.Fatalf("Expected default allocation to resume at channel 1, got %d", response.NewChannelID)
+	}
+}
+
+type blockingHandler struct {
+	entered chan bool
+	release chan bool
+}
+
+func (handler *blockingHandler) HandleMessage(data []byte) []byte {
+	handler.entered <- true
+	<-handler.release
+	return []byte{0x00}
+}
+
+func TestMaxConcurrentCBOR(t *testing.T) {
+	handler := &blockingHandler{entered: make(chan bool), release: make(chan bool)}
+	server := NewCTAPHIDServer(handler, &dummyHandler{})
+	server.SetMaxConcurrentCBOR(2)
+	lock := &sync.Mutex{}
+	var channelIDs []ctapHIDChannelID
+	errors := make(map[ctapHIDChannelID]ctapHIDErrorCode)
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch ctapHIDCommand(response[4]) {
+		case ctapHIDCommandInit:
+			_, initResponse := parseInitResponse(t, response)
+			channelIDs = append(channelIDs, initResponse.NewChannelID)
+		case ctapHIDCommandError:
+			errors[util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(response))] = ctapHIDErrorCode(response[7])
+		}
+	})
+	for i := 0; i < 4; i++ {
+		server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	}
+	cborPacket := func(channelID ctapHIDChannelID) []byte {
+		return util.Pad(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x04}), ctapHIDMaxPacketSize)
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, channelID := range channelIDs[:2] {
+		wg.Add(1)
+		go func(channelID ctapHIDChannelID) {
+			server.HandleMessage(cborPacket(channelID))
+			wg.Done()
+		}(channelID)
+		<-handler.entered
+	}
+	server.HandleMessage(cborPacket(channelIDs[2]))
+	lock.Lock()
+	busy := errors[channelIDs[2]]
+	lock.Unlock()
+	if busy != ctapHIDErrorChannelBusy {
+		t.Fatalf("CBOR command over the limit was not rejected as busy: 0x%x", busy)
+	}
+
+	handler.release <- true
+	handler.release <- true
+	wg.Wait()
+	go func() {
+		<-handler.entered
+		handler.release <- true
+	}()
+	server.HandleMessage(cborPacket(channelIDs[3]))
+	if _, ok := errors[channelIDs[3]]; ok {
+		t.Fatalf("CBOR command rejected after the in-flight commands finished")
+	}
+}
+
+func sendWink(server *CTAPHIDServer) (ctapHIDInitResponse, [][]byte) {
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	initResponse := util.ReadLE[ctapHIDInitResponse](bytes.NewBuffer(responses[0][7:]))
+	responses = nil
+	server.HandleMessage(util.Pad(util.Concat(
+		util.ToLE(initResponse.NewChannelID),
+		[]byte{byte(ctapHIDCommandWink)},
+		util.ToBE[uint16](0)), ctapHIDMaxPacketSize))
+	return initResponse, responses
+}
+
+func TestWink(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	winks := 0
+	server.SetWinkHandler(func() { winks++ })
+	initResponse, responses := sendWink(server)
+	if initResponse.CapabilitiesFlags&ctapHIDCapabilityWink == 0 {
+		t.Fatalf("WINK not advertised with a wink handler: %#v", initResponse)
+	}
+	if winks != 1 {
+		t.Fatalf("Wink handler called %d times", winks)
+	}
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandWink) || util.ReadBE[uint16](bytes.NewBuffer(responses[0][5:7])) != 0 {
+		t.Fatalf("WINK was not answered with an empty WINK: %#v", responses)
+	}
+}
+
+func TestWinkWithoutHandler(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	initResponse, responses := sendWink(server)
+	if initResponse.CapabilitiesFlags&ctapHIDCapabilityWink != 0 {
+		t.Fatalf("WINK advertised without a wink handler: %#v", initResponse)
+	}
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorInvalidCommand) {
+		t.Fatalf("WINK without a handler did not return INVALID_CMD: %#v", responses)
+	}
+}
+
+func TestCancelHandler(t *testing.T) {
+	ctapHandler := &recordingHandler{}
+	server := NewCTAPHIDServer(ctapHandler, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	type cancellation struct {
+		channelID ctapHIDChannelID
+		command   ctapHIDCommand
+	}
+	var cancellations []cancellation
+	server.SetCancelHandler(func(channelID uint32, command uint8) {
+		cancellations = append(cancellations, cancellation{ctapHIDChannelID(channelID), ctapHIDCommand(command)})
+	})
+	channelIDs := []ctapHIDChannelID{}
+	for i := 0; i < 2; i++ {
+		responses = nil
+		server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+		_, response := parseInitResponse(t, responses[0])
+		channelIDs = append(channelIDs, response.NewChannelID)
+	}
+	cancelPacket := func(channelId ctapHIDChannelID) []byte {
+		return util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCancel)}, util.ToBE[uint16](0)), ctapHIDMaxPacketSize)
+	}
+
+	// A CANCEL with nothing in flight aborts nothing
+	responses = nil
+	server.HandleMessage(cancelPacket(channelIDs[0]))
+	if len(cancellations) != 0 {
+		t.Fatalf("Cancel handler called without a transaction in flight: %#v", cancellations)
+	}
+
+	for i, command := range []ctapHIDCommand{ctapHIDCommandCBOR, ctapHIDCommandMsg} {
+		server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelIDs[i]), []byte{byte(command)}, util.ToBE[uint16](100)), ctapHIDMaxPacketSize))
+	}
+	server.HandleMessage(cancelPacket(channelIDs[1]))
+	server.HandleMessage(cancelPacket(channelIDs[0]))
+	expected := []cancellation{{channelIDs[1], ctapHIDCommandMsg}, {channelIDs[0], ctapHIDCommandCBOR}}
+	if len(cancellations) != 2 || cancellations[0] != expected[0] || cancellations[1] != expected[1] {
+		t.Fatalf("Expected cancellations %#v, got %#v", expected, cancellations)
+	}
+	if len(responses) != 0 || len(ctapHandler.requests) != 0 {
+		t.Fatalf("Cancelled transactions were answered: %#v %#v", responses, ctapHandler.requests)
+	}
+}
+
+func TestCancelWhileWaitingForApproval(t *testing.T) {
+	handler := &blockingHandler{entered: make(chan bool), release: make(chan bool)}
+	server := NewCTAPHIDServer(handler, &dummyHandler{})
+	lock := sync.Mutex{}
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		if response[4] != byte(ctapHIDCommandKeepalive) {
+			responses = append(responses, response)
+		}
+	})
+	cancelled := make(chan uint32, 1)
+	server.SetCancelHandler(func(channelID uint32, command uint8) {
+		if ctapHIDCommand(command) == ctapHIDCommandCBOR {
+			cancelled <- channelID
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	channelId := response.NewChannelID
+	lock.Lock()
+	responses = nil
+	lock.Unlock()
+
+	finished := make(chan bool)
+	go func() {
+		server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x02}), ctapHIDMaxPacketSize))
+		finished <- true
+	}()
+	<-handler.entered
+
+	// The CANCEL is handled while the CBOR request is still waiting for approval
+	done := make(chan bool)
+	go func() {
+		server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCancel)}, util.ToBE[uint16](0)), ctapHIDMaxPacketSize))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("CANCEL waited for the CBOR request to finish")
+	}
+	select {
+	case channelID := <-cancelled:
+		if ctapHIDChannelID(channelID) != channelId {
+			t.Fatalf("Cancel handler called for channel 0x%x instead of 0x%x", channelID, channelId)
+		}
+	default:
+		t.Fatalf("Cancel handler not called while waiting for approval")
+	}
+	lock.Lock()
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandCBOR) || responses[0][7] != ctap2ErrKeepaliveCancel {
+		t.Fatalf("Cancelled request was not answered with KEEPALIVE_CANCEL: %#v", responses)
+	}
+	lock.Unlock()
+
+	// The CTAP server's eventual response is dropped
+	handler.release <- true
+	<-finished
+	lock.Lock()
+	defer lock.Unlock()
+	if len(responses) != 1 {
+		t.Fatalf("Cancelled request was answered again: %#v", responses)
+	}
+}
+
+// Blocks like blockingHandler, then reports whether the request was cancelled by then
+type cancellableBlockingHandler struct {
+	blockingHandler
+	cancelledAtRelease chan bool
+}
+
+func (handler *cancellableBlockingHandler) HandleCancellableMessage(data []byte, cancelled func() bool) []byte {
+	handler.entered <- true
+	<-handler.release
+	handler.cancelledAtRelease <- cancelled()
+	return []byte{0x00}
+}
+
+func TestCancelReachesCancellableClient(t *testing.T) {
+	handler := &cancellableBlockingHandler{
+		blockingHandler:    blockingHandler{entered: make(chan bool), release: make(chan bool)},
+		cancelledAtRelease: make(chan bool, 1),
+	}
+	server := NewCTAPHIDServer(handler, &dummyHandler{})
+	var responses [][]byte
+	lock := sync.Mutex{}
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		responses = append(responses, response)
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, responses[0])
+	channelId := response.NewChannelID
+
+	finished := make(chan bool)
+	go func() {
+		server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x01}), ctapHIDMaxPacketSize))
+		finished <- true
+	}()
+	<-handler.entered
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCancel)}, util.ToBE[uint16](0)), ctapHIDMaxPacketSize))
+	handler.release <- true
+	<-finished
+	if !<-handler.cancelledAtRelease {
+		t.Fatalf("CTAP server not told that the request was cancelled")
+	}
+}
+
+func TestResponseDelayKeepsAlive(t *testing.T) {
+	server := NewCTAPHIDServer(&fixedResponseHandler{response: []byte{0x00}}, &dummyHandler{})
+	server.SetResponseDelay(200*time.Millisecond, 200*time.Millisecond)
+	lock := sync.Mutex{}
+	var packets [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		packets = append(packets, response)
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	_, response := parseInitResponse(t, packets[0])
+	channelId := response.NewChannelID
+	lock.Lock()
+	packets = nil
+	lock.Unlock()
+
+	start := time.Now()
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x04}), ctapHIDMaxPacketSize))
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("CBOR response sent after %s, before the configured delay", elapsed)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	keepalives, answered := 0, false
+	for _, packet := range packets {
+		if packet[4] == byte(ctapHIDCommandCBOR) {
+			answered = true
+			break
+		}
+		if packet[4] == byte(ctapHIDCommandKeepalive) {
+			keepalives++
+		}
+	}
+	if !answered {
+		t.Fatalf("No CBOR response after the delay: %#v", packets)
+	}
+	if keepalives < 2 {
+		t.Fatalf("Expected keepalives during the delay before the response, got %d: %#v", keepalives, packets)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	server := NewCTAPHIDServer(&fixedResponseHandler{response: []byte{0x00, 0xA0}}, &dummyHandler{})
+	server.Pause()
+	responses := sendCBORRequest(server)
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorChannelBusy) {
+		t.Fatalf("CBOR command while paused did not return CHANNEL_BUSY: %#v", responses)
+	}
+
+	server.Resume()
+	responses = sendCBORRequest(server)
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandCBOR) || !bytes.Equal(responses[0][7:9], []byte{0x00, 0xA0}) {
+		t.Fatalf("CBOR command after resuming did not succeed: %#v", responses)
+	}
+}
+
+func TestPingDoesNotWaitForUserPresence(t *testing.T) {
+	// Both handlers block as if waiting for the user to approve
+	handler := &blockingHandler{entered: make(chan bool), release: make(chan bool)}
+	server := NewCTAPHIDServer(handler, handler)
+	lock := &sync.Mutex{}
+	var pings [][]byte
+	var channelIDs []ctapHIDChannelID
+	server.SetResponseHandler(func(response []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch ctapHIDCommand(response[4]) {
+		case ctapHIDCommandInit:
+			_, initResponse := parseInitResponse(t, response)
+			channelIDs = append(channelIDs, initResponse.NewChannelID)
+		case ctapHIDCommandPing:
+			pings = append(pings, response)
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	lock.Lock()
+	busyChannel, pingChannel := channelIDs[0], channelIDs[1]
+	lock.Unlock()
+
+	// Leave a CBOR request waiting for presence on one channel
+	go server.HandleMessage(util.Pad(util.Concat(util.ToLE(busyChannel), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x04}), ctapHIDMaxPacketSize))
+	<-handler.entered
+	defer func() { handler.release <- true }()
+
+	payload := []byte("ping payload")
+	for _, channelID := range []ctapHIDChannelID{ctapHIDBroadcastChannel, pingChannel} {
+		done := make(chan bool)
+		go func() {
+			server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandPing)}, util.ToBE(uint16(len(payload))), payload), ctapHIDMaxPacketSize))
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-handler.entered:
+			t.Fatalf("PING on channel 0x%x asked for user presence", channelID)
+		case <-time.After(time.Second):
+			t.Fatalf("PING on channel 0x%x did not return", channelID)
+		}
+		lock.Lock()
+		ping := pings[len(pings)-1]
+		lock.Unlock()
+		if util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(ping)) != channelID || !bytes.Equal(ping[7:7+len(payload)], payload) {
+			t.Fatalf("PING on channel 0x%x was not echoed: %#v", channelID, ping)
+		}
+	}
+}
+
+func TestChannelDiagnostics(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var channelID ctapHIDChannelID
+	server.SetResponseHandler(func(response []byte) {
+		if ctapHIDCommand(response[4]) == ctapHIDCommandInit {
+			_, initResponse := parseInitResponse(t, response)
+			channelID = initResponse.NewChannelID
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	before := time.Now()
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandCBOR)}, util.ToBE[uint16](1), []byte{0x04}), ctapHIDMaxPacketSize))
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](4), []byte("ping")), ctapHIDMaxPacketSize))
+
+	diagnostics := server.ChannelDiagnostics()
+	if len(diagnostics) != 2 || diagnostics[0].ChannelID != uint32(channelID) || diagnostics[1].ChannelID != uint32(ctapHIDBroadcastChannel) {
+		t.Fatalf("Unexpected channels: %#v", diagnostics)
+	}
+	channel := diagnostics[0]
+	if channel.LastCommand != uint8(ctapHIDCommandPing) || channel.CommandCount != 2 {
+		t.Fatalf("Expected 2 commands ending with PING, got %#v", channel)
+	}
+	if channel.LastCommandAt.Before(before) {
+		t.Fatalf("Last command time not recorded: %s", channel.LastCommandAt)
+	}
+	broadcast := diagnostics[1]
+	if broadcast.LastCommand != uint8(ctapHIDCommandInit) || broadcast.CommandCount != 1 {
+		t.Fatalf("Expected the INIT on broadcast, got %#v", broadcast)
+	}
+}
+
+func TestPendingReassemblies(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var channelID ctapHIDChannelID
+	server.SetResponseHandler(func(response []byte) {
+		if ctapHIDCommand(response[4]) == ctapHIDCommandInit {
+			_, initResponse := parseInitResponse(t, response)
+			channelID = initResponse.NewChannelID
+		}
+	})
+	server.HandleMessage(initPacket(ctapHIDBroadcastChannel, crypto.RandomBytes(8)))
+	// A 200 byte message needs an init packet and three continuation packets
+	payload := crypto.RandomBytes(200)
+	server.HandleMessage(util.Concat(util.ToLE(channelID), []byte{byte(ctapHIDCommandPing)}, util.ToBE[uint16](200), payload[:57]))
+	server.HandleMessage(util.Concat(util.ToLE(channelID), []byte{0}, payload[57:116]))
+
+	reassemblies := server.PendingReassemblies()
+	if len(reassemblies) != 2 || reassemblies[1].InProgress {
+		t.Fatalf("Unexpected reassemblies: %#v", reassemblies)
+	}
+	pending := reassemblies[0]
+	if pending.ChannelID != uint32(channelID) || !pending.InProgress || pending.Command != uint8(ctapHIDCommandPing) {
+		t.Fatalf("Pending PING not reported: %#v", pending)
+	}
+	if pending.ExpectedLength != 200 || pending.ReceivedLength != 116 {
+		t.Fatalf("Expected 116 of 200 bytes, got %#v", pending)
+	}
+
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{1}, payload[116:175]), ctapHIDMaxPacketSize))
+	server.HandleMessage(util.Pad(util.Concat(util.ToLE(channelID), []byte{2}, payload[175:]), ctapHIDMaxPacketSize))
+	if reassembly := server.PendingReassemblies()[0]; reassembly.InProgress {
+		t.Fatalf("Completed message still reported as pending: %#v", reassembly)
+	}
+}
+
+func TestShortFramesRejected(t *testing.T) {
+	server := NewCTAPHIDServer(&dummyHandler{}, &dummyHandler{})
+	var responses [][]byte
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	server.HandleMessage([]byte{0xFF, 0xFF, 0xFF})
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorInvalidLength) {
+		t.Fatalf("3 byte frame not rejected with INVALID_LENGTH: %#v", responses)
+	}
+	if util.ReadLE[ctapHIDChannelID](bytes.NewBuffer(responses[0])) != ctapHIDBroadcastChannel {
+		t.Fatalf("Error for a frame without a channel ID not sent on broadcast")
+	}
+
+	// An init packet cut off before its payload length
+	responses = nil
+	server.HandleMessage(util.Concat(util.ToLE(ctapHIDBroadcastChannel), []byte{byte(ctapHIDCommandInit), 0x00}))
+	if len(responses) != 1 || responses[0][4] != byte(ctapHIDCommandError) || responses[0][7] != byte(ctapHIDErrorInvalidLength) {
+		t.Fatalf("Truncated init packet not rejected with INVALID_LENGTH: %#v", responses)
+	}
+}
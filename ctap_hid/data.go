@@ -6,8 +6,20 @@ import (
 
 const (
 	ctapHIDMaxPacketSize int = 64
+	// Continuation sequence numbers only go up to 127, so a message is at most an init
+	// packet and 128 continuation packets long
+	ctapHIDMaxSequence int = 127
+	// An init packet has a channel ID, command and payload length; a continuation packet has
+	// a channel ID and sequence number
+	ctapHIDInitHeaderSize         int = 7
+	ctapHIDContinuationHeaderSize int = 5
 )
 
+// maxMessageSize is the largest payload that fits in one message with the given packet size
+func maxMessageSize(packetSize int) int {
+	return (packetSize - ctapHIDInitHeaderSize) + (ctapHIDMaxSequence+1)*(packetSize-ctapHIDContinuationHeaderSize)
+}
+
 const ctapHIDStatusUpneeded uint8 = 2
 
 type ctapHIDChannelID uint32
@@ -69,9 +81,9 @@ var ctapHIDErrorCodeDescriptions = map[ctapHIDErrorCode]string{
 	ctapHIDErrorOther:            "ctapHIDErrOther",
 }
 
-func ctapHidError(channelId ctapHIDChannelID, err ctapHIDErrorCode) [][]byte {
+func ctapHidError(packetSize int, channelId ctapHIDChannelID, err ctapHIDErrorCode) [][]byte {
 	ctapHIDLogger.Printf("CTAPHID ERROR: %s\n\n", ctapHIDErrorCodeDescriptions[err])
-	return createResponsePackets(channelId, ctapHIDCommandError, []byte{byte(err)})
+	return createResponsePackets(packetSize, channelId, ctapHIDCommandError, []byte{byte(err)})
 }
 
 type ctapHIDCapabilityFlag uint8
@@ -0,0 +1,57 @@
+package ctap_hid
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChannelDiagnostics describes the traffic on one allocated channel
+type ChannelDiagnostics struct {
+	ChannelID uint32
+	// The command byte of the last complete message, with the 0x80 frame type bit set
+	LastCommand   uint8
+	LastCommandAt time.Time
+	// Number of complete messages handled, whether or not they succeeded
+	CommandCount int
+}
+
+type channelStats struct {
+	lock          sync.Mutex
+	lastCommand   ctapHIDCommand
+	lastCommandAt time.Time
+	count         int
+}
+
+func (stats *channelStats) record(command ctapHIDCommand) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.lastCommand = command
+	stats.lastCommandAt = time.Now()
+	stats.count++
+}
+
+// ChannelDiagnostics lists every channel, including broadcast, with the last command each
+// one handled, for working out which host sent what during interop testing
+func (server *CTAPHIDServer) ChannelDiagnostics() []ChannelDiagnostics {
+	server.channelsLock.Lock()
+	channels := make([]*ctapHIDChannel, 0, len(server.channels))
+	for _, channel := range server.channels {
+		channels = append(channels, channel)
+	}
+	server.channelsLock.Unlock()
+
+	diagnostics := make([]ChannelDiagnostics, 0, len(channels))
+	for _, channel := range channels {
+		channel.stats.lock.Lock()
+		diagnostics = append(diagnostics, ChannelDiagnostics{
+			ChannelID:     uint32(channel.channelId),
+			LastCommand:   uint8(channel.stats.lastCommand),
+			LastCommandAt: channel.stats.lastCommandAt,
+			CommandCount:  channel.stats.count,
+		})
+		channel.stats.lock.Unlock()
+	}
+	sort.Slice(diagnostics, func(i, j int) bool { return diagnostics[i].ChannelID < diagnostics[j].ChannelID })
+	return diagnostics
+}
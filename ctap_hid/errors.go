@@ -0,0 +1,26 @@
+package ctap_hid
+
+import "fmt"
+
+// HIDError is a CTAPHID error code returned as a Go error, which the transport sends to the
+// host in an ERROR packet
+type HIDError struct {
+	code ctapHIDErrorCode
+}
+
+// Code returns the error code sent to the host
+func (err *HIDError) Code() byte {
+	return byte(err.code)
+}
+
+func (err *HIDError) Error() string {
+	if description, ok := ctapHIDErrorCodeDescriptions[err.code]; ok {
+		return description
+	}
+	return fmt.Sprintf("CTAPHID error 0x%02x", byte(err.code))
+}
+
+func (err *HIDError) Is(target error) bool {
+	other, ok := target.(*HIDError)
+	return ok && other.code == err.code
+}
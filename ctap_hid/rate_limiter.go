@@ -0,0 +1,50 @@
+package ctap_hid
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket limiting how often an event may happen. A zero rate disables limiting.
+type rateLimiter struct {
+	lock       sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+	now        func() time.Time
+}
+
+func newRateLimiter(perSecond int, burst int) *rateLimiter {
+	limiter := &rateLimiter{now: time.Now}
+	limiter.setRate(perSecond, burst)
+	return limiter
+}
+
+func (limiter *rateLimiter) setRate(perSecond int, burst int) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.rate = float64(perSecond)
+	limiter.burst = float64(burst)
+	limiter.tokens = float64(burst)
+	limiter.lastRefill = limiter.now()
+}
+
+func (limiter *rateLimiter) allow() bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.rate <= 0 {
+		return true
+	}
+	now := limiter.now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.lastRefill = now
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
@@ -0,0 +1,66 @@
+package ctap_hid
+
+import (
+	"sort"
+	"sync"
+)
+
+// ChannelReassembly describes the message a channel is waiting on continuation packets for
+type ChannelReassembly struct {
+	ChannelID  uint32
+	InProgress bool
+	// The command byte from the init packet, with the 0x80 frame type bit set
+	Command        uint8
+	ExpectedLength int
+	ReceivedLength int
+}
+
+// reassemblyState is a copy of the channel's pending transaction. The transaction itself is
+// guarded by the channel's message lock, which is held while a command waits for user
+// presence, so inspecting it directly could block.
+type reassemblyState struct {
+	lock     sync.Mutex
+	pending  bool
+	command  ctapHIDCommand
+	expected int
+	received int
+}
+
+func (state *reassemblyState) update(transaction *ctapHIDTransaction) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.pending = transaction != nil && !transaction.done
+	if state.pending {
+		state.command = transaction.result.header.Command
+		state.expected = int(transaction.result.header.PayloadLength)
+		state.received = len(transaction.result.payload)
+	}
+}
+
+// PendingReassemblies reports, for every channel, whether it has received the init packet
+// of a message but not all of its continuation packets, for diagnosing hosts that leave
+// transactions incomplete
+func (server *CTAPHIDServer) PendingReassemblies() []ChannelReassembly {
+	server.channelsLock.Lock()
+	channels := make([]*ctapHIDChannel, 0, len(server.channels))
+	for _, channel := range server.channels {
+		channels = append(channels, channel)
+	}
+	server.channelsLock.Unlock()
+
+	reassemblies := make([]ChannelReassembly, 0, len(channels))
+	for _, channel := range channels {
+		state := &channel.reassembly
+		state.lock.Lock()
+		reassembly := ChannelReassembly{ChannelID: uint32(channel.channelId), InProgress: state.pending}
+		if state.pending {
+			reassembly.Command = uint8(state.command)
+			reassembly.ExpectedLength = state.expected
+			reassembly.ReceivedLength = state.received
+		}
+		state.lock.Unlock()
+		reassemblies = append(reassemblies, reassembly)
+	}
+	sort.Slice(reassemblies, func(i, j int) bool { return reassemblies[i].ChannelID < reassemblies[j].ChannelID })
+	return reassemblies
+}
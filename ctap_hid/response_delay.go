@@ -0,0 +1,28 @@
+package ctap_hid
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// SetResponseDelay makes the device wait before answering CBOR and MSG requests, to
+// simulate slow hardware. Each delay is picked uniformly between min and max, so equal
+// values give a fixed delay. Keepalives keep going out during the delay of a CBOR request.
+// Zero for both, the default, turns the delay off.
+func (server *CTAPHIDServer) SetResponseDelay(min time.Duration, max time.Duration) {
+	util.Assert(min >= 0 && max >= min, "Response delay range is invalid")
+	server.minDelay = min
+	server.maxDelay = max
+}
+
+func (server *CTAPHIDServer) simulateResponseDelay() {
+	delay := server.minDelay
+	if spread := server.maxDelay - server.minDelay; spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
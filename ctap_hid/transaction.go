@@ -16,7 +16,7 @@ type transactionResult struct {
 type ctapHIDTransaction struct {
 	done      bool
 	cancelled bool
-	errorCode ctapHIDErrorCode
+	err       error
 	result    *transactionResult
 }
 
@@ -35,6 +35,11 @@ func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 		transaction.cancel() // No response to cancel message
 		return &transaction
 	}
+	if len(message) < ctapHIDInitHeaderSize {
+		ctapHIDLogger.Printf("CTAPHID ERROR: %d byte init packet has no payload length\n\n", len(message))
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	payloadLength := util.ReadBE[uint16](buffer)
 	result := transactionResult{
 		header: ctapHIDMessageHeader{
@@ -101,7 +106,7 @@ func (transaction *ctapHIDTransaction) finish() {
 func (transaction *ctapHIDTransaction) error(code ctapHIDErrorCode) {
 	ctapHIDLogger.Printf("CTAPHID TRANSACTION ERROR: %v\n\n", ctapHIDErrorCodeDescriptions[code])
 	transaction.done = true
-	transaction.errorCode = code
+	transaction.err = &HIDError{code: code}
 	transaction.result = nil
 }
 
@@ -0,0 +1,34 @@
+package ctap_hid
+
+import "sync"
+
+// Caps how many transactions may execute at once. A zero limit disables the cap.
+type transactionLimiter struct {
+	lock   sync.Mutex
+	limit  int
+	active int
+}
+
+func (limiter *transactionLimiter) setLimit(limit int) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.limit = limit
+}
+
+// acquire reserves a slot, returning false if the limit has been reached. Every successful
+// acquire must be followed by a release.
+func (limiter *transactionLimiter) acquire() bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.limit > 0 && limiter.active >= limiter.limit {
+		return false
+	}
+	limiter.active++
+	return true
+}
+
+func (limiter *transactionLimiter) release() {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.active--
+}
@@ -1,6 +1,7 @@
 package ctap_hid
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/bulwarkid/virtual-fido/test"
@@ -39,3 +40,53 @@ func TestMultipleMessages(t *testing.T) {
 	test.AssertEqual(t, result.header.PayloadLength, uint16(len(payload1)+len(payload2)), "Payload length is incorrect")
 	test.AssertArrEqual(t, result.payload, payload, "Payload is incorrect")
 }
+
+// Splits a payload into padded packets the way a host would send it
+func hostPackets(channelId ctapHIDChannelID, payload []byte) [][]byte {
+	initLength := ctapHIDMaxPacketSize - 7
+	if initLength > len(payload) {
+		initLength = len(payload)
+	}
+	packets := [][]byte{util.Pad(util.Concat(makeHeader(channelId, uint8(ctapHIDCommandCBOR), uint16(len(payload))), payload[:initLength]), ctapHIDMaxPacketSize)}
+	payload = payload[initLength:]
+	for sequence := 0; len(payload) > 0; sequence++ {
+		length := ctapHIDMaxPacketSize - 5
+		if length > len(payload) {
+			length = len(payload)
+		}
+		packets = append(packets, util.Pad(util.Concat(util.ToLE(channelId), []byte{byte(sequence)}, payload[:length]), ctapHIDMaxPacketSize))
+		payload = payload[length:]
+	}
+	return packets
+}
+
+func TestBoundaryPayloads(t *testing.T) {
+	// 57 bytes exactly fill the init packet, 57+59 exactly fill one continuation packet
+	for _, size := range []int{56, 57, 58, 57 + 58, 57 + 59, 57 + 60} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i + 1)
+		}
+		packets := hostPackets(1, payload)
+		transaction := newCTAPHIDTransaction(packets[0])
+		for _, packet := range packets[1:] {
+			test.Assert(t, !transaction.done, "Transaction finished before its last packet")
+			transaction.addMessage(packet)
+		}
+		test.Assert(t, transaction.done, "Transaction not finished after its last packet")
+		test.Assert(t, transaction.err == nil, "Transaction failed")
+		test.AssertArrEqual(t, transaction.result.payload, payload, "Reassembled payload is incorrect")
+
+		responsePackets := createResponsePackets(ctapHIDMaxPacketSize, 1, ctapHIDCommandCBOR, payload)
+		test.AssertEqual(t, len(responsePackets), len(packets), "Response split into the wrong number of packets")
+	}
+}
+
+func TestTransactionErrorIsHIDError(t *testing.T) {
+	transaction := newCTAPHIDTransaction(makeHeader(1, uint8(ctapHIDCommandCBOR), 100))
+	transaction.addMessage(util.Concat(util.ToLE(ctapHIDChannelID(1)), []byte{5}))
+	var hidErr *HIDError
+	test.Assert(t, errors.As(transaction.err, &hidErr), "Transaction error is not a HIDError")
+	test.AssertEqual(t, hidErr.Code(), byte(ctapHIDErrorInvalidSequence), "Wrong error code")
+	test.Assert(t, errors.Is(transaction.err, &HIDError{code: ctapHIDErrorInvalidSequence}), "errors.Is does not match the code")
+}
@@ -0,0 +1,56 @@
+package fido_client
+
+import (
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// BatchAssertion is one assertion produced by SignAssertions
+type BatchAssertion struct {
+	AuthenticatorData []byte
+	Signature         []byte
+	SignCount         uint32
+}
+
+// SignAssertions performs count assertions with the given credential over the same client
+// data hash, looking the credential up once. Each assertion increments the signature counter,
+// just as getAssertion does, and the counter is saved once after the batch. Intended for benchmarks and bulk testing, so no approval
+// is requested from the user.
+func (client *DefaultFIDOClient) SignAssertions(
+	relyingPartyID string,
+	credentialID []byte,
+	clientDataHash []byte,
+	count int) ([]BatchAssertion, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("Invalid assertion count: %d", count)
+	}
+	allowList := []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}}
+	sources := identities.MatchingCredentialSources(client.credentials(), relyingPartyID, allowList)
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No credential found for relying party %s", relyingPartyID)
+	}
+	source := sources[0]
+	// Also save when the counter runs out partway, since earlier increments already happened
+	defer client.saveData()
+	assertions := make([]BatchAssertion, 0, count)
+	for i := 0; i < count; i++ {
+		if !source.CounterAvailable() {
+			return nil, fmt.Errorf("Signature counter exhausted after %d assertions", i)
+		}
+		if err := client.credentials().IncrementCounter(source); err != nil {
+			return nil, fmt.Errorf("Could not increment signature counter: %w", err)
+		}
+		signCount := source.SignatureCounter
+		authData := ctap.NewAuthenticatorData(relyingPartyID, ctap.AuthDataFlagUserPresent, signCount).Bytes()
+		assertions = append(assertions, BatchAssertion{
+			AuthenticatorData: authData,
+			Signature:         source.PrivateKey.Sign(util.Concat(authData, clientDataHash)),
+			SignCount:         signCount,
+		})
+	}
+	return assertions, nil
+}
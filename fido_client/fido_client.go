@@ -1,9 +1,14 @@
 package fido_client
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
@@ -24,6 +29,7 @@ const (
 	ClientActionU2FAuthenticate    ClientAction = 1
 	ClientActionFIDOMakeCredential ClientAction = 2
 	ClientActionFIDOGetAssertion   ClientAction = 3
+	ClientActionFIDOUserPresence   ClientAction = 4
 )
 
 var clientLogger *log.Logger = util.NewLogger("[CLIENT] ", util.LogLevelDebug)
@@ -39,7 +45,12 @@ type ClientDataSaver interface {
 }
 
 type DefaultFIDOClient struct {
+	// keyLock guards the master key and the previous key, which key rotation replaces
+	// while U2F requests may be opening key handles
+	keyLock               sync.Locker
 	deviceEncryptionKey   []byte
+	previousKey           []byte
+	previousKeyExpiry     time.Time
 	certificateAuthority  *x509.Certificate
 	certPrivateKey        *cose.SupportedCOSEPrivateKey
 	authenticationCounter uint32
@@ -49,8 +60,23 @@ type DefaultFIDOClient struct {
 	pinKeyAgreement *crypto.ECDHKey
 	pinRetries      int32
 	pinHash         []byte
+	alwaysUV        bool
+	enterpriseAtt   bool
+	minPINLength    int
+	minPINRPIDs     []string
+
+	bioEnrollmentEnabled bool
+	bioEnrollments       []identities.BioEnrollment
+	largeBlobArray       []byte
+
+	autoUserPresence     bool
+	autoUserVerification bool
+	credentialSeed       []byte
+	counterStep          uint32
+	approvalTimeouts     map[ClientAction]time.Duration
 
 	vault           *identities.IdentityVault
+	store           identities.CredentialStore
 	requestApprover ClientRequestApprover
 	dataSaver       ClientDataSaver
 }
@@ -64,6 +90,7 @@ func NewDefaultClient(
 	dataSaver ClientDataSaver) *DefaultFIDOClient {
 	client := &DefaultFIDOClient{
 		pinEnabled:            enablePIN,
+		keyLock:               &sync.Mutex{},
 		deviceEncryptionKey:   secretEncryptionKey[:],
 		certificateAuthority:  rootAttestationCertificate,
 		certPrivateKey:        rootAttestationCertPrivateKey,
@@ -75,6 +102,7 @@ func NewDefaultClient(
 		vault:                 identities.NewIdentityVault(),
 		requestApprover:       requestApprover,
 		dataSaver:             dataSaver,
+		approvalTimeouts:      make(map[ClientAction]time.Duration),
 	}
 	client.loadData()
 	return client
@@ -84,53 +112,273 @@ func (client *DefaultFIDOClient) SupportsResidentKey() bool {
 	return true
 }
 
+// SetAutoApproval makes the device act as if the user approved every request (user
+// presence) and passed built-in user verification, for headless tests. The UP and UV
+// bits are still only set for the actions that were simulated.
+func (client *DefaultFIDOClient) SetAutoApproval(userPresence bool, userVerification bool) {
+	client.autoUserPresence = userPresence
+	client.autoUserVerification = userVerification
+}
+
+// SetApprovalTimeout denies requests for the given action if the request approver hasn't
+// answered within timeout, as a real authenticator stops waiting for a touch. A zero
+// timeout, the default, waits forever.
+func (client *DefaultFIDOClient) SetApprovalTimeout(action ClientAction, timeout time.Duration) {
+	util.Assert(timeout >= 0, "Approval timeout can't be negative")
+	if timeout == 0 {
+		delete(client.approvalTimeouts, action)
+		return
+	}
+	client.approvalTimeouts[action] = timeout
+}
+
+func (client *DefaultFIDOClient) approve(action ClientAction, params ClientActionRequestParams) bool {
+	timeout, ok := client.approvalTimeouts[action]
+	if !ok {
+		return client.requestApprover.ApproveClientAction(action, params)
+	}
+	// Buffered so the approver can still answer after we stop waiting
+	approved := make(chan bool, 1)
+	go func() {
+		approved <- client.requestApprover.ApproveClientAction(action, params)
+	}()
+	select {
+	case result := <-approved:
+		return result
+	case <-time.After(timeout):
+		clientLogger.Printf("ERROR: Approval of action %d timed out after %s\n\n", action, timeout)
+		return false
+	}
+}
+
+// SetDeterministicCredentials makes new credentials reproducible from the seed, for tests
+// only. See IdentityVault.SetDeterministicSeed.
+func (client *DefaultFIDOClient) SetDeterministicCredentials(seed []byte) {
+	client.credentialSeed = seed
+	client.vault.SetDeterministicSeed(seed)
+}
+
+// SetCredentialStore keeps credentials in the given store instead of the built-in vault.
+// Credentials in a custom store are not part of the saved device state: the store is
+// responsible for persisting them. A nil store restores the built-in vault.
+func (client *DefaultFIDOClient) SetCredentialStore(store identities.CredentialStore) {
+	client.store = store
+}
+
+// SetCounterStep sets how much the signature counter of credentials created from now on
+// increases with each assertion. The default is 1.
+func (client *DefaultFIDOClient) SetCounterStep(step uint32) {
+	util.Assert(step > 0, "Counter step must be positive")
+	client.counterStep = step
+}
+
+// SetCredentialCounterStep overrides the counter step of an existing credential
+func (client *DefaultFIDOClient) SetCredentialCounterStep(credentialID []byte, step uint32) error {
+	util.Assert(step > 0, "Counter step must be positive")
+	for _, source := range client.credentials().List() {
+		if bytes.Equal(source.ID, credentialID) {
+			source.CounterStep = step
+			if err := client.credentials().Save(source); err != nil {
+				return fmt.Errorf("Could not save credential: %w", err)
+			}
+			client.saveData()
+			return nil
+		}
+	}
+	return fmt.Errorf("No credential with ID %x", credentialID)
+}
+
+func (client *DefaultFIDOClient) credentials() identities.CredentialStore {
+	if client.store != nil {
+		return client.store
+	}
+	return client.vault
+}
+
+func (client *DefaultFIDOClient) SupportsUserVerification() bool {
+	return client.autoUserVerification
+}
+
+func (client *DefaultFIDOClient) VerifyUser(relyingParty string) bool {
+	return client.autoUserVerification
+}
+
 func (client *DefaultFIDOClient) NewCredentialSource(
 	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
 	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
 	relyingParty *webauthn.PublicKeyCredentialRPEntity,
-	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
-	supported := false
-	for _, param := range PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-			break
+	user *webauthn.PublicKeyCrendentialUserEntity) (*identities.CredentialSource, error) {
+	return client.newCredentialSource(PubKeyCredParams, relyingParty, user, true)
+}
+
+func (client *DefaultFIDOClient) newCredentialSource(
+	params []webauthn.PublicKeyCredentialParams,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity,
+	discoverable bool) (*identities.CredentialSource, error) {
+	// Parameters are in the relying party's order of preference
+	for _, param := range params {
+		if param.Type == "public-key" && identities.SupportsAlgorithm(param.Algorithm) {
+			newSource, err := client.saveNewCredentialSource(param.Algorithm, relyingParty, user, discoverable)
+			if err != nil {
+				return nil, fmt.Errorf("Could not save credential: %w", err)
+			}
+			client.saveData()
+			return newSource, nil
 		}
 	}
-	if !supported {
-		return nil
+	return nil, fmt.Errorf("No supported credential algorithm")
+}
+
+// Give up after this many credential ID collisions, which with random IDs means the random
+// number generator is broken
+const maxCredentialIDAttempts = 3
+
+// replaceSameCredential saves a credential over the earlier registration of the same
+// account in deterministic mode, which derived the same credential ID. The earlier
+// credential is put back if the new one can't be saved.
+func (client *DefaultFIDOClient) replaceSameCredential(existing *identities.CredentialSource, newSource *identities.CredentialSource) error {
+	store := client.credentials()
+	store.Delete(existing.ID)
+	err := store.Save(newSource)
+	if err != nil {
+		if restoreErr := store.Save(existing); restoreErr != nil {
+			clientLogger.Printf("ERROR: Could not restore credential %x: %s\n\n", existing.ID, restoreErr)
+		}
 	}
-	newSource := client.vault.NewIdentity(relyingParty, user)
-	client.saveData()
-	return newSource
+	return err
+}
+
+// deleteReplacedCredentials deletes the discoverable credentials of the same user that a
+// new discoverable credential overwrites, as the spec requires. It is only called once the
+// new credential is saved, so a failed registration keeps the user's existing credential.
+func (client *DefaultFIDOClient) deleteReplacedCredentials(newSource *identities.CredentialSource) {
+	if !newSource.Discoverable {
+		return
+	}
+	store := client.credentials()
+	for _, existing := range store.FindDiscoverable(identities.RPIDHash(newSource.RelyingParty.ID)) {
+		if !bytes.Equal(existing.ID, newSource.ID) && bytes.Equal(existing.User.ID, newSource.User.ID) {
+			store.Delete(existing.ID)
+		}
+	}
+}
+
+// saveNewCredentialSource generates and saves a credential, generating it again if its ID
+// collides with another account's credential
+func (client *DefaultFIDOClient) saveNewCredentialSource(
+	algorithm cose.COSEAlgorithmID,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity,
+	discoverable bool) (*identities.CredentialSource, error) {
+	newSource, err := client.saveGeneratedCredential(algorithm, relyingParty, user, discoverable)
+	if err != nil {
+		return nil, err
+	}
+	client.deleteReplacedCredentials(newSource)
+	return newSource, nil
 }
 
-func (client *DefaultFIDOClient) GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
-	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
+func (client *DefaultFIDOClient) saveGeneratedCredential(
+	algorithm cose.COSEAlgorithmID,
+	relyingParty *webauthn.PublicKeyCredentialRPEntity,
+	user *webauthn.PublicKeyCrendentialUserEntity,
+	discoverable bool) (*identities.CredentialSource, error) {
+	store := client.credentials()
+	var err error
+	for attempt := 0; attempt < maxCredentialIDAttempts; attempt++ {
+		newSource := client.vault.GenerateIdentity(algorithm, relyingParty, user)
+		newSource.Discoverable = discoverable
+		newSource.CounterStep = client.counterStep
+		err = store.Save(newSource)
+		if errors.Is(err, identities.ErrCredentialIDExists) {
+			existing := store.Lookup(identities.RPIDHash(relyingParty.ID), newSource.ID)
+			if existing != nil && bytes.Equal(existing.User.ID, user.ID) {
+				err = client.replaceSameCredential(existing, newSource)
+			}
+		}
+		if err == nil {
+			return newSource, nil
+		}
+		if !errors.Is(err, identities.ErrCredentialIDExists) {
+			return nil, err
+		}
+		clientLogger.Printf("ERROR: Credential ID %x collides with an existing credential\n\n", newSource.ID)
+	}
+	return nil, err
+}
+
+// CreateCredential creates and stores a credential directly, without going through
+// makeCredential. Intended for seeding known state in tests.
+func (client *DefaultFIDOClient) CreateCredential(
+	relyingPartyID string,
+	user webauthn.PublicKeyCrendentialUserEntity,
+	discoverable bool,
+	algorithm cose.COSEAlgorithmID) (*identities.CredentialSource, error) {
+	params := []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: algorithm}}
+	relyingParty := webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID, Name: relyingPartyID}
+	if !identities.SupportsAlgorithm(algorithm) {
+		return nil, fmt.Errorf("Unsupported credential algorithm: %d", algorithm)
+	}
+	return client.newCredentialSource(params, &relyingParty, &user, discoverable)
+}
+
+func (client *DefaultFIDOClient) GetAssertionSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*identities.CredentialSource {
+	sources := identities.MatchingCredentialSources(client.credentials(), relyingPartyID, allowList)
 	if len(sources) == 0 {
+		if source := client.u2fAssertionSource(relyingPartyID, allowList); source != nil {
+			return []*identities.CredentialSource{source}
+		}
 		clientLogger.Printf("ERROR: No Credentials\n\n")
-		return nil
 	}
+	return sources
+}
 
-	// TODO: Allow user to choose credential source
-	credentialSource := sources[0]
-	credentialSource.SignatureCounter++
+// IncrementSignatureCounter increments and saves the counter of a credential the user
+// approved an assertion with. U2F key handles aren't stored, and count with the
+// device-wide U2F counter instead.
+func (client *DefaultFIDOClient) IncrementSignatureCounter(credentialSource *identities.CredentialSource) error {
+	rpIDHash := identities.RPIDHash(credentialSource.RelyingParty.ID)
+	if client.credentials().Lookup(rpIDHash, credentialSource.ID) == nil {
+		credentialSource.SignatureCounter = client.NewAuthenticationCounterId()
+		return nil
+	}
+	if err := client.credentials().IncrementCounter(credentialSource); err != nil {
+		return err
+	}
 	client.saveData()
-	return credentialSource
+	return nil
 }
 
-func (client DefaultFIDOClient) ApproveAccountCreation(relyingParty string) bool {
+func (client *DefaultFIDOClient) ApproveAccountCreation(relyingParty string) bool {
+	if client.autoUserPresence {
+		return true
+	}
 	params := ClientActionRequestParams{
 		RelyingParty: relyingParty,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOMakeCredential, params)
+	return client.approve(ClientActionFIDOMakeCredential, params)
 }
 
-func (client DefaultFIDOClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+func (client *DefaultFIDOClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+	if client.autoUserPresence {
+		return true
+	}
 	params := ClientActionRequestParams{
 		RelyingParty: credentialSource.RelyingParty.Name,
 		UserName:     credentialSource.User.Name,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOGetAssertion, params)
+	return client.approve(ClientActionFIDOGetAssertion, params)
+}
+
+func (client *DefaultFIDOClient) ApproveUserPresence(relyingParty string) bool {
+	if client.autoUserPresence {
+		return true
+	}
+	params := ClientActionRequestParams{
+		RelyingParty: relyingParty,
+	}
+	return client.approve(ClientActionFIDOUserPresence, params)
 }
 
 // -----------------------
@@ -166,7 +414,7 @@ func (client *DefaultFIDOClient) SetPINHash(newHash []byte) {
 }
 
 func (client *DefaultFIDOClient) PINRetries() int32 {
-	util.Assert(client.pinRetries > 0 && client.pinRetries <= 8, "Invalid PIN Retries")
+	util.Assert(client.pinRetries >= 0 && client.pinRetries <= 8, "Invalid PIN Retries")
 	return client.pinRetries
 }
 
@@ -182,11 +430,88 @@ func (client *DefaultFIDOClient) PINToken() []byte {
 	return client.pinToken
 }
 
+func (client *DefaultFIDOClient) AlwaysUV() bool {
+	return client.alwaysUV
+}
+
+func (client *DefaultFIDOClient) SetAlwaysUV(alwaysUV bool) {
+	client.alwaysUV = alwaysUV
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) EnterpriseAttestation() bool {
+	return client.enterpriseAtt
+}
+
+func (client *DefaultFIDOClient) SetEnterpriseAttestation(enabled bool) {
+	client.enterpriseAtt = enabled
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) MinPINLength() int {
+	return client.minPINLength
+}
+
+func (client *DefaultFIDOClient) SetMinPINLength(length int) {
+	client.minPINLength = length
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) MinPINLengthRPIDs() []string {
+	return client.minPINRPIDs
+}
+
+func (client *DefaultFIDOClient) SetMinPINLengthRPIDs(rpIDs []string) {
+	client.minPINRPIDs = rpIDs
+	client.saveData()
+}
+
+// -----------------------------
+// Bio Enrollment Methods
+// -----------------------------
+
+// EnableBioEnrollment turns on the simulated fingerprint sensor
+func (client *DefaultFIDOClient) EnableBioEnrollment() {
+	client.bioEnrollmentEnabled = true
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) DisableBioEnrollment() {
+	client.bioEnrollmentEnabled = false
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) SupportsBioEnrollment() bool {
+	return client.bioEnrollmentEnabled
+}
+
+func (client *DefaultFIDOClient) BioEnrollments() []identities.BioEnrollment {
+	enrollments := make([]identities.BioEnrollment, len(client.bioEnrollments))
+	copy(enrollments, client.bioEnrollments)
+	return enrollments
+}
+
+func (client *DefaultFIDOClient) SetBioEnrollments(enrollments []identities.BioEnrollment) {
+	client.bioEnrollments = enrollments
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) LargeBlobArray() []byte {
+	return client.largeBlobArray
+}
+
+func (client *DefaultFIDOClient) SetLargeBlobArray(array []byte) {
+	client.largeBlobArray = array
+	client.saveData()
+}
+
 // -----------------------------
 // U2F Methods
 // -----------------------------
 
-func (client DefaultFIDOClient) SealingEncryptionKey() []byte {
+func (client *DefaultFIDOClient) SealingEncryptionKey() []byte {
+	client.keyLock.Lock()
+	defer client.keyLock.Unlock()
 	return client.deviceEncryptionKey
 }
 
@@ -194,9 +519,12 @@ func (client *DefaultFIDOClient) NewPrivateKey() *ecdsa.PrivateKey {
 	return crypto.GenerateECDSAKey()
 }
 
+// NewAuthenticationCounterId returns the next value of the counter shared by U2F
+// authentications and CTAP2 assertions with U2F key handles
 func (client *DefaultFIDOClient) NewAuthenticationCounterId() uint32 {
 	num := client.authenticationCounter
 	client.authenticationCounter++
+	client.saveData()
 	return num
 }
 
@@ -206,28 +534,48 @@ func (client *DefaultFIDOClient) CreateAttestationCertificiate(privateKey *cose.
 	return cert.Raw
 }
 
-func (client DefaultFIDOClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
+func (client *DefaultFIDOClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
+	if client.autoUserPresence {
+		return true
+	}
 	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FRegister, params)
+	return client.approve(ClientActionU2FRegister, params)
 }
 
-func (client DefaultFIDOClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
+func (client *DefaultFIDOClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
+	if client.autoUserPresence {
+		return true
+	}
 	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FAuthenticate, params)
+	return client.approve(ClientActionU2FAuthenticate, params)
 }
 
 func (client *DefaultFIDOClient) exportData(passphrase string) []byte {
 	privKeyBytes := cose.MarshalCOSEPrivateKey(client.certPrivateKey)
 	identityData := client.vault.Export()
+	client.keyLock.Lock()
+	encryptionKey, previousKey, previousKeyExpiry := client.deviceEncryptionKey, client.previousSealingKey(), client.previousKeyExpiry
+	client.keyLock.Unlock()
 	state := identities.FIDODeviceConfig{
-		EncryptionKey:          client.deviceEncryptionKey,
+		EncryptionKey:          encryptionKey,
+		PreviousKey:            previousKey,
 		AttestationCertificate: client.certificateAuthority.Raw,
 		AttestationPrivateKey:  privKeyBytes,
 		AuthenticationCounter:  client.authenticationCounter,
 		PINEnabled:             client.pinEnabled,
 		PINHash:                client.pinHash,
+		AlwaysUV:               client.alwaysUV,
+		EnterpriseAttestation:  client.enterpriseAtt,
+		MinPINLength:           client.minPINLength,
+		MinPINLengthRPIDs:      client.minPINRPIDs,
+		BioEnrollmentEnabled:   client.bioEnrollmentEnabled,
+		BioEnrollments:         client.bioEnrollments,
+		LargeBlobArray:         client.largeBlobArray,
 		Sources:                identityData,
 	}
+	if state.PreviousKey != nil {
+		state.PreviousKeyExpiry = &previousKeyExpiry
+	}
 	savedBytes, err := identities.EncryptFIDOState(state, passphrase)
 	util.CheckErr(err, "Could not encode saved state")
 	return savedBytes
@@ -244,13 +592,28 @@ func (client *DefaultFIDOClient) importData(data []byte, passphrase string) erro
 		util.CheckErr(err, "Could not parse private key")
 		privateKey = &cose.SupportedCOSEPrivateKey{ECDSA: privateKeyECDSA}
 	}
+	client.keyLock.Lock()
 	client.deviceEncryptionKey = state.EncryptionKey
+	client.previousKey = nil
+	if state.PreviousKey != nil && state.PreviousKeyExpiry != nil {
+		client.previousKey = state.PreviousKey
+		client.previousKeyExpiry = *state.PreviousKeyExpiry
+	}
+	client.keyLock.Unlock()
 	client.certificateAuthority = cert
 	client.certPrivateKey = privateKey
 	client.authenticationCounter = state.AuthenticationCounter
 	client.pinEnabled = state.PINEnabled
 	client.pinHash = state.PINHash
+	client.alwaysUV = state.AlwaysUV
+	client.enterpriseAtt = state.EnterpriseAttestation
+	client.minPINLength = state.MinPINLength
+	client.minPINRPIDs = state.MinPINLengthRPIDs
+	client.bioEnrollmentEnabled = state.BioEnrollmentEnabled
+	client.bioEnrollments = state.BioEnrollments
+	client.largeBlobArray = state.LargeBlobArray
 	client.vault = identities.NewIdentityVault()
+	client.vault.SetDeterministicSeed(client.credentialSeed)
 	client.vault.Import(state.Sources)
 	return nil
 }
@@ -269,14 +632,34 @@ func (client *DefaultFIDOClient) loadData() {
 
 func (client *DefaultFIDOClient) Identities() []identities.CredentialSource {
 	sources := make([]identities.CredentialSource, 0)
-	for _, source := range client.vault.CredentialSources {
+	for _, source := range client.credentials().List() {
 		sources = append(sources, *source)
 	}
 	return sources
 }
 
+// ExportCredentialBackup encrypts the stored discoverable credentials into a portable blob
+// that can be imported into another device
+func (client *DefaultFIDOClient) ExportCredentialBackup(passphrase string) ([]byte, error) {
+	return identities.ExportCredentialBackup(client.credentials().List(), passphrase)
+}
+
+// ImportCredentialBackup adds the credentials from a backup blob to this device
+func (client *DefaultFIDOClient) ImportCredentialBackup(data []byte, passphrase string) error {
+	sources, err := identities.DecryptCredentialBackup(data, passphrase)
+	if err != nil {
+		return err
+	}
+	err = identities.ImportCredentialSources(client.credentials(), sources)
+	if err != nil {
+		return err
+	}
+	client.saveData()
+	return nil
+}
+
 func (client *DefaultFIDOClient) DeleteIdentity(id []byte) bool {
-	success := client.vault.DeleteIdentity(id)
+	success := client.credentials().Delete(id)
 	if success {
 		client.saveData()
 	}
@@ -0,0 +1,581 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type dummyClientSupport struct {
+	data          []byte
+	saves         int
+	deny          bool
+	approvalDelay time.Duration
+}
+
+func (support *dummyClientSupport) ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool {
+	time.Sleep(support.approvalDelay)
+	return !support.deny
+}
+
+func (support *dummyClientSupport) SaveData(data []byte) {
+	support.data = data
+	support.saves++
+}
+
+func (support *dummyClientSupport) RetrieveData() []byte {
+	return support.data
+}
+
+func (support *dummyClientSupport) Passphrase() string {
+	return "passphrase"
+}
+
+// Records which CredentialStore methods were called, keeping credentials in a vault
+type mockCredentialStore struct {
+	vault *identities.IdentityVault
+	calls []string
+}
+
+func (store *mockCredentialStore) Save(source *identities.CredentialSource) error {
+	store.calls = append(store.calls, "Save")
+	return store.vault.Save(source)
+}
+
+func (store *mockCredentialStore) Lookup(rpIDHash []byte, credentialID []byte) *identities.CredentialSource {
+	store.calls = append(store.calls, "Lookup")
+	return store.vault.Lookup(rpIDHash, credentialID)
+}
+
+func (store *mockCredentialStore) FindDiscoverable(rpIDHash []byte) []*identities.CredentialSource {
+	store.calls = append(store.calls, "FindDiscoverable")
+	return store.vault.FindDiscoverable(rpIDHash)
+}
+
+func (store *mockCredentialStore) Delete(credentialID []byte) bool {
+	store.calls = append(store.calls, "Delete")
+	return store.vault.Delete(credentialID)
+}
+
+func (store *mockCredentialStore) IncrementCounter(source *identities.CredentialSource) error {
+	store.calls = append(store.calls, "IncrementCounter")
+	return store.vault.IncrementCounter(source)
+}
+
+func (store *mockCredentialStore) List() []*identities.CredentialSource {
+	store.calls = append(store.calls, "List")
+	return store.vault.List()
+}
+
+func (store *mockCredentialStore) takeCalls() []string {
+	calls := store.calls
+	store.calls = nil
+	return calls
+}
+
+func newTestClient(t *testing.T) *DefaultFIDOClient {
+	return newTestClientWithSupport(t, &dummyClientSupport{})
+}
+
+func newTestClientWithSupport(t *testing.T, support *dummyClientSupport) *DefaultFIDOClient {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA private key")
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	return NewDefaultClient(certificateAuthority, caPrivateKey, sha256.Sum256([]byte("test")), false, support, support)
+}
+
+type testAssertion struct {
+	Credential webauthn.PublicKeyCredentialDescriptor `cbor:"1,keyasint"`
+	AuthData   []byte                                 `cbor:"2,keyasint"`
+	Signature  []byte                                 `cbor:"3,keyasint"`
+}
+
+func getAssertion(server *ctap.CTAPServer, rpID string, clientDataHash []byte, allowList []webauthn.PublicKeyCredentialDescriptor) (byte, *testAssertion) {
+	return getAssertionWithOptions(server, rpID, clientDataHash, allowList, nil)
+}
+
+func getAssertionWithOptions(server *ctap.CTAPServer, rpID string, clientDataHash []byte, allowList []webauthn.PublicKeyCredentialDescriptor, options map[string]bool) (byte, *testAssertion) {
+	args := map[int]interface{}{1: rpID, 2: clientDataHash}
+	if allowList != nil {
+		args[3] = allowList
+	}
+	if options != nil {
+		args[5] = options
+	}
+	response := server.HandleMessage(util.Concat([]byte{0x02}, util.MarshalCBOR(args)))
+	if response[0] != 0 {
+		return response[0], nil
+	}
+	assertion := testAssertion{}
+	util.CheckErr(cbor.Unmarshal(response[1:], &assertion), "Could not decode assertion")
+	return response[0], &assertion
+}
+
+func TestCreateCredential(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice", DisplayName: "Alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	status, response := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "Assertion failed")
+	test.Assert(t, bytes.Equal(response.Credential.ID, source.ID), "Wrong credential returned")
+	test.Assert(t, source.PrivateKey.Public().Verify(util.Concat(response.AuthData, clientDataHash[:]), response.Signature), "Could not verify assertion signature")
+}
+
+func TestCreateNonDiscoverableCredential(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, false, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	status, _ := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0x2E), "Non-discoverable credential found without allow list")
+	status, response := getAssertion(server, "example.com", clientDataHash[:], []webauthn.PublicKeyCredentialDescriptor{source.CTAPDescriptor()})
+	test.AssertEqual(t, status, byte(0), "Assertion with allow list failed")
+	test.Assert(t, bytes.Equal(response.Credential.ID, source.ID), "Wrong credential returned")
+}
+
+func TestEmptyAllowListWithOnlyNonDiscoverableCredentials(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	_, err := client.CreateCredential("example.com", user, false, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	emptyAllowList := []webauthn.PublicKeyCredentialDescriptor{}
+	status, _ := getAssertion(server, "example.com", clientDataHash[:], emptyAllowList)
+	test.AssertEqual(t, status, byte(0x2E), "Non-discoverable credential found with an empty allow list")
+
+	// An empty allow list still finds discoverable credentials
+	discoverable, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	status, response := getAssertion(server, "example.com", clientDataHash[:], emptyAllowList)
+	test.AssertEqual(t, status, byte(0), "Discoverable credential not found with an empty allow list")
+	test.Assert(t, bytes.Equal(response.Credential.ID, discoverable.ID), "Wrong credential returned")
+}
+
+func TestCreateCredentialUnsupportedAlgorithm(t *testing.T) {
+	client := newTestClient(t)
+	_, err := client.CreateCredential("example.com", webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}}, true, cose.COSEAlgorithmID(-9999))
+	test.Assert(t, err != nil, "Created credential with unsupported algorithm")
+}
+
+func TestAutoApprovalSetsPresenceAndVerification(t *testing.T) {
+	support := &dummyClientSupport{deny: true}
+	client := newTestClientWithSupport(t, support)
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	makeCredential := map[int]interface{}{
+		1: clientDataHash[:],
+		2: webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		3: webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"},
+		4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		7: map[string]bool{"rk": true, "uv": true},
+	}
+	message := util.Concat([]byte{0x01}, util.MarshalCBOR(makeCredential))
+	// Without auto verification the client has no way to verify the user, so uv is rejected
+	test.AssertEqual(t, server.HandleMessage(message)[0], byte(0x2C), "Request for impossible UV was not rejected")
+
+	client.SetAutoApproval(true, true)
+	response := server.HandleMessage(message)
+	test.AssertEqual(t, response[0], byte(0), "makeCredential failed with auto approval")
+	var mcResponse struct {
+		AuthData []byte `cbor:"2,keyasint"`
+	}
+	util.CheckErr(cbor.Unmarshal(response[1:], &mcResponse), "Could not decode makeCredential response")
+	authData, err := ctap.ParseAuthenticatorData(mcResponse.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, authData.HasFlag(ctap.AuthDataFlagUserPresent), "UP not set with auto approval")
+	test.Assert(t, authData.HasFlag(ctap.AuthDataFlagUserVerified), "UV not set with auto verification")
+
+	status, assertion := getAssertionWithOptions(server, "example.com", clientDataHash[:], nil, map[string]bool{"uv": true})
+	test.AssertEqual(t, status, byte(0), "getAssertion failed with auto approval")
+	authData, err = ctap.ParseAuthenticatorData(assertion.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.Assert(t, authData.HasFlag(ctap.AuthDataFlagUserPresent), "UP not set with auto approval")
+	test.Assert(t, authData.HasFlag(ctap.AuthDataFlagUserVerified), "UV not set with auto verification")
+
+	// UV is only reported when it was asked for and simulated
+	status, assertion = getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "getAssertion failed with auto approval")
+	authData, _ = ctap.ParseAuthenticatorData(assertion.AuthData)
+	test.Assert(t, authData.HasFlag(ctap.AuthDataFlagUserPresent), "UP not set with auto approval")
+	test.Assert(t, !authData.HasFlag(ctap.AuthDataFlagUserVerified), "UV set without being requested")
+
+	// Without a way to verify the user, a required UV fails instead of being skipped
+	client.SetAutoApproval(true, false)
+	status, _ = getAssertionWithOptions(server, "example.com", clientDataHash[:], nil, map[string]bool{"uv": true})
+	test.AssertEqual(t, status, byte(0x2C), "getAssertion requiring UV succeeded without auto verification")
+}
+
+func TestDeterministicCredentials(t *testing.T) {
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	seed := []byte("test seed")
+	first := newTestClient(t)
+	first.SetDeterministicCredentials(seed)
+	firstSource, err := first.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	second := newTestClient(t)
+	second.SetDeterministicCredentials(seed)
+	secondSource, err := second.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	test.AssertArrEqual(t, firstSource.ID, secondSource.ID, "Credential IDs differ with the same seed")
+
+	// Registering the same user again derives the same ID and overwrites the credential
+	thirdSource, err := second.CreateCredential("example.com", user, false, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not register the same user again")
+	test.AssertArrEqual(t, thirdSource.ID, secondSource.ID, "Credential ID differs for the same user")
+	test.AssertEqual(t, len(second.credentials().List()), 1, "Re-registration did not replace the credential")
+	test.Assert(t, second.credentials().List()[0] == thirdSource, "Existing credential was kept")
+}
+
+func TestMakeCredentialOverwritesDiscoverableCredential(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	first, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	nonDiscoverable, err := client.CreateCredential("example.com", user, false, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	other, err := client.CreateCredential("example.com", webauthn.PublicKeyCrendentialUserEntity{ID: []byte{4}, Name: "bob"}, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	second, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	stored := client.credentials().List()
+	test.AssertEqual(t, len(stored), 3, "Wrong number of credentials")
+	for _, source := range stored {
+		test.Assert(t, source != first, "Discoverable credential for the same user was kept")
+	}
+	test.Assert(t, client.credentials().Lookup(identities.RPIDHash("example.com"), second.ID) == second, "New credential not stored")
+	test.Assert(t, client.credentials().Lookup(identities.RPIDHash("example.com"), nonDiscoverable.ID) == nonDiscoverable, "Non-discoverable credential was replaced")
+	test.Assert(t, client.credentials().Lookup(identities.RPIDHash("example.com"), other.ID) == other, "Another user's credential was replaced")
+}
+
+// Fails the first save after a delete, as if the disk filled up mid-replacement
+type failingSaveStore struct {
+	identities.CredentialStore
+	deleted bool
+	failed  bool
+}
+
+func (store *failingSaveStore) Delete(credentialID []byte) bool {
+	store.deleted = true
+	return store.CredentialStore.Delete(credentialID)
+}
+
+func (store *failingSaveStore) Save(source *identities.CredentialSource) error {
+	if store.deleted && !store.failed {
+		store.failed = true
+		return fmt.Errorf("disk full")
+	}
+	return store.CredentialStore.Save(source)
+}
+
+func TestFailedRegistrationKeepsCredential(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	vault := identities.NewIdentityVault()
+	client.SetCredentialStore(&mockCredentialStore{vault: vault})
+	existing, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	client.SetCredentialStore(&brokenCredentialStore{mockCredentialStore: mockCredentialStore{vault: vault}, saveErr: fmt.Errorf("disk full")})
+	_, err = client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err != nil, "Save error not reported")
+	test.Assert(t, vault.Lookup(identities.RPIDHash("example.com"), existing.ID) == existing, "Existing credential deleted by a failed registration")
+
+	// In deterministic mode the new credential has the same ID, and the old one is restored
+	seeded := newTestClient(t)
+	seeded.SetDeterministicCredentials([]byte("test seed"))
+	existing, err = seeded.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	store := &failingSaveStore{CredentialStore: seeded.credentials()}
+	seeded.SetCredentialStore(store)
+	_, err = seeded.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err != nil, "Save error not reported")
+	test.Assert(t, seeded.vault.Lookup(identities.RPIDHash("example.com"), existing.ID) == existing, "Existing credential not restored")
+}
+
+func TestSignAssertions(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	support := client.dataSaver.(*dummyClientSupport)
+	savesBefore := support.saves
+	assertions, err := client.SignAssertions("example.com", source.ID, clientDataHash[:], 10)
+	test.Assert(t, err == nil, "Could not sign assertions")
+	test.AssertEqual(t, len(assertions), 10, "Wrong number of assertions")
+	previousCount := uint32(0)
+	for _, assertion := range assertions {
+		authData, err := ctap.ParseAuthenticatorData(assertion.AuthenticatorData)
+		test.Assert(t, err == nil, "Could not parse authenticator data")
+		test.AssertEqual(t, authData.SignCount, assertion.SignCount, "Sign count doesn't match authenticator data")
+		test.Assert(t, assertion.SignCount > previousCount, "Sign counter did not increase")
+		test.Assert(t, source.PrivateKey.Public().Verify(util.Concat(assertion.AuthenticatorData, clientDataHash[:]), assertion.Signature), "Could not verify assertion signature")
+		previousCount = assertion.SignCount
+	}
+
+	// The last counter must have been saved, once for the whole batch
+	test.AssertEqual(t, support.saves, savesBefore+1, "Batch was not saved exactly once")
+	reloaded := newTestClientWithSupport(t, support)
+	test.AssertEqual(t, reloaded.Identities()[0].SignatureCounter, previousCount, "Sign counter was not saved")
+
+	_, err = client.SignAssertions("example.com", source.ID, clientDataHash[:], -1)
+	test.Assert(t, err != nil, "Signed a negative number of assertions")
+
+	_, err = client.SignAssertions("other.com", source.ID, clientDataHash[:], 1)
+	test.Assert(t, err != nil, "Signed assertions for the wrong relying party")
+}
+
+func BenchmarkSignAssertions(b *testing.B) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	util.CheckErr(err, "Could not create CA private key")
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	util.CheckErr(err, "Could not create CA")
+	support := &dummyClientSupport{}
+	client := NewDefaultClient(certificateAuthority, caPrivateKey, sha256.Sum256([]byte("test")), false, support, support)
+	source, err := client.CreateCredential("example.com", webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}}, true, cose.COSE_ALGORITHM_ID_ES256)
+	util.CheckErr(err, "Could not create credential")
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	b.ResetTimer()
+	_, err = client.SignAssertions("example.com", source.ID, clientDataHash[:], b.N)
+	util.CheckErr(err, "Could not sign assertions")
+}
+
+func TestAssertionSignedWithCredentialAlgorithm(t *testing.T) {
+	client := newTestClient(t)
+	server := ctap.NewCTAPServer(client)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	edSource, err := client.CreateCredential("ed.example.com", user, true, cose.COSE_ALGORITHM_ID_ED25519)
+	test.Assert(t, err == nil, "Could not create EdDSA credential")
+	ecSource, err := client.CreateCredential("ec.example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create ES256 credential")
+	test.AssertEqual(t, edSource.Algorithm(), cose.COSE_ALGORITHM_ID_ED25519, "Wrong algorithm for EdDSA credential")
+	test.AssertEqual(t, ecSource.Algorithm(), cose.COSE_ALGORITHM_ID_ES256, "Wrong algorithm for ES256 credential")
+
+	// Reload from saved data to check the algorithm is stored with the key
+	reloaded := newTestClientWithSupport(t, client.dataSaver.(*dummyClientSupport))
+	server = ctap.NewCTAPServer(reloaded)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+
+	status, response := getAssertion(server, "ed.example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "EdDSA assertion failed")
+	signedData := util.Concat(response.AuthData, clientDataHash[:])
+	test.Assert(t, ed25519.Verify(edSource.PrivateKey.Ed25519.Public().(ed25519.PublicKey), signedData, response.Signature), "EdDSA assertion was not signed with Ed25519")
+
+	status, response = getAssertion(server, "ec.example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "ES256 assertion failed")
+	signedData = util.Concat(response.AuthData, clientDataHash[:])
+	digest := sha256.Sum256(signedData)
+	test.Assert(t, ecdsa.VerifyASN1(&ecSource.PrivateKey.ECDSA.PublicKey, digest[:], response.Signature), "ES256 assertion was not signed with ECDSA")
+}
+
+func TestCustomCredentialStore(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	client.SetAutoApproval(true, false)
+	store := &mockCredentialStore{vault: identities.NewIdentityVault()}
+	client.SetCredentialStore(store)
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+
+	makeCredential := map[int]interface{}{
+		1: clientDataHash[:],
+		2: webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		3: webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"},
+		4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+	}
+	response := server.HandleMessage(util.Concat([]byte{0x01}, util.MarshalCBOR(makeCredential)))
+	test.AssertEqual(t, response[0], byte(0), "makeCredential failed")
+	test.AssertArrEqual(t, store.takeCalls(), []string{"Save", "FindDiscoverable"}, "Wrong store calls during makeCredential")
+	test.AssertEqual(t, len(store.vault.CredentialSources), 1, "Credential not saved in custom store")
+	// The custom store persists its own credentials, so none end up in the saved device state
+	state, err := identities.DecryptFIDOState(support.data, support.Passphrase())
+	test.Assert(t, err == nil, "Could not decrypt saved state")
+	test.AssertEqual(t, len(state.Sources), 0, "Custom store credentials saved with the device state")
+
+	status, assertion := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "Discoverable getAssertion failed")
+	test.AssertArrEqual(t, store.takeCalls(), []string{"FindDiscoverable", "Lookup", "IncrementCounter"}, "Wrong store calls during discoverable getAssertion")
+
+	allowList := []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: assertion.Credential.ID}}
+	status, _ = getAssertion(server, "example.com", clientDataHash[:], allowList)
+	test.AssertEqual(t, status, byte(0), "getAssertion with allow list failed")
+	test.AssertArrEqual(t, store.takeCalls(), []string{"Lookup", "Lookup", "IncrementCounter"}, "Wrong store calls during getAssertion with allow list")
+	test.AssertEqual(t, store.vault.CredentialSources[0].SignatureCounter, uint32(2), "Signature counter not incremented in store")
+
+	test.Assert(t, client.DeleteIdentity(assertion.Credential.ID), "Could not delete credential")
+	test.AssertArrEqual(t, store.takeCalls(), []string{"Delete"}, "Wrong store calls during delete")
+	test.AssertEqual(t, len(store.vault.CredentialSources), 0, "Credential not deleted from custom store")
+}
+
+func TestSignatureCounterExhausted(t *testing.T) {
+	client := newTestClient(t)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	source.SignatureCounter = identities.MaxSignatureCounter - 2
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	status, response := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "Assertion below the maximum counter failed")
+	authData, err := ctap.ParseAuthenticatorData(response.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.AssertEqual(t, authData.SignCount, identities.MaxSignatureCounter-1, "Wrong sign count")
+
+	// The next assertion would reach the maximum, so it is refused without touching the counter
+	status, _ = getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0x30), "Assertion at the maximum counter was not refused with NOT_ALLOWED")
+	status, _ = getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0x30), "Assertion after the maximum counter was not refused with NOT_ALLOWED")
+	test.AssertEqual(t, source.SignatureCounter, identities.MaxSignatureCounter-1, "Refused assertion changed the signature counter")
+
+	_, err = client.SignAssertions("example.com", source.ID, clientDataHash[:], 1)
+	test.Assert(t, err != nil, "Signed batch assertion with an exhausted counter")
+}
+
+func TestDeniedAssertionKeepsCounter(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	savedBefore := support.data
+
+	support.deny = true
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	status, _ := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0x27), "Denied assertion was not refused with OPERATION_DENIED")
+	test.AssertEqual(t, source.SignatureCounter, uint32(0), "Denied assertion incremented the signature counter")
+	test.Assert(t, source.LastUsedAt.IsZero(), "Denied assertion marked the credential as used")
+	test.Assert(t, bytes.Equal(support.data, savedBefore), "Denied assertion saved the device state")
+
+	support.deny = false
+	status, response := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "Approved assertion failed")
+	authData, err := ctap.ParseAuthenticatorData(response.AuthData)
+	test.Assert(t, err == nil, "Could not parse authenticator data")
+	test.AssertEqual(t, authData.SignCount, uint32(1), "Approved assertion did not increment the counter")
+}
+
+func TestCounterStep(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	client.SetCounterStep(5)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	signCount := func() uint32 {
+		status, response := getAssertion(server, "example.com", clientDataHash[:], nil)
+		test.AssertEqual(t, status, byte(0), "Assertion failed")
+		authData, err := ctap.ParseAuthenticatorData(response.AuthData)
+		test.Assert(t, err == nil, "Could not parse authenticator data")
+		return authData.SignCount
+	}
+	test.AssertEqual(t, signCount(), uint32(5), "Counter did not step by 5")
+	test.AssertEqual(t, signCount(), uint32(10), "Counter did not step by 5")
+
+	// A per-credential override survives reloading the device state
+	test.Assert(t, client.SetCredentialCounterStep(source.ID, 2) == nil, "Could not override counter step")
+	test.AssertEqual(t, signCount(), uint32(12), "Counter did not use the per-credential step")
+	reloaded := newTestClientWithSupport(t, support)
+	server = ctap.NewCTAPServer(reloaded)
+	test.AssertEqual(t, signCount(), uint32(14), "Counter step was not saved with the credential")
+	test.Assert(t, reloaded.SetCredentialCounterStep([]byte{9, 9}, 2) != nil, "Overrode the step of a missing credential")
+}
+
+func TestCredentialTimestamps(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	before := time.Now()
+	_, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	listed := client.Identities()[0]
+	test.Assert(t, !listed.CreatedAt.Before(before) && !listed.CreatedAt.After(time.Now()), "Creation time not set")
+	test.Assert(t, listed.LastUsedAt.IsZero(), "New credential marked as used")
+
+	server := ctap.NewCTAPServer(client)
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	beforeAssertion := time.Now()
+	status, _ := getAssertion(server, "example.com", clientDataHash[:], nil)
+	test.AssertEqual(t, status, byte(0), "Assertion failed")
+	used := client.Identities()[0]
+	test.Assert(t, !used.LastUsedAt.Before(beforeAssertion) && !used.LastUsedAt.After(time.Now()), "Last used time not updated on assertion")
+	test.Assert(t, used.CreatedAt.Equal(listed.CreatedAt), "Creation time changed on assertion")
+
+	// Both timestamps are saved with the credential
+	reloaded := newTestClientWithSupport(t, support).Identities()[0]
+	test.Assert(t, reloaded.CreatedAt.Equal(used.CreatedAt), "Creation time not saved")
+	test.Assert(t, reloaded.LastUsedAt.Equal(used.LastUsedAt), "Last used time not saved")
+}
+
+func TestApprovalTimeoutPerAction(t *testing.T) {
+	support := &dummyClientSupport{approvalDelay: 50 * time.Millisecond}
+	client := newTestClientWithSupport(t, support)
+	client.SetApprovalTimeout(ClientActionFIDOUserPresence, 10*time.Millisecond)
+	client.SetApprovalTimeout(ClientActionFIDOMakeCredential, time.Second)
+
+	start := time.Now()
+	test.Assert(t, !client.ApproveUserPresence("example.com"), "Selection approved after its timeout")
+	test.Assert(t, time.Since(start) < 50*time.Millisecond, "Selection did not time out early")
+	test.Assert(t, client.ApproveAccountCreation("example.com"), "makeCredential timed out before its own timeout")
+
+	// Actions without a timeout wait for the approver
+	test.Assert(t, client.ApproveAccountLogin(&identities.CredentialSource{
+		RelyingParty: &webauthn.PublicKeyCredentialRPEntity{ID: "example.com"},
+		User:         &webauthn.PublicKeyCrendentialUserEntity{Name: "alice"},
+	}), "Action without a timeout was denied")
+	client.SetApprovalTimeout(ClientActionFIDOUserPresence, 0)
+	test.Assert(t, client.ApproveUserPresence("example.com"), "Cleared timeout still applied")
+}
+
+func TestMakeCredentialReportsSaveError(t *testing.T) {
+	client := newTestClient(t)
+	client.SetAutoApproval(true, false)
+	client.SetCredentialStore(&brokenCredentialStore{
+		mockCredentialStore: mockCredentialStore{vault: identities.NewIdentityVault()},
+		saveErr:             identities.ErrCredentialIDExists,
+	})
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	_, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, errors.Is(err, identities.ErrCredentialIDExists), "Credential ID collision not reported")
+
+	clientDataHash := sha256.Sum256([]byte("client data"))
+	makeCredential := map[int]interface{}{
+		1: clientDataHash[:],
+		2: webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		3: user,
+		4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+	}
+	response := ctap.NewCTAPServer(client).HandleMessage(util.Concat([]byte{0x01}, util.MarshalCBOR(makeCredential)))
+	test.AssertArrEqual(t, response, []byte{0x7F}, "Save failure not reported as CTAP1_ERR_OTHER")
+}
@@ -0,0 +1,35 @@
+package fido_client
+
+import "time"
+
+// RotateMasterKey replaces the device master key, which wraps the non-resident U2F key
+// handles, and saves the device state with the new key. Resident credentials are kept in
+// the passphrase-encrypted state rather than wrapped by the master key, so they carry over
+// unchanged. Key handles sealed with the old key are still accepted for the
+// grace period and become invalid after it. A zero grace period invalidates them at once.
+func (client *DefaultFIDOClient) RotateMasterKey(newKey [32]byte, gracePeriod time.Duration) {
+	client.keyLock.Lock()
+	client.previousKey = nil
+	if gracePeriod > 0 {
+		client.previousKey = client.deviceEncryptionKey
+		client.previousKeyExpiry = time.Now().Add(gracePeriod)
+	}
+	client.deviceEncryptionKey = newKey[:]
+	client.keyLock.Unlock()
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) PreviousSealingEncryptionKey() []byte {
+	client.keyLock.Lock()
+	defer client.keyLock.Unlock()
+	return client.previousSealingKey()
+}
+
+// previousSealingKey returns the previous key while it is within its grace period. The
+// caller must hold keyLock.
+func (client *DefaultFIDOClient) previousSealingKey() []byte {
+	if client.previousKey == nil || time.Now().After(client.previousKeyExpiry) {
+		return nil
+	}
+	return client.previousKey
+}
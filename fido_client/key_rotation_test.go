@@ -0,0 +1,104 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func registerU2F(t *testing.T, server *u2f.U2FServer, application []byte) []byte {
+	request := util.Concat([]byte{0, 0x01, 0, 0, 0, 0, 64}, crypto.RandomBytes(32), application)
+	response := server.HandleMessage(request)
+	test.Assert(t, len(response) > 67 && response[0] == 0x05, "U2F registration failed")
+	return response[67 : 67+int(response[66])]
+}
+
+// checkU2FKeyHandle asks the server whether it recognizes the key handle, which a check-only
+// authentication answers with "conditions not satisfied"
+func checkU2FKeyHandle(server *u2f.U2FServer, application []byte, keyHandle []byte) bool {
+	request := util.Concat(crypto.RandomBytes(32), application, []byte{uint8(len(keyHandle))}, keyHandle)
+	message := util.Concat([]byte{0, 0x02, 0x07, 0, 0}, util.ToBE(uint16(len(request))), request)
+	return bytes.Equal(server.HandleMessage(message), []byte{0x69, 0x85})
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	client.SetAutoApproval(true, false)
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	source, err := client.CreateCredential("example.com", user, true, cose.COSE_ALGORITHM_ID_ES256)
+	test.Assert(t, err == nil, "Could not create credential")
+	u2fServer := u2f.NewU2FServer(client)
+	application := crypto.HashSHA256([]byte("example.com"))
+	keyHandle := registerU2F(t, u2fServer, application)
+
+	oldKey := append([]byte{}, client.SealingEncryptionKey()...)
+	client.RotateMasterKey(sha256.Sum256([]byte("rotated")), time.Hour)
+	test.Assert(t, !bytes.Equal(client.SealingEncryptionKey(), oldKey), "Master key did not change")
+	state, err := identities.DecryptFIDOState(support.data, support.Passphrase())
+	test.Assert(t, err == nil, "Could not decrypt saved state")
+	test.AssertArrEqual(t, state.EncryptionKey, client.SealingEncryptionKey(), "New master key not saved")
+
+	// Resident credentials survive the rotation, also after reloading the saved state
+	for _, rotated := range []*DefaultFIDOClient{client, newTestClientWithSupport(t, support)} {
+		server := ctap.NewCTAPServer(rotated)
+		clientDataHash := sha256.Sum256([]byte("client data"))
+		status, response := getAssertion(server, "example.com", clientDataHash[:], nil)
+		test.AssertEqual(t, status, byte(0), "Assertion failed after rotation")
+		test.Assert(t, bytes.Equal(response.Credential.ID, source.ID), "Wrong credential returned")
+		test.Assert(t, source.PrivateKey.Public().Verify(util.Concat(response.AuthData, clientDataHash[:]), response.Signature), "Could not verify assertion signature")
+	}
+
+	// Old key handles keep working during the grace period, new ones use the new key
+	test.Assert(t, checkU2FKeyHandle(u2fServer, application, keyHandle), "Old key handle rejected during the grace period")
+	reloaded := newTestClientWithSupport(t, support)
+	test.Assert(t, checkU2FKeyHandle(u2f.NewU2FServer(reloaded), application, keyHandle), "Grace period not saved")
+	newKeyHandle := registerU2F(t, u2fServer, application)
+
+	client.RotateMasterKey(sha256.Sum256([]byte("rotated again")), 0)
+	test.Assert(t, !checkU2FKeyHandle(u2fServer, application, keyHandle), "Key handle accepted two rotations later")
+	test.Assert(t, !checkU2FKeyHandle(u2fServer, application, newKeyHandle), "Key handle accepted without a grace period")
+}
+
+func TestRotateMasterKeyGracePeriodExpires(t *testing.T) {
+	client := newTestClient(t)
+	client.SetAutoApproval(true, false)
+	u2fServer := u2f.NewU2FServer(client)
+	application := crypto.HashSHA256([]byte("example.com"))
+	keyHandle := registerU2F(t, u2fServer, application)
+	client.RotateMasterKey(sha256.Sum256([]byte("rotated")), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	test.Assert(t, client.PreviousSealingEncryptionKey() == nil, "Previous key still returned after the grace period")
+	test.Assert(t, !checkU2FKeyHandle(u2fServer, application, keyHandle), "Key handle accepted after the grace period")
+}
+
+func TestRotateMasterKeyWhileOpeningKeyHandles(t *testing.T) {
+	client := newTestClientWithSupport(t, &dummyClientSupport{})
+	client.SetAutoApproval(true, false)
+	u2fServer := u2f.NewU2FServer(client)
+	application := crypto.HashSHA256([]byte("example.com"))
+	keyHandle := registerU2F(t, u2fServer, application)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			client.RotateMasterKey(sha256.Sum256([]byte{byte(i)}), time.Hour)
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		checkU2FKeyHandle(u2fServer, application, keyHandle)
+	}
+	<-done
+	test.Assert(t, !checkU2FKeyHandle(u2fServer, application, keyHandle), "Key handle accepted after the previous key was replaced twice")
+}
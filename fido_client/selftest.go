@@ -0,0 +1,60 @@
+package fido_client
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// SelfTest checks that the device works end to end before it is exposed to hosts: it signs
+// and verifies with a key of every supported algorithm, encrypts with the device key, and
+// saves, looks up and deletes a credential. The credential goes to a scratch in-memory
+// vault, so the user's credential store is never written.
+func (client *DefaultFIDOClient) SelfTest() error {
+	relyingParty := &webauthn.PublicKeyCredentialRPEntity{ID: "self-test.invalid", Name: "Self test"}
+	user := &webauthn.PublicKeyCrendentialUserEntity{ID: crypto.RandomBytes(16), Name: "self-test"}
+	testVector := []byte("virtual-fido self test")
+
+	var source *identities.CredentialSource
+	for _, algorithm := range ctap.CredentialAlgorithms() {
+		source = client.vault.GenerateIdentity(algorithm, relyingParty, user)
+		if source == nil {
+			return fmt.Errorf("Could not generate a key for algorithm %d", algorithm)
+		}
+		signature := source.PrivateKey.Sign(testVector)
+		if !source.PrivateKey.Public().Verify(testVector, signature) {
+			return fmt.Errorf("Signature with algorithm %d does not verify", algorithm)
+		}
+		if source.PrivateKey.Public().Verify(append(testVector, 0), signature) {
+			return fmt.Errorf("Signature with algorithm %d verifies for different data", algorithm)
+		}
+	}
+
+	deviceKey := client.SealingEncryptionKey()
+	encrypted, nonce, err := crypto.Encrypt(deviceKey, testVector)
+	if err != nil {
+		return fmt.Errorf("Could not encrypt with the device key: %w", err)
+	}
+	decrypted, err := crypto.Decrypt(deviceKey, encrypted, nonce)
+	if err != nil || !bytes.Equal(decrypted, testVector) {
+		return fmt.Errorf("Could not decrypt with the device key: %v", err)
+	}
+
+	store := identities.NewIdentityVault()
+	if err := store.Save(source); err != nil {
+		return fmt.Errorf("Could not save a credential: %w", err)
+	}
+	found := store.Lookup(identities.RPIDHash(relyingParty.ID), source.ID)
+	deleted := store.Delete(source.ID)
+	if found == nil || !bytes.Equal(found.ID, source.ID) || !found.PrivateKey.Equal(source.PrivateKey) {
+		return fmt.Errorf("Saved credential could not be looked up")
+	}
+	if !deleted {
+		return fmt.Errorf("Saved credential could not be deleted")
+	}
+	return nil
+}
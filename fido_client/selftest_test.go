@@ -0,0 +1,42 @@
+package fido_client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+)
+
+// Loses everything it is given
+type brokenCredentialStore struct {
+	mockCredentialStore
+	saveErr error
+}
+
+func (store *brokenCredentialStore) Save(source *identities.CredentialSource) error {
+	return store.saveErr
+}
+
+func TestSelfTest(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClientWithSupport(t, support)
+	test.Assert(t, client.SelfTest() == nil, "Self test failed with the default configuration")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Self test left a credential behind")
+	test.Assert(t, support.data == nil, "Self test saved the device state")
+
+	store := &mockCredentialStore{vault: &identities.IdentityVault{}}
+	client.SetCredentialStore(store)
+	test.Assert(t, client.SelfTest() == nil, "Self test failed with a working custom store")
+	test.AssertEqual(t, len(store.takeCalls()), 0, "Self test used the custom store")
+}
+
+func TestSelfTestBrokenStore(t *testing.T) {
+	// The self test only uses a scratch vault, so the state of the real store can't fail it
+	client := newTestClient(t)
+	client.SetCredentialStore(&brokenCredentialStore{
+		mockCredentialStore: mockCredentialStore{vault: &identities.IdentityVault{}},
+		saveErr:             fmt.Errorf("disk full"),
+	})
+	test.Assert(t, client.SelfTest() == nil, "Self test used the broken store")
+}
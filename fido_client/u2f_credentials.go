@@ -0,0 +1,45 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/x509"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// u2fCredentialSource opens a credential ID that is a U2F key handle registered for the
+// relying party, or returns nil if it isn't one. The source isn't stored anywhere, since
+// the key handle holds the whole credential.
+func (client *DefaultFIDOClient) u2fCredentialSource(relyingPartyID string, credentialID []byte) *identities.CredentialSource {
+	keyHandle, err := u2f.OpenKeyHandle(client, credentialID)
+	if err != nil || keyHandle.PrivateKey == nil || !bytes.Equal(keyHandle.ApplicationID, identities.RPIDHash(relyingPartyID)) {
+		return nil
+	}
+	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
+	if err != nil {
+		return nil
+	}
+	return &identities.CredentialSource{
+		Type:         "public-key",
+		ID:           credentialID,
+		PrivateKey:   &cose.SupportedCOSEPrivateKey{ECDSA: privateKey},
+		RelyingParty: &webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID, Name: relyingPartyID},
+		User:         &webauthn.PublicKeyCrendentialUserEntity{},
+	}
+}
+
+// u2fAssertionSource finds a U2F key handle in the allow list. Its signature counter comes
+// from the same counter as U2F authentications, so relying parties that see the credential
+// over both protocols never see the counter go backwards. The counter is only taken in
+// IncrementSignatureCounter, once the assertion was approved.
+func (client *DefaultFIDOClient) u2fAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
+	for _, allowed := range allowList {
+		if source := client.u2fCredentialSource(relyingPartyID, allowed.ID); source != nil {
+			return source
+		}
+	}
+	return nil
+}
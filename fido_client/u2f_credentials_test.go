@@ -0,0 +1,52 @@
+package fido_client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func authenticateU2F(t *testing.T, server *u2f.U2FServer, application []byte, keyHandle []byte) uint32 {
+	request := util.Concat(crypto.RandomBytes(32), application, []byte{uint8(len(keyHandle))}, keyHandle)
+	message := util.Concat([]byte{0, 0x02, 0x03, 0, 0}, util.ToBE(uint16(len(request))), request)
+	response := server.HandleMessage(message)
+	test.Assert(t, len(response) > 7 && bytes.Equal(response[len(response)-2:], []byte{0x90, 0x00}), "U2F authentication failed")
+	return util.ReadBE[uint32](bytes.NewBuffer(response[1:5]))
+}
+
+func TestU2FKeyHandleSharesCounterWithCTAP2(t *testing.T) {
+	client := newTestClient(t)
+	client.SetAutoApproval(true, false)
+	u2fServer := u2f.NewU2FServer(client)
+	ctapServer := ctap.NewCTAPServer(client)
+	application := crypto.HashSHA256([]byte("example.com"))
+	keyHandle := registerU2F(t, u2fServer, application)
+	allowList := []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: keyHandle}}
+	clientDataHash := sha256.Sum256([]byte("client data"))
+
+	previous := uint32(0)
+	for i := 0; i < 3; i++ {
+		counter := authenticateU2F(t, u2fServer, application, keyHandle)
+		test.Assert(t, counter > previous, "U2F counter did not increase")
+		previous = counter
+
+		status, assertion := getAssertion(ctapServer, "example.com", clientDataHash[:], allowList)
+		test.AssertEqual(t, status, byte(0), "getAssertion with a U2F key handle failed")
+		test.AssertArrEqual(t, assertion.Credential.ID, keyHandle, "Wrong credential returned")
+		authData, err := ctap.ParseAuthenticatorData(assertion.AuthData)
+		test.Assert(t, err == nil, "Could not parse authenticator data")
+		test.Assert(t, authData.SignCount > previous, "CTAP2 counter did not increase past the U2F counter")
+		previous = authData.SignCount
+	}
+
+	// The key handle is bound to the relying party it was registered for
+	status, _ := getAssertion(ctapServer, "other.example.com", clientDataHash[:], allowList)
+	test.AssertEqual(t, status, byte(0x2E), "U2F key handle used for another relying party")
+}
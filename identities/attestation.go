@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"math/big"
 	"time"
 
@@ -104,3 +105,54 @@ func CreateSelfSignedCA(privateKey *cose.SupportedCOSEPrivateKey) (*x509.Certifi
 	}
 	return x509.ParseCertificate(certBytes)
 }
+
+var (
+	oidSubjectAltName      = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+	oidTPMManufacturer     = asn1.ObjectIdentifier{2, 23, 133, 2, 1}
+	oidTPMModel            = asn1.ObjectIdentifier{2, 23, 133, 2, 2}
+	oidTPMVersion          = asn1.ObjectIdentifier{2, 23, 133, 2, 3}
+)
+
+// CreateTPMAIKCertificate issues a certificate for a TPM attestation identity key shaped the
+// way WebAuthn's tpm attestation format requires: an empty subject, the TPM described in a
+// critical subject alternative name, and the tcg-kp-AIKCertificate extended key usage.
+func CreateTPMAIKCertificate(
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	aik *cose.SupportedCOSEPrivateKey) (*x509.Certificate, error) {
+	tpmDescription, err := asn1.Marshal(pkix.RDNSequence{
+		{{Type: oidTPMManufacturer, Value: "id:FFFFF1D0"}},
+		{{Type: oidTPMModel, Value: "Virtual FIDO"}},
+		{{Type: oidTPMVersion, Value: "id:00000001"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	subjectAltName, err := asn1.Marshal([]asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: tpmDescription},
+	})
+	if err != nil {
+		return nil, err
+	}
+	templateCert := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidTCGKpAIKCertificate},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		IsCA:                  false,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidSubjectAltName, Critical: true, Value: subjectAltName}},
+	}
+	certBytes, err := x509.CreateCertificate(
+		rand.Reader,
+		templateCert,
+		certificateAuthority,
+		extractPublicKey(aik.Public()),
+		extractPrivateKey(certificateAuthorityPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certBytes)
+}
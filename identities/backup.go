@@ -0,0 +1,134 @@
+package identities
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// CredentialBackupVersion is the current version of the credential backup format
+const CredentialBackupVersion uint32 = 1
+
+const (
+	credentialBackupArgon2Time    uint32 = 3
+	credentialBackupArgon2Memory  uint32 = 64 * 1024
+	credentialBackupArgon2Threads uint8  = 4
+	credentialBackupKeyLength     uint32 = 32
+	credentialBackupSaltLength    int    = 16
+	// Upper bounds on the parameters accepted from a backup, which could otherwise make
+	// import run for arbitrarily long or allocate without limit. Memory is in KiB.
+	credentialBackupMaxTime    uint32 = 16
+	credentialBackupMaxMemory  uint32 = 256 * 1024
+	credentialBackupMaxThreads uint8  = 16
+)
+
+// CredentialBackup is a portable, passphrase-encrypted set of credentials meant for
+// transfer between devices. Unlike FIDODeviceConfig it carries no device secrets.
+type CredentialBackup struct {
+	Version       uint32 `json:"version"`
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Memory  uint32 `json:"argon2_memory"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+	Salt          []byte `json:"salt"`
+	Nonce         []byte `json:"nonce"`
+	EncryptedData []byte `json:"encrypted_data"`
+}
+
+type credentialBackupContents struct {
+	Sources []SavedCredentialSource `json:"sources"`
+}
+
+// validBackupParameters checks the key derivation parameters read from a backup, which
+// come from an untrusted file
+func validBackupParameters(backup *CredentialBackup) bool {
+	if len(backup.Salt) != credentialBackupSaltLength {
+		return false
+	}
+	if backup.Argon2Time == 0 || backup.Argon2Time > credentialBackupMaxTime {
+		return false
+	}
+	if backup.Argon2Threads == 0 || backup.Argon2Threads > credentialBackupMaxThreads {
+		return false
+	}
+	return backup.Argon2Memory <= credentialBackupMaxMemory
+}
+
+func deriveBackupKey(passphrase string, backup *CredentialBackup) []byte {
+	return argon2.IDKey([]byte(passphrase), backup.Salt, backup.Argon2Time, backup.Argon2Memory, backup.Argon2Threads, credentialBackupKeyLength)
+}
+
+func EncryptCredentialBackup(sources []SavedCredentialSource, passphrase string) ([]byte, error) {
+	contents, err := json.Marshal(credentialBackupContents{Sources: sources})
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode credentials: %w", err)
+	}
+	backup := CredentialBackup{
+		Version:       CredentialBackupVersion,
+		Argon2Time:    credentialBackupArgon2Time,
+		Argon2Memory:  credentialBackupArgon2Memory,
+		Argon2Threads: credentialBackupArgon2Threads,
+		Salt:          crypto.RandomBytes(credentialBackupSaltLength),
+	}
+	backup.EncryptedData, backup.Nonce, err = crypto.Encrypt(deriveBackupKey(passphrase, &backup), contents)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt credentials: %w", err)
+	}
+	backupBytes, err := json.Marshal(backup)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode backup: %w", err)
+	}
+	return backupBytes, nil
+}
+
+func DecryptCredentialBackup(data []byte, passphrase string) ([]SavedCredentialSource, error) {
+	backup := CredentialBackup{}
+	err := json.Unmarshal(data, &backup)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode backup: %w", err)
+	}
+	if backup.Version != CredentialBackupVersion {
+		return nil, fmt.Errorf("Unsupported credential backup version: %d", backup.Version)
+	}
+	if !validBackupParameters(&backup) {
+		return nil, fmt.Errorf("Invalid key derivation parameters in backup")
+	}
+	contentBytes, err := crypto.Decrypt(deriveBackupKey(passphrase, &backup), backup.EncryptedData, backup.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt backup (wrong passphrase?): %w", err)
+	}
+	contents := credentialBackupContents{}
+	err = json.Unmarshal(contentBytes, &contents)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode credentials: %w", err)
+	}
+	return contents.Sources, nil
+}
+
+// ExportCredentialBackup encrypts the discoverable credentials among sources into a portable
+// backup blob. Non-discoverable credentials stay on the device, like passkey sync.
+func ExportCredentialBackup(sources []*CredentialSource, passphrase string) ([]byte, error) {
+	discoverable := make([]*CredentialSource, 0, len(sources))
+	for _, source := range sources {
+		if source.Discoverable {
+			discoverable = append(discoverable, source)
+		}
+	}
+	return EncryptCredentialBackup(ExportCredentialSources(discoverable), passphrase)
+}
+
+// ExportBackup encrypts the discoverable credentials in the vault into a portable backup blob
+func (vault *IdentityVault) ExportBackup(passphrase string) ([]byte, error) {
+	return ExportCredentialBackup(vault.CredentialSources, passphrase)
+}
+
+// ImportBackup decrypts a backup blob and adds its credentials to the vault
+func (vault *IdentityVault) ImportBackup(data []byte, passphrase string) error {
+	sources, err := DecryptCredentialBackup(data, passphrase)
+	if err != nil {
+		return err
+	}
+	return vault.Import(sources)
+}
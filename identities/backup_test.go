@@ -0,0 +1,76 @@
+package identities
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestCredentialBackupRoundTrip(t *testing.T) {
+	vault := NewIdentityVault()
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	user := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "user", DisplayName: "User"}
+	source := vault.NewIdentity(rp, user)
+	source.SignatureCounter = 5
+	vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "other.com", Name: "Other"}, user)
+	vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "server-side.com", Name: "Server-side"}, user).Discoverable = false
+
+	backup, err := vault.ExportBackup("passphrase")
+	test.Assert(t, err == nil, "Could not export backup")
+
+	newVault := NewIdentityVault()
+	err = newVault.ImportBackup(backup, "passphrase")
+	test.Assert(t, err == nil, "Could not import backup")
+	test.AssertEqual(t, len(newVault.CredentialSources), 2, "Non-discoverable credential exported")
+	imported := newVault.GetMatchingCredentialSources("example.com", nil)
+	test.AssertEqual(t, len(imported), 1, "Could not find imported credential")
+	test.Assert(t, bytes.Equal(imported[0].ID, source.ID), "Credential ID does not match")
+	test.AssertEqual(t, imported[0].SignatureCounter, uint32(5), "Signature counter does not match")
+	test.AssertEqual(t, imported[0].User.Name, "user", "User does not match")
+	test.Assert(t, imported[0].PrivateKey.ECDSA.Equal(source.PrivateKey.ECDSA), "Private key does not match")
+}
+
+func TestCredentialBackupWrongPassphrase(t *testing.T) {
+	vault := NewIdentityVault()
+	vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com"}, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}})
+	backup, err := vault.ExportBackup("passphrase")
+	test.Assert(t, err == nil, "Could not export backup")
+	newVault := NewIdentityVault()
+	err = newVault.ImportBackup(backup, "wrong passphrase")
+	test.Assert(t, err != nil, "Imported backup with wrong passphrase")
+	test.AssertEqual(t, len(newVault.CredentialSources), 0, "Credentials imported despite error")
+}
+
+func TestCredentialBackupImportSkipsDuplicates(t *testing.T) {
+	vault := NewIdentityVault()
+	vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com"}, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}})
+	backup, err := vault.ExportBackup("passphrase")
+	test.Assert(t, err == nil, "Could not export backup")
+	err = vault.ImportBackup(backup, "passphrase")
+	test.Assert(t, err == nil, "Could not import backup")
+	test.AssertEqual(t, len(vault.CredentialSources), 1, "Duplicate key material was imported")
+}
+
+func TestCredentialBackupRejectsExpensiveParameters(t *testing.T) {
+	vault := NewIdentityVault()
+	vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "example.com"}, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}})
+	data, err := vault.ExportBackup("passphrase")
+	test.Assert(t, err == nil, "Could not export backup")
+	for _, tamper := range []func(backup *CredentialBackup){
+		func(backup *CredentialBackup) { backup.Argon2Time = credentialBackupMaxTime + 1 },
+		func(backup *CredentialBackup) { backup.Argon2Memory = credentialBackupMaxMemory + 1 },
+		func(backup *CredentialBackup) { backup.Argon2Threads = credentialBackupMaxThreads + 1 },
+	} {
+		var backup CredentialBackup
+		util.CheckErr(json.Unmarshal(data, &backup), "Could not decode backup")
+		tamper(&backup)
+		tampered, err := json.Marshal(backup)
+		util.CheckErr(err, "Could not encode backup")
+		_, err = DecryptCredentialBackup(tampered, "passphrase")
+		test.Assert(t, err != nil, "Backup with excessive key derivation parameters accepted")
+	}
+}
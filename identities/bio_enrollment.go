@@ -0,0 +1,20 @@
+package identities
+
+import "bytes"
+
+// BioEnrollment is a fingerprint template enrolled on the simulated sensor. No biometric
+// data is kept, only the identifier the platform uses to manage the enrollment.
+type BioEnrollment struct {
+	TemplateID   []byte `json:"template_id"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+}
+
+// FindBioEnrollment returns the index of the enrollment with the given template ID, or -1
+func FindBioEnrollment(enrollments []BioEnrollment, templateID []byte) int {
+	for i, enrollment := range enrollments {
+		if bytes.Equal(enrollment.TemplateID, templateID) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,70 @@
+package identities
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// CredentialStore holds an authenticator's credentials. IdentityVault is the built-in
+// in-memory store; other implementations can keep credentials in a database instead.
+// Relying parties are identified by the SHA-256 hash of their ID, as in authenticator data.
+type CredentialStore interface {
+	// Save stores a new credential, returning ErrCredentialIDExists rather than replacing a
+	// different credential with the same ID
+	Save(source *CredentialSource) error
+	// Lookup returns the relying party's credential with the given ID, or nil
+	Lookup(rpIDHash []byte, credentialID []byte) *CredentialSource
+	// FindDiscoverable returns all discoverable credentials for the relying party
+	FindDiscoverable(rpIDHash []byte) []*CredentialSource
+	// Delete removes the credential with the given ID, returning false if there was none
+	Delete(credentialID []byte) bool
+	// IncrementCounter increments and stores the credential's signature counter, which must
+	// stop at MaxSignatureCounter rather than wrap around
+	IncrementCounter(source *CredentialSource) error
+	// List returns every stored credential
+	List() []*CredentialSource
+}
+
+func RPIDHash(relyingPartyID string) []byte {
+	hash := sha256.Sum256([]byte(relyingPartyID))
+	return hash[:]
+}
+
+// MatchingCredentialSources returns the credentials in the allow list, or the discoverable
+// credentials for the relying party if the allow list is missing or empty. Non-discoverable
+// credentials can only be found by ID, so without one nothing matches them.
+func MatchingCredentialSources(store CredentialStore, relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*CredentialSource {
+	rpIDHash := RPIDHash(relyingPartyID)
+	if len(allowList) == 0 {
+		return store.FindDiscoverable(rpIDHash)
+	}
+	sources := make([]*CredentialSource, 0)
+	for _, allowed := range allowList {
+		if len(allowed.ID) == 0 {
+			continue
+		}
+		source := store.Lookup(rpIDHash, allowed.ID)
+		// Don't trust the store to have checked the RP: a credential ID from another relying
+		// party must never be usable here
+		if source != nil && boundToRelyingParty(source, rpIDHash) && !containsSource(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+func boundToRelyingParty(source *CredentialSource, rpIDHash []byte) bool {
+	return subtle.ConstantTimeCompare(RPIDHash(source.RelyingParty.ID), rpIDHash) == 1
+}
+
+func containsSource(sources []*CredentialSource, source *CredentialSource) bool {
+	for _, existing := range sources {
+		if bytes.Equal(existing.ID, source.ID) {
+			return true
+		}
+	}
+	return false
+}
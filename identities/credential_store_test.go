@@ -0,0 +1,52 @@
+package identities
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// carelessStore implements Lookup without checking the relying party
+type carelessStore struct {
+	*IdentityVault
+}
+
+func (store carelessStore) Lookup(rpIDHash []byte, credentialID []byte) *CredentialSource {
+	for _, source := range store.CredentialSources {
+		if bytes.Equal(source.ID, credentialID) {
+			return source
+		}
+	}
+	return nil
+}
+
+func TestMatchingCredentialSourcesRejectsOtherRP(t *testing.T) {
+	vault := NewIdentityVault()
+	source := vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{ID: "a.example", Name: "A"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"})
+	allowList := []webauthn.PublicKeyCredentialDescriptor{source.CTAPDescriptor()}
+
+	test.AssertEqual(t, len(MatchingCredentialSources(vault, "a.example", allowList)), 1, "Credential not found for its own RP")
+	test.AssertEqual(t, len(MatchingCredentialSources(vault, "b.example", allowList)), 0, "Credential matched for another RP")
+	test.AssertEqual(t, len(MatchingCredentialSources(carelessStore{vault}, "b.example", allowList)), 0, "Credential from a careless store matched for another RP")
+}
+
+func TestSaveRejectsCredentialIDCollision(t *testing.T) {
+	// Every credential gets the same ID and key material
+	randomBytes = func(length int) []byte { return make([]byte, length) }
+	defer func() { randomBytes = crypto.RandomBytes }()
+	vault := NewIdentityVault()
+	relyingParty := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	first := vault.GenerateIdentity(cose.COSE_ALGORITHM_ID_ES256, relyingParty, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"})
+	second := vault.GenerateIdentity(cose.COSE_ALGORITHM_ID_ES256, relyingParty, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "bob"})
+	test.Assert(t, vault.Save(first) == nil, "Could not save credential")
+	test.Assert(t, errors.Is(vault.Save(second), ErrCredentialIDExists), "Colliding credential was saved")
+	test.Assert(t, vault.Save(first) == nil, "Could not save an existing credential again")
+	test.AssertEqual(t, len(vault.List()), 1, "Colliding credential was stored")
+	test.Assert(t, vault.Lookup(RPIDHash("example.com"), first.ID) == first, "Existing credential was replaced")
+}
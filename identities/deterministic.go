@@ -0,0 +1,28 @@
+package identities
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// SetDeterministicSeed makes new credentials a pure function of the seed, the RP ID and
+// the user handle, so tests can discard state and re-register to get the same credential.
+// Their ECDSA signatures use RFC 6979 nonces, so assertions are reproducible as well.
+// Anyone who knows the seed can recompute every private key: never use this outside tests.
+// A nil seed restores random credentials.
+func (vault *IdentityVault) SetDeterministicSeed(seed []byte) {
+	vault.credentialSeed = seed
+}
+
+func (vault *IdentityVault) deriveCredentialBytes(label string, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) []byte {
+	mac := hmac.New(sha256.New, vault.credentialSeed)
+	// Length-prefix each input so different splits of the same bytes can't collide
+	for _, part := range [][]byte{[]byte(label), []byte(relyingParty.ID), user.ID} {
+		mac.Write(util.ToBE(uint32(len(part))))
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
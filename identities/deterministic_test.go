@@ -0,0 +1,37 @@
+package identities
+
+import (
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestDeterministicCredentials(t *testing.T) {
+	seed := []byte("test seed")
+	relyingParty := &webauthn.PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"}
+	user := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+
+	first := NewIdentityVault()
+	first.SetDeterministicSeed(seed)
+	firstSource := first.NewIdentity(relyingParty, user)
+	// A fresh vault stands in for a device whose state was discarded
+	second := NewIdentityVault()
+	second.SetDeterministicSeed(seed)
+	secondSource := second.NewIdentity(relyingParty, user)
+	test.AssertArrEqual(t, firstSource.ID, secondSource.ID, "Credential IDs differ with the same seed")
+	test.Assert(t, firstSource.PrivateKey.Equal(secondSource.PrivateKey), "Private keys differ with the same seed")
+	test.AssertArrEqual(t, firstSource.CredRandomWithUV, secondSource.CredRandomWithUV, "CredRandom differs with the same seed")
+
+	otherUser := &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{4, 5, 6}, Name: "bob"}
+	otherSource := second.NewIdentity(relyingParty, otherUser)
+	test.AssertNotEqual(t, string(otherSource.ID), string(firstSource.ID), "Different users got the same credential ID")
+	test.Assert(t, !otherSource.PrivateKey.Equal(firstSource.PrivateKey), "Different users got the same private key")
+
+	// The derived key has to be usable
+	signature := firstSource.PrivateKey.Sign([]byte("data"))
+	test.Assert(t, secondSource.PrivateKey.Public().Verify([]byte("data"), signature), "Derived key signature does not verify")
+
+	random := NewIdentityVault().NewIdentity(relyingParty, user)
+	test.AssertNotEqual(t, string(random.ID), string(firstSource.ID), "Random credential matches the seeded one")
+}
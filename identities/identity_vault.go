@@ -2,21 +2,89 @@ package identities
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"crypto/x509"
 	"fmt"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 )
 
+// MaxSignatureCounter is where signature counters stop. Wrapping around would look like a
+// cloned authenticator to relying parties, so a credential whose counter reaches the maximum
+// can't be used for assertions any more.
+const MaxSignatureCounter uint32 = 0xFFFFFFFF
+
+// ErrCredentialIDExists is returned when saving a credential whose ID is already taken by a
+// different credential
+var ErrCredentialIDExists = fmt.Errorf("Credential ID already exists")
+
+// randomBytes generates credential IDs and key material; tests replace it to force collisions
+var randomBytes = crypto.RandomBytes
+
 type CredentialSource struct {
 	Type             string
 	ID               []byte
 	PrivateKey       *cose.SupportedCOSEPrivateKey
 	RelyingParty     *webauthn.PublicKeyCredentialRPEntity
 	User             *webauthn.PublicKeyCrendentialUserEntity
-	SignatureCounter int32
+	SignatureCounter uint32
+	// How much each assertion increases SignatureCounter by, where 0 means 1
+	CounterStep uint32
+	CreatedAt   time.Time
+	// Zero if the credential has never been used for an assertion
+	LastUsedAt time.Time
+	// Discoverable credentials can be found without the relying party listing their IDs
+	Discoverable bool
+	// Per-credential secrets for the hmac-secret extension, chosen by whether UV was performed
+	CredRandomWithUV    []byte
+	CredRandomWithoutUV []byte
+	// The credProtect level, from 1 (UV optional) to 3 (UV required), where 0 means 1
+	CredProtect uint8
+	// The key for the credential's large blob, returned by the largeBlobKey extension
+	LargeBlobKey []byte
+}
+
+// Algorithm returns the COSE algorithm the credential was created with, which its
+// assertions are signed with
+func (source *CredentialSource) Algorithm() cose.COSEAlgorithmID {
+	return source.PrivateKey.Algorithm()
+}
+
+// IncrementCounter increases the signature counter by the credential's counter step,
+// stopping at MaxSignatureCounter, and records the assertion as the credential's last use
+func (source *CredentialSource) IncrementCounter() {
+	step := source.counterStep()
+	if source.SignatureCounter > MaxSignatureCounter-step {
+		source.SignatureCounter = MaxSignatureCounter
+	} else {
+		source.SignatureCounter += step
+	}
+	// Assertions are refused once the counter is exhausted, so they don't count as a use
+	if !source.CounterExhausted() {
+		source.LastUsedAt = time.Now()
+	}
+}
+
+// CounterExhausted reports whether the signature counter has reached its maximum
+func (source *CredentialSource) CounterExhausted() bool {
+	return source.SignatureCounter == MaxSignatureCounter
+}
+
+// CounterAvailable reports whether the credential can make another assertion, that is
+// whether incrementing the counter would stay below MaxSignatureCounter. Checking it
+// doesn't change the counter, so refused assertions don't use up counter values.
+func (source *CredentialSource) CounterAvailable() bool {
+	return source.SignatureCounter < MaxSignatureCounter-source.counterStep()
+}
+
+func (source *CredentialSource) counterStep() uint32 {
+	if source.CounterStep == 0 {
+		return 1
+	}
+	return source.CounterStep
 }
 
 func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDescriptor {
@@ -29,6 +97,8 @@ func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDes
 
 type IdentityVault struct {
 	CredentialSources []*CredentialSource
+	// Only set in tests, see SetDeterministicSeed
+	credentialSeed []byte
 }
 
 func NewIdentityVault() *IdentityVault {
@@ -36,19 +106,63 @@ func NewIdentityVault() *IdentityVault {
 	return &IdentityVault{CredentialSources: sources}
 }
 
+// SupportsAlgorithm reports whether NewIdentityWithAlgorithm can create credentials for the algorithm
+func SupportsAlgorithm(algorithm cose.COSEAlgorithmID) bool {
+	return algorithm == cose.COSE_ALGORITHM_ID_ES256 || algorithm == cose.COSE_ALGORITHM_ID_ED25519
+}
+
 func (vault *IdentityVault) NewIdentity(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
-	credentialID := crypto.RandomBytes(16)
-	privateKey := crypto.GenerateECDSAKey()
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
+	return vault.NewIdentityWithAlgorithm(cose.COSE_ALGORITHM_ID_ES256, relyingParty, user)
+}
+
+// NewIdentityWithAlgorithm creates a credential whose key uses the given algorithm, or returns
+// nil if the algorithm isn't supported
+func (vault *IdentityVault) NewIdentityWithAlgorithm(algorithm cose.COSEAlgorithmID, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+	credentialSource := vault.GenerateIdentity(algorithm, relyingParty, user)
+	if credentialSource != nil {
+		vault.AddIdentity(credentialSource)
+	}
+	return credentialSource
+}
+
+// GenerateIdentity creates a credential like NewIdentityWithAlgorithm without adding it to
+// the vault, so that it can be saved in another CredentialStore
+func (vault *IdentityVault) GenerateIdentity(algorithm cose.COSEAlgorithmID, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+	if !SupportsAlgorithm(algorithm) {
+		return nil
+	}
+	credentialID := randomBytes(16)
+	keyMaterial := randomBytes(32)
+	credRandomWithUV := randomBytes(32)
+	credRandomWithoutUV := randomBytes(32)
+	largeBlobKey := randomBytes(32)
+	if vault.credentialSeed != nil {
+		credentialID = vault.deriveCredentialBytes("credential-id", relyingParty, user)[:16]
+		keyMaterial = vault.deriveCredentialBytes("private-key", relyingParty, user)
+		credRandomWithUV = vault.deriveCredentialBytes("cred-random-uv", relyingParty, user)
+		credRandomWithoutUV = vault.deriveCredentialBytes("cred-random-no-uv", relyingParty, user)
+		largeBlobKey = vault.deriveCredentialBytes("large-blob-key", relyingParty, user)
+	}
+	cosePrivateKey := &cose.SupportedCOSEPrivateKey{DeterministicSignatures: vault.credentialSeed != nil}
+	switch algorithm {
+	case cose.COSE_ALGORITHM_ID_ES256:
+		cosePrivateKey.ECDSA = crypto.DeriveECDSAKey(keyMaterial)
+	case cose.COSE_ALGORITHM_ID_ED25519:
+		cosePrivateKey.Ed25519 = crypto.DeriveEd25519Key(keyMaterial)
+	}
 	credentialSource := CredentialSource{
-		Type:             "public-key",
-		ID:               credentialID,
-		PrivateKey:       cosePrivateKey,
-		RelyingParty:     relyingParty,
-		User:             user,
-		SignatureCounter: 0,
-	}
-	vault.AddIdentity(&credentialSource)
+		Type:                "public-key",
+		ID:                  credentialID,
+		PrivateKey:          cosePrivateKey,
+		RelyingParty:        relyingParty,
+		User:                user,
+		SignatureCounter:    0,
+		CreatedAt:           time.Now(),
+		Discoverable:        true,
+		CredRandomWithUV:    credRandomWithUV,
+		CredRandomWithoutUV: credRandomWithoutUV,
+		LargeBlobKey:        largeBlobKey,
+	}
 	return &credentialSource
 }
 
@@ -68,42 +182,109 @@ func (vault *IdentityVault) DeleteIdentity(id []byte) bool {
 }
 
 func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*CredentialSource {
+	return MatchingCredentialSources(vault, relyingPartyID, allowList)
+}
+
+// Save adds the credential to the vault, implementing CredentialStore
+func (vault *IdentityVault) Save(source *CredentialSource) error {
+	for _, existing := range vault.CredentialSources {
+		if existing == source {
+			return nil
+		}
+		if bytes.Equal(existing.ID, source.ID) {
+			return ErrCredentialIDExists
+		}
+	}
+	vault.AddIdentity(source)
+	return nil
+}
+
+// Lookup compares every credential in constant time, so the response time doesn't reveal
+// whether a credential ID exists for a different relying party
+func (vault *IdentityVault) Lookup(rpIDHash []byte, credentialID []byte) *CredentialSource {
+	var match *CredentialSource
+	for _, source := range vault.CredentialSources {
+		sameID := subtle.ConstantTimeCompare(source.ID, credentialID)
+		sameRP := subtle.ConstantTimeCompare(RPIDHash(source.RelyingParty.ID), rpIDHash)
+		if sameID&sameRP == 1 {
+			match = source
+		}
+	}
+	return match
+}
+
+func (vault *IdentityVault) FindDiscoverable(rpIDHash []byte) []*CredentialSource {
 	sources := make([]*CredentialSource, 0)
-	for _, credentialSource := range vault.CredentialSources {
-		if credentialSource.RelyingParty.ID == relyingPartyID {
-			if allowList != nil {
-				for _, allowedSource := range allowList {
-					if bytes.Equal(allowedSource.ID, credentialSource.ID) {
-						sources = append(sources, credentialSource)
-						break
-					}
-				}
-			} else {
-				sources = append(sources, credentialSource)
-			}
+	for _, source := range vault.CredentialSources {
+		if source.Discoverable && bytes.Equal(RPIDHash(source.RelyingParty.ID), rpIDHash) {
+			sources = append(sources, source)
 		}
 	}
 	return sources
 }
 
+func (vault *IdentityVault) Delete(credentialID []byte) bool {
+	return vault.DeleteIdentity(credentialID)
+}
+
+func (vault *IdentityVault) IncrementCounter(source *CredentialSource) error {
+	source.IncrementCounter()
+	return nil
+}
+
+func (vault *IdentityVault) List() []*CredentialSource {
+	return append([]*CredentialSource{}, vault.CredentialSources...)
+}
+
 func (vault *IdentityVault) Export() []SavedCredentialSource {
+	return ExportCredentialSources(vault.CredentialSources)
+}
+
+// ExportCredentialSources converts credentials into their saved form
+func ExportCredentialSources(credentialSources []*CredentialSource) []SavedCredentialSource {
 	sources := make([]SavedCredentialSource, 0)
-	for _, source := range vault.CredentialSources {
+	for _, source := range credentialSources {
 		key := cose.MarshalCOSEPrivateKey(source.PrivateKey)
+		discoverable := source.Discoverable
 		savedSource := SavedCredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     *source.RelyingParty,
-			User:             *source.User,
-			SignatureCounter: source.SignatureCounter,
+			Type:                source.Type,
+			ID:                  source.ID,
+			PrivateKey:          key,
+			RelyingParty:        *source.RelyingParty,
+			User:                *source.User,
+			SignatureCounter:    source.SignatureCounter,
+			CounterStep:         source.CounterStep,
+			CreatedAt:           source.CreatedAt,
+			LastUsedAt:          source.LastUsedAt,
+			Discoverable:        &discoverable,
+			CredRandomWithUV:    source.CredRandomWithUV,
+			CredRandomWithoutUV: source.CredRandomWithoutUV,
+			CredProtect:         source.CredProtect,
+			LargeBlobKey:        source.LargeBlobKey,
 		}
 		sources = append(sources, savedSource)
 	}
 	return sources
 }
 
+func hasKeyMaterial(store CredentialStore, key *cose.SupportedCOSEPrivateKey) bool {
+	thumbprint := cose.Thumbprint(key.Public())
+	for _, source := range store.List() {
+		if bytes.Equal(cose.Thumbprint(source.PrivateKey.Public()), thumbprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Import adds saved credentials to the vault, skipping any whose key material is already present
 func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
+	return ImportCredentialSources(vault, sources)
+}
+
+// ImportCredentialSources saves credentials into the store, skipping any whose key material
+// is already present
+func ImportCredentialSources(store CredentialStore, sources []SavedCredentialSource) error {
 	for _, source := range sources {
 		key, err := cose.UnmarshalCOSEPrivateKey(source.PrivateKey)
 		if err != nil {
@@ -113,15 +294,32 @@ func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
 			}
 			key = &cose.SupportedCOSEPrivateKey{ECDSA: oldFormatKey}
 		}
+		if hasKeyMaterial(store, key) {
+			continue
+		}
+		relyingParty := source.RelyingParty
+		user := source.User
+		// Credentials saved before discoverability was tracked were all discoverable
+		discoverable := source.Discoverable == nil || *source.Discoverable
 		decodedSource := CredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     &source.RelyingParty,
-			User:             &source.User,
-			SignatureCounter: source.SignatureCounter,
+			Type:                source.Type,
+			ID:                  source.ID,
+			PrivateKey:          key,
+			RelyingParty:        &relyingParty,
+			User:                &user,
+			SignatureCounter:    source.SignatureCounter,
+			CounterStep:         source.CounterStep,
+			CreatedAt:           source.CreatedAt,
+			LastUsedAt:          source.LastUsedAt,
+			Discoverable:        discoverable,
+			CredRandomWithUV:    source.CredRandomWithUV,
+			CredRandomWithoutUV: source.CredRandomWithoutUV,
+			CredProtect:         source.CredProtect,
+			LargeBlobKey:        source.LargeBlobKey,
+		}
+		if err := store.Save(&decodedSource); err != nil {
+			return fmt.Errorf("Could not save imported credential: %w", err)
 		}
-		vault.AddIdentity(&decodedSource)
 	}
 	return nil
 }
@@ -3,6 +3,7 @@ package identities
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/util"
@@ -17,16 +18,34 @@ type SavedCredentialSource struct {
 	PrivateKey       []byte                                  `json:"private_key"`
 	RelyingParty     webauthn.PublicKeyCredentialRPEntity    `json:"relying_party"`
 	User             webauthn.PublicKeyCrendentialUserEntity `json:"user"`
-	SignatureCounter int32                                   `json:"signature_counter"`
+	SignatureCounter uint32                                  `json:"signature_counter"`
+	CounterStep      uint32                                  `json:"counter_step,omitempty"`
+	CreatedAt        time.Time                               `json:"created_at"`
+	LastUsedAt       time.Time                               `json:"last_used_at"`
+	Discoverable     *bool                                   `json:"discoverable,omitempty"`
+	// Credentials saved before hmac-secret support have no CredRandom and can't use the extension
+	CredRandomWithUV    []byte `json:"cred_random_uv,omitempty"`
+	CredRandomWithoutUV []byte `json:"cred_random_no_uv,omitempty"`
+	CredProtect         uint8  `json:"cred_protect,omitempty"`
+	LargeBlobKey        []byte `json:"large_blob_key,omitempty"`
 }
 
 type FIDODeviceConfig struct {
 	EncryptionKey          []byte                  `json:"encryption_key"`
+	PreviousKey            []byte                  `json:"previous_encryption_key,omitempty"`
+	PreviousKeyExpiry      *time.Time              `json:"previous_encryption_key_expiry,omitempty"`
 	AttestationCertificate []byte                  `json:"attestation_certificate"`
 	AttestationPrivateKey  []byte                  `json:"attestation_private_key"`
 	AuthenticationCounter  uint32                  `json:"authentication_counter"`
 	PINEnabled             bool                    `json:"pin_enabled,omitempty"`
 	PINHash                []byte                  `json:"pin_hash,omitempty"`
+	AlwaysUV               bool                    `json:"always_uv,omitempty"`
+	EnterpriseAttestation  bool                    `json:"enterprise_attestation,omitempty"`
+	MinPINLength           int                     `json:"min_pin_length,omitempty"`
+	MinPINLengthRPIDs      []string                `json:"min_pin_length_rp_ids,omitempty"`
+	BioEnrollmentEnabled   bool                    `json:"bio_enrollment_enabled,omitempty"`
+	BioEnrollments         []BioEnrollment         `json:"bio_enrollments,omitempty"`
+	LargeBlobArray         []byte                  `json:"large_blob_array,omitempty"`
 	Sources                []SavedCredentialSource `json:"sources"`
 }
 
@@ -0,0 +1,42 @@
+package testutil
+
+import (
+	"crypto/sha256"
+
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/fido_client"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// MemoryClientSupport approves every request and keeps saved device state in memory
+type MemoryClientSupport struct {
+	Data []byte
+}
+
+func (support *MemoryClientSupport) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
+	return true
+}
+
+func (support *MemoryClientSupport) SaveData(data []byte) {
+	support.Data = data
+}
+
+func (support *MemoryClientSupport) RetrieveData() []byte {
+	return support.Data
+}
+
+func (support *MemoryClientSupport) Passphrase() string {
+	return "testutil"
+}
+
+// NewTestDevice creates an in-memory client with a fresh attestation CA, and a CTAP server for it
+func NewTestDevice() (*fido_client.DefaultFIDOClient, *ctap.CTAPServer) {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	util.CheckErr(err, "Could not create attestation CA private key")
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	util.CheckErr(err, "Could not create attestation CA")
+	support := &MemoryClientSupport{}
+	client := fido_client.NewDefaultClient(certificateAuthority, caPrivateKey, sha256.Sum256([]byte("testutil")), false, support, support)
+	return client, ctap.NewCTAPServer(client)
+}
@@ -0,0 +1,182 @@
+// Package testutil provides a WebAuthn-level client for driving a virtual authenticator
+// from tests and examples without hand-building CBOR requests.
+package testutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	ctapCommandMakeCredential byte = 0x01
+	ctapCommandGetAssertion   byte = 0x02
+)
+
+// CTAPDevice is anything that handles raw CTAP2 messages, such as ctap.CTAPServer
+type CTAPDevice interface {
+	HandleMessage(data []byte) []byte
+}
+
+type CollectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type WebAuthnClient struct {
+	device CTAPDevice
+	origin string
+	rpID   string
+}
+
+func NewWebAuthnClient(device CTAPDevice, origin string, rpID string) *WebAuthnClient {
+	return &WebAuthnClient{device: device, origin: origin, rpID: rpID}
+}
+
+type Registration struct {
+	ClientDataJSON       []byte
+	AttestationObject    []byte // As a browser would hand it to the relying party
+	Format               string
+	RawAuthData          []byte
+	AuthData             *ctap.AuthenticatorData
+	AttestationStatement map[string]interface{}
+	CredentialID         []byte
+	PublicKey            *cose.SupportedCOSEPublicKey
+}
+
+type Assertion struct {
+	ClientDataJSON []byte
+	CredentialID   []byte
+	RawAuthData    []byte
+	AuthData       *ctap.AuthenticatorData
+	Signature      []byte
+}
+
+// Verify checks the assertion signature over authData || SHA-256(clientDataJSON)
+func (assertion *Assertion) Verify(publicKey *cose.SupportedCOSEPublicKey) bool {
+	clientDataHash := sha256.Sum256(assertion.ClientDataJSON)
+	return publicKey.Verify(util.Concat(assertion.RawAuthData, clientDataHash[:]), assertion.Signature)
+}
+
+func (client *WebAuthnClient) clientDataJSON(ceremony string, challenge []byte) []byte {
+	clientData := CollectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    client.origin,
+	}
+	data, err := json.Marshal(clientData)
+	util.CheckErr(err, "Could not encode client data")
+	return data
+}
+
+func (client *WebAuthnClient) send(command byte, args interface{}) ([]byte, error) {
+	response := client.device.HandleMessage(util.Concat([]byte{command}, util.MarshalCBOR(args)))
+	if len(response) == 0 {
+		return nil, fmt.Errorf("Empty response from device")
+	}
+	if response[0] != 0 {
+		return nil, fmt.Errorf("CTAP error: 0x%02x", response[0])
+	}
+	return response[1:], nil
+}
+
+// Register creates a discoverable ES256 credential for the user
+func (client *WebAuthnClient) Register(user webauthn.PublicKeyCrendentialUserEntity, challenge []byte) (*Registration, error) {
+	clientDataJSON := client.clientDataJSON("webauthn.create", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	args := map[int]interface{}{
+		1: clientDataHash[:],
+		2: webauthn.PublicKeyCredentialRPEntity{ID: client.rpID, Name: client.rpID},
+		3: user,
+		4: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		7: map[string]bool{"rk": true},
+	}
+	responseBytes, err := client.send(ctapCommandMakeCredential, args)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Format               string                 `cbor:"1,keyasint"`
+		AuthData             []byte                 `cbor:"2,keyasint"`
+		AttestationStatement map[string]interface{} `cbor:"3,keyasint"`
+	}
+	if err := cbor.Unmarshal(responseBytes, &response); err != nil {
+		return nil, fmt.Errorf("Could not decode makeCredential response: %w", err)
+	}
+	authData, err := ctap.ParseAuthenticatorData(response.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.AttestedCredentialData == nil {
+		return nil, fmt.Errorf("makeCredential response has no attested credential data")
+	}
+	publicKey, err := cose.UnmarshalCOSEPublicKey(authData.AttestedCredentialData.CredentialPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	attestationObject := util.MarshalCBOR(map[string]interface{}{
+		"fmt":      response.Format,
+		"authData": response.AuthData,
+		"attStmt":  response.AttestationStatement,
+	})
+	return &Registration{
+		ClientDataJSON:       clientDataJSON,
+		AttestationObject:    attestationObject,
+		Format:               response.Format,
+		RawAuthData:          response.AuthData,
+		AuthData:             authData,
+		AttestationStatement: response.AttestationStatement,
+		CredentialID:         authData.AttestedCredentialData.CredentialID,
+		PublicKey:            publicKey,
+	}, nil
+}
+
+// Authenticate gets an assertion for one of the allowed credentials, or for any
+// discoverable credential if none are given
+func (client *WebAuthnClient) Authenticate(challenge []byte, allowCredentials ...[]byte) (*Assertion, error) {
+	clientDataJSON := client.clientDataJSON("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	args := map[int]interface{}{
+		1: client.rpID,
+		2: clientDataHash[:],
+	}
+	if len(allowCredentials) > 0 {
+		allowList := make([]webauthn.PublicKeyCredentialDescriptor, 0, len(allowCredentials))
+		for _, id := range allowCredentials {
+			allowList = append(allowList, webauthn.PublicKeyCredentialDescriptor{Type: "public-key", ID: id})
+		}
+		args[3] = allowList
+	}
+	responseBytes, err := client.send(ctapCommandGetAssertion, args)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Credential webauthn.PublicKeyCredentialDescriptor `cbor:"1,keyasint"`
+		AuthData   []byte                                 `cbor:"2,keyasint"`
+		Signature  []byte                                 `cbor:"3,keyasint"`
+	}
+	if err := cbor.Unmarshal(responseBytes, &response); err != nil {
+		return nil, fmt.Errorf("Could not decode getAssertion response: %w", err)
+	}
+	authData, err := ctap.ParseAuthenticatorData(response.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	return &Assertion{
+		ClientDataJSON: clientDataJSON,
+		CredentialID:   response.Credential.ID,
+		RawAuthData:    response.AuthData,
+		AuthData:       authData,
+		Signature:      response.Signature,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestRegisterThenAuthenticate(t *testing.T) {
+	_, device := NewTestDevice()
+	client := NewWebAuthnClient(device, "https://example.com", "example.com")
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice", DisplayName: "Alice"}
+
+	registration, err := client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	test.AssertEqual(t, registration.Format, "packed", "Unexpected attestation format")
+	test.Assert(t, registration.AuthData.HasFlag(ctap.AuthDataFlagUserPresent), "UP not set on registration")
+
+	challenge := crypto.RandomBytes(32)
+	assertion, err := client.Authenticate(challenge, registration.CredentialID)
+	test.Assert(t, err == nil, "Authentication failed")
+	test.Assert(t, bytes.Equal(assertion.CredentialID, registration.CredentialID), "Wrong credential used")
+	test.Assert(t, assertion.Verify(registration.PublicKey), "Assertion signature does not verify")
+	test.Assert(t, assertion.AuthData.SignCount > registration.AuthData.SignCount, "Signature counter did not increase")
+
+	var clientData CollectedClientData
+	test.Assert(t, json.Unmarshal(assertion.ClientDataJSON, &clientData) == nil, "Invalid client data JSON")
+	test.AssertEqual(t, clientData.Type, "webauthn.get", "Wrong client data type")
+	test.AssertEqual(t, clientData.Origin, "https://example.com", "Wrong client data origin")
+
+	assertion.Signature[len(assertion.Signature)-1] ^= 0xFF
+	test.Assert(t, !assertion.Verify(registration.PublicKey), "Tampered signature verified")
+}
+
+func TestAuthenticateDiscoverable(t *testing.T) {
+	_, device := NewTestDevice()
+	client := NewWebAuthnClient(device, "https://example.com", "example.com")
+	registration, err := client.Register(webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice"}, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	assertion, err := client.Authenticate(crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Discoverable authentication failed")
+	test.Assert(t, assertion.Verify(registration.PublicKey), "Assertion signature does not verify")
+
+	other := NewWebAuthnClient(device, "https://other.com", "other.com")
+	_, err = other.Authenticate(crypto.RandomBytes(32))
+	test.Assert(t, err != nil, "Authenticated for an RP without credentials")
+}
+
+func TestIndependentDevices(t *testing.T) {
+	firstClient, firstDevice := NewTestDevice()
+	secondClient, secondDevice := NewTestDevice()
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	first := NewWebAuthnClient(firstDevice, "https://example.com", "example.com")
+	second := NewWebAuthnClient(secondDevice, "https://example.com", "example.com")
+
+	firstRegistration, err := first.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration on first device failed")
+	secondRegistration, err := second.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration on second device failed")
+	test.AssertEqual(t, len(firstClient.Identities()), 1, "Wrong number of credentials on first device")
+	test.AssertEqual(t, len(secondClient.Identities()), 1, "Wrong number of credentials on second device")
+
+	// Each device only knows its own credential
+	assertion, err := first.Authenticate(crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Authentication on first device failed")
+	test.Assert(t, bytes.Equal(assertion.CredentialID, firstRegistration.CredentialID), "First device used another device's credential")
+	_, err = first.Authenticate(crypto.RandomBytes(32), secondRegistration.CredentialID)
+	test.Assert(t, err != nil, "First device authenticated with the second device's credential")
+	assertion, err = second.Authenticate(crypto.RandomBytes(32), secondRegistration.CredentialID)
+	test.Assert(t, err == nil, "Authentication on second device failed")
+	test.Assert(t, assertion.Verify(secondRegistration.PublicKey), "Second device signature does not verify")
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/x509"
 	"fmt"
+	"sync"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
@@ -22,12 +23,15 @@ const (
 	u2f_COMMAND_REGISTER     U2FCommand = 0x01
 	u2f_COMMAND_AUTHENTICATE U2FCommand = 0x02
 	u2f_COMMAND_VERSION      U2FCommand = 0x03
+	// ISO 7816-4 GET RESPONSE, which fetches the rest of a chained response
+	u2f_COMMAND_GET_RESPONSE U2FCommand = 0xC0
 )
 
 var U2FCommandDescriptions = map[U2FCommand]string{
 	u2f_COMMAND_REGISTER:     "u2f_COMMAND_REGISTER",
 	u2f_COMMAND_AUTHENTICATE: "u2f_COMMAND_AUTHENTICATE",
 	u2f_COMMAND_VERSION:      "u2f_COMMAND_VERSION",
+	u2f_COMMAND_GET_RESPONSE: "u2f_COMMAND_GET_RESPONSE",
 }
 
 type U2FStatusWord uint16
@@ -39,6 +43,9 @@ const (
 	u2f_SW_WRONG_LENGTH             U2FStatusWord = 0x6700
 	u2f_SW_CLA_NOT_SUPPORTED        U2FStatusWord = 0x6E00
 	u2f_SW_INS_NOT_SUPPORTED        U2FStatusWord = 0x6D00
+	u2f_SW_COMMAND_NOT_ALLOWED      U2FStatusWord = 0x6986
+	// The low byte holds how many more bytes GET RESPONSE can fetch, 0 meaning 256 or more
+	u2f_SW_BYTES_REMAINING U2FStatusWord = 0x6100
 )
 
 type U2FAuthenticateControl uint8
@@ -49,6 +56,11 @@ const (
 	u2f_AUTH_CONTROL_SIGN                           U2FAuthenticateControl = 0x08
 )
 
+const u2f_USER_PRESENCE_VERIFIED uint8 = 0x01
+
+// Key handles are sent with a one-byte length, so they can be at most 255 bytes
+const u2f_KEY_HANDLE_MAX_LENGTH int = 255
+
 type U2FMessageHeader struct {
 	Cla     uint8
 	Command U2FCommand
@@ -66,79 +78,162 @@ func (header U2FMessageHeader) String() string {
 
 type U2FClient interface {
 	SealingEncryptionKey() []byte
+	// PreviousSealingEncryptionKey returns the key that was replaced by a master key
+	// rotation while key handles sealed with it are still accepted, or nil
+	PreviousSealingEncryptionKey() []byte
 	NewPrivateKey() *ecdsa.PrivateKey
 	NewAuthenticationCounterId() uint32
 	CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte
 	ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool
 	ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool
+	// AlwaysUV reports whether the CTAP2 alwaysUv option is enabled. U2F can't verify the
+	// user, so registration and authentication are refused while it is.
+	AlwaysUV() bool
 }
 
 type U2FServer struct {
 	client U2FClient
+	// The part of a response that didn't fit in the Le the host asked for
+	pendingResponse []byte
+	pendingLock     sync.Mutex
 }
 
 func NewU2FServer(client U2FClient) *U2FServer {
 	return &U2FServer{client: client}
 }
 
-func decodeU2FMessage(messageBytes []byte) (U2FMessageHeader, []byte, uint16) {
+// decodeU2FMessage splits an extended length APDU into its header, request data and
+// expected response length
+func decodeU2FMessage(messageBytes []byte) (U2FMessageHeader, []byte, uint16, error) {
+	if len(messageBytes) < 4 {
+		return U2FMessageHeader{}, nil, 0, fmt.Errorf("APDU is shorter than its header: %#v", messageBytes)
+	}
 	buffer := bytes.NewBuffer(messageBytes)
 	header := util.ReadBE[U2FMessageHeader](buffer)
 	if buffer.Len() == 0 {
 		// No request length, no response length
-		return header, []byte{}, 0
+		return header, []byte{}, 0, nil
 	}
 	// We should either have a request length or response length, so we have at least
 	// one '0' byte at the start
-	if util.Read(buffer, 1)[0] != 0 {
-		panic(fmt.Sprintf("Invalid U2F Payload length: %s %#v", header, messageBytes))
+	if buffer.Len() < 3 || util.Read(buffer, 1)[0] != 0 {
+		return header, nil, 0, fmt.Errorf("Invalid U2F payload length: %s %#v", header, messageBytes)
 	}
 	length := util.ReadBE[uint16](buffer)
 	if buffer.Len() == 0 {
 		// No payload, so length must be the response length
-		return header, []byte{}, length
+		return header, []byte{}, length, nil
 	}
 	// length is the request length
+	if buffer.Len() < int(length) {
+		return header, nil, 0, fmt.Errorf("U2F request is shorter than its length %d: %s", length, header)
+	}
 	request := util.Read(buffer, uint(length))
 	if buffer.Len() == 0 {
-		return header, request, 0
+		return header, request, 0, nil
+	}
+	if buffer.Len() != 2 {
+		return header, nil, 0, fmt.Errorf("Invalid U2F response length: %s %#v", header, buffer.Bytes())
 	}
 	responseLength := util.ReadBE[uint16](buffer)
-	return header, request, responseLength
+	return header, request, responseLength, nil
 }
 
 func (server *U2FServer) HandleMessage(message []byte) []byte {
-	header, request, responseLength := decodeU2FMessage(message)
+	header, request, responseLength, err := decodeU2FMessage(message)
+	if err != nil {
+		u2fLogger.Printf("ERROR: %s\n\n", err)
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	u2fLogger.Printf("MESSAGE: Header: %s Request: %#v Response Length: %d\n\n", header, request, responseLength)
+	if header.Cla != 0 {
+		return util.ToBE(u2f_SW_CLA_NOT_SUPPORTED)
+	}
+	server.pendingLock.Lock()
+	defer server.pendingLock.Unlock()
+	if header.Command == u2f_COMMAND_GET_RESPONSE {
+		return server.handleGetResponse(responseLength)
+	}
+	// Any other command abandons a chained response
+	server.pendingResponse = nil
 	var response []byte
 	switch header.Command {
 	case u2f_COMMAND_VERSION:
 		response = append([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR)...)
-	case u2f_COMMAND_REGISTER:
-		response = server.handleU2FRegister(header, request)
-	case u2f_COMMAND_AUTHENTICATE:
-		response = server.handleU2FAuthenticate(header, request)
+	case u2f_COMMAND_REGISTER, u2f_COMMAND_AUTHENTICATE:
+		if server.client.AlwaysUV() {
+			u2fLogger.Printf("ERROR: U2F is disabled while alwaysUv is enabled: %s\n\n", header)
+			response = util.ToBE(u2f_SW_COMMAND_NOT_ALLOWED)
+		} else if header.Command == u2f_COMMAND_REGISTER {
+			response = server.handleU2FRegister(header, request)
+		} else {
+			response = server.handleU2FAuthenticate(header, request)
+		}
 	default:
-		panic(fmt.Sprintf("Invalid U2F Command: %#v", header))
+		u2fLogger.Printf("ERROR: Unsupported U2F instruction: %s\n\n", header)
+		response = util.ToBE(u2f_SW_INS_NOT_SUPPORTED)
 	}
 	u2fLogger.Printf("RESPONSE: %#v\n\n", response)
-	return response
+	return server.chainResponse(response, responseLength)
 }
 
+// chainResponse returns at most responseLength bytes of a successful response's data,
+// keeping the rest for GET RESPONSE. A zero responseLength is 65536 in an extended length
+// APDU, which always fits.
+func (server *U2FServer) chainResponse(response []byte, responseLength uint16) []byte {
+	data := response[:len(response)-2]
+	status := util.ReadBE[U2FStatusWord](bytes.NewBuffer(response[len(response)-2:]))
+	if status != u2f_SW_NO_ERROR || responseLength == 0 || len(data) <= int(responseLength) {
+		return response
+	}
+	server.pendingResponse = data[responseLength:]
+	remaining := len(server.pendingResponse)
+	if remaining > 0xFF {
+		remaining = 0
+	}
+	return util.Concat(data[:responseLength], util.ToBE(u2f_SW_BYTES_REMAINING|U2FStatusWord(remaining)))
+}
+
+func (server *U2FServer) handleGetResponse(responseLength uint16) []byte {
+	if server.pendingResponse == nil {
+		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
+	}
+	pending := server.pendingResponse
+	server.pendingResponse = nil
+	return server.chainResponse(util.Concat(pending, util.ToBE(u2f_SW_NO_ERROR)), responseLength)
+}
+
+// sealKeyHandle encrypts the key handle and pads it to the maximum length, so every key
+// handle exercises the full range of the one-byte length field
 func (server *U2FServer) sealKeyHandle(keyHandle *webauthn.KeyHandle) []byte {
-	box := crypto.Seal(server.client.SealingEncryptionKey(), util.MarshalCBOR(keyHandle))
-	return util.MarshalCBOR(box)
+	data := util.MarshalCBOR(keyHandle)
+	sealed := util.MarshalCBOR(crypto.Seal(server.client.SealingEncryptionKey(), data))
+	util.Assert(len(sealed) <= u2f_KEY_HANDLE_MAX_LENGTH, "Key handle is too long")
+	// Padding goes after the CBOR inside the box, where OpenKeyHandle ignores it
+	padding := make([]byte, u2f_KEY_HANDLE_MAX_LENGTH-len(sealed))
+	sealed = util.MarshalCBOR(crypto.Seal(server.client.SealingEncryptionKey(), util.Concat(data, padding)))
+	util.Assert(len(sealed) == u2f_KEY_HANDLE_MAX_LENGTH, "Could not pad key handle")
+	return sealed
 }
 
-func (server *U2FServer) openKeyHandle(boxBytes []byte) (*webauthn.KeyHandle, error) {
+// OpenKeyHandle decrypts a key handle sealed with the client's current or previous sealing
+// key, so that other protocols can use credentials registered over U2F
+func OpenKeyHandle(client U2FClient, boxBytes []byte) (*webauthn.KeyHandle, error) {
 	var box crypto.EncryptedBox
 	err := cbor.Unmarshal(boxBytes, &box)
 	if err != nil {
 		return nil, err
 	}
-	data := crypto.Open(server.client.SealingEncryptionKey(), box)
+	data, err := crypto.Decrypt(client.SealingEncryptionKey(), box.Data, box.IV)
+	if previousKey := client.PreviousSealingEncryptionKey(); err != nil && previousKey != nil {
+		data, err = crypto.Decrypt(previousKey, box.Data, box.IV)
+	}
+	if err != nil {
+		return nil, err
+	}
 	var keyHandle webauthn.KeyHandle
-	err = cbor.Unmarshal(data, &keyHandle)
+	// Decode only the first CBOR item, skipping any padding
+	err = cbor.NewDecoder(bytes.NewReader(data)).Decode(&keyHandle)
 	if err != nil {
 		return nil, err
 	}
@@ -146,10 +241,12 @@ func (server *U2FServer) openKeyHandle(boxBytes []byte) (*webauthn.KeyHandle, er
 }
 
 func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []byte) []byte {
+	if len(request) != 64 {
+		u2fLogger.Printf("U2F REGISTER: Request is %d bytes instead of 64\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	challenge := request[:32]
 	application := request[32:]
-	util.Assert(len(challenge) == 32, "Challenge is not 32 bytes")
-	util.Assert(len(application) == 32, "Application is not 32 bytes")
 
 	privateKey := server.client.NewPrivateKey()
 	encodedPublicKey := elliptic.Marshal(elliptic.P256(), privateKey.PublicKey.X, privateKey.PublicKey.Y)
@@ -174,6 +271,10 @@ func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []by
 }
 
 func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request []byte) []byte {
+	if len(request) < 65 || len(request) != 65+int(request[64]) {
+		u2fLogger.Printf("U2F AUTHENTICATE: Key handle length does not match request length %d\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	requestReader := bytes.NewBuffer(request)
 	control := U2FAuthenticateControl(header.Param1)
 	challenge := util.Read(requestReader, 32)
@@ -181,7 +282,7 @@ func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request
 
 	keyHandleLength := util.ReadLE[uint8](requestReader)
 	encryptedKeyHandleBytes := util.Read(requestReader, uint(keyHandleLength))
-	keyHandle, err := server.openKeyHandle(encryptedKeyHandleBytes)
+	keyHandle, err := OpenKeyHandle(server.client, encryptedKeyHandleBytes)
 	if err != nil {
 		u2fLogger.Printf("U2F AUTHENTICATE: Invalid key handle given - %s %#v\n\n", err, encryptedKeyHandleBytes)
 		return util.ToBE(u2f_SW_WRONG_DATA)
@@ -195,17 +296,21 @@ func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request
 	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
 
 	if control == u2f_AUTH_CONTROL_CHECK_ONLY {
+		// Check-only never asks for or reports user presence
 		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 	} else if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN || control == u2f_AUTH_CONTROL_SIGN {
+		// The user presence byte must reflect whether presence was actually obtained
+		var userPresence uint8 = 0
 		if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN {
 			if !server.client.ApproveU2FAuthentication(keyHandle) {
 				return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 			}
+			userPresence = u2f_USER_PRESENCE_VERIFIED
 		}
 		counter := server.client.NewAuthenticationCounterId()
-		signatureDataBytes := util.Concat(application, []byte{1}, util.ToBE(counter), challenge)
+		signatureDataBytes := util.Concat(application, []byte{userPresence}, util.ToBE(counter), challenge)
 		signature := cosePrivateKey.Sign(signatureDataBytes)
-		return util.Concat([]byte{1}, util.ToBE(counter), signature, util.ToBE(u2f_SW_NO_ERROR))
+		return util.Concat([]byte{userPresence}, util.ToBE(counter), signature, util.ToBE(u2f_SW_NO_ERROR))
 	} else {
 		// No error specific to invalid control byte, so return WRONG_LENGTH to indicate data error
 		return util.ToBE(u2f_SW_WRONG_LENGTH)
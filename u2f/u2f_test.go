@@ -17,6 +17,7 @@ import (
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
 )
@@ -32,6 +33,10 @@ type DummyU2FClient struct {
 	authorityCert  *x509.Certificate
 	certPrivateKey *ecdsa.PrivateKey
 	counter        uint32
+	denyApproval   bool
+	alwaysUV       bool
+	// Pads attestation certificates with an extension this many bytes long
+	certificatePadding int
 }
 
 func newDummyU2FClient() U2FClient {
@@ -68,6 +73,10 @@ func (client *DummyU2FClient) SealingEncryptionKey() []byte {
 	return client.encryptionKey
 }
 
+func (client *DummyU2FClient) PreviousSealingEncryptionKey() []byte {
+	return nil
+}
+
 func (client *DummyU2FClient) NewPrivateKey() *ecdsa.PrivateKey {
 	return crypto.GenerateECDSAKey()
 }
@@ -97,17 +106,24 @@ func (client *DummyU2FClient) CreateAttestationCertificiate(cosePrivateKey *cose
 		IsCA:                  false,
 		BasicConstraintsValid: true,
 	}
+	if client.certificatePadding > 0 {
+		templateCert.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: make([]byte, client.certificatePadding)}}
+	}
 	certBytes, err := x509.CreateCertificate(rand.Reader, templateCert, client.authorityCert, &privateKey.PublicKey, client.certPrivateKey)
 	util.CheckErr(err, "Could not generate attestation certificate")
 	return certBytes
 }
 
 func (client *DummyU2FClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
-	return true
+	return !client.denyApproval
 }
 
 func (client *DummyU2FClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
-	return true
+	return !client.denyApproval
+}
+
+func (client *DummyU2FClient) AlwaysUV() bool {
+	return client.alwaysUV
 }
 
 func u2fHeader(command U2FCommand, param1 uint8, param2 uint8) []byte {
@@ -141,7 +157,7 @@ func TestU2FRegistration(t *testing.T) {
 	server := NewU2FServer(client)
 	challenge := crypto.RandomBytes(32)
 	application := crypto.RandomBytes(32)
-	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, util.ToBE(512), challenge, application)
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, challenge, application)
 	response := server.HandleMessage(registration)
 	code, publicKey, keyHandle, certificate, signature, returnCode := parseRegistrationResponse(response, t)
 	if code != 0x05 {
@@ -161,3 +177,222 @@ func TestU2FRegistration(t *testing.T) {
 		t.Fatalf("Could not verify signature returned by Authenticate")
 	}
 }
+
+func registerU2FKey(t *testing.T, server *U2FServer, application []byte) (*ecdsa.PublicKey, []byte) {
+	challenge := crypto.RandomBytes(32)
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, challenge, application)
+	_, publicKey, keyHandle, _, _, returnCode := parseRegistrationResponse(server.HandleMessage(registration), t)
+	if returnCode != u2f_SW_NO_ERROR {
+		t.Fatalf("Could not register U2F key: %x", returnCode)
+	}
+	return publicKey, keyHandle
+}
+
+func u2fAuthenticateMessage(control U2FAuthenticateControl, challenge []byte, application []byte, keyHandle []byte) []byte {
+	request := util.Concat(challenge, application, []byte{uint8(len(keyHandle))}, keyHandle)
+	return util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(control), 0), []byte{0}, util.ToBE(uint16(len(request))), request)
+}
+
+func TestU2FAuthenticateUserPresence(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	application := crypto.RandomBytes(32)
+	publicKey, keyHandle := registerU2FKey(t, server, application)
+	challenge := crypto.RandomBytes(32)
+
+	response := server.HandleMessage(u2fAuthenticateMessage(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN, challenge, application, keyHandle))
+	if util.FromBE[U2FStatusWord](response[len(response)-2:]) != u2f_SW_NO_ERROR {
+		t.Fatalf("Authentication failed: %#v", response)
+	}
+	if response[0] != u2f_USER_PRESENCE_VERIFIED {
+		t.Fatalf("User presence not set after approval: %d", response[0])
+	}
+	signatureData := util.Concat(application, response[:5], challenge)
+	if !crypto.VerifyECDSA(publicKey, signatureData, response[5:len(response)-2]) {
+		t.Fatalf("Could not verify authentication signature")
+	}
+
+	response = server.HandleMessage(u2fAuthenticateMessage(u2f_AUTH_CONTROL_SIGN, challenge, application, keyHandle))
+	if response[0] != 0 {
+		t.Fatalf("User presence set without asking for approval: %d", response[0])
+	}
+	signatureData = util.Concat(application, response[:5], challenge)
+	if !crypto.VerifyECDSA(publicKey, signatureData, response[5:len(response)-2]) {
+		t.Fatalf("Could not verify authentication signature")
+	}
+
+	response = server.HandleMessage(u2fAuthenticateMessage(u2f_AUTH_CONTROL_CHECK_ONLY, challenge, application, keyHandle))
+	if !bytes.Equal(response, util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)) {
+		t.Fatalf("Check-only did not return conditions not satisfied: %#v", response)
+	}
+}
+
+func TestU2FRefusedWithAlwaysUV(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	application := crypto.RandomBytes(32)
+	_, keyHandle := registerU2FKey(t, server, application)
+	client.(*DummyU2FClient).alwaysUV = true
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(32), application)
+	if response := server.HandleMessage(registration); !bytes.Equal(response, util.ToBE(u2f_SW_COMMAND_NOT_ALLOWED)) {
+		t.Fatalf("Registration not refused with alwaysUv: %#v", response)
+	}
+	response := server.HandleMessage(u2fAuthenticateMessage(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN, crypto.RandomBytes(32), application, keyHandle))
+	if !bytes.Equal(response, util.ToBE(u2f_SW_COMMAND_NOT_ALLOWED)) {
+		t.Fatalf("Authentication not refused with alwaysUv: %#v", response)
+	}
+}
+
+func TestU2FAuthenticateDenied(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	application := crypto.RandomBytes(32)
+	_, keyHandle := registerU2FKey(t, server, application)
+	client.(*DummyU2FClient).denyApproval = true
+	response := server.HandleMessage(u2fAuthenticateMessage(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN, crypto.RandomBytes(32), application, keyHandle))
+	if !bytes.Equal(response, util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)) {
+		t.Fatalf("Denied authentication did not return conditions not satisfied: %#v", response)
+	}
+}
+
+func TestU2FMaximumLengthKeyHandle(t *testing.T) {
+	client := newDummyU2FClient()
+	server := NewU2FServer(client)
+	application := crypto.RandomBytes(32)
+	challenge := crypto.RandomBytes(32)
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, challenge, application)
+	response := server.HandleMessage(registration)
+	// The length byte follows the response code and the 65 byte public key
+	if response[66] != 255 {
+		t.Fatalf("Key handle length byte is not the maximum: %d", response[66])
+	}
+	_, publicKey, keyHandle, _, _, _ := parseRegistrationResponse(response, t)
+	if !bytes.Equal(keyHandle, response[67:67+255]) {
+		t.Fatalf("Key handle does not match the registration response")
+	}
+
+	request := u2fAuthenticateMessage(u2f_AUTH_CONTROL_SIGN, challenge, application, keyHandle)
+	if request[7+64] != 255 || !bytes.Equal(request[7+65:], keyHandle) {
+		t.Fatalf("Key handle was not sent unchanged")
+	}
+	response = server.HandleMessage(request)
+	if util.FromBE[U2FStatusWord](response[len(response)-2:]) != u2f_SW_NO_ERROR {
+		t.Fatalf("Authentication with maximum length key handle failed: %#v", response)
+	}
+	signatureData := util.Concat(application, response[:5], challenge)
+	if !crypto.VerifyECDSA(publicKey, signatureData, response[5:len(response)-2]) {
+		t.Fatalf("Could not verify authentication signature")
+	}
+
+	// A key handle shorter than its length byte must not be read past the end of the request
+	truncated := util.Concat(challenge, application, []byte{255}, keyHandle[:254])
+	message := util.Concat(u2fHeader(u2f_COMMAND_AUTHENTICATE, uint8(u2f_AUTH_CONTROL_SIGN), 0), []byte{0}, util.ToBE(uint16(len(truncated))), truncated)
+	response = server.HandleMessage(message)
+	if !bytes.Equal(response, util.ToBE(u2f_SW_WRONG_LENGTH)) {
+		t.Fatalf("Truncated key handle did not return wrong length: %#v", response)
+	}
+}
+
+func TestU2FMalformedAPDUs(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	cases := []struct {
+		name     string
+		message  []byte
+		expected U2FStatusWord
+	}{
+		{"unknown INS", u2fHeader(U2FCommand(0x42), 0, 0), u2f_SW_INS_NOT_SUPPORTED},
+		{"unsupported CLA", []byte{0x80, byte(u2f_COMMAND_VERSION), 0, 0}, u2f_SW_CLA_NOT_SUPPORTED},
+		{"truncated header", []byte{0, byte(u2f_COMMAND_VERSION)}, u2f_SW_WRONG_LENGTH},
+		{"truncated length", util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0}), u2f_SW_WRONG_LENGTH},
+		{"short length encoding", util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{64}, crypto.RandomBytes(64)), u2f_SW_WRONG_LENGTH},
+		{"truncated request", util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(32)), u2f_SW_WRONG_LENGTH},
+		{"trailing bytes", util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(64), []byte{1, 2, 3}), u2f_SW_WRONG_LENGTH},
+		{"short register request", util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 32}, crypto.RandomBytes(32)), u2f_SW_WRONG_LENGTH},
+	}
+	for _, c := range cases {
+		response := server.HandleMessage(c.message)
+		if !bytes.Equal(response, util.ToBE(c.expected)) {
+			t.Fatalf("%s: expected status 0x%04x, got %#v", c.name, c.expected, response)
+		}
+	}
+}
+
+func largeCertificateServer() *U2FServer {
+	client := newDummyU2FClient().(*DummyU2FClient)
+	client.certificatePadding = 4000
+	return NewU2FServer(client)
+}
+
+func TestU2FLargeResponseOverCTAPHID(t *testing.T) {
+	hidServer := ctap_hid.NewCTAPHIDServer(nil, largeCertificateServer())
+	var packets [][]byte
+	hidServer.SetResponseHandler(func(response []byte) {
+		packets = append(packets, response)
+	})
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff}
+	hidServer.HandleMessage(util.Pad(util.Concat(broadcast, []byte{0x86, 0, 8}, crypto.RandomBytes(8)), 64))
+	channel := packets[0][15:19]
+	packets = nil
+
+	challenge := crypto.RandomBytes(32)
+	application := crypto.RandomBytes(32)
+	request := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, challenge, application)
+	hidServer.HandleMessage(util.Pad(util.Concat(channel, []byte{0x83}, util.ToBE(uint16(len(request))), request[:57]), 64))
+	hidServer.HandleMessage(util.Pad(util.Concat(channel, []byte{0}, request[57:]), 64))
+
+	if len(packets) == 0 || packets[0][4] != 0x83 {
+		t.Fatalf("No MSG response: %#v", packets)
+	}
+	length := int(util.ReadBE[uint16](bytes.NewBuffer(packets[0][5:7])))
+	response := append([]byte{}, packets[0][7:]...)
+	for i, packet := range packets[1:] {
+		if packet[4] != byte(i) {
+			t.Fatalf("Continuation packet %d has sequence number %d", i, packet[4])
+		}
+		response = append(response, packet[5:]...)
+	}
+	if length < 4000 || len(response) < length {
+		t.Fatalf("Response is %d bytes, got %d", length, len(response))
+	}
+	_, publicKey, keyHandle, certificate, signature, returnCode := parseRegistrationResponse(response[:length], t)
+	if returnCode != u2f_SW_NO_ERROR {
+		t.Fatalf("Incorrect return code: %x", returnCode)
+	}
+	if len(certificate.Raw) < 4000 {
+		t.Fatalf("Attestation certificate was truncated to %d bytes", len(certificate.Raw))
+	}
+	encodedPublicKey := crypto.EncodePublicKey(publicKey)
+	if !crypto.VerifyECDSA(publicKey, util.Concat([]byte{0}, application, challenge, keyHandle, encodedPublicKey), signature) {
+		t.Fatalf("Could not verify the signature of a large registration")
+	}
+}
+
+func TestU2FResponseChaining(t *testing.T) {
+	server := largeCertificateServer()
+	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, crypto.RandomBytes(32), crypto.RandomBytes(32), []byte{0x01, 0x00})
+	response := server.HandleMessage(registration)
+	data := []byte{}
+	for {
+		status := util.ReadBE[U2FStatusWord](bytes.NewBuffer(response[len(response)-2:]))
+		if len(response)-2 > 256 {
+			t.Fatalf("Response data of %d bytes exceeds Le", len(response)-2)
+		}
+		data = append(data, response[:len(response)-2]...)
+		if status == u2f_SW_NO_ERROR {
+			break
+		}
+		if status&0xFF00 != u2f_SW_BYTES_REMAINING {
+			t.Fatalf("Unexpected status while chaining: %x", status)
+		}
+		response = server.HandleMessage(util.Concat(u2fHeader(u2f_COMMAND_GET_RESPONSE, 0, 0), []byte{0, 0x01, 0x00}))
+	}
+	_, _, _, certificate, _, returnCode := parseRegistrationResponse(util.Concat(data, util.ToBE(u2f_SW_NO_ERROR)), t)
+	if returnCode != u2f_SW_NO_ERROR || len(certificate.Raw) < 4000 {
+		t.Fatalf("Chained response did not reassemble to the full registration")
+	}
+
+	response = server.HandleMessage(util.Concat(u2fHeader(u2f_COMMAND_GET_RESPONSE, 0, 0), []byte{0, 0, 0}))
+	if !bytes.Equal(response, util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)) {
+		t.Fatalf("GET RESPONSE without a pending response returned %#v", response)
+	}
+}
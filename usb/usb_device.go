@@ -3,6 +3,8 @@ package usb
 import (
 	"bytes"
 	"fmt"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/bulwarkid/virtual-fido/usbip"
@@ -16,15 +18,44 @@ type USBDeviceDelegate interface {
 	SetResponseHandler(handler func(response []byte))
 }
 
+// USBDeviceConfig holds the identifying fields the device advertises in its descriptors
+type USBDeviceConfig struct {
+	VendorID     uint16
+	ProductID    uint16
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	// Position on the virtual bus, so that devices served together get distinct bus IDs
+	Index uint32
+}
+
+func DefaultUSBDeviceConfig() USBDeviceConfig {
+	return USBDeviceConfig{
+		VendorID:     0,
+		ProductID:    0,
+		Manufacturer: "No Company",
+		Product:      "Virtual FIDO",
+		SerialNumber: "No Serial Number",
+	}
+}
+
 type USBDevice struct {
 	delegate        USBDeviceDelegate
 	requestBuffer *util.RequestBuffer
+	config        USBDeviceConfig
+	activityLock  sync.Mutex
+	lastActivity  time.Time
 }
 
 func NewUSBDevice(delegate USBDeviceDelegate) *USBDevice {
+	return NewUSBDeviceWithConfig(delegate, DefaultUSBDeviceConfig())
+}
+
+func NewUSBDeviceWithConfig(delegate USBDeviceDelegate, config USBDeviceConfig) *USBDevice {
 	device := &USBDevice{
 		delegate:        delegate,
 		requestBuffer:   util.MakeRequestBuffer(),
+		config:          config,
 	}
 	delegate.SetResponseHandler(func(response []byte) {
 		device.handleResponse(response)
@@ -32,18 +63,22 @@ func NewUSBDevice(delegate USBDeviceDelegate) *USBDevice {
 	return device
 }
 
+func (device *USBDevice) deviceNumber() uint32 {
+	return 2 + device.config.Index
+}
+
 func (device *USBDevice) BusID() string {
-	return "2-2"
+	return fmt.Sprintf("2-%d", device.deviceNumber())
 }
 
 func (device *USBDevice) DeviceSummary() usbip.USBIPDeviceSummary {
 	summary := usbip.USBIPDeviceSummary{
 		Header: usbip.USBIPDeviceSummaryHeader{
 			Busnum:              2,
-			Devnum:              2,
+			Devnum:              device.deviceNumber(),
 			Speed:               2,
-			IdVendor:            0,
-			IdProduct:           0,
+			IdVendor:            device.config.VendorID,
+			IdProduct:           device.config.ProductID,
 			BcdDevice:           0,
 			BDeviceClass:        0,
 			BDeviceSubclass:     0,
@@ -58,11 +93,45 @@ func (device *USBDevice) DeviceSummary() usbip.USBIPDeviceSummary {
 			Padding:            0,
 		},
 	}
-	copy(summary.Header.Path[:], []byte("/device/0"))
-	copy(summary.Header.BusID[:], []byte("2-2"))
+	copy(summary.Header.Path[:], []byte(fmt.Sprintf("/device/%d", device.config.Index)))
+	copy(summary.Header.BusID[:], []byte(device.BusID()))
 	return summary
 }
 
+// USBDescriptors are the raw descriptors the device presents to the host during enumeration
+type USBDescriptors struct {
+	Device []byte
+	// The configuration descriptor followed by the interface, HID and endpoint descriptors
+	Configuration []byte
+	HIDReport     []byte
+}
+
+// Descriptors returns the descriptors the host reads while enumerating the device, for
+// checking them without a USB/IP client
+func (device *USBDevice) Descriptors() USBDescriptors {
+	return USBDescriptors{
+		Device:        device.getDescriptor(usbDescriptorDevice, 0),
+		Configuration: device.getDescriptor(usbDescriptorConfiguration, 0),
+		HIDReport:     device.getHIDReport(),
+	}
+}
+
+func (device *USBDevice) LastActivity() time.Time {
+	device.activityLock.Lock()
+	defer device.activityLock.Unlock()
+	return device.lastActivity
+}
+
+func (device *USBDevice) recordActivity() {
+	device.activityLock.Lock()
+	defer device.activityLock.Unlock()
+	device.lastActivity = time.Now()
+}
+
+func (device *USBDevice) Detach() {
+	device.requestBuffer.CancelAll()
+}
+
 func (device *USBDevice) RemoveWaitingRequest(id uint32) bool {
 	return device.requestBuffer.CancelRequest(id)
 }
@@ -85,6 +154,7 @@ func (device *USBDevice) HandleMessage(id uint32, onFinish func(response []byte)
 		// onFinish will be called when a response is returned
 	case usbEndpointInput:
 		usbLogger.Printf("INPUT DATA: %#v\n\n", data)
+		device.recordActivity()
 		go device.delegate.HandleMessage(data)
 		onFinish(nil)
 	default:
@@ -93,6 +163,7 @@ func (device *USBDevice) HandleMessage(id uint32, onFinish func(response []byte)
 }
 
 func (device *USBDevice) handleResponse(response []byte) {
+	device.recordActivity()
 	device.requestBuffer.Respond(response)
 }
 
@@ -195,8 +266,8 @@ func (device *USBDevice) getDeviceDescriptor() usbDeviceDescriptor {
 		BDeviceSubclass:    0,
 		BDeviceProtocol:    0,
 		BMaxPacketSize:     64,
-		IDVendor:           0,
-		IDProduct:          0,
+		IDVendor:           device.config.VendorID,
+		IDProduct:          device.config.ProductID,
 		BcdDevice:          0x1,
 		IManufacturer:      1,
 		IProduct:           2,
@@ -277,11 +348,11 @@ func (device *USBDevice) getStringDescriptor(index uint8) []byte {
 	case 0:
 		return util.ToLE[uint16](usbLangIDEngUSA)
 	case 1:
-		return util.Utf16encode("No Company")
+		return util.Utf16encode(device.config.Manufacturer)
 	case 2:
-		return util.Utf16encode("Virtual FIDO")
+		return util.Utf16encode(device.config.Product)
 	case 3:
-		return util.Utf16encode("No Serial Number")
+		return util.Utf16encode(device.config.SerialNumber)
 	case 4:
 		return util.Utf16encode("String 4")
 	case 5:
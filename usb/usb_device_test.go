@@ -139,4 +139,98 @@ func TestDeviceSummary(t *testing.T) {
 		util.CStringToString(summary.Header.Path[:]) != "/device/0" {
 		t.Fatalf("Device summary incorrect")
 	}
-}
\ No newline at end of file
+}
+func TestCustomDeviceConfig(t *testing.T) {
+	delegate := dummyUSBDeviceDelegate{}
+	config := USBDeviceConfig{
+		VendorID:     0x1050,
+		ProductID:    0x0407,
+		Manufacturer: "Test Manufacturer",
+		Product:      "Test Key",
+		SerialNumber: "0001",
+	}
+	device := NewUSBDeviceWithConfig(&delegate, config)
+	getDescriptor := func(descriptorType usbDescriptorType, index uint8) []byte {
+		var response []byte = nil
+		var setup usbSetupPacket
+		setup.setDirection(usbHostToDevice)
+		setup.setRequestClass(usbRequestClassStandard)
+		setup.setRecipient(usbRequestRecipientDevice)
+		setup.BRequest = usbRequestGetDescriptor
+		setup.WValue = (uint16(descriptorType) << 8 | uint16(index))
+		setup.WLength = 64
+		device.HandleMessage(0, func(other []byte) { response = other }, 0, util.ToLE(setup), []byte{})
+		return response
+	}
+	response := getDescriptor(usbDescriptorDevice, 0)
+	// idVendor and idProduct follow bLength, bDescriptorType, bcdUSB, class/subclass/protocol and bMaxPacketSize
+	test.AssertArrEqual(t, response[8:12], []byte{0x50, 0x10, 0x07, 0x04}, "Descriptor bytes do not contain custom VID/PID")
+	deviceDescriptor := util.ReadLE[usbDeviceDescriptor](bytes.NewBuffer(response))
+	test.AssertEqual(t, deviceDescriptor.IDVendor, 0x1050, "Incorrect vendor ID")
+	test.AssertEqual(t, deviceDescriptor.IDProduct, 0x0407, "Incorrect product ID")
+
+	header := int(util.SizeOf[usbStringDescriptorHeader]())
+	test.AssertArrEqual(t, getDescriptor(usbDescriptorString, 1)[header:], util.Utf16encode("Test Manufacturer"), "Incorrect manufacturer string")
+	test.AssertArrEqual(t, getDescriptor(usbDescriptorString, 2)[header:], util.Utf16encode("Test Key"), "Incorrect product string")
+	test.AssertArrEqual(t, getDescriptor(usbDescriptorString, 3)[header:], util.Utf16encode("0001"), "Incorrect serial number string")
+
+	summary := device.DeviceSummary()
+	test.AssertEqual(t, summary.Header.IdVendor, 0x1050, "Incorrect vendor ID in device summary")
+	test.AssertEqual(t, summary.Header.IdProduct, 0x0407, "Incorrect product ID in device summary")
+}
+
+func TestDeviceIndex(t *testing.T) {
+	first := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	config := DefaultUSBDeviceConfig()
+	config.Index = 1
+	second := NewUSBDeviceWithConfig(&dummyUSBDeviceDelegate{}, config)
+	test.AssertNotEqual(t, first.BusID(), second.BusID(), "Devices at different indexes share a bus ID")
+	summary := second.DeviceSummary()
+	test.AssertEqual(t, util.CStringToString(summary.Header.BusID[:]), "2-3", "Wrong bus ID in summary")
+	test.AssertEqual(t, summary.Header.Devnum, uint32(3), "Wrong device number")
+	test.AssertEqual(t, util.CStringToString(summary.Header.Path[:]), "/device/1", "Wrong device path")
+}
+
+func TestDescriptorsHIDReport(t *testing.T) {
+	device := NewUSBDevice(&dummyUSBDeviceDelegate{})
+	descriptors := device.Descriptors()
+	test.AssertEqual(t, int(descriptors.Device[0]), len(descriptors.Device), "Incorrect device descriptor length")
+	hidDescriptor := util.ReadLE[usbHIDDescriptor](bytes.NewBuffer(descriptors.Configuration[util.SizeOf[usbConfigurationDescriptor]()+util.SizeOf[usbInterfaceDescriptor]():]))
+	test.AssertEqual(t, int(hidDescriptor.WReportDescriptorLength), len(descriptors.HIDReport), "HID descriptor has the wrong report length")
+
+	// Walk the short items of the report descriptor, tracking the global report size and count
+	var usagePage, usage, reportSize, reportCount uint32
+	reportBits := map[byte]uint32{}
+	report := descriptors.HIDReport
+	for len(report) > 0 {
+		prefix := report[0]
+		size := int(prefix & 0x3)
+		if size == 3 {
+			size = 4
+		}
+		test.Assert(t, len(report) > size, "Truncated HID report item")
+		var value uint32
+		for i := size; i > 0; i-- {
+			value = value<<8 | uint32(report[i])
+		}
+		switch tag := prefix & 0xFC; tag {
+		case 0x04:
+			usagePage = value
+		case 0x08:
+			if usage == 0 {
+				usage = value
+			}
+		case 0x74:
+			reportSize = value
+		case 0x94:
+			reportCount = value
+		case 0x80, 0x90:
+			reportBits[tag] = reportSize * reportCount
+		}
+		report = report[1+size:]
+	}
+	test.AssertEqual(t, usagePage, uint32(0xF1D0), "HID report is not on the FIDO usage page")
+	test.AssertEqual(t, usage, uint32(0x01), "HID report is not a CTAPHID usage")
+	test.AssertEqual(t, reportBits[0x80], uint32(64*8), "Input report is not 64 bytes")
+	test.AssertEqual(t, reportBits[0x90], uint32(64*8), "Output report is not 64 bytes")
+}
@@ -2,6 +2,9 @@ package usbip
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
 )
 
 const (
@@ -72,6 +75,15 @@ type usbipOpRepDevlist struct {
 	Devices    []USBIPDeviceSummary
 }
 
+// Bytes encodes the reply explicitly, since binary.Write can't encode the variable length device list
+func (reply usbipOpRepDevlist) Bytes() []byte {
+	data := util.Concat(util.ToBE(reply.Header), util.ToBE(reply.NumDevices))
+	for _, device := range reply.Devices {
+		data = append(data, util.ToBE(device)...)
+	}
+	return data
+}
+
 func newOpRepDevlist(devices []USBIPDevice) usbipOpRepDevlist {
 	summaries := make([]USBIPDeviceSummary, len(devices))
 	for i := range devices {
@@ -246,4 +258,8 @@ type USBIPDevice interface {
 	RemoveWaitingRequest(id uint32) bool
 	BusID() string
 	DeviceSummary() USBIPDeviceSummary
+	// LastActivity is when the device last exchanged data with the host, not counting polling
+	LastActivity() time.Time
+	// Detach drops all requests waiting for a response when the host connection goes away
+	Detach()
 }
@@ -1,10 +1,13 @@
 package usbip
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/util"
 )
@@ -12,23 +15,60 @@ import (
 var usbipLogger = util.NewLogger("[USBIP] ", util.LogLevelTrace)
 var errLogger = util.NewLogger("[ERR] ", util.LogLevelEnabled)
 
+// The shortest interval the idle watcher checks at, however small the idle timeout
+const minIdleCheckInterval = 10 * time.Millisecond
+
 type USBIPServer struct {
-	devices []USBIPDevice
+	devices      []USBIPDevice
+	idleTimeout  time.Duration
+	attachedLock sync.Mutex
+	attached     map[string]bool
+	onAttachment func(busID string, attached bool)
 }
 
 func NewUSBIPServer(devices []USBIPDevice) *USBIPServer {
 	server := new(USBIPServer)
 	server.devices = devices
+	server.attached = make(map[string]bool)
+	for i, device := range devices {
+		for _, other := range devices[:i] {
+			util.Assert(device.BusID() != other.BusID(), "Two USB/IP devices have bus ID "+device.BusID())
+		}
+	}
 	return server
 }
 
+// SetIdleTimeout disconnects an attached host after the device has had no traffic for the
+// given duration, freeing its resources until the host attaches again. Zero disables it.
+func (server *USBIPServer) SetIdleTimeout(timeout time.Duration) {
+	util.Assert(timeout >= 0, "USB/IP idle timeout is negative: "+timeout.String())
+	server.idleTimeout = timeout
+}
+
+// SetAttachmentHandler calls handler when a host attaches a device and again when that host
+// detaches or is disconnected, so embedders can show whether the device is in use. It may be
+// called from any connection or idle watcher goroutine, so it must be safe for concurrent
+// use, and it must be set before Serve.
+func (server *USBIPServer) SetAttachmentHandler(handler func(busID string, attached bool)) {
+	server.onAttachment = handler
+}
+
 func (server *USBIPServer) Start() {
 	usbipLogger.Println("Starting USBIP server...")
 	listener, err := net.Listen("tcp", ":3240")
 	util.CheckErr(err, "Could not create listener")
+	server.Serve(listener)
+}
+
+// Serve handles USB/IP connections from the listener. Each device can be attached by one
+// connection at a time, so several devices can be in use at once.
+func (server *USBIPServer) Serve(listener net.Listener) {
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			usbipLogger.Printf("Connection accept error: %v", err)
 			continue
 		}
@@ -38,7 +78,7 @@ func (server *USBIPServer) Start() {
 			continue
 		}
 		usbipConn := newUSBIPConnection(server, connection)
-		util.Try(func() {
+		go util.Try(func() {
 			usbipConn.handle()
 		}, func(err interface{}) {
 			errLogger.Printf("%v", err)
@@ -46,6 +86,23 @@ func (server *USBIPServer) Start() {
 	}
 }
 
+// attach marks the device as in use, returning false if another connection already has it
+func (server *USBIPServer) attach(busID string) bool {
+	server.attachedLock.Lock()
+	defer server.attachedLock.Unlock()
+	if server.attached[busID] {
+		return false
+	}
+	server.attached[busID] = true
+	return true
+}
+
+func (server *USBIPServer) detach(busID string) {
+	server.attachedLock.Lock()
+	defer server.attachedLock.Unlock()
+	delete(server.attached, busID)
+}
+
 func (server *USBIPServer) getDevice(busID string) USBIPDevice {
 	var device USBIPDevice = nil
 	for _, other := range server.devices {
@@ -61,6 +118,10 @@ type usbipConnection struct {
 	responseMutex *sync.Mutex
 	conn          net.Conn
 	server        *USBIPServer
+	closeOnce     sync.Once
+	closed        chan struct{}
+	// Bus ID of the device this connection imported, if any
+	attachedBusID string
 }
 
 func newUSBIPConnection(server *USBIPServer, conn net.Conn) *usbipConnection {
@@ -68,9 +129,67 @@ func newUSBIPConnection(server *USBIPServer, conn net.Conn) *usbipConnection {
 	usbipConn.responseMutex = &sync.Mutex{}
 	usbipConn.conn = conn
 	usbipConn.server = server
+	usbipConn.closed = make(chan struct{})
 	return usbipConn
 }
 
+func (conn *usbipConnection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.conn.Close()
+		// Release the device before the host notices, so it can attach again right away
+		if conn.attachedBusID != "" {
+			conn.server.detach(conn.attachedBusID)
+			if conn.server.onAttachment != nil {
+				conn.server.onAttachment(conn.attachedBusID, false)
+			}
+		}
+	})
+}
+
+func (conn *usbipConnection) isClosed() bool {
+	select {
+	case <-conn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// idleCheckInterval checks a few times per timeout so a disconnect isn't late by much more
+// than a quarter of it
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / 4; interval > minIdleCheckInterval {
+		return interval
+	}
+	return minIdleCheckInterval
+}
+
+// watchIdle closes the connection once the device has been idle for the server's idle
+// timeout, counting the attach itself as activity
+func (conn *usbipConnection) watchIdle(device USBIPDevice) {
+	timeout := conn.server.idleTimeout
+	attached := time.Now()
+	ticker := time.NewTicker(idleCheckInterval(timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case now := <-ticker.C:
+			lastActivity := device.LastActivity()
+			if lastActivity.Before(attached) {
+				lastActivity = attached
+			}
+			if now.Sub(lastActivity) >= timeout {
+				usbipLogger.Printf("Device %s idle for %v, disconnecting\n\n", device.BusID(), timeout)
+				conn.close()
+				return
+			}
+		}
+	}
+}
+
 func (conn *usbipConnection) handle() {
 	for {
 		header := util.ReadBE[usbipControlHeader](conn.conn)
@@ -78,7 +197,7 @@ func (conn *usbipConnection) handle() {
 		if header.Command == usbipCommandOpReqDevlist {
 			reply := newOpRepDevlist(conn.server.devices)
 			usbipLogger.Printf("[OP_REP_DEVLIST] %#v\n\n", reply)
-			conn.writeResponse(util.ToBE(reply))
+			conn.writeResponse(reply.Bytes())
 		} else if header.Command == usbipCommandOpReqImport {
 			busIDData := util.Read(conn.conn, 32)
 			busID := util.CStringToString(busIDData)
@@ -89,10 +208,21 @@ func (conn *usbipConnection) handle() {
 				conn.writeResponse(util.ToBE(reply))
 				continue
 			}
+			if !conn.server.attach(busID) {
+				usbipLogger.Printf("Device %s is already attached\n\n", busID)
+				reply := opRepImportError(1)
+				conn.writeResponse(util.ToBE(reply))
+				continue
+			}
+			conn.attachedBusID = busID
 			reply := newOpRepImport(device)
 			usbipLogger.Printf("[OP_REP_IMPORT] %s\n\n", reply)
 			conn.writeResponse(util.ToBE(reply))
+			if conn.server.onAttachment != nil {
+				conn.server.onAttachment(busID, true)
+			}
 			conn.handleCommands(device)
+			return
 		} else {
 			usbipLogger.Printf("Unknown Command Code: %d", header.Command)
 		}
@@ -100,9 +230,20 @@ func (conn *usbipConnection) handle() {
 }
 
 func (conn *usbipConnection) handleCommands(device USBIPDevice) {
-	for {
+	defer conn.close()
+	defer device.Detach()
+	if conn.server.idleTimeout > 0 {
+		go conn.watchIdle(device)
+	}
+	for !conn.isClosed() {
 		util.Try(func() {
-			header := util.ReadBE[usbipMessageHeader](conn.conn)
+			var header usbipMessageHeader
+			if err := binary.Read(conn.conn, binary.BigEndian, &header); err != nil {
+				// The host disconnected or the connection was closed for idling
+				usbipLogger.Printf("Connection to device %s closed: %v\n\n", device.BusID(), err)
+				conn.close()
+				return
+			}
 			usbipLogger.Printf("[MESSAGE HEADER] %s\n\n", header)
 			if header.Command == usbipCmdSubmit {
 				conn.handleCommandSubmit(device, header)
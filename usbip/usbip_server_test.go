@@ -0,0 +1,231 @@
+package usbip
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+type dummyUSBIPDevice struct {
+	busID        string
+	lock         sync.Mutex
+	lastActivity time.Time
+	detached     chan struct{}
+}
+
+func newDummyUSBIPDevice() *dummyUSBIPDevice {
+	return &dummyUSBIPDevice{busID: "2-2", detached: make(chan struct{}, 10)}
+}
+
+func (device *dummyUSBIPDevice) HandleMessage(id uint32, onFinish func(response []byte), endpoint uint32, setupBytes []byte, transferBuffer []byte) {
+	device.lock.Lock()
+	device.lastActivity = time.Now()
+	device.lock.Unlock()
+	onFinish([]byte{1, 2, 3, 4})
+}
+func (device *dummyUSBIPDevice) RemoveWaitingRequest(id uint32) bool {
+	return false
+}
+func (device *dummyUSBIPDevice) BusID() string {
+	return device.busID
+}
+func (device *dummyUSBIPDevice) DeviceSummary() USBIPDeviceSummary {
+	summary := USBIPDeviceSummary{}
+	copy(summary.Header.BusID[:], []byte(device.busID))
+	return summary
+}
+func (device *dummyUSBIPDevice) LastActivity() time.Time {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.lastActivity
+}
+func (device *dummyUSBIPDevice) Detach() {
+	device.detached <- struct{}{}
+}
+
+func importDevice(t *testing.T, address string, busID string) (net.Conn, uint32) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	busIDData := make([]byte, 32)
+	copy(busIDData, []byte(busID))
+	request := util.Concat(util.ToBE(usbipControlHeader{Version: usbipVersion, Command: usbipCommandOpReqImport}), busIDData)
+	util.Write(conn, request)
+	header := util.ReadBE[usbipControlHeader](conn)
+	if header.Command != usbipCommandOpRepImport {
+		t.Fatalf("Unexpected reply to import: %#v", header)
+	}
+	if header.Status == 0 {
+		util.ReadBE[USBIPDeviceSummaryHeader](conn)
+	}
+	return conn, header.Status
+}
+
+func attachDevice(t *testing.T, address string) net.Conn {
+	conn, status := importDevice(t, address, "2-2")
+	if status != 0 {
+		t.Fatalf("Import failed with status %d", status)
+	}
+	return conn
+}
+
+func TestIdleDisconnectAndReattach(t *testing.T) {
+	device := newDummyUSBIPDevice()
+	server := NewUSBIPServer([]USBIPDevice{device})
+	server.SetIdleTimeout(100 * time.Millisecond)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+
+	conn := attachDevice(t, listener.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Idle connection was not closed by the server: %v", err)
+	}
+	select {
+	case <-device.detached:
+	case <-time.After(time.Second):
+		t.Fatalf("Device was not detached after idle disconnect")
+	}
+
+	conn = attachDevice(t, listener.Addr().String())
+	defer conn.Close()
+	header := usbipMessageHeader{Command: usbipCmdSubmit, SequenceNumber: 7, Direction: usbipDirIn, Endpoint: 0}
+	body := usbipCommandSubmitBody{TransferBufferLength: 4}
+	util.Write(conn, util.Concat(util.ToBE(header), util.ToBE(body)))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	replyHeader := util.ReadBE[usbipMessageHeader](conn)
+	replyBody := util.ReadBE[usbipReturnSubmitBody](conn)
+	data := util.Read(conn, 4)
+	if replyHeader.Command != usbipRetSubmit || replyHeader.SequenceNumber != 7 || replyBody.ActualLength != 4 {
+		t.Fatalf("Incorrect reply after reattaching: %s %#v", replyHeader, replyBody)
+	}
+	if string(data) != string([]byte{1, 2, 3, 4}) {
+		t.Fatalf("Incorrect reply data after reattaching: %v", data)
+	}
+}
+
+func TestTinyIdleTimeout(t *testing.T) {
+	device := newDummyUSBIPDevice()
+	server := NewUSBIPServer([]USBIPDevice{device})
+	// A quarter of this rounds down to a zero tick, which must not panic the watcher
+	server.SetIdleTimeout(time.Nanosecond)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+
+	conn := attachDevice(t, listener.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Idle connection was not closed by the server: %v", err)
+	}
+}
+
+func TestAttachMultipleDevices(t *testing.T) {
+	first := newDummyUSBIPDevice()
+	second := newDummyUSBIPDevice()
+	second.busID = "2-3"
+	server := NewUSBIPServer([]USBIPDevice{first, second})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	address := listener.Addr().String()
+
+	firstConn, status := importDevice(t, address, "2-2")
+	if status != 0 {
+		t.Fatalf("Could not attach first device: %d", status)
+	}
+	defer firstConn.Close()
+	// The second device can be attached while the first is in use
+	secondConn, status := importDevice(t, address, "2-3")
+	if status != 0 {
+		t.Fatalf("Could not attach second device: %d", status)
+	}
+	// But a device can't be attached twice
+	duplicateConn, status := importDevice(t, address, "2-2")
+	duplicateConn.Close()
+	if status == 0 {
+		t.Fatalf("Attached the same device twice")
+	}
+
+	secondConn.Close()
+	select {
+	case <-second.detached:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Second device not detached after the host disconnected")
+	}
+	if len(first.detached) != 0 {
+		t.Fatalf("First device detached when the second host disconnected")
+	}
+	reattachedConn, status := importDevice(t, address, "2-3")
+	if status != 0 {
+		t.Fatalf("Could not reattach second device: %d", status)
+	}
+	reattachedConn.Close()
+}
+
+func TestAttachmentHandler(t *testing.T) {
+	type attachment struct {
+		busID    string
+		attached bool
+	}
+	events := make(chan attachment, 10)
+	server := NewUSBIPServer([]USBIPDevice{newDummyUSBIPDevice()})
+	server.SetAttachmentHandler(func(busID string, attached bool) {
+		events <- attachment{busID, attached}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	nextEvent := func() attachment {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No attachment event")
+			return attachment{}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		conn := attachDevice(t, listener.Addr().String())
+		if event := nextEvent(); event != (attachment{"2-2", true}) {
+			t.Fatalf("Expected an attach event, got %#v", event)
+		}
+		conn.Close()
+		if event := nextEvent(); event != (attachment{"2-2", false}) {
+			t.Fatalf("Expected a detach event, got %#v", event)
+		}
+	}
+
+	// A failed import doesn't attach anything
+	conn, status := importDevice(t, listener.Addr().String(), "9-9")
+	conn.Close()
+	if status == 0 {
+		t.Fatalf("Imported a device that doesn't exist")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected event for a failed import: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
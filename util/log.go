@@ -52,6 +52,9 @@ var debugLogOutput *logBuffer = newLogBuffer()
 var traceLogOutput *logBuffer = newLogBuffer()
 var unsafeLogOutput *logBuffer = newLogBuffer()
 
+// The lowest level whose logs are passed on to the log output
+var activeLogLevel = LogLevelEnabled
+
 func SetLogOutput(out io.Writer) {
 	enabledLogOutput.setOutput(out)
 }
@@ -66,9 +69,18 @@ func SetLogLevel(level LogLevel) {
 	if level <= LogLevelDebug {
 		debugLogOutput.setOutput(enabledLogOutput)
 	}
+	if level < activeLogLevel {
+		activeLogLevel = level
+	}
 	logLog.Printf("Log Level Set: %d\n", level)
 }
 
+// LogLevelActive reports whether logs at the given level are shown, so callers can skip
+// building expensive log messages that would only sit in the buffer
+func LogLevelActive(level LogLevel) bool {
+	return level >= activeLogLevel
+}
+
 func NewLogger(prefix string, level LogLevel) *log.Logger {
 	if level == LogLevelEnabled {
 		return log.New(enabledLogOutput, prefix, 0)
@@ -42,6 +42,14 @@ func (buffer *RequestBuffer) CancelRequest(id uint32) bool {
 	}
 }
 
+// CancelAll drops every waiting request and any responses nobody has asked for yet
+func (buffer *RequestBuffer) CancelAll() {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	buffer.waitingForData = make(map[uint32]func([]byte))
+	buffer.responses = make([][]byte, 0)
+}
+
 func (buffer *RequestBuffer) Respond(data []byte) {
 	buffer.lock.Lock()
 	if len(buffer.waitingForData) > 0 {
@@ -27,4 +27,19 @@ func TestRequestBuffer(t *testing.T) {
 	buffer.Request(3, makeRequest([]byte{4}))
 	buffer.Request(3, makeRequest([]byte{5}))
 	buffer.Request(3, makeRequest([]byte{6}))
-}
\ No newline at end of file
+}
+func TestRequestBufferCancelAll(t *testing.T) {
+	buffer := MakeRequestBuffer()
+	buffer.Request(1, func(response []byte) {
+		t.Fatalf("Cancelled request received a response")
+	})
+	buffer.CancelAll()
+	test.Assert(t, !buffer.CancelRequest(1), "Request still waiting after CancelAll")
+	buffer.Respond([]byte{1})
+	buffer.CancelAll()
+	answered := false
+	buffer.Request(2, func(response []byte) {
+		answered = true
+	})
+	test.Assert(t, !answered, "Response queued before CancelAll was delivered")
+}
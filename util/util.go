@@ -67,15 +67,20 @@ func ReadLE[T any](reader io.Reader) T {
 	return value
 }
 
+// ToLE encodes a fixed-size value (or struct of fixed-size fields) as packed little endian
+// bytes. Values without a fixed size, such as int, panic instead of encoding to nothing.
 func ToLE[T any](val T) []byte {
 	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.LittleEndian, val)
+	err := binary.Write(buffer, binary.LittleEndian, val)
+	CheckErr(err, "Could not encode data")
 	return buffer.Bytes()
 }
 
+// ToBE is the big endian equivalent of ToLE
 func ToBE[T any](val T) []byte {
 	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, val)
+	err := binary.Write(buffer, binary.BigEndian, val)
+	CheckErr(err, "Could not encode data")
 	return buffer.Bytes()
 }
 
@@ -115,9 +120,9 @@ func Utf16encode(message string) []byte {
 
 func SizeOf[T any]() uint8 {
 	var val T
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, &val)
-	return uint8(buffer.Len())
+	size := binary.Size(&val)
+	Assert(size >= 0 && size <= 0xFF, fmt.Sprintf("Invalid size for %T: %d", val, size))
+	return uint8(size)
 }
 
 func Concat[T any](arrays ...[]T) []T {
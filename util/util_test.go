@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+)
+
+func TestIntegerEncoding(t *testing.T) {
+	test.AssertArrEqual(t, ToLE[uint8](0x12), []byte{0x12}, "Incorrect uint8 LE encoding")
+	test.AssertArrEqual(t, ToLE[uint16](0x1234), []byte{0x34, 0x12}, "Incorrect uint16 LE encoding")
+	test.AssertArrEqual(t, ToBE[uint16](0x1234), []byte{0x12, 0x34}, "Incorrect uint16 BE encoding")
+	test.AssertArrEqual(t, ToLE[uint32](0x12345678), []byte{0x78, 0x56, 0x34, 0x12}, "Incorrect uint32 LE encoding")
+	test.AssertArrEqual(t, ToBE[uint32](0x12345678), []byte{0x12, 0x34, 0x56, 0x78}, "Incorrect uint32 BE encoding")
+	test.AssertArrEqual(t, ToBE[int32](-2), []byte{0xFF, 0xFF, 0xFF, 0xFE}, "Incorrect int32 BE encoding")
+
+	test.AssertEqual(t, ReadLE[uint16](bytes.NewBuffer([]byte{0x34, 0x12})), uint16(0x1234), "Incorrect uint16 LE decoding")
+	test.AssertEqual(t, ReadBE[uint32](bytes.NewBuffer([]byte{0x12, 0x34, 0x56, 0x78})), uint32(0x12345678), "Incorrect uint32 BE decoding")
+	test.AssertEqual(t, FromBE[int32]([]byte{0xFF, 0xFF, 0xFF, 0xFE}), int32(-2), "Incorrect int32 BE decoding")
+}
+
+func TestStructEncodingIsPacked(t *testing.T) {
+	type packed struct {
+		A uint8
+		B uint32
+		C [2]byte
+		D uint16
+	}
+	value := packed{A: 1, B: 0x02030405, C: [2]byte{6, 7}, D: 0x0809}
+	test.AssertArrEqual(t, ToLE(value), []byte{1, 5, 4, 3, 2, 6, 7, 9, 8}, "Struct LE encoding is not packed")
+	test.AssertArrEqual(t, ToBE(value), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, "Struct BE encoding is not packed")
+	test.AssertEqual(t, SizeOf[packed](), uint8(9), "Incorrect struct size")
+	test.AssertEqual(t, ReadLE[packed](bytes.NewBuffer(ToLE(value))), value, "Struct LE round trip failed")
+}
+
+func TestEncodingVariableSizePanics(t *testing.T) {
+	panicked := false
+	Try(func() {
+		ToBE(int(1))
+	}, func(val interface{}) {
+		panicked = true
+	})
+	test.Assert(t, panicked, "Encoding a value without a fixed size did not panic")
+}
+
+func TestLogLevelActive(t *testing.T) {
+	test.Assert(t, LogLevelActive(LogLevelEnabled), "Enabled logs are not active")
+	test.Assert(t, !LogLevelActive(LogLevelDebug), "Debug logs are active before setting the level")
+	SetLogLevel(LogLevelDebug)
+	test.Assert(t, LogLevelActive(LogLevelDebug), "Debug logs are not active after setting the level")
+	test.Assert(t, !LogLevelActive(LogLevelTrace), "Trace logs are active at the debug level")
+}
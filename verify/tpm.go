@@ -0,0 +1,184 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+const (
+	tpmGeneratedValue  uint32 = 0xff544347
+	tpmSTAttestCertify uint16 = 0x8017
+	tpmAlgECC          uint16 = 0x0023
+	tpmAlgSHA256       uint16 = 0x000B
+	tpmAlgNull         uint16 = 0x0010
+	tpmECCNISTP256     uint16 = 0x0003
+)
+
+var oidTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+
+type tpmAttestationStatement struct {
+	Ver      string   `cbor:"ver"`
+	Alg      int64    `cbor:"alg"`
+	X5c      [][]byte `cbor:"x5c"`
+	Sig      []byte   `cbor:"sig"`
+	CertInfo []byte   `cbor:"certInfo"`
+	PubArea  []byte   `cbor:"pubArea"`
+}
+
+// tpmReader reads big-endian TPM structures, remembering the first error so callers only
+// need to check once at the end
+type tpmReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *tpmReader) read(length int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if len(reader.data) < length {
+		reader.err = fmt.Errorf("TPM structure is truncated")
+		return nil
+	}
+	value := reader.data[:length]
+	reader.data = reader.data[length:]
+	return value
+}
+
+func (reader *tpmReader) uint16() uint16 {
+	if value := reader.read(2); value != nil {
+		return binary.BigEndian.Uint16(value)
+	}
+	return 0
+}
+
+func (reader *tpmReader) uint32() uint32 {
+	if value := reader.read(4); value != nil {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+func (reader *tpmReader) tpm2b() []byte {
+	return reader.read(int(reader.uint16()))
+}
+
+// parseTPMECCPublicArea reads the curve point out of an ECC TPMT_PUBLIC
+func parseTPMECCPublicArea(publicArea []byte) (*big.Int, *big.Int, error) {
+	reader := &tpmReader{data: publicArea}
+	if keyType := reader.uint16(); keyType != tpmAlgECC && reader.err == nil {
+		return nil, nil, fmt.Errorf("Unsupported TPM key type: 0x%04x", keyType)
+	}
+	reader.uint16() // nameAlg
+	reader.uint32() // objectAttributes
+	reader.tpm2b()  // authPolicy
+	if symmetric := reader.uint16(); symmetric != tpmAlgNull && reader.err == nil {
+		return nil, nil, fmt.Errorf("TPM signing key has a symmetric algorithm")
+	}
+	if scheme := reader.uint16(); scheme != tpmAlgNull {
+		reader.uint16() // the scheme's hash algorithm
+	}
+	if curve := reader.uint16(); curve != tpmECCNISTP256 && reader.err == nil {
+		return nil, nil, fmt.Errorf("Unsupported TPM curve: 0x%04x", curve)
+	}
+	if kdf := reader.uint16(); kdf != tpmAlgNull {
+		reader.uint16() // the KDF's hash algorithm
+	}
+	x := reader.tpm2b()
+	y := reader.tpm2b()
+	if reader.err != nil {
+		return nil, nil, fmt.Errorf("Invalid pubArea: %w", reader.err)
+	}
+	return new(big.Int).SetBytes(x), new(big.Int).SetBytes(y), nil
+}
+
+func checkTPMAIKCertificate(certificate *x509.Certificate) error {
+	if certificate.Version != 3 {
+		return fmt.Errorf("AIK certificate is not version 3")
+	}
+	if !bytes.Equal(certificate.RawSubject, []byte{0x30, 0x00}) {
+		return fmt.Errorf("AIK certificate subject is not empty")
+	}
+	if certificate.IsCA {
+		return fmt.Errorf("AIK certificate is a CA certificate")
+	}
+	for _, usage := range certificate.UnknownExtKeyUsage {
+		if usage.Equal(oidTCGKpAIKCertificate) {
+			return nil
+		}
+	}
+	return fmt.Errorf("AIK certificate does not have the tcg-kp-AIKCertificate extended key usage")
+}
+
+// verifyTPMAttestation follows the tpm attestation verification procedure from the
+// WebAuthn spec for P-256 credentials and AIKs that sign with a SHA-256 algorithm
+func verifyTPMAttestation(statement *tpmAttestationStatement, authData []byte, clientDataHash []byte, credentialKey *cose.SupportedCOSEPublicKey) error {
+	if statement.Ver != "2.0" {
+		return fmt.Errorf("Unsupported TPM version: %s", statement.Ver)
+	}
+	switch cose.COSEAlgorithmID(statement.Alg) {
+	case cose.COSE_ALGORITHM_ID_ES256, cose.COSE_ALGORITHM_ID_RS256, cose.COSE_ALGORITHM_ID_PS256:
+		// extraData is checked as a SHA-256 hash below
+	default:
+		return fmt.Errorf("Unsupported TPM attestation algorithm: %d", statement.Alg)
+	}
+	x, y, err := parseTPMECCPublicArea(statement.PubArea)
+	if err != nil {
+		return err
+	}
+	if credentialKey.ECDSA == nil || credentialKey.ECDSA.Curve != elliptic.P256() || credentialKey.ECDSA.X.Cmp(x) != 0 || credentialKey.ECDSA.Y.Cmp(y) != 0 {
+		return fmt.Errorf("pubArea does not match the credential public key")
+	}
+
+	reader := &tpmReader{data: statement.CertInfo}
+	magic := reader.uint32()
+	attestType := reader.uint16()
+	reader.tpm2b() // qualifiedSigner
+	extraData := reader.tpm2b()
+	reader.read(17) // clockInfo
+	reader.read(8)  // firmwareVersion
+	attestedName := reader.tpm2b()
+	reader.tpm2b() // qualifiedName
+	if reader.err != nil {
+		return fmt.Errorf("Invalid certInfo: %w", reader.err)
+	}
+	if magic != tpmGeneratedValue || attestType != tpmSTAttestCertify {
+		return fmt.Errorf("certInfo is not a TPM generated certify structure")
+	}
+	expectedExtraData := sha256.Sum256(util.Concat(authData, clientDataHash))
+	if !bytes.Equal(extraData, expectedExtraData[:]) {
+		return fmt.Errorf("certInfo extraData does not match the attested data")
+	}
+	pubAreaDigest := sha256.Sum256(statement.PubArea)
+	if !bytes.Equal(attestedName, util.Concat(util.ToBE(tpmAlgSHA256), pubAreaDigest[:])) {
+		return fmt.Errorf("certInfo does not certify pubArea")
+	}
+
+	if len(statement.X5c) == 0 {
+		return fmt.Errorf("TPM attestation has no AIK certificate")
+	}
+	aikCertificate, err := x509.ParseCertificate(statement.X5c[0])
+	if err != nil {
+		return fmt.Errorf("Could not parse AIK certificate: %w", err)
+	}
+	if err := checkTPMAIKCertificate(aikCertificate); err != nil {
+		return err
+	}
+	aikKey, err := certificatePublicKey(statement.X5c[0])
+	if err != nil {
+		return err
+	}
+	if err := verifyStatementSignature(statement.Alg, aikKey, statement.CertInfo, statement.Sig); err != nil {
+		return fmt.Errorf("TPM certInfo: %w", err)
+	}
+	return nil
+}
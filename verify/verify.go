@@ -0,0 +1,184 @@
+// Package verify checks attestations and assertions the way a relying party would, so the
+// device's own output can be validated in tests and tooling.
+package verify
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type attestationObject struct {
+	Format               string                 `cbor:"fmt"`
+	AuthData             []byte                 `cbor:"authData"`
+	AttestationStatement map[string]interface{} `cbor:"attStmt"`
+}
+
+// The makeCredential response uses integer keys for the same fields
+type ctapAttestationObject struct {
+	Format               string                 `cbor:"1,keyasint"`
+	AuthData             []byte                 `cbor:"2,keyasint"`
+	AttestationStatement map[string]interface{} `cbor:"3,keyasint"`
+}
+
+type packedAttestationStatement struct {
+	Alg int64    `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+func decodeAttestationObject(data []byte) (*attestationObject, error) {
+	var object attestationObject
+	if err := cbor.Unmarshal(data, &object); err == nil && object.Format != "" {
+		return &object, nil
+	}
+	var ctapObject ctapAttestationObject
+	if err := cbor.Unmarshal(data, &ctapObject); err != nil {
+		return nil, fmt.Errorf("Could not decode attestation object: %w", err)
+	}
+	if ctapObject.Format == "" {
+		return nil, fmt.Errorf("Attestation object has no format")
+	}
+	return &attestationObject{
+		Format:               ctapObject.Format,
+		AuthData:             ctapObject.AuthData,
+		AttestationStatement: ctapObject.AttestationStatement,
+	}, nil
+}
+
+func certificatePublicKey(certificateBytes []byte) (*cose.SupportedCOSEPublicKey, error) {
+	certificate, err := x509.ParseCertificate(certificateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse attestation certificate: %w", err)
+	}
+	switch publicKey := certificate.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return &cose.SupportedCOSEPublicKey{ECDSA: publicKey}, nil
+	case ed25519.PublicKey:
+		return &cose.SupportedCOSEPublicKey{Ed25519: &publicKey}, nil
+	case *rsa.PublicKey:
+		return &cose.SupportedCOSEPublicKey{RSA: publicKey}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported attestation certificate key type: %T", publicKey)
+	}
+}
+
+// The curve each ECDSA attestation algorithm signs with
+var ecdsaStatementCurves = map[cose.COSEAlgorithmID]elliptic.Curve{
+	cose.COSE_ALGORITHM_ID_ES256: elliptic.P256(),
+	cose.COSE_ALGORITHM_ID_ES384: elliptic.P384(),
+	cose.COSE_ALGORITHM_ID_ES512: elliptic.P521(),
+}
+
+// verifyStatementSignature checks an attestation statement signature with the algorithm
+// the statement declares, rejecting an algorithm that doesn't fit the key's type and curve
+func verifyStatementSignature(alg int64, key *cose.SupportedCOSEPublicKey, data []byte, signature []byte) error {
+	algorithm := cose.COSEAlgorithmID(alg)
+	valid := false
+	switch {
+	case key.ECDSA != nil && ecdsaStatementCurves[algorithm] == key.ECDSA.Curve:
+		// The hash follows from the curve, as it does for the algorithm
+		valid = key.Verify(data, signature)
+	case key.Ed25519 != nil && algorithm == cose.COSE_ALGORITHM_ID_ED25519:
+		valid = key.Verify(data, signature)
+	case key.RSA != nil && algorithm == cose.COSE_ALGORITHM_ID_PS256:
+		valid = key.Verify(data, signature)
+	case key.RSA != nil && algorithm == cose.COSE_ALGORITHM_ID_RS256:
+		digest := sha256.Sum256(data)
+		valid = rsa.VerifyPKCS1v15(key.RSA, stdcrypto.SHA256, digest[:], signature) == nil
+	default:
+		return fmt.Errorf("Attestation algorithm %d does not match the attestation key", alg)
+	}
+	if !valid {
+		return fmt.Errorf("Attestation signature is invalid")
+	}
+	return nil
+}
+
+func decodeAttestationStatement(attestationStatement map[string]interface{}, statement interface{}) error {
+	statementBytes, err := cbor.Marshal(attestationStatement)
+	if err != nil {
+		return fmt.Errorf("Could not encode attestation statement: %w", err)
+	}
+	if err := cbor.Unmarshal(statementBytes, statement); err != nil {
+		return fmt.Errorf("Could not decode attestation statement: %w", err)
+	}
+	return nil
+}
+
+// VerifyAttestation checks a WebAuthn attestation object, or the body of a CTAP2
+// makeCredential response, against the client data hash it was created for. Packed
+// attestation is verified with the x5c certificate if present, otherwise as self
+// attestation with the credential public key. TPM attestation is verified with the AIK
+// certificate.
+func VerifyAttestation(attestation []byte, clientDataHash []byte) error {
+	object, err := decodeAttestationObject(attestation)
+	if err != nil {
+		return err
+	}
+	authData, err := ctap.ParseAuthenticatorData(object.AuthData)
+	if err != nil {
+		return err
+	}
+	if authData.AttestedCredentialData == nil {
+		return fmt.Errorf("Attestation has no attested credential data")
+	}
+	credentialKey, err := cose.UnmarshalCOSEPublicKey(authData.AttestedCredentialData.CredentialPublicKey)
+	if err != nil {
+		return fmt.Errorf("Could not decode credential public key: %w", err)
+	}
+	switch object.Format {
+	case "none":
+		if len(object.AttestationStatement) != 0 {
+			return fmt.Errorf("Attestation format none has a non-empty statement")
+		}
+		return nil
+	case "packed":
+		var statement packedAttestationStatement
+		if err := decodeAttestationStatement(object.AttestationStatement, &statement); err != nil {
+			return err
+		}
+		if statement.Sig == nil {
+			return fmt.Errorf("Attestation statement has no signature")
+		}
+		verificationKey := credentialKey
+		if len(statement.X5c) > 0 {
+			verificationKey, err = certificatePublicKey(statement.X5c[0])
+			if err != nil {
+				return err
+			}
+		}
+		return verifyStatementSignature(statement.Alg, verificationKey, util.Concat(object.AuthData, clientDataHash), statement.Sig)
+	case "tpm":
+		var statement tpmAttestationStatement
+		if err := decodeAttestationStatement(object.AttestationStatement, &statement); err != nil {
+			return err
+		}
+		return verifyTPMAttestation(&statement, object.AuthData, clientDataHash, credentialKey)
+	default:
+		return fmt.Errorf("Unsupported attestation format: %s", object.Format)
+	}
+}
+
+// VerifyAssertion checks an assertion signature over authData || clientDataHash with the
+// credential's public key
+func VerifyAssertion(credential *cose.SupportedCOSEPublicKey, authData []byte, clientDataHash []byte, signature []byte) error {
+	if _, err := ctap.ParseAuthenticatorData(authData); err != nil {
+		return err
+	}
+	if !credential.Verify(util.Concat(authData, clientDataHash), signature) {
+		return fmt.Errorf("Assertion signature is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package verify
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/testutil"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+func TestVerifyAttestationAndAssertion(t *testing.T) {
+	_, device := testutil.NewTestDevice()
+	client := testutil.NewWebAuthnClient(device, "https://example.com", "example.com")
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	registration, err := client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	registrationHash := sha256.Sum256(registration.ClientDataJSON)
+	test.Assert(t, VerifyAttestation(registration.AttestationObject, registrationHash[:]) == nil, "Valid attestation rejected")
+	otherHash := sha256.Sum256([]byte("other"))
+	test.Assert(t, VerifyAttestation(registration.AttestationObject, otherHash[:]) != nil, "Attestation verified for the wrong client data")
+
+	// The signature doesn't cover alg, so only the key type check catches a wrong one
+	object, err := decodeAttestationObject(registration.AttestationObject)
+	test.Assert(t, err == nil, "Could not decode attestation object")
+	object.AttestationStatement["alg"] = int64(cose.COSE_ALGORITHM_ID_ED25519)
+	err = VerifyAttestation(util.MarshalCBOR(object), registrationHash[:])
+	test.Assert(t, err != nil && strings.Contains(err.Error(), "does not match"), "Attestation with the wrong alg accepted")
+
+	assertion, err := client.Authenticate(crypto.RandomBytes(32), registration.CredentialID)
+	test.Assert(t, err == nil, "Authentication failed")
+	assertionHash := sha256.Sum256(assertion.ClientDataJSON)
+	err = VerifyAssertion(registration.PublicKey, assertion.RawAuthData, assertionHash[:], assertion.Signature)
+	test.Assert(t, err == nil, "Valid assertion rejected")
+
+	assertion.Signature[len(assertion.Signature)-1] ^= 0xFF
+	err = VerifyAssertion(registration.PublicKey, assertion.RawAuthData, assertionHash[:], assertion.Signature)
+	test.Assert(t, err != nil, "Tampered assertion signature accepted")
+}
+
+func TestVerifyTPMAttestation(t *testing.T) {
+	_, device := testutil.NewTestDevice()
+	caKey, err := identities.CreateCAPrivateKey()
+	test.Assert(t, err == nil, "Could not create CA key")
+	ca, err := identities.CreateSelfSignedCA(caKey)
+	test.Assert(t, err == nil, "Could not create CA")
+	aik, _ := identities.CreateCAPrivateKey()
+	aikCertificate, err := identities.CreateTPMAIKCertificate(ca, caKey, aik)
+	test.Assert(t, err == nil, "Could not create AIK certificate")
+	device.SetTPMAttestation(aik, [][]byte{aikCertificate.Raw})
+
+	client := testutil.NewWebAuthnClient(device, "https://example.com", "example.com")
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	registration, err := client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	test.AssertEqual(t, registration.Format, "tpm", "Registration did not use tpm attestation")
+	registrationHash := sha256.Sum256(registration.ClientDataJSON)
+	err = VerifyAttestation(registration.AttestationObject, registrationHash[:])
+	test.Assert(t, err == nil, "Valid tpm attestation rejected")
+	otherHash := sha256.Sum256([]byte("other"))
+	test.Assert(t, VerifyAttestation(registration.AttestationObject, otherHash[:]) != nil, "tpm attestation verified for the wrong client data")
+
+	// The AIK certificate must be a TPM AIK certificate, not any certificate for the key
+	packedCertificate, err := identities.CreateSelfSignedAttestationCertificate(ca, caKey, aik)
+	test.Assert(t, err == nil, "Could not create certificate")
+	device.SetTPMAttestation(aik, [][]byte{packedCertificate.Raw})
+	registration, err = client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	registrationHash = sha256.Sum256(registration.ClientDataJSON)
+	test.Assert(t, VerifyAttestation(registration.AttestationObject, registrationHash[:]) != nil, "tpm attestation with a non-AIK certificate accepted")
+}
+
+// resignAttestation replaces the attestation key of a registration, signing with sign under alg
+func resignAttestation(t *testing.T, attestation []byte, certificate []byte, alg cose.COSEAlgorithmID, signedData func(object *attestationObject) []byte, sign func(data []byte) []byte) []byte {
+	object, err := decodeAttestationObject(attestation)
+	test.Assert(t, err == nil, "Could not decode attestation object")
+	object.AttestationStatement["alg"] = int64(alg)
+	object.AttestationStatement["x5c"] = [][]byte{certificate}
+	object.AttestationStatement["sig"] = sign(signedData(object))
+	return util.MarshalCBOR(object)
+}
+
+func signPKCS1v15(key *rsa.PrivateKey) func(data []byte) []byte {
+	return func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, stdcrypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return signature
+	}
+}
+
+func TestVerifyPackedAttestationAlgorithms(t *testing.T) {
+	_, device := testutil.NewTestDevice()
+	client := testutil.NewWebAuthnClient(device, "https://example.com", "example.com")
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	registration, err := client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	registrationHash := sha256.Sum256(registration.ClientDataJSON)
+	packedData := func(object *attestationObject) []byte {
+		return util.Concat(object.AuthData, registrationHash[:])
+	}
+	caKey, _ := identities.CreateCAPrivateKey()
+	ca, _ := identities.CreateSelfSignedCA(caKey)
+
+	rsaKey := crypto.GenerateRSAKey()
+	rsaCertificate, err := identities.CreateSelfSignedAttestationCertificate(ca, caKey, &cose.SupportedCOSEPrivateKey{RSA: rsaKey})
+	test.Assert(t, err == nil, "Could not create RSA certificate")
+	rs256 := resignAttestation(t, registration.AttestationObject, rsaCertificate.Raw, cose.COSE_ALGORITHM_ID_RS256, packedData, signPKCS1v15(rsaKey))
+	test.Assert(t, VerifyAttestation(rs256, registrationHash[:]) == nil, "Valid RS256 attestation rejected")
+	ps256 := resignAttestation(t, registration.AttestationObject, rsaCertificate.Raw, cose.COSE_ALGORITHM_ID_PS256, packedData, func(data []byte) []byte {
+		return crypto.SignRSA(rsaKey, data)
+	})
+	test.Assert(t, VerifyAttestation(ps256, registrationHash[:]) == nil, "Valid PS256 attestation rejected")
+	mislabeled := resignAttestation(t, registration.AttestationObject, rsaCertificate.Raw, cose.COSE_ALGORITHM_ID_PS256, packedData, signPKCS1v15(rsaKey))
+	test.Assert(t, VerifyAttestation(mislabeled, registrationHash[:]) != nil, "RS256 signature accepted as PS256")
+	mislabeled = resignAttestation(t, registration.AttestationObject, rsaCertificate.Raw, cose.COSE_ALGORITHM_ID_ES256, packedData, signPKCS1v15(rsaKey))
+	err = VerifyAttestation(mislabeled, registrationHash[:])
+	test.Assert(t, err != nil && strings.Contains(err.Error(), "does not match"), "ES256 accepted for an RSA key")
+
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p384Certificate, err := identities.CreateSelfSignedAttestationCertificate(ca, caKey, &cose.SupportedCOSEPrivateKey{ECDSA: p384Key})
+	test.Assert(t, err == nil, "Could not create P-384 certificate")
+	signP384 := func(data []byte) []byte {
+		return crypto.SignECDSA(p384Key, data)
+	}
+	es384 := resignAttestation(t, registration.AttestationObject, p384Certificate.Raw, cose.COSE_ALGORITHM_ID_ES384, packedData, signP384)
+	test.Assert(t, VerifyAttestation(es384, registrationHash[:]) == nil, "Valid ES384 attestation rejected")
+	mislabeled = resignAttestation(t, registration.AttestationObject, p384Certificate.Raw, cose.COSE_ALGORITHM_ID_ES256, packedData, signP384)
+	err = VerifyAttestation(mislabeled, registrationHash[:])
+	test.Assert(t, err != nil && strings.Contains(err.Error(), "does not match"), "ES256 accepted for a P-384 key")
+}
+
+func TestVerifyTPMAttestationRS256(t *testing.T) {
+	_, device := testutil.NewTestDevice()
+	caKey, _ := identities.CreateCAPrivateKey()
+	ca, _ := identities.CreateSelfSignedCA(caKey)
+	aik, _ := identities.CreateCAPrivateKey()
+	aikCertificate, _ := identities.CreateTPMAIKCertificate(ca, caKey, aik)
+	device.SetTPMAttestation(aik, [][]byte{aikCertificate.Raw})
+	client := testutil.NewWebAuthnClient(device, "https://example.com", "example.com")
+	user := webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1, 2, 3}, Name: "alice"}
+	registration, err := client.Register(user, crypto.RandomBytes(32))
+	test.Assert(t, err == nil, "Registration failed")
+	registrationHash := sha256.Sum256(registration.ClientDataJSON)
+
+	rsaAIK := crypto.GenerateRSAKey()
+	rsaAIKCertificate, err := identities.CreateTPMAIKCertificate(ca, caKey, &cose.SupportedCOSEPrivateKey{RSA: rsaAIK})
+	test.Assert(t, err == nil, "Could not create RSA AIK certificate")
+	certInfo := func(object *attestationObject) []byte {
+		return object.AttestationStatement["certInfo"].([]byte)
+	}
+	rs256 := resignAttestation(t, registration.AttestationObject, rsaAIKCertificate.Raw, cose.COSE_ALGORITHM_ID_RS256, certInfo, signPKCS1v15(rsaAIK))
+	test.Assert(t, VerifyAttestation(rs256, registrationHash[:]) == nil, "Valid RS256 tpm attestation rejected")
+	mislabeled := resignAttestation(t, registration.AttestationObject, rsaAIKCertificate.Raw, cose.COSE_ALGORITHM_ID_PS256, certInfo, signPKCS1v15(rsaAIK))
+	test.Assert(t, VerifyAttestation(mislabeled, registrationHash[:]) != nil, "RS256 tpm signature accepted as PS256")
+}
@@ -2,9 +2,12 @@ package virtual_fido
 
 import (
 	"io"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/ctap_hid"
 	"github.com/bulwarkid/virtual-fido/u2f"
+	"github.com/bulwarkid/virtual-fido/usb"
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
@@ -13,9 +16,68 @@ type FIDOClient interface {
 	ctap.CTAPClient
 }
 
+// The settings below are process-wide: every device started by Start or StartDevices uses
+// the same configuration, since all of them are served by one USB/IP server
+var usbDeviceConfig = usb.DefaultUSBDeviceConfig()
+
+// SetUSBDeviceConfig sets the vendor/product IDs and strings the USB/IP device advertises.
+// It applies to every device, which differ only in serial number, must be called before Start,
+// and has no effect on the Mac client.
+func SetUSBDeviceConfig(config usb.USBDeviceConfig) {
+	usbDeviceConfig = config
+}
+
+var usbipIdleTimeout time.Duration = 0
+
+// SetIdleTimeout makes the USB/IP server disconnect the host after the device has been idle
+// for the given duration; the host can attach again whenever it needs the device. The timeout
+// applies to every device, must be set before Start, and has no effect on the Mac client.
+func SetIdleTimeout(timeout time.Duration) {
+	usbipIdleTimeout = timeout
+}
+
+var usbipAttachmentHandler func(busID string, attached bool) = nil
+
+// SetAttachmentHandler calls handler with a device's USB/IP bus ID when a host attaches it
+// and when the host detaches. The handler may run on any goroutine, including the one that
+// disconnects idle hosts, so it must be safe for concurrent use. It must be called before
+// Start, and has no effect on the Mac client.
+func SetAttachmentHandler(handler func(busID string, attached bool)) {
+	usbipAttachmentHandler = handler
+}
+
+var u2fEnabled = true
+
+// DisableU2F turns off the legacy U2F (CTAP1) protocol, making every device CBOR only.
+// It must be called before Start.
+func DisableU2F() {
+	u2fEnabled = false
+}
+
+func newCTAPServer(client FIDOClient) *ctap.CTAPServer {
+	ctapServer := ctap.NewCTAPServer(client)
+	ctapServer.SetU2FEnabled(u2fEnabled)
+	return ctapServer
+}
+
+func newCTAPHIDServer(client FIDOClient) *ctap_hid.CTAPHIDServer {
+	ctapServer := newCTAPServer(client)
+	if !u2fEnabled {
+		return ctap_hid.NewCTAPHIDServer(ctapServer, nil)
+	}
+	return ctap_hid.NewCTAPHIDServer(ctapServer, u2f.NewU2FServer(client))
+}
+
 func Start(client FIDOClient) {
+	StartDevices(client)
+}
+
+// StartDevices runs an independent authenticator for each client, for testing platforms
+// with several security keys. The devices share the process-wide settings above, apart from
+// their serial numbers. The Mac client only supports a single device.
+func StartDevices(clients ...FIDOClient) {
 	// Calls either the Mac or USB/IP client, based on system
-	startClient(client)
+	startClients(clients)
 }
 
 func SetLogLevel(level util.LogLevel) {
@@ -0,0 +1,27 @@
+package virtual_fido
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/testutil"
+)
+
+func getInfoVersions(t *testing.T, client FIDOClient) []string {
+	jsonBytes, err := newCTAPServer(client).GetInfoJSON()
+	test.Assert(t, err == nil, "Could not get getInfo")
+	var info struct {
+		Versions []string `json:"versions"`
+	}
+	test.Assert(t, json.Unmarshal(jsonBytes, &info) == nil, "Could not decode getInfo")
+	return info.Versions
+}
+
+func TestDisableU2FVersions(t *testing.T) {
+	client, _ := testutil.NewTestDevice()
+	test.AssertArrEqual(t, getInfoVersions(t, client), []string{"FIDO_2_0", "U2F_V2"}, "Wrong versions with U2F enabled")
+	DisableU2F()
+	defer func() { u2fEnabled = true }()
+	test.AssertArrEqual(t, getInfoVersions(t, client), []string{"FIDO_2_0"}, "U2F_V2 reported with U2F disabled")
+}